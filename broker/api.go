@@ -4,6 +4,7 @@ import (
 	"time"
 
 	"github.com/Cloud-Foundations/cloud-gate/broker/configuration"
+	"github.com/Cloud-Foundations/golib/pkg/log"
 )
 
 type PermittedAccount struct {
@@ -20,13 +21,188 @@ type AWSCredentialsJSON struct {
 	Expiration   time.Time `json:"cloudgate_comment_expiration,omitempty"`
 }
 
+// AccountGroup describes how the groups of a user map onto the roles of an
+// account: a group named <GroupName>-<role> grants <role>. If GroupName is
+// empty the AccountName is used. GroupName is matched literally, not as a
+// regular expression.
+type AccountGroup struct {
+	AccountName    string
+	GroupName      string
+	ExtraUserRoles []string
+}
+
+// StaticAccount is an account whose roles are all configured, such as a GCP
+// project or an Azure subscription.
+type StaticAccount struct {
+	Name           string
+	DisplayName    string
+	GroupName      string
+	ExtraUserRoles []string
+	RoleNames      []string
+}
+
+// StaticAccounts decides which roles of the static accounts users may use,
+// from their groups. The accounts and groups are read through the accessors
+// on every call, so that configuration updates take effect.
+type StaticAccounts struct {
+	getAccounts   func() ([]StaticAccount, error)
+	getUserGroups func(username string) ([]string, error)
+	logger        log.DebugLogger
+}
+
+// UserAttributesGetter is the interface that wraps the GetUserAttributes
+// method. It is optionally implemented by userinfo backends.
+//
+// GetUserAttributes gets the attributes (such as mail or cost center) of the
+// user specified by username.
+type UserAttributesGetter interface {
+	GetUserAttributes(username string) (map[string]string, error)
+}
+
+// UserGroupsChangeNotifier is the interface that wraps the
+// NotifyUserGroupsChange method. It is optionally implemented by userinfo
+// backends which are told when groups change, rather than polling.
+//
+// NotifyUserGroupsChange registers a function which is called with the
+// username whenever the groups of that user may have changed, so that cached
+// authorisations can be dropped.
+type UserGroupsChangeNotifier interface {
+	NotifyUserGroupsChange(notifier func(username string))
+}
+
+// RoleHealth is the result of checking that the broker is trusted to assume
+// a role.
+type RoleHealth struct {
+	Account   string    `json:"account"`
+	Role      string    `json:"role"`
+	Healthy   bool      `json:"healthy"`
+	Message   string    `json:"message,omitempty"`
+	CheckedAt time.Time `json:"checkedAt"`
+}
+
+// RoleHealthChecker is the interface that wraps the GetRoleHealth method. It
+// is optionally implemented by brokers.
+//
+// GetRoleHealth returns the last known health of the roles of every account.
+type RoleHealthChecker interface {
+	GetRoleHealth() []RoleHealth
+}
+
+// LimitedConsoleURLGetter is the interface that wraps the
+// GetLimitedConsoleURLForAccountRole method. It is optionally implemented by
+// brokers whose console sessions expire.
+//
+// GetLimitedConsoleURLForAccountRole is like GetConsoleURLForAccountRole, with
+// the console session lasting at most maxDuration, as far as the minimum
+// session duration of the cloud allows.
+type LimitedConsoleURLGetter interface {
+	GetLimitedConsoleURLForAccountRole(accountName string, roleName string,
+		username string, issuerURL string,
+		maxDuration time.Duration) (string, error)
+}
+
+// AccountRolesGetter is the interface that wraps the GetAccountRoles method.
+// It is optionally implemented by brokers.
+//
+// GetAccountRoles returns the roles of the account which may be brokered, or
+// an error if the account is unknown.
+type AccountRolesGetter interface {
+	GetAccountRoles(accountName string) ([]string, error)
+}
+
+// AccountDisplayNameGetter is the interface that wraps the
+// GetAccountDisplayName method. It is optionally implemented by brokers.
+//
+// GetAccountDisplayName returns the name of the account to show users, or an
+// error if the account is unknown.
+type AccountDisplayNameGetter interface {
+	GetAccountDisplayName(accountName string) (string, error)
+}
+
+// BreakGlassIssuer is the interface that wraps the GetBreakGlassConsoleURL
+// and GenerateBreakGlassTokenCredentials methods. It is optionally
+// implemented by brokers which otherwise consult userinfo when issuing
+// access.
+//
+// GetBreakGlassConsoleURL and GenerateBreakGlassTokenCredentials are like
+// GetConsoleURLForAccountRole and GenerateTokenCredentials, but never consult
+// userinfo, since break-glass access is used when it is unavailable.
+type BreakGlassIssuer interface {
+	GetBreakGlassConsoleURL(accountName string, roleName string,
+		username string, issuerURL string) (string, error)
+	GenerateBreakGlassTokenCredentials(accountName string, roleName string,
+		username string) (*AWSCredentialsJSON, error)
+}
+
 type Broker interface {
 	UpdateConfiguration(config *configuration.Configuration) error
 	GetUserAllowedAccounts(username string) ([]PermittedAccount, error)
 	IsUserAllowedToAssumeRole(username string, accountName string, roleName string) (bool, error)
 	GetConsoleURLForAccountRole(accountName string, roleName string, username string, issuerURL string) (string, error)
-	GenerateTokenCredentials(accountName string, roleName string, username string) (*AWSCredentialsJSON, error)
+	// GenerateTokenCredentials generates credentials valid for the requested
+	// duration, clamped to the maximum configured for the account and role.
+	// A zero duration requests the default.
+	GenerateTokenCredentials(accountName string, roleName string, username string, duration time.Duration) (*AWSCredentialsJSON, error)
 	ProcessNewUnsealingSecret(secret string) (ready bool, err error)
 	GetIsUnsealedChannel() (<-chan error, error)
 	LoadCredentialsFile() error
 }
+
+// GetAllowedRolesFromGroups returns the roles granted by the userGroups, keyed
+// by account name. Groups are matched case insensitively and the
+// ExtraUserRoles of every account are always granted. Group names are quoted,
+// so that a "." in an account name only matches a ".".
+func GetAllowedRolesFromGroups(accounts []AccountGroup,
+	userGroups []string) (map[string][]string, error) {
+	return getAllowedRolesFromGroups(accounts, userGroups)
+}
+
+// NewStaticAccounts creates a StaticAccounts which reads the accounts with
+// getAccounts and the groups of users with getUserGroups.
+func NewStaticAccounts(getAccounts func() ([]StaticAccount, error),
+	getUserGroups func(username string) ([]string, error),
+	logger log.DebugLogger) *StaticAccounts {
+	return &StaticAccounts{
+		getAccounts:   getAccounts,
+		getUserGroups: getUserGroups,
+		logger:        logger,
+	}
+}
+
+// GetUserAllowedAccounts returns the accounts and roles the user may use.
+func (sa *StaticAccounts) GetUserAllowedAccounts(username string) (
+	[]PermittedAccount, error) {
+	return sa.getUserAllowedAccounts(username)
+}
+
+// GetUserAllowedAccountsFromGroups returns the accounts and roles which
+// userGroups grant.
+func (sa *StaticAccounts) GetUserAllowedAccountsFromGroups(
+	userGroups []string) ([]PermittedAccount, error) {
+	return sa.getUserAllowedAccountsFromGroups(userGroups)
+}
+
+// IsUserAllowedToAssumeRole returns true if the user may use the role.
+func (sa *StaticAccounts) IsUserAllowedToAssumeRole(username string,
+	accountName string, roleName string) (bool, error) {
+	return sa.isUserAllowedToAssumeRole(username, accountName, roleName)
+}
+
+// GetAccountDisplayName returns the display name of the account, or its name
+// if it has none.
+func (sa *StaticAccounts) GetAccountDisplayName(accountName string) (
+	string, error) {
+	return sa.getAccountDisplayName(accountName)
+}
+
+// GetAccountRoles returns the sorted roles of the account.
+func (sa *StaticAccounts) GetAccountRoles(accountName string) (
+	[]string, error) {
+	return sa.getAccountRoles(accountName)
+}
+
+// StringIntersectionNoDups returns the values of set1 that also appear,
+// compared case insensitively, in set2.
+func StringIntersectionNoDups(set1, set2 []string) []string {
+	return stringIntersectionNoDups(set1, set2)
+}
@@ -0,0 +1,75 @@
+package audit
+
+import (
+	"time"
+
+	"github.com/Cloud-Foundations/golib/pkg/log"
+)
+
+const (
+	ActionApproveGrant     = "approve_grant"
+	ActionBreakGlass       = "break_glass"
+	ActionConsoleURL       = "console_url"
+	ActionDenyGrant        = "deny_grant"
+	ActionLogout           = "logout"
+	ActionRequestGrant     = "request_grant"
+	ActionRevokeSessions   = "revoke_sessions"
+	ActionTokenCredentials = "token_credentials"
+
+	AuthMethodClientCert = "client_cert"
+	AuthMethodOIDCCookie = "oidc_cookie"
+
+	OutcomeSuccess = "success"
+	OutcomeDenied  = "denied"
+	OutcomeFailure = "failure"
+)
+
+// Event is a single auditable action.
+type Event struct {
+	Time        time.Time `json:"time"`
+	Action      string    `json:"action"`
+	Username    string    `json:"user"`
+	TargetUser  string    `json:"target_user,omitempty"`
+	Cloud       string    `json:"cloud,omitempty"`
+	Account     string    `json:"account,omitempty"`
+	Role        string    `json:"role,omitempty"`
+	AccessKeyID string    `json:"access_key_id,omitempty"`
+	GrantID     string    `json:"grant_id,omitempty"`
+	SourceIP    string    `json:"source_ip,omitempty"`
+	UserAgent   string    `json:"user_agent,omitempty"`
+	AuthMethod  string    `json:"auth_method,omitempty"`
+	Outcome     string    `json:"outcome"`
+	Message     string    `json:"message,omitempty"`
+}
+
+// AuditSink is the interface that wraps the Emit method.
+//
+// Emit records the event. Implementations must be safe for concurrent use.
+type AuditSink interface {
+	Emit(event *Event) error
+}
+
+// NewFileSink returns an AuditSink which appends one JSON object per line to
+// the named file, creating it if needed.
+func NewFileSink(filename string) (AuditSink, error) {
+	return newFileSink(filename)
+}
+
+// NewLoggerSink returns an AuditSink which writes one JSON object per line to
+// the logger. Wrap a syslog writer to get syslog-JSON.
+func NewLoggerSink(logger log.Logger) AuditSink {
+	return &loggerSink{logger: logger}
+}
+
+// NewMultiSink returns an AuditSink which emits every event to all of the
+// sinks.
+func NewMultiSink(sinks ...AuditSink) AuditSink {
+	return multiSink(sinks)
+}
+
+// NewWebhookSink returns an AuditSink which POSTs every event as JSON to the
+// URL. Events are queued and sent in the background so that a slow webhook
+// does not hold up requests; events are dropped if the queue is full.
+func NewWebhookSink(url string, logger log.DebugLogger) AuditSink {
+	return newWebhookSink(url, logger)
+}
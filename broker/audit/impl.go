@@ -0,0 +1,145 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/Cloud-Foundations/golib/pkg/log"
+)
+
+const webhookQueueSize = 1024
+
+var (
+	auditWebhookDropped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cloudgate_audit_webhook_dropped_counter",
+			Help: "Audit events dropped because the webhook queue was full",
+		},
+	)
+	auditWebhookFailure = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cloudgate_audit_webhook_failure_counter",
+			Help: "Audit events which could not be sent to the webhook",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(auditWebhookDropped)
+	prometheus.MustRegister(auditWebhookFailure)
+}
+
+type fileSink struct {
+	mutex sync.Mutex
+	file  *os.File
+}
+
+type loggerSink struct {
+	logger log.Logger
+}
+
+type multiSink []AuditSink
+
+type webhookSink struct {
+	url        string
+	logger     log.DebugLogger
+	httpClient *http.Client
+	queue      chan []byte
+}
+
+func newFileSink(filename string) (*fileSink, error) {
+	file, err := os.OpenFile(filename,
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &fileSink{file: file}, nil
+}
+
+func (s *fileSink) Emit(event *Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, err = s.file.Write(data)
+	return err
+}
+
+func (s *loggerSink) Emit(event *Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	s.logger.Println(string(data))
+	return nil
+}
+
+func (sinks multiSink) Emit(event *Event) error {
+	var errs []error
+	for _, sink := range sinks {
+		if err := sink.Emit(event); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func newWebhookSink(url string, logger log.DebugLogger) *webhookSink {
+	s := &webhookSink{
+		url:        url,
+		logger:     logger,
+		httpClient: &http.Client{Timeout: time.Second * 10},
+		queue:      make(chan []byte, webhookQueueSize),
+	}
+	go s.sendLoop()
+	return s
+}
+
+func (s *webhookSink) Emit(event *Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	select {
+	case s.queue <- data:
+		return nil
+	default:
+		auditWebhookDropped.Inc()
+		return errors.New("audit webhook queue full, event dropped")
+	}
+}
+
+func (s *webhookSink) sendLoop() {
+	for data := range s.queue {
+		if err := s.send(data); err != nil {
+			auditWebhookFailure.Inc()
+			s.logger.Printf("Failed sending audit event to webhook: %s\n", err)
+		}
+	}
+}
+
+func (s *webhookSink) send(data []byte) error {
+	resp, err := s.httpClient.Post(s.url, "application/json",
+		bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("status=%d body=%s", resp.StatusCode, string(body))
+	}
+	return nil
+}
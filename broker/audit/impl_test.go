@@ -0,0 +1,86 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+)
+
+var testEvent = &Event{
+	Time:       time.Now().UTC().Truncate(time.Second),
+	Action:     ActionTokenCredentials,
+	Username:   "user1",
+	Cloud:      "aws",
+	Account:    "prod",
+	Role:       "admin",
+	AuthMethod: AuthMethodClientCert,
+	Outcome:    OutcomeDenied,
+}
+
+func TestFileSinkAppends(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "audit.log")
+	for i := 0; i < 2; i++ {
+		sink, err := NewFileSink(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sink.Emit(testEvent); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	lines := 0
+	for scanner.Scan() {
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatal(err)
+		}
+		if event != *testEvent {
+			t.Fatalf("expected: %+v, got: %+v", *testEvent, event)
+		}
+		lines++
+	}
+	if lines != 2 {
+		t.Fatalf("expected 2 lines, got %d", lines)
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	received := make(chan Event, 1)
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			var event Event
+			if err := json.Unmarshal(body, &event); err != nil {
+				http.Error(w, "bad event", http.StatusBadRequest)
+				return
+			}
+			received <- event
+		}))
+	defer ts.Close()
+	sink := NewWebhookSink(ts.URL, testlogger.New(t))
+	if err := sink.Emit(testEvent); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-received:
+		if event != *testEvent {
+			t.Fatalf("expected: %+v, got: %+v", *testEvent, event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event not received")
+	}
+}
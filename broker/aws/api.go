@@ -1,6 +1,7 @@
 package aws
 
 import (
+	"io"
 	"sync"
 	"time"
 
@@ -34,12 +35,12 @@ type awsProfileEntry struct {
 const defaultListRolesRoleName = "CPEBrokerRole"
 
 type Broker struct {
-	config                      *configuration.Configuration
+	config                      *configuration.Configuration // With org. accounts.
+	rawConfig                   *configuration.Configuration
 	userInfo                    userinfo.UserGroupsGetter
 	rawUserInfo                 userinfo.UserGroupsGetter
 	credentialsFilename         string
 	logger                      log.DebugLogger
-	auditLogger                 log.DebugLogger
 	masterStsClient             *sts.Client
 	masterStsRegion             string
 	userAllowedCredentialsCache map[string]userAllowedCredentialsCacheEntry
@@ -51,13 +52,27 @@ type Broker struct {
 	rawCredentialsFile          []byte
 	listRolesRoleName           string
 	listRolesSemaphore          *semaphore.Weighted
+	cacheFilename               string
+	cacheDirty                  chan struct{}
+	refreshStates               map[string]*accountRefreshState // K: acc. name
+	refreshMutex                sync.Mutex
+	roleHealth                  map[string]map[string]broker.RoleHealth // K: acc., role
+	principalARNs               map[string]string                       // K: profile name
+	roleHealthMutex             sync.Mutex
+	organizationAccounts        []configuration.AWSAccount
+	organizationsInterval       time.Duration
+	organizationMutex           sync.Mutex // Protect config, rawConfig, org. accounts.
 }
 
+// New creates an AWS broker. If cacheFilename is not empty, the account role
+// and user permission caches are persisted to it and reloaded at startup.
+// If the configuration enables it, the accounts of the AWS Organization are
+// discovered every organizationsInterval.
 func New(userInfo userinfo.UserGroupsGetter, credentialsFilename string,
-	listRolesRoleName string, logger log.DebugLogger,
-	auditLogger log.DebugLogger) *Broker {
-	return newBroker(userInfo, credentialsFilename, listRolesRoleName, logger,
-		auditLogger)
+	listRolesRoleName string, cacheFilename string,
+	organizationsInterval time.Duration, logger log.DebugLogger) *Broker {
+	return newBroker(userInfo, credentialsFilename, listRolesRoleName,
+		cacheFilename, organizationsInterval, logger)
 }
 
 func (b *Broker) UpdateConfiguration(
@@ -74,11 +89,46 @@ func (b *Broker) IsUserAllowedToAssumeRole(username string, accountName string,
 }
 
 func (b *Broker) GetConsoleURLForAccountRole(accountName string, roleName string, userName string, issuerURL string) (string, error) {
-	return b.getConsoleURLForAccountRole(accountName, roleName, userName, issuerURL)
+	return b.getConsoleURLForAccountRole(accountName, roleName, userName, issuerURL, 0)
 }
 
-func (b *Broker) GenerateTokenCredentials(accountName string, roleName string, userName string) (*broker.AWSCredentialsJSON, error) {
-	return b.generateTokenCredentials(accountName, roleName, userName)
+// GetLimitedConsoleURLForAccountRole is like GetConsoleURLForAccountRole,
+// with the sessions lasting at most maxDuration, or 15 minutes.
+func (b *Broker) GetLimitedConsoleURLForAccountRole(accountName string,
+	roleName string, userName string, issuerURL string,
+	maxDuration time.Duration) (string, error) {
+	return b.getConsoleURLForAccountRole(accountName, roleName, userName,
+		issuerURL, maxDuration)
+}
+
+// GetAccountDisplayName returns the display name of the account.
+func (b *Broker) GetAccountDisplayName(accountName string) (string, error) {
+	return b.accountHumanNameFromName(accountName)
+}
+
+// GetAccountRoles returns the discovered roles of the account.
+func (b *Broker) GetAccountRoles(accountName string) ([]string, error) {
+	return b.getAccountRoles(accountName)
+}
+
+// GetBreakGlassConsoleURL is like GetConsoleURLForAccountRole, leaving out
+// the session tags taken from userinfo.
+func (b *Broker) GetBreakGlassConsoleURL(accountName string, roleName string,
+	userName string, issuerURL string) (string, error) {
+	return b.getBreakGlassConsoleURL(accountName, roleName, userName,
+		issuerURL)
+}
+
+// GenerateBreakGlassTokenCredentials is like GenerateTokenCredentials for the
+// default duration, leaving out the session tags taken from userinfo.
+func (b *Broker) GenerateBreakGlassTokenCredentials(accountName string,
+	roleName string, userName string) (*broker.AWSCredentialsJSON, error) {
+	return b.generateBreakGlassTokenCredentials(accountName, roleName,
+		userName)
+}
+
+func (b *Broker) GenerateTokenCredentials(accountName string, roleName string, userName string, duration time.Duration) (*broker.AWSCredentialsJSON, error) {
+	return b.generateTokenCredentials(accountName, roleName, userName, duration)
 }
 
 func (b *Broker) ProcessNewUnsealingSecret(secret string) (ready bool, err error) {
@@ -92,3 +142,14 @@ func (b *Broker) GetIsUnsealedChannel() (<-chan error, error) {
 func (b *Broker) LoadCredentialsFile() error {
 	return b.loadCredentialsFile()
 }
+
+// GetRoleHealth returns the result of the last trust policy check of each
+// discovered role.
+func (b *Broker) GetRoleHealth() []broker.RoleHealth {
+	return b.getRoleHealth()
+}
+
+// WriteHtml writes the freshness of the cached roles of each account.
+func (b *Broker) WriteHtml(writer io.Writer) {
+	b.writeHtml(writer)
+}
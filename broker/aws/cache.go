@@ -0,0 +1,92 @@
+package aws
+
+import (
+	"os"
+	"time"
+
+	libjson "github.com/Cloud-Foundations/Dominator/lib/json"
+)
+
+const (
+	cacheFilePerms     = 0600
+	cacheWriteInterval = time.Second * 30
+)
+
+// diskCache is the on-disk form of the role and permission caches.
+type diskCache struct {
+	AccountRoles        map[string]accountRoleCacheEntry            `json:",omitempty"`
+	UserAllowedAccounts map[string]userAllowedCredentialsCacheEntry `json:",omitempty"`
+}
+
+// loadCache fills the in-memory caches from the cache file. The entries are
+// marked as expired, so they are refreshed on first use but are still used
+// if AWS or the userinfo backend are unavailable.
+func (b *Broker) loadCache() error {
+	var cache diskCache
+	if err := libjson.ReadFromFile(b.cacheFilename, &cache); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	now := time.Now()
+	b.accountRoleMutex.Lock()
+	for accountName, entry := range cache.AccountRoles {
+		if entry.Expiration.After(now) {
+			entry.Expiration = now
+		}
+		b.accountRoleCache[accountName] = entry
+	}
+	b.accountRoleMutex.Unlock()
+	b.userAllowedCredentialsMutex.Lock()
+	for username, entry := range cache.UserAllowedAccounts {
+		if entry.Expiration.After(now) {
+			entry.Expiration = now
+		}
+		b.userAllowedCredentialsCache[username] = entry
+	}
+	b.userAllowedCredentialsMutex.Unlock()
+	b.logger.Printf("Loaded cached roles for %d accounts and %d users",
+		len(cache.AccountRoles), len(cache.UserAllowedAccounts))
+	return nil
+}
+
+func (b *Broker) saveCache() error {
+	cache := diskCache{
+		AccountRoles: make(map[string]accountRoleCacheEntry),
+		UserAllowedAccounts: make(
+			map[string]userAllowedCredentialsCacheEntry),
+	}
+	b.accountRoleMutex.Lock()
+	for accountName, entry := range b.accountRoleCache {
+		cache.AccountRoles[accountName] = entry
+	}
+	b.accountRoleMutex.Unlock()
+	b.userAllowedCredentialsMutex.Lock()
+	for username, entry := range b.userAllowedCredentialsCache {
+		cache.UserAllowedAccounts[username] = entry
+	}
+	b.userAllowedCredentialsMutex.Unlock()
+	return libjson.WriteToFile(b.cacheFilename, cacheFilePerms, "    ", cache)
+}
+
+// markCacheDirty schedules a write of the cache file.
+func (b *Broker) markCacheDirty() {
+	if b.cacheDirty == nil {
+		return
+	}
+	select {
+	case b.cacheDirty <- struct{}{}:
+	default:
+	}
+}
+
+// cacheWriteLoop writes the cache file at most once per cacheWriteInterval.
+func (b *Broker) cacheWriteLoop() {
+	for range b.cacheDirty {
+		if err := b.saveCache(); err != nil {
+			b.logger.Printf("Error writing cache file: %s", err)
+		}
+		time.Sleep(cacheWriteInterval)
+	}
+}
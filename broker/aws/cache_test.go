@@ -0,0 +1,61 @@
+package aws
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+)
+
+func TestCacheSaveAndLoad(t *testing.T) {
+	b := setupCachedBroker(t)
+	b.cacheFilename = filepath.Join(t.TempDir(), "aws-cache.json")
+	b.accountRoleCache["demoAccount"] = accountRoleCacheEntry{
+		Roles:      []string{"ro-ccount", "admin"},
+		Expiration: time.Now().Add(time.Hour),
+	}
+	if err := b.saveCache(); err != nil {
+		t.Fatal(err)
+	}
+	loaded := &Broker{
+		cacheFilename:               b.cacheFilename,
+		logger:                      testlogger.New(t),
+		userAllowedCredentialsCache: make(map[string]userAllowedCredentialsCacheEntry),
+		accountRoleCache:            make(map[string]accountRoleCacheEntry),
+	}
+	if err := loaded.loadCache(); err != nil {
+		t.Fatal(err)
+	}
+	roleEntry, ok := loaded.accountRoleCache["demoAccount"]
+	if !ok || len(roleEntry.Roles) != 2 {
+		t.Fatalf("unexpected account roles: %+v", roleEntry)
+	}
+	if roleEntry.Expiration.After(time.Now()) {
+		t.Fatal("loaded account roles should be stale")
+	}
+	userEntry, ok := loaded.userAllowedCredentialsCache["demouser"]
+	if !ok || len(userEntry.PermittedAccounts) != 1 ||
+		userEntry.PermittedAccounts[0].Name != "demoAccount" {
+		t.Fatalf("unexpected user accounts: %+v", userEntry)
+	}
+	if userEntry.Expiration.After(time.Now()) {
+		t.Fatal("loaded user accounts should be stale")
+	}
+	// Stale entries are still served when a refresh fails.
+	accounts, err := loaded.getUserAllowedAccounts("demouser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accounts) != 1 {
+		t.Fatalf("expected stale accounts, got: %+v", accounts)
+	}
+}
+
+func TestCacheLoadMissingFile(t *testing.T) {
+	b := setupCachedBroker(t)
+	b.cacheFilename = filepath.Join(t.TempDir(), "missing.json")
+	if err := b.loadCache(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"net/url"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -34,17 +35,35 @@ import (
 	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
 	"github.com/aws/aws-sdk-go-v2/service/iam"
 	"github.com/aws/aws-sdk-go-v2/service/sts"
+	ststypes "github.com/aws/aws-sdk-go-v2/service/sts/types"
 
 	"gopkg.in/ini.v1"
 )
 
-// TODO: these should come in from config
 const (
-	profileAssumeRoleDurationSeconds = 3600
-	defaultRegion                    = "us-west-2"
-	masterAWSProfileName             = "broker-master"
+	defaultSessionDuration        = time.Hour
+	minSessionDuration            = time.Minute * 15
+	defaultConsoleSessionDuration = time.Second * 43000
+	maxConsoleSessionDuration     = time.Hour * 12
+	defaultRegion                 = "us-west-2"
+	masterAWSProfileName          = "broker-master"
+	maxSourceIdentityLength       = 64
+	maxSessionTagValueLength      = 256
 )
 
+var (
+	sourceIdentityInvalidChars = regexp.MustCompile(`[^\w+=,.@-]`)
+	sessionTagInvalidChars     = regexp.MustCompile(`[^\p{L}\p{Z}\p{N}_.:/=+\-@]`)
+)
+
+// assumeRoleIdentity holds what ties an assumed role session back to the
+// user who requested it.
+type assumeRoleIdentity struct {
+	sourceIdentity    string
+	tags              []ststypes.Tag
+	transitiveTagKeys []string
+}
+
 var (
 	awsListRolesAttempt = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -86,28 +105,48 @@ func init() {
 const maxRoleRequestsInFlight = 10
 
 func newBroker(userInfo userinfo.UserGroupsGetter, credentialsFilename string,
-	listRolesRoleName string, logger log.DebugLogger,
-	auditLogger log.DebugLogger) *Broker {
+	listRolesRoleName string, cacheFilename string,
+	organizationsInterval time.Duration, logger log.DebugLogger) *Broker {
 	if listRolesRoleName == "" {
 		listRolesRoleName = defaultListRolesRoleName
 	}
-	return &Broker{
+	b := &Broker{
 		rawUserInfo:         userInfo,
 		credentialsFilename: credentialsFilename,
 		logger:              logger,
-		auditLogger:         auditLogger,
 		listRolesRoleName:   listRolesRoleName,
 		listRolesSemaphore:  semaphore.NewWeighted(int64(maxRoleRequestsInFlight)),
 		userAllowedCredentialsCache: make(
 			map[string]userAllowedCredentialsCacheEntry),
-		accountRoleCache:   make(map[string]accountRoleCacheEntry),
-		isUnsealedChannel:  make(chan error, 1),
-		profileCredentials: make(map[string]awsProfileEntry),
+		accountRoleCache:      make(map[string]accountRoleCacheEntry),
+		isUnsealedChannel:     make(chan error, 1),
+		profileCredentials:    make(map[string]awsProfileEntry),
+		cacheFilename:         cacheFilename,
+		organizationsInterval: organizationsInterval,
+	}
+	if cacheFilename != "" {
+		if err := b.loadCache(); err != nil {
+			logger.Printf("Error loading cache file: %s", err)
+		}
+		b.cacheDirty = make(chan struct{}, 1)
+		go b.cacheWriteLoop()
+	}
+	if notifier, ok := userInfo.(broker.UserGroupsChangeNotifier); ok {
+		notifier.NotifyUserGroupsChange(b.flushUserAllowedAccounts)
 	}
+	return b
+}
+
+// getConfig returns the configuration with the organization accounts. It is
+// replaced rather than modified, so it may be used without holding the lock.
+func (b *Broker) getConfig() *configuration.Configuration {
+	b.organizationMutex.Lock()
+	defer b.organizationMutex.Unlock()
+	return b.config
 }
 
 func (b *Broker) accountIDFromName(accountName string) (string, error) {
-	for _, account := range b.config.AWS.Account {
+	for _, account := range b.getConfig().AWS.Account {
 		if account.Name == accountName {
 			return account.AccountID, nil
 		}
@@ -116,7 +155,7 @@ func (b *Broker) accountIDFromName(accountName string) (string, error) {
 }
 
 func (b *Broker) accountHumanNameFromName(accountName string) (string, error) {
-	for _, account := range b.config.AWS.Account {
+	for _, account := range b.getConfig().AWS.Account {
 		if account.Name == accountName {
 			if account.DisplayName != "" {
 				return account.DisplayName, nil
@@ -127,6 +166,207 @@ func (b *Broker) accountHumanNameFromName(accountName string) (string, error) {
 	return "", errors.New("accountNAme not found")
 }
 
+// getConfiguredMaxSessionDuration returns the maximum duration of the
+// sessions for the role, which is the per-role override if set, or else the
+// maximum of the account. It returns zero if neither is configured.
+func (b *Broker) getConfiguredMaxSessionDuration(accountName string,
+	roleName string) time.Duration {
+	for _, account := range b.getConfig().AWS.Account {
+		if account.Name != accountName {
+			continue
+		}
+		for name, duration := range account.RoleMaxSessionDuration {
+			if strings.EqualFold(name, roleName) && duration > 0 {
+				return duration
+			}
+		}
+		if account.MaxSessionDuration > 0 {
+			return account.MaxSessionDuration
+		}
+	}
+	return 0
+}
+
+// getMaxSessionDuration returns the configured maximum duration of the
+// sessions for the role, or else the default.
+func (b *Broker) getMaxSessionDuration(accountName string,
+	roleName string) time.Duration {
+	if duration := b.getConfiguredMaxSessionDuration(accountName,
+		roleName); duration > 0 {
+		return duration
+	}
+	return defaultSessionDuration
+}
+
+// getConsoleSessionDuration returns the duration of console sessions for the
+// role, which is limited only when a maximum is configured.
+func (b *Broker) getConsoleSessionDuration(accountName string,
+	roleName string) time.Duration {
+	duration := defaultConsoleSessionDuration
+	maxDuration := b.getConfiguredMaxSessionDuration(accountName, roleName)
+	if maxDuration > 0 && maxDuration < duration {
+		duration = maxDuration
+	}
+	return duration
+}
+
+// getRoleFilter returns the IAM path prefix and the tag which the roles of
+// the account must have to be brokered. The account settings override the
+// global ones.
+func (b *Broker) getRoleFilter(accountName string) (string,
+	configuration.AWSRoleTag) {
+	awsConfig := b.getConfig().AWS
+	pathPrefix := awsConfig.RolePathPrefix
+	requiredTag := awsConfig.RequiredRoleTag
+	for _, account := range awsConfig.Account {
+		if account.Name != accountName {
+			continue
+		}
+		if account.RolePathPrefix != "" {
+			pathPrefix = account.RolePathPrefix
+		}
+		if account.RequiredRoleTag.Key != "" {
+			requiredTag = account.RequiredRoleTag
+		}
+	}
+	return pathPrefix, requiredTag
+}
+
+// getSessionDuration clamps the requested duration to what is allowed for
+// the role. A zero duration selects the default, as long as the maximum
+// permits it.
+func (b *Broker) getSessionDuration(accountName string, roleName string,
+	requested time.Duration) time.Duration {
+	maxDuration := b.getMaxSessionDuration(accountName, roleName)
+	duration := requested
+	if duration <= 0 {
+		duration = defaultSessionDuration
+	}
+	if duration > maxDuration {
+		duration = maxDuration
+	}
+	if duration < minSessionDuration {
+		duration = minSessionDuration
+	}
+	return duration
+}
+
+// sanitizeValue replaces the characters that AWS rejects and truncates the
+// value to maxLength.
+func sanitizeValue(invalidChars *regexp.Regexp, value string,
+	maxLength int) string {
+	value = invalidChars.ReplaceAllString(value, "-")
+	if len(value) > maxLength {
+		value = value[:maxLength]
+	}
+	return value
+}
+
+// getSessionTagConfigs returns the global session tags, replaced by the
+// tags of the account with the same key.
+func (b *Broker) getSessionTagConfigs(
+	accountName string) []configuration.AWSSessionTag {
+	awsConfig := b.getConfig().AWS
+	var accountTags []configuration.AWSSessionTag
+	for _, account := range awsConfig.Account {
+		if account.Name == accountName {
+			accountTags = account.SessionTags
+			break
+		}
+	}
+	tagConfigs := make([]configuration.AWSSessionTag, 0,
+		len(awsConfig.SessionTags)+len(accountTags))
+	for _, tagConfig := range awsConfig.SessionTags {
+		overridden := false
+		for _, accountTag := range accountTags {
+			if accountTag.Key == tagConfig.Key {
+				overridden = true
+				break
+			}
+		}
+		if !overridden {
+			tagConfigs = append(tagConfigs, tagConfig)
+		}
+	}
+	return append(tagConfigs, accountTags...)
+}
+
+func (b *Broker) getUserAttributes(username string) (map[string]string, error) {
+	attributesGetter, ok := b.rawUserInfo.(broker.UserAttributesGetter)
+	if !ok {
+		return map[string]string{}, nil
+	}
+	return attributesGetter.GetUserAttributes(username)
+}
+
+func getGroupTagValue(re *regexp.Regexp, groups []string) string {
+	for _, group := range groups {
+		matches := re.FindStringSubmatch(group)
+		if len(matches) > 1 {
+			return matches[1]
+		}
+		if len(matches) == 1 {
+			return matches[0]
+		}
+	}
+	return ""
+}
+
+// getAssumeRoleIdentity returns the source identity and session tags of the
+// user. Unless useUserInfo is true, the tags taken from the attributes or
+// groups of the user are left out, so that userinfo is not consulted.
+func (b *Broker) getAssumeRoleIdentity(accountName string, userName string,
+	useUserInfo bool) (*assumeRoleIdentity, error) {
+	var identity assumeRoleIdentity
+	if b.getConfig().AWS.SetSourceIdentity {
+		identity.sourceIdentity = sanitizeValue(sourceIdentityInvalidChars,
+			userName, maxSourceIdentityLength)
+	}
+	var attributes map[string]string
+	var groups []string
+	var err error
+	for _, tagConfig := range b.getSessionTagConfigs(accountName) {
+		value := tagConfig.Value
+		if !useUserInfo &&
+			(tagConfig.Attribute != "" || tagConfig.GroupRegexp != nil) {
+			continue
+		}
+		if tagConfig.Attribute != "" {
+			if attributes == nil {
+				attributes, err = b.getUserAttributes(userName)
+				if err != nil {
+					return nil, err
+				}
+			}
+			value = attributes[tagConfig.Attribute]
+		} else if tagConfig.GroupRegexp != nil {
+			if groups == nil {
+				groups, err = b.rawUserInfo.GetUserGroups(userName)
+				if err != nil {
+					return nil, err
+				}
+			}
+			value = getGroupTagValue(tagConfig.GroupRegexp, groups)
+		}
+		value = sanitizeValue(sessionTagInvalidChars, value,
+			maxSessionTagValueLength)
+		if value == "" {
+			continue
+		}
+		identity.tags = append(identity.tags, ststypes.Tag{
+			Key:   aws.String(tagConfig.Key),
+			Value: aws.String(value),
+		})
+		if tagConfig.Transitive {
+			identity.transitiveTagKeys = append(identity.transitiveTagKeys,
+				tagConfig.Key)
+		}
+	}
+	b.logger.Debugf(2, "identity for %s on %s: %+v", userName, accountName,
+		identity)
+	return &identity, nil
+}
+
 func (b *Broker) finishUnsealing() error {
 	credentialProvider, region, err := b.getCredentialsProviderFromProfile(
 		masterAWSProfileName)
@@ -144,6 +384,10 @@ func (b *Broker) finishUnsealing() error {
 	}
 	b.masterStsClient = sts.New(stsOptions)
 	b.masterStsRegion = region
+	if b.organizationsInterval > 0 {
+		go b.organizationsLoop()
+	}
+	go b.roleRefreshLoop()
 	b.isUnsealedChannel <- nil
 	return nil
 }
@@ -296,26 +540,29 @@ func (b *Broker) getStsClient(profileName string) (*sts.Client, string, error) {
 	return stsClient, region, nil
 }
 
+// withProfileAssumeRole assumes the role using the credentials of the profile.
+// If identity is not nil its source identity and session tags are set on the
+// session.
 func (b *Broker) withProfileAssumeRole(accountName string, profileName string,
-	roleName string,
-	roleSessionName string) (*sts.AssumeRoleOutput, string, error) {
+	roleName string, roleSessionName string, duration time.Duration,
+	identity *assumeRoleIdentity) (*sts.AssumeRoleOutput, string, error) {
 	ctx := context.TODO()
 	stsClient, region, err := b.getStsClient(profileName)
 	if err != nil {
 		return nil, "", err
 	}
 	b.logger.Debugf(2, "stsClient=%v", stsClient)
-	var durationSeconds int32
-	durationSeconds = profileAssumeRoleDurationSeconds
+	durationSeconds := int32(duration / time.Second)
 	accountID, err := b.accountIDFromName(accountName)
 	if err != nil {
 		return nil, "", err
 	}
-	arnRolePrefix := "arn:aws:iam"
-	if strings.HasPrefix(region, "us-gov-") {
-		arnRolePrefix = "arn:aws-us-gov:iam"
+	region = b.getAccountRegion(accountName, region)
+	accountPartition, err := b.getAccountPartition(accountName, region)
+	if err != nil {
+		return nil, "", err
 	}
-	roleArn := fmt.Sprintf("%s::%s:role/%s", arnRolePrefix, accountID, roleName)
+	roleArn := accountPartition.roleARN(accountID, roleName)
 	b.logger.Debugf(2, "calling sts.AssumeRole(role=%s, sessionName=%s)\n",
 		roleArn, roleSessionName)
 	assumeRoleInput := sts.AssumeRoleInput{
@@ -323,15 +570,52 @@ func (b *Broker) withProfileAssumeRole(accountName string, profileName string,
 		RoleArn:         &roleArn,
 		RoleSessionName: &roleSessionName,
 	}
+	if identity != nil {
+		if identity.sourceIdentity != "" {
+			assumeRoleInput.SourceIdentity = aws.String(identity.sourceIdentity)
+		}
+		assumeRoleInput.Tags = identity.tags
+		assumeRoleInput.TransitiveTagKeys = identity.transitiveTagKeys
+	}
 	awsAssumeRoleAttempt.WithLabelValues(accountName, roleName).Inc()
-	assumeRoleOutput, err := stsClient.AssumeRole(ctx, &assumeRoleInput)
+	// Use the regional STS endpoint of the account.
+	assumeRoleOutput, err := stsClient.AssumeRole(ctx, &assumeRoleInput,
+		func(options *sts.Options) { options.Region = region })
 	if err == nil {
 		awsAssumeRoleSuccess.WithLabelValues(accountName, roleName).Inc()
 	}
 	return assumeRoleOutput, region, err
 }
 
-const getAWSRolesTimeout = 10 * time.Second
+const (
+	getAWSRolesTimeout       = 10 * time.Second
+	getTaggedAWSRolesTimeout = 30 * time.Second // One call per role for tags.
+)
+
+// roleHasTag returns true if the role carries the tag. An empty tag value
+// matches any value.
+func roleHasTag(ctx context.Context, iamClient *iam.Client, roleName string,
+	requiredTag configuration.AWSRoleTag) (bool, error) {
+	paginator := iam.NewListRoleTagsPaginator(iamClient,
+		&iam.ListRoleTagsInput{RoleName: aws.String(roleName)})
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return false, fmt.Errorf("cannot list tags of role %s: %s",
+				roleName, err)
+		}
+		for _, tag := range output.Tags {
+			if aws.ToString(tag.Key) != requiredTag.Key {
+				continue
+			}
+			if requiredTag.Value == "" ||
+				aws.ToString(tag.Value) == requiredTag.Value {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
 
 func (b *Broker) withAWSCredentialsProviderGetAWSRoleList(credentialsProvider aws.CredentialsProvider, awsRegion string, accountName string) ([]string, error) {
 	cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithCredentialsProvider(credentialsProvider), config.WithRegion(awsRegion))
@@ -343,6 +627,14 @@ func (b *Broker) withAWSCredentialsProviderGetAWSRoleList(credentialsProvider aw
 	var maxItems int32
 	maxItems = 500
 	listRolesInput := iam.ListRolesInput{MaxItems: &maxItems}
+	pathPrefix, requiredTag := b.getRoleFilter(accountName)
+	if pathPrefix != "" {
+		listRolesInput.PathPrefix = aws.String(pathPrefix)
+	}
+	timeout := getAWSRolesTimeout
+	if requiredTag.Key != "" {
+		timeout = getTaggedAWSRolesTimeout
+	}
 	var roleNames []string
 
 	ctx := context.TODO()
@@ -367,6 +659,17 @@ func (b *Broker) withAWSCredentialsProviderGetAWSRoleList(credentialsProvider aw
 				return
 			}
 			for _, role := range listRolesOutput.Roles {
+				if requiredTag.Key != "" {
+					hasTag, err := roleHasTag(ctx, iamClient, *role.RoleName,
+						requiredTag)
+					if err != nil {
+						c <- err
+						return
+					}
+					if !hasTag {
+						continue
+					}
+				}
 				roleNames = append(roleNames, *role.RoleName)
 			}
 		}
@@ -377,7 +680,7 @@ func (b *Broker) withAWSCredentialsProviderGetAWSRoleList(credentialsProvider aw
 		if getRolesErr != nil {
 			return nil, getRolesErr
 		}
-	case <-time.After(getAWSRolesTimeout):
+	case <-time.After(timeout):
 		return nil, fmt.Errorf("AWS Get roles had a timeout for account %s", accountName)
 	}
 
@@ -388,12 +691,13 @@ func (b *Broker) withAWSCredentialsProviderGetAWSRoleList(credentialsProvider aw
 	return roleNames, nil
 }
 
-func (b *Broker) masterGetAWSRolesForAccount(accountName string) ([]string, error) {
-	b.logger.Debugf(1, "top of masterGetAWSRolesForAccount for account =%s",
-		accountName)
-	assumeRoleOutput, region, err := b.withProfileAssumeRole(accountName, masterAWSProfileName, b.listRolesRoleName, "brokermaster")
+// masterGetListRolesCredentialsProvider returns credentials for the list
+// roles role of the account, assumed by the master profile.
+func (b *Broker) masterGetListRolesCredentialsProvider(accountName string) (
+	aws.CredentialsProvider, string, error) {
+	assumeRoleOutput, region, err := b.withProfileAssumeRole(accountName, masterAWSProfileName, b.listRolesRoleName, "brokermaster", defaultSessionDuration, nil)
 	if err != nil {
-		return nil, fmt.Errorf(
+		return nil, "", fmt.Errorf(
 			"profile: %s cannot assume role: %s in account: %s: %s",
 			masterAWSProfileName, b.listRolesRoleName, accountName, err)
 	}
@@ -401,6 +705,17 @@ func (b *Broker) masterGetAWSRolesForAccount(accountName string) ([]string, erro
 	provider := credentials.NewStaticCredentialsProvider(
 		*assumeRoleOutput.Credentials.AccessKeyId,
 		*assumeRoleOutput.Credentials.SecretAccessKey, *assumeRoleOutput.Credentials.SessionToken)
+	return provider, region, nil
+}
+
+func (b *Broker) masterGetAWSRolesForAccount(accountName string) ([]string, error) {
+	b.logger.Debugf(1, "top of masterGetAWSRolesForAccount for account =%s",
+		accountName)
+	provider, region, err := b.masterGetListRolesCredentialsProvider(
+		accountName)
+	if err != nil {
+		return nil, err
+	}
 	return b.withAWSCredentialsProviderGetAWSRoleList(provider, region, accountName)
 }
 
@@ -463,6 +778,7 @@ func (b *Broker) getAWSRolesForAccount(accountName string) ([]string, error) {
 		b.accountRoleMutex.Lock()
 		b.accountRoleCache[accountName] = cachedEntry
 		b.accountRoleMutex.Unlock()
+		b.markCacheDirty()
 		return value, nil
 	}
 	value, err := b.getAWSRolesForAccountNonCached(accountName)
@@ -474,78 +790,40 @@ func (b *Broker) getAWSRolesForAccount(accountName string) ([]string, error) {
 	b.accountRoleMutex.Lock()
 	b.accountRoleCache[accountName] = cachedEntry
 	b.accountRoleMutex.Unlock()
+	b.markCacheDirty()
 	return value, nil
 }
 
-func stringIntersectionNoDups(set1, set2 []string) (intersection []string) {
-	stringMap := make(map[string]string, len(set1))
-	for _, v1 := range set1 {
-		stringMap[strings.ToLower(v1)] = v1
-	}
-	for _, v2 := range set2 {
-		v1, ok := stringMap[strings.ToLower(v2)]
-		if ok {
-			intersection = append(intersection, v1)
-		}
+func (b *Broker) getAccountRoles(accountName string) ([]string, error) {
+	if _, err := b.accountIDFromName(accountName); err != nil {
+		return nil, err
 	}
-	return intersection
+	return b.getAWSRolesForAccount(accountName)
 }
 
 func (b *Broker) getUserAllowedAccountsFromGroups(userGroups []string) ([]broker.PermittedAccount, error) {
 	b.logger.Debugf(1,
 		"top of getUserAllowedAccountsFromGroups for userGroups: %v",
 		userGroups)
-	groupToAccountName := make(map[string]string)
-	var groupList []string
-	for _, account := range b.config.AWS.Account {
-		groupName := account.GroupName
-		if len(groupName) == 0 {
-			groupName = account.Name
-		}
-		groupName = strings.ToLower(groupName)
-		groupToAccountName[groupName] = account.Name
-		groupList = append(groupList, groupName)
-	}
-	var allowedRoles map[string][]string
-	allowedRoles = make(map[string][]string)
-	for _, accountName := range groupList {
-		reString := fmt.Sprintf("(?i)^%s-(.*)$", accountName)
-		b.logger.Debugf(2, "reString=%v", reString)
-		re, err := regexp.Compile(reString)
-		if err != nil {
-			return nil, err
-		}
-		for _, group := range userGroups {
-			matches := re.FindStringSubmatch(group)
-			b.logger.Debugf(4, "matches-XXX=%v %d", matches, len(matches))
-			if len(matches) == 2 {
-				b.logger.Debugf(2, "matches=%v", matches)
-				accountGroupName := accountName
-				allowedRoles[accountGroupName] = append(allowedRoles[accountGroupName], matches[1])
-			}
-		}
-	}
-	b.logger.Debugf(1, "allowedRoles(pre)=%v", allowedRoles)
-	//now add extra roles:
-	for _, account := range b.config.AWS.Account {
-		if len(account.ExtraUserRoles) < 1 {
-			continue
-		}
-		if currentValue, ok := allowedRoles[account.Name]; ok {
-			allowedRoles[account.Name] = append(currentValue, account.ExtraUserRoles...)
-		} else {
-			allowedRoles[account.Name] = account.ExtraUserRoles
-		}
+	accounts := b.getConfig().AWS.Account
+	accountGroups := make([]broker.AccountGroup, 0, len(accounts))
+	for _, account := range accounts {
+		accountGroups = append(accountGroups, broker.AccountGroup{
+			AccountName:    account.Name,
+			GroupName:      account.GroupName,
+			ExtraUserRoles: account.ExtraUserRoles,
+		})
+	}
+	allowedRoles, err := broker.GetAllowedRolesFromGroups(accountGroups,
+		userGroups)
+	if err != nil {
+		return nil, err
 	}
-	b.logger.Debugf(1, "allowedRoles(post)=%v", allowedRoles)
+	b.logger.Debugf(1, "allowedRoles=%v", allowedRoles)
 	var permittedAccounts []broker.PermittedAccount
 	var mux sync.Mutex
 	var wg sync.WaitGroup
-	for groupName, allowedRoles := range allowedRoles {
-		accountName, ok := groupToAccountName[groupName]
-		if !ok {
-			return nil, errors.New("Cannot map to accountname for some username")
-		}
+	for accountName, allowedRoles := range allowedRoles {
 		displayName, err := b.accountHumanNameFromName(accountName)
 		if err != nil {
 			return nil, err
@@ -558,7 +836,7 @@ func (b *Broker) getUserAllowedAccountsFromGroups(userGroups []string) ([]broker
 				b.logger.Printf("Error getting profile for account %s: %s", accountName, err)
 				return
 			}
-			allowedAndAvailable := stringIntersectionNoDups(rolesForAccount, allowedRoles)
+			allowedAndAvailable := broker.StringIntersectionNoDups(rolesForAccount, allowedRoles)
 			if len(allowedAndAvailable) < 1 {
 				return
 			}
@@ -577,7 +855,7 @@ func (b *Broker) getUserAllowedAccountsFromGroups(userGroups []string) ([]broker
 }
 
 func (b *Broker) getUserAllowedAccountsNonCached(username string) ([]broker.PermittedAccount, error) {
-	if b.config == nil {
+	if b.getConfig() == nil {
 		return nil, errors.New("nil config")
 	}
 	userGroups, err := b.userInfo.GetUserGroups(username)
@@ -591,6 +869,13 @@ func (b *Broker) getUserAllowedAccountsNonCached(username string) ([]broker.Perm
 
 const cacheDuration = time.Second * 300
 
+func (b *Broker) flushUserAllowedAccounts(username string) {
+	b.userAllowedCredentialsMutex.Lock()
+	delete(b.userAllowedCredentialsCache, username)
+	b.userAllowedCredentialsMutex.Unlock()
+	b.markCacheDirty()
+}
+
 func (b *Broker) getUserAllowedAccounts(username string) ([]broker.PermittedAccount, error) {
 	b.userAllowedCredentialsMutex.Lock()
 	cachedEntry, ok := b.userAllowedCredentialsCache[username]
@@ -611,6 +896,7 @@ func (b *Broker) getUserAllowedAccounts(username string) ([]broker.PermittedAcco
 		b.userAllowedCredentialsMutex.Lock()
 		b.userAllowedCredentialsCache[username] = cachedEntry
 		b.userAllowedCredentialsMutex.Unlock()
+		b.markCacheDirty()
 		return value, nil
 	}
 	permittedAccounts, err := b.getUserAllowedAccountsNonCached(username)
@@ -623,6 +909,7 @@ func (b *Broker) getUserAllowedAccounts(username string) ([]broker.PermittedAcco
 	b.userAllowedCredentialsMutex.Lock()
 	b.userAllowedCredentialsCache[username] = cachedEntry
 	b.userAllowedCredentialsMutex.Unlock()
+	b.markCacheDirty()
 	return permittedAccounts, nil
 }
 
@@ -655,28 +942,68 @@ type SessionTokenResponseJSON struct {
 	SigninToken string `json:"SigninToken"`
 }
 
-const consoleSessionDurationSeconds = "43000" //3600 * 12
+// limitSessionDuration limits the duration to maxDuration if that is not
+// zero, but not below the minimum duration of sessions.
+func limitSessionDuration(duration time.Duration,
+	maxDuration time.Duration) time.Duration {
+	if maxDuration > 0 && duration > maxDuration {
+		duration = maxDuration
+	}
+	if duration < minSessionDuration {
+		duration = minSessionDuration
+	}
+	return duration
+}
 
-func (b *Broker) getConsoleURLForAccountRole(accountName string, roleName string, userName string, issuerURL string) (string, error) {
-	assumeRoleOutput, region, err := b.withProfileAssumeRole(accountName, masterAWSProfileName, roleName, userName)
+// getConsoleURLForAccountRole limits the sessions to maxDuration, unless it
+// is zero.
+func (b *Broker) getConsoleURLForAccountRole(accountName string, roleName string, userName string, issuerURL string, maxDuration time.Duration) (string, error) {
+	identity, err := b.getAssumeRoleIdentity(accountName, userName, true)
+	if err != nil {
+		return "", err
+	}
+	return b.getConsoleURLForIdentity(accountName, roleName, userName,
+		issuerURL, maxDuration, identity)
+}
+
+func (b *Broker) getConsoleURLForIdentity(accountName string, roleName string,
+	userName string, issuerURL string, maxDuration time.Duration,
+	identity *assumeRoleIdentity) (string, error) {
+	sessionDuration := limitSessionDuration(
+		b.getMaxSessionDuration(accountName, roleName), maxDuration)
+	assumeRoleOutput, region, err := b.withProfileAssumeRole(accountName, masterAWSProfileName, roleName, userName, sessionDuration, identity)
 	if err != nil {
 		b.logger.Debugf(1, "cannot assume role for account %s with master account, err=%s ", accountName, err)
 		// try using a direct role if possible then
-		assumeRoleOutput, region, err = b.withProfileAssumeRole(accountName, accountName, roleName, userName)
+		assumeRoleOutput, region, err = b.withProfileAssumeRole(accountName, accountName, roleName, userName, sessionDuration, identity)
 		if err != nil {
 			b.logger.Printf("cannot assume role for account %s, err=%s", accountName, err)
 			return "", err
 		}
 	}
 	b.logger.Debugf(2, "assume role success for account=%s, roleoutput=%v", accountName, assumeRoleOutput)
-
+	accountPartition, err := b.getAccountPartition(accountName, region)
+	if err != nil {
+		return "", err
+	}
 	sessionCredentials := ExchangeCredentialsJSON{
 		SessionId:    *assumeRoleOutput.Credentials.AccessKeyId,
 		SessionKey:   *assumeRoleOutput.Credentials.SecretAccessKey,
 		SessionToken: *assumeRoleOutput.Credentials.SessionToken,
 	}
 	b.logger.Debugf(2, "sessionCredentials=%v", sessionCredentials)
+	consoleSessionDuration := limitSessionDuration(
+		b.getConsoleSessionDuration(accountName, roleName), maxDuration)
+	return b.getConsoleURLFromCredentials(accountPartition, sessionCredentials,
+		consoleSessionDuration, issuerURL)
+}
 
+// getConsoleURLFromCredentials exchanges the session credentials for a
+// signin token at the federation endpoint of the partition, and returns the
+// console login URL.
+func (b *Broker) getConsoleURLFromCredentials(accountPartition *partition,
+	sessionCredentials ExchangeCredentialsJSON, sessionDuration time.Duration,
+	issuerURL string) (string, error) {
 	bcreds, err := json.Marshal(sessionCredentials)
 	if err != nil {
 		return "", err
@@ -684,12 +1011,8 @@ func (b *Broker) getConsoleURLForAccountRole(accountName string, roleName string
 	creds := url.QueryEscape(string(bcreds[:]))
 	b.logger.Debugf(1, "sessionCredentials-escaped=%v", creds)
 
-	federationUrl := "https://signin.aws.amazon.com/federation"
-	awsDestinationURL := "https://console.aws.amazon.com/"
-	if strings.HasPrefix(region, "us-gov-") {
-		federationUrl = "https://signin.amazonaws-us-gov.com/federation"
-		awsDestinationURL = "https://console.amazonaws-us-gov.com/"
-	}
+	federationUrl := accountPartition.FederationURL
+	awsDestinationURL := accountPartition.ConsoleURL
 
 	req, err := http.NewRequest("GET", federationUrl, nil)
 	if err != nil {
@@ -698,7 +1021,12 @@ func (b *Broker) getConsoleURLForAccountRole(accountName string, roleName string
 	q := req.URL.Query()
 	q.Add("Action", "getSigninToken")
 	q.Add("Session", string(bcreds[:]))
-	q.Add("SessionDuration", consoleSessionDurationSeconds)
+	consoleSessionDuration := sessionDuration
+	if consoleSessionDuration > maxConsoleSessionDuration {
+		consoleSessionDuration = maxConsoleSessionDuration
+	}
+	q.Add("SessionDuration",
+		strconv.FormatInt(int64(consoleSessionDuration/time.Second), 10))
 	req.URL.RawQuery = q.Encode()
 	b.logger.Debugf(2, "req=%+v", req)
 
@@ -729,24 +1057,40 @@ func (b *Broker) getConsoleURLForAccountRole(accountName string, roleName string
 	encodedIssuer := url.QueryEscape(issuerURL)
 	targetUrl := fmt.Sprintf("%s?Action=login&Issuer=%s&Destination=%s&SigninToken=%s", federationUrl, encodedIssuer, awsDestinationURL, tokenOutput.SigninToken)
 	b.logger.Debugf(1, "targetURL=%s", targetUrl)
-
-	b.auditLogger.Printf("Console url generated for: %s on account %s role %s", userName, accountName, roleName)
 	return targetUrl, nil
 }
 
-func (b *Broker) generateTokenCredentials(accountName string, roleName string, userName string) (*broker.AWSCredentialsJSON, error) {
-	assumeRoleOutput, region, err := b.withProfileAssumeRole(accountName, masterAWSProfileName, roleName, userName)
+func (b *Broker) generateTokenCredentials(accountName string, roleName string, userName string, duration time.Duration) (*broker.AWSCredentialsJSON, error) {
+	identity, err := b.getAssumeRoleIdentity(accountName, userName, true)
+	if err != nil {
+		return nil, err
+	}
+	return b.generateTokenCredentialsForIdentity(accountName, roleName,
+		userName, duration, identity)
+}
+
+func (b *Broker) generateTokenCredentialsForIdentity(accountName string,
+	roleName string, userName string, duration time.Duration,
+	identity *assumeRoleIdentity) (*broker.AWSCredentialsJSON, error) {
+	sessionDuration := b.getSessionDuration(accountName, roleName, duration)
+	assumeRoleOutput, region, err := b.withProfileAssumeRole(accountName, masterAWSProfileName, roleName, userName, sessionDuration, identity)
 	if err != nil {
 		b.logger.Debugf(1, "cannot assume role for account %s with master account, err=%s ", accountName, err)
 		// try using a direct role if possible then
-		assumeRoleOutput, region, err = b.withProfileAssumeRole(accountName, accountName, roleName, userName)
+		assumeRoleOutput, region, err = b.withProfileAssumeRole(accountName, accountName, roleName, userName, sessionDuration, identity)
 		if err != nil {
 			b.logger.Printf("cannot assume role for account %s, err=%s", accountName, err)
 			return nil, err
 		}
 	}
 	b.logger.Debugf(2, "assume role success for account=%s, roleoutput=%v", accountName, assumeRoleOutput)
-	if !strings.HasPrefix(region, "us-gov-") {
+	accountPartition, err := b.getAccountPartition(accountName, region)
+	if err != nil {
+		return nil, err
+	}
+	// Clients default to the aws partition, so only report the region of
+	// other partitions.
+	if accountPartition == awsPartition {
 		region = ""
 	}
 	outVal := broker.AWSCredentialsJSON{
@@ -754,13 +1098,35 @@ func (b *Broker) generateTokenCredentials(accountName string, roleName string, u
 		SessionKey:   *assumeRoleOutput.Credentials.SecretAccessKey,
 		SessionToken: *assumeRoleOutput.Credentials.SessionToken,
 		Region:       region,
-		Expiration:   time.Now().Add(time.Second * profileAssumeRoleDurationSeconds),
+		Expiration:   aws.ToTime(assumeRoleOutput.Credentials.Expiration),
 	}
-	b.auditLogger.Printf("Token credentials (KeyId %s) generated for: %s on account %s role %s",
-		*assumeRoleOutput.Credentials.AccessKeyId, userName, accountName, roleName)
 	return &outVal, nil
 }
 
+// getBreakGlassConsoleURL issues a console URL without consulting userinfo,
+// which break-glass access must not depend on.
+func (b *Broker) getBreakGlassConsoleURL(accountName string, roleName string,
+	userName string, issuerURL string) (string, error) {
+	identity, err := b.getAssumeRoleIdentity(accountName, userName, false)
+	if err != nil {
+		return "", err
+	}
+	return b.getConsoleURLForIdentity(accountName, roleName, userName,
+		issuerURL, 0, identity)
+}
+
+// generateBreakGlassTokenCredentials issues credentials of the default
+// duration without consulting userinfo.
+func (b *Broker) generateBreakGlassTokenCredentials(accountName string,
+	roleName string, userName string) (*broker.AWSCredentialsJSON, error) {
+	identity, err := b.getAssumeRoleIdentity(accountName, userName, false)
+	if err != nil {
+		return nil, err
+	}
+	return b.generateTokenCredentialsForIdentity(accountName, roleName,
+		userName, 0, identity)
+}
+
 func (b *Broker) updateConfiguration(
 	config *configuration.Configuration) error {
 	if config == nil {
@@ -777,6 +1143,9 @@ func (b *Broker) updateConfiguration(
 		b.userInfo = ui
 	}
 	b.logger.Debugf(1, "config=%+v", *config)
-	b.config = config
+	b.organizationMutex.Lock()
+	defer b.organizationMutex.Unlock()
+	b.rawConfig = config
+	b.config = mergeConfiguration(config, b.organizationAccounts)
 	return nil
 }
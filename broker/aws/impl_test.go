@@ -1,10 +1,13 @@
 package aws
 
 import (
+	"errors"
+	"regexp"
 	"testing"
 	"time"
 
 	"github.com/Cloud-Foundations/cloud-gate/broker"
+	"github.com/Cloud-Foundations/cloud-gate/broker/configuration"
 	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
 )
 
@@ -116,3 +119,210 @@ func TestGetAWSRolesForAccountFromCache(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestGetSessionDuration(t *testing.T) {
+	b := setupCachedBroker(t)
+	b.config = &configuration.Configuration{
+		AWS: configuration.AWSConfiguration{
+			Account: []configuration.AWSAccount{
+				{
+					Name:               "long",
+					MaxSessionDuration: 8 * time.Hour,
+					RoleMaxSessionDuration: map[string]time.Duration{
+						"Admin": 2 * time.Hour,
+					},
+				},
+				{Name: "default"},
+			},
+		},
+	}
+	tests := []struct {
+		accountName string
+		roleName    string
+		requested   time.Duration
+		expected    time.Duration
+	}{
+		{"long", "ReadOnly", 0, time.Hour},
+		{"long", "ReadOnly", 4 * time.Hour, 4 * time.Hour},
+		{"long", "ReadOnly", 24 * time.Hour, 8 * time.Hour},
+		{"long", "admin", 4 * time.Hour, 2 * time.Hour},
+		{"long", "ReadOnly", time.Minute, minSessionDuration},
+		{"default", "ReadOnly", 4 * time.Hour, time.Hour},
+		{"unknown", "ReadOnly", 0, time.Hour},
+	}
+	for _, test := range tests {
+		duration := b.getSessionDuration(test.accountName, test.roleName,
+			test.requested)
+		if duration != test.expected {
+			t.Errorf("%s/%s requested: %s, expected: %s, got: %s",
+				test.accountName, test.roleName, test.requested,
+				test.expected, duration)
+		}
+	}
+	consoleTests := []struct {
+		accountName string
+		roleName    string
+		expected    time.Duration
+	}{
+		{"long", "ReadOnly", 8 * time.Hour},
+		{"long", "admin", 2 * time.Hour},
+		{"default", "ReadOnly", defaultConsoleSessionDuration},
+	}
+	for _, test := range consoleTests {
+		duration := b.getConsoleSessionDuration(test.accountName,
+			test.roleName)
+		if duration != test.expected {
+			t.Errorf("console %s/%s expected: %s, got: %s", test.accountName,
+				test.roleName, test.expected, duration)
+		}
+	}
+}
+
+type testUserInfo struct {
+	groups     map[string][]string
+	attributes map[string]map[string]string
+}
+
+func (ui *testUserInfo) GetUserGroups(username string) ([]string, error) {
+	return ui.groups[username], nil
+}
+
+func (ui *testUserInfo) GetUserAttributes(username string) (
+	map[string]string, error) {
+	return ui.attributes[username], nil
+}
+
+// failingUserInfo is a userinfo backend which is unavailable.
+type failingUserInfo struct{}
+
+func (failingUserInfo) GetUserGroups(string) ([]string, error) {
+	return nil, errors.New("userinfo unavailable")
+}
+
+func (failingUserInfo) GetUserAttributes(string) (map[string]string, error) {
+	return nil, errors.New("userinfo unavailable")
+}
+
+func TestGetAssumeRoleIdentity(t *testing.T) {
+	b := setupCachedBroker(t)
+	b.rawUserInfo = &testUserInfo{
+		groups: map[string][]string{
+			"user1": {"prod-admin", "team-storage"},
+		},
+		attributes: map[string]map[string]string{
+			"user1": {"mail": "user1@example.com"},
+		},
+	}
+	b.config = &configuration.Configuration{
+		AWS: configuration.AWSConfiguration{
+			SetSourceIdentity: true,
+			SessionTags: []configuration.AWSSessionTag{
+				{Key: "email", Attribute: "mail"},
+				{Key: "team", GroupRegex: "^team-(.*)$",
+					GroupRegexp: regexp.MustCompile("^team-(.*)$"),
+					Transitive:  true},
+				{Key: "cost-center", Value: "1000"},
+				{Key: "missing", Attribute: "costCenter"},
+			},
+			Account: []configuration.AWSAccount{
+				{
+					Name: "prod",
+					SessionTags: []configuration.AWSSessionTag{
+						{Key: "cost-center", Value: "2000"},
+					},
+				},
+			},
+		},
+	}
+	identity, err := b.getAssumeRoleIdentity("prod", "user1", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.sourceIdentity != "user1" {
+		t.Fatalf("unexpected source identity: %s", identity.sourceIdentity)
+	}
+	sanitized := sanitizeValue(sourceIdentityInvalidChars, "user 1 (cert)",
+		maxSourceIdentityLength)
+	if sanitized != "user-1--cert-" {
+		t.Fatalf("unexpected sanitized source identity: %s", sanitized)
+	}
+	expectedTags := map[string]string{
+		"email":       "user1@example.com",
+		"team":        "storage",
+		"cost-center": "2000",
+	}
+	if len(identity.tags) != len(expectedTags) {
+		t.Fatalf("unexpected tags: %+v", identity.tags)
+	}
+	for _, tag := range identity.tags {
+		if expectedTags[*tag.Key] != *tag.Value {
+			t.Errorf("tag %s expected: %s, got: %s", *tag.Key,
+				expectedTags[*tag.Key], *tag.Value)
+		}
+	}
+	if len(identity.transitiveTagKeys) != 1 ||
+		identity.transitiveTagKeys[0] != "team" {
+		t.Fatalf("unexpected transitive keys: %v", identity.transitiveTagKeys)
+	}
+	// Break-glass access does not depend on userinfo.
+	b.rawUserInfo = failingUserInfo{}
+	if _, err := b.getAssumeRoleIdentity("prod", "user1", true); err == nil {
+		t.Fatal("expected error from failing userinfo")
+	}
+	identity, err = b.getAssumeRoleIdentity("prod", "user1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.sourceIdentity != "user1" || len(identity.tags) != 1 ||
+		*identity.tags[0].Key != "cost-center" ||
+		*identity.tags[0].Value != "2000" {
+		t.Fatalf("unexpected break-glass identity: %+v", identity)
+	}
+}
+
+func TestGetRoleFilter(t *testing.T) {
+	b := setupCachedBroker(t)
+	b.config = &configuration.Configuration{
+		AWS: configuration.AWSConfiguration{
+			RolePathPrefix: "/cloudgate/",
+			RequiredRoleTag: configuration.AWSRoleTag{
+				Key: "cloudgate:brokerable", Value: "true"},
+			Account: []configuration.AWSAccount{
+				{Name: "default"},
+				{
+					Name:           "legacy",
+					RolePathPrefix: "/",
+					RequiredRoleTag: configuration.AWSRoleTag{
+						Key: "legacy-brokerable"},
+				},
+			},
+		},
+	}
+	pathPrefix, requiredTag := b.getRoleFilter("default")
+	if pathPrefix != "/cloudgate/" || requiredTag.Key != "cloudgate:brokerable" ||
+		requiredTag.Value != "true" {
+		t.Fatalf("unexpected default filter: %s %+v", pathPrefix, requiredTag)
+	}
+	pathPrefix, requiredTag = b.getRoleFilter("legacy")
+	if pathPrefix != "/" || requiredTag.Key != "legacy-brokerable" ||
+		requiredTag.Value != "" {
+		t.Fatalf("unexpected legacy filter: %s %+v", pathPrefix, requiredTag)
+	}
+}
+
+func TestLimitSessionDuration(t *testing.T) {
+	for _, test := range []struct {
+		duration, maxDuration, expected time.Duration
+	}{
+		{12 * time.Hour, 0, 12 * time.Hour},
+		{12 * time.Hour, 2 * time.Hour, 2 * time.Hour},
+		{time.Hour, 2 * time.Hour, time.Hour},
+		{12 * time.Hour, time.Minute, minSessionDuration},
+	} {
+		duration := limitSessionDuration(test.duration, test.maxDuration)
+		if duration != test.expected {
+			t.Errorf("%s limited to %s: expected: %s, got: %s",
+				test.duration, test.maxDuration, test.expected, duration)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package aws
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/organizations"
+	orgtypes "github.com/aws/aws-sdk-go-v2/service/organizations/types"
+
+	"github.com/Cloud-Foundations/cloud-gate/broker/configuration"
+)
+
+const organizationsRequestTimeout = time.Minute * 2
+
+var accountNameInvalidChars = regexp.MustCompile(`[^a-z0-9_.-]+`)
+
+// getOrganizationAccountNames returns the name and display name of a
+// discovered account.
+func getOrganizationAccountNames(orgConfig configuration.AWSOrganization,
+	accountName string, tags map[string]string) (string, string) {
+	name := tags[orgConfig.NameTag]
+	if orgConfig.NameTag == "" || name == "" {
+		name = strings.Trim(accountNameInvalidChars.ReplaceAllString(
+			strings.ToLower(accountName), "-"), "-")
+	}
+	displayName := tags[orgConfig.DisplayNameTag]
+	if orgConfig.DisplayNameTag == "" || displayName == "" {
+		displayName = accountName
+	}
+	return name, displayName
+}
+
+// mergeAccounts returns the static accounts followed by the discovered
+// accounts whose ID and name are not already used by a static account.
+func mergeAccounts(static []configuration.AWSAccount,
+	discovered []configuration.AWSAccount) []configuration.AWSAccount {
+	accounts := make([]configuration.AWSAccount, 0,
+		len(static)+len(discovered))
+	usedIDs := make(map[string]struct{}, len(static))
+	usedNames := make(map[string]struct{}, len(static))
+	for _, account := range static {
+		accounts = append(accounts, account)
+		usedIDs[account.AccountID] = struct{}{}
+		usedNames[account.Name] = struct{}{}
+	}
+	for _, account := range discovered {
+		if _, ok := usedIDs[account.AccountID]; ok {
+			continue
+		}
+		if _, ok := usedNames[account.Name]; ok {
+			continue
+		}
+		accounts = append(accounts, account)
+		usedIDs[account.AccountID] = struct{}{}
+		usedNames[account.Name] = struct{}{}
+	}
+	return accounts
+}
+
+// mergeConfiguration returns the configuration with the discovered accounts
+// added, or the configuration itself if there are none.
+func mergeConfiguration(config *configuration.Configuration,
+	discovered []configuration.AWSAccount) *configuration.Configuration {
+	if !config.AWS.Organization.Enabled || len(discovered) < 1 {
+		return config
+	}
+	merged := *config
+	merged.AWS.Account = mergeAccounts(config.AWS.Account, discovered)
+	return &merged
+}
+
+func (b *Broker) getOrganizationsClient() (*organizations.Client, error) {
+	provider, _, err := b.getCredentialsProviderFromProfile(
+		masterAWSProfileName)
+	if err != nil {
+		return nil, err
+	}
+	// Organizations is a global service, served from one region of the
+	// partition.
+	region := getPartitionFromRegion(b.masterStsRegion).GlobalRegion
+	cfg, err := config.LoadDefaultConfig(context.TODO(),
+		config.WithCredentialsProvider(provider), config.WithRegion(region))
+	if err != nil {
+		return nil, err
+	}
+	return organizations.NewFromConfig(cfg), nil
+}
+
+func listAllOrganizationAccounts(ctx context.Context,
+	client *organizations.Client) ([]orgtypes.Account, error) {
+	var accounts []orgtypes.Account
+	paginator := organizations.NewListAccountsPaginator(client,
+		&organizations.ListAccountsInput{})
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, output.Accounts...)
+	}
+	return accounts, nil
+}
+
+// listOrganizationalUnitAccounts returns the accounts under the parent and
+// all of its nested organizational units.
+func listOrganizationalUnitAccounts(ctx context.Context,
+	client *organizations.Client, parentID string) ([]orgtypes.Account, error) {
+	var accounts []orgtypes.Account
+	accountPaginator := organizations.NewListAccountsForParentPaginator(client,
+		&organizations.ListAccountsForParentInput{
+			ParentId: aws.String(parentID)})
+	for accountPaginator.HasMorePages() {
+		output, err := accountPaginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, output.Accounts...)
+	}
+	unitPaginator := organizations.NewListOrganizationalUnitsForParentPaginator(
+		client, &organizations.ListOrganizationalUnitsForParentInput{
+			ParentId: aws.String(parentID)})
+	for unitPaginator.HasMorePages() {
+		output, err := unitPaginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, unit := range output.OrganizationalUnits {
+			unitAccounts, err := listOrganizationalUnitAccounts(ctx, client,
+				aws.ToString(unit.Id))
+			if err != nil {
+				return nil, err
+			}
+			accounts = append(accounts, unitAccounts...)
+		}
+	}
+	return accounts, nil
+}
+
+func getOrganizationAccountTags(ctx context.Context,
+	client *organizations.Client, accountID string) (map[string]string, error) {
+	tags := make(map[string]string)
+	paginator := organizations.NewListTagsForResourcePaginator(client,
+		&organizations.ListTagsForResourceInput{
+			ResourceId: aws.String(accountID)})
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, tag := range output.Tags {
+			tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+		}
+	}
+	return tags, nil
+}
+
+func (b *Broker) discoverOrganizationAccounts(
+	orgConfig configuration.AWSOrganization) (
+	[]configuration.AWSAccount, error) {
+	client, err := b.getOrganizationsClient()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(),
+		organizationsRequestTimeout)
+	defer cancel()
+	var orgAccounts []orgtypes.Account
+	if len(orgConfig.OrganizationalUnits) < 1 {
+		orgAccounts, err = listAllOrganizationAccounts(ctx, client)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, unitID := range orgConfig.OrganizationalUnits {
+		unitAccounts, err := listOrganizationalUnitAccounts(ctx, client,
+			unitID)
+		if err != nil {
+			return nil, err
+		}
+		orgAccounts = append(orgAccounts, unitAccounts...)
+	}
+	needTags := orgConfig.NameTag != "" || orgConfig.DisplayNameTag != ""
+	var accounts []configuration.AWSAccount
+	for _, orgAccount := range orgAccounts {
+		if orgAccount.Status != orgtypes.AccountStatusActive {
+			continue
+		}
+		accountID := aws.ToString(orgAccount.Id)
+		var tags map[string]string
+		if needTags {
+			tags, err = getOrganizationAccountTags(ctx, client, accountID)
+			if err != nil {
+				return nil, err
+			}
+		}
+		name, displayName := getOrganizationAccountNames(orgConfig,
+			aws.ToString(orgAccount.Name), tags)
+		if name == "" {
+			continue
+		}
+		accounts = append(accounts, configuration.AWSAccount{
+			Name:        name,
+			AccountID:   accountID,
+			DisplayName: displayName,
+		})
+	}
+	return accounts, nil
+}
+
+// refreshOrganizationAccounts discovers the accounts of the organization and
+// merges them into the configuration. It returns false if there is no
+// configuration yet.
+func (b *Broker) refreshOrganizationAccounts() bool {
+	b.organizationMutex.Lock()
+	rawConfig := b.rawConfig
+	b.organizationMutex.Unlock()
+	if rawConfig == nil {
+		return false
+	}
+	if !rawConfig.AWS.Organization.Enabled {
+		return true
+	}
+	accounts, err := b.discoverOrganizationAccounts(
+		rawConfig.AWS.Organization)
+	if err != nil {
+		b.logger.Printf("Cannot discover organization accounts: %s", err)
+		return true
+	}
+	b.logger.Debugf(1, "discovered %d organization accounts", len(accounts))
+	b.setOrganizationAccounts(accounts)
+	return true
+}
+
+// setOrganizationAccounts replaces the configuration with one which has the
+// discovered accounts, since readers use it without holding the lock.
+func (b *Broker) setOrganizationAccounts(accounts []configuration.AWSAccount) {
+	b.organizationMutex.Lock()
+	defer b.organizationMutex.Unlock()
+	b.organizationAccounts = accounts
+	b.config = mergeConfiguration(b.rawConfig, accounts)
+}
+
+func (b *Broker) organizationsLoop() {
+	for {
+		if b.refreshOrganizationAccounts() {
+			time.Sleep(b.organizationsInterval)
+		} else {
+			time.Sleep(time.Second * 5)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package aws
+
+import (
+	"testing"
+
+	"github.com/Cloud-Foundations/cloud-gate/broker/configuration"
+)
+
+func TestGetOrganizationAccountNames(t *testing.T) {
+	orgConfig := configuration.AWSOrganization{
+		NameTag: "cloudgate:name", DisplayNameTag: "cloudgate:display-name"}
+	name, displayName := getOrganizationAccountNames(orgConfig,
+		"Core Prod (EU)", nil)
+	if name != "core-prod-eu" || displayName != "Core Prod (EU)" {
+		t.Fatalf("unexpected names without tags: %s, %s", name, displayName)
+	}
+	name, displayName = getOrganizationAccountNames(orgConfig,
+		"Core Prod (EU)", map[string]string{
+			"cloudgate:name":         "core-prod-eu-01",
+			"cloudgate:display-name": "Core Production EU",
+		})
+	if name != "core-prod-eu-01" || displayName != "Core Production EU" {
+		t.Fatalf("unexpected names from tags: %s, %s", name, displayName)
+	}
+}
+
+func TestMergeConfiguration(t *testing.T) {
+	config := &configuration.Configuration{}
+	config.AWS.Account = []configuration.AWSAccount{
+		{Name: "prod", AccountID: "111111111111", GroupName: "prod-team"},
+	}
+	discovered := []configuration.AWSAccount{
+		{Name: "prod-renamed", AccountID: "111111111111"},
+		{Name: "prod", AccountID: "222222222222"},
+		{Name: "sandbox", AccountID: "333333333333"},
+	}
+	if merged := mergeConfiguration(config, discovered); merged != config {
+		t.Fatal("accounts merged while organization is disabled")
+	}
+	config.AWS.Organization.Enabled = true
+	merged := mergeConfiguration(config, discovered)
+	if len(config.AWS.Account) != 1 {
+		t.Fatal("static configuration was modified")
+	}
+	if len(merged.AWS.Account) != 2 {
+		t.Fatalf("unexpected merged accounts: %+v", merged.AWS.Account)
+	}
+	if merged.AWS.Account[0].GroupName != "prod-team" ||
+		merged.AWS.Account[1].Name != "sandbox" {
+		t.Fatalf("unexpected merged accounts: %+v", merged.AWS.Account)
+	}
+}
+
+func TestSetOrganizationAccounts(t *testing.T) {
+	b := setupCachedBroker(t)
+	b.rawConfig = &configuration.Configuration{}
+	b.rawConfig.AWS.Organization.Enabled = true
+	b.config = b.rawConfig
+	discovered := []configuration.AWSAccount{
+		{Name: "sandbox", AccountID: "333333333333"},
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			b.setOrganizationAccounts(discovered)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		b.accountIDFromName("sandbox")
+	}
+	<-done
+	accountID, err := b.accountIDFromName("sandbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accountID != "333333333333" {
+		t.Fatalf("unexpected account ID: %s", accountID)
+	}
+}
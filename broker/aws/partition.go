@@ -0,0 +1,92 @@
+package aws
+
+import (
+	"fmt"
+	"strings"
+)
+
+// partition describes the endpoints of an AWS partition.
+type partition struct {
+	Name          string // Used in ARNs.
+	RegionPrefix  string // Empty for the default partition.
+	GlobalRegion  string // Region serving global services.
+	FederationURL string
+	ConsoleURL    string
+}
+
+var (
+	awsPartition = &partition{
+		Name:          "aws",
+		GlobalRegion:  "us-east-1",
+		FederationURL: "https://signin.aws.amazon.com/federation",
+		ConsoleURL:    "https://console.aws.amazon.com/",
+	}
+	awsChinaPartition = &partition{
+		Name:          "aws-cn",
+		RegionPrefix:  "cn-",
+		GlobalRegion:  "cn-northwest-1",
+		FederationURL: "https://signin.amazonaws.cn/federation",
+		ConsoleURL:    "https://console.amazonaws.cn/",
+	}
+	awsGovCloudPartition = &partition{
+		Name:          "aws-us-gov",
+		RegionPrefix:  "us-gov-",
+		GlobalRegion:  "us-gov-west-1",
+		FederationURL: "https://signin.amazonaws-us-gov.com/federation",
+		ConsoleURL:    "https://console.amazonaws-us-gov.com/",
+	}
+	partitions = []*partition{
+		awsPartition,
+		awsChinaPartition,
+		awsGovCloudPartition,
+	}
+)
+
+// getPartitionFromRegion returns the partition of the region, defaulting to
+// the aws partition.
+func getPartitionFromRegion(region string) *partition {
+	for _, p := range partitions {
+		if p.RegionPrefix != "" && strings.HasPrefix(region, p.RegionPrefix) {
+			return p
+		}
+	}
+	return awsPartition
+}
+
+func getPartitionByName(name string) (*partition, error) {
+	for _, p := range partitions {
+		if p.Name == name {
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown partition: %s", name)
+}
+
+// roleARN returns the ARN of the role in the account.
+func (p *partition) roleARN(accountID string, roleName string) string {
+	return fmt.Sprintf("arn:%s:iam::%s:role/%s", p.Name, accountID, roleName)
+}
+
+// getAccountRegion returns the STS region configured for the account, or
+// defaultRegion.
+func (b *Broker) getAccountRegion(accountName string,
+	defaultRegion string) string {
+	for _, account := range b.getConfig().AWS.Account {
+		if account.Name == accountName && account.Region != "" {
+			return account.Region
+		}
+	}
+	return defaultRegion
+}
+
+// getAccountPartition returns the partition configured for the account, or
+// else the partition of the region.
+func (b *Broker) getAccountPartition(accountName string,
+	region string) (*partition, error) {
+	for _, account := range b.getConfig().AWS.Account {
+		if account.Name == accountName && account.Partition != "" {
+			return getPartitionByName(account.Partition)
+		}
+	}
+	return getPartitionFromRegion(region), nil
+}
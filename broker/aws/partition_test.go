@@ -0,0 +1,123 @@
+package aws
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/cloud-gate/broker/configuration"
+)
+
+func TestGetPartitionFromRegion(t *testing.T) {
+	tests := map[string]*partition{
+		"us-west-2":      awsPartition,
+		"eu-central-1":   awsPartition,
+		"us-gov-west-1":  awsGovCloudPartition,
+		"cn-northwest-1": awsChinaPartition,
+		"":               awsPartition,
+	}
+	for region, expected := range tests {
+		if p := getPartitionFromRegion(region); p != expected {
+			t.Errorf("region %s: expected: %s, got: %s", region, expected.Name,
+				p.Name)
+		}
+	}
+	if arn := awsChinaPartition.roleARN("123456789012", "admin"); arn !=
+		"arn:aws-cn:iam::123456789012:role/admin" {
+		t.Fatalf("unexpected ARN: %s", arn)
+	}
+}
+
+func TestGetAccountPartition(t *testing.T) {
+	b := setupCachedBroker(t)
+	b.config = &configuration.Configuration{}
+	b.config.AWS.Account = []configuration.AWSAccount{
+		{Name: "china", Region: "cn-north-1"},
+		{Name: "gov", Partition: "aws-us-gov"},
+		{Name: "bad", Partition: "aws-mars"},
+	}
+	region := b.getAccountRegion("china", "us-west-2")
+	if region != "cn-north-1" {
+		t.Fatalf("unexpected region: %s", region)
+	}
+	if p, err := b.getAccountPartition("china", region); err != nil ||
+		p != awsChinaPartition {
+		t.Fatalf("unexpected partition for china: %v %v", p, err)
+	}
+	if p, err := b.getAccountPartition("gov", "us-west-2"); err != nil ||
+		p != awsGovCloudPartition {
+		t.Fatalf("unexpected partition for gov: %v %v", p, err)
+	}
+	if _, err := b.getAccountPartition("bad", "us-west-2"); err == nil {
+		t.Fatal("expected error for unknown partition")
+	}
+	if b.getAccountRegion("other", "us-west-2") != "us-west-2" {
+		t.Fatal("expected default region")
+	}
+}
+
+func TestGetConsoleURLFromCredentials(t *testing.T) {
+	var gotSession ExchangeCredentialsJSON
+	var gotDuration string
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/federation" ||
+				r.URL.Query().Get("Action") != "getSigninToken" {
+				http.Error(w, "bad request", http.StatusBadRequest)
+				return
+			}
+			err := json.Unmarshal([]byte(r.URL.Query().Get("Session")),
+				&gotSession)
+			if err != nil {
+				http.Error(w, "bad session", http.StatusBadRequest)
+				return
+			}
+			gotDuration = r.URL.Query().Get("SessionDuration")
+			json.NewEncoder(w).Encode(
+				SessionTokenResponseJSON{SigninToken: "token123"})
+		}))
+	defer server.Close()
+	fakePartition := &partition{
+		Name:          "aws-cn",
+		FederationURL: server.URL + "/federation",
+		ConsoleURL:    "https://console.amazonaws.cn/",
+	}
+	b := setupCachedBroker(t)
+	credentials := ExchangeCredentialsJSON{SessionId: "AKIA",
+		SessionKey: "secret", SessionToken: "session"}
+	consoleURL, err := b.getConsoleURLFromCredentials(fakePartition,
+		credentials, 24*time.Hour, "https://cloudgate.example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotSession != credentials {
+		t.Fatalf("unexpected session: %+v", gotSession)
+	}
+	if gotDuration != "43200" {
+		t.Fatalf("console session not clamped: %s", gotDuration)
+	}
+	parsedURL, err := url.Parse(consoleURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(consoleURL, server.URL+"/federation?") ||
+		parsedURL.Query().Get("SigninToken") != "token123" ||
+		parsedURL.Query().Get("Destination") != fakePartition.ConsoleURL {
+		t.Fatalf("unexpected console URL: %s", consoleURL)
+	}
+	failingServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "denied", http.StatusForbidden)
+		}))
+	defer failingServer.Close()
+	fakePartition.FederationURL = failingServer.URL + "/federation"
+	_, err = b.getConsoleURLFromCredentials(fakePartition, credentials,
+		time.Hour, "https://cloudgate.example.com/")
+	if err == nil {
+		t.Fatal("expected error from federation endpoint")
+	}
+}
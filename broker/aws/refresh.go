@@ -0,0 +1,188 @@
+package aws
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	roleRefreshInterval      = time.Minute
+	roleRefreshLeadTime      = time.Minute * 5
+	roleRefreshMaxJitter     = time.Minute * 5
+	roleRefreshMinBackoff    = time.Second * 30
+	roleRefreshMaxBackoff    = time.Minute * 15
+	maxRoleRefreshesInFlight = 4
+)
+
+// accountRefreshState tracks the background refreshes of the roles of an
+// account.
+type accountRefreshState struct {
+	jitter      time.Duration
+	failures    uint
+	lastAttempt time.Time
+	lastSuccess time.Time
+	lastError   string
+	nextRetry   time.Time
+}
+
+func roleRefreshBackoff(failures uint) time.Duration {
+	backoff := roleRefreshMinBackoff
+	for ; failures > 1 && backoff < roleRefreshMaxBackoff; failures-- {
+		backoff *= 2
+	}
+	if backoff > roleRefreshMaxBackoff {
+		return roleRefreshMaxBackoff
+	}
+	return backoff
+}
+
+// getRefreshState returns a copy of the refresh state of the account,
+// creating it with a random jitter if needed.
+func (b *Broker) getRefreshState(accountName string) accountRefreshState {
+	b.refreshMutex.Lock()
+	defer b.refreshMutex.Unlock()
+	if b.refreshStates == nil {
+		b.refreshStates = make(map[string]*accountRefreshState)
+	}
+	state, ok := b.refreshStates[accountName]
+	if !ok {
+		state = &accountRefreshState{
+			jitter: time.Duration(rand.Int63n(int64(roleRefreshMaxJitter))),
+		}
+		b.refreshStates[accountName] = state
+	}
+	return *state
+}
+
+func (b *Broker) isRoleRefreshDue(accountName string, now time.Time) bool {
+	state := b.getRefreshState(accountName)
+	if state.failures > 0 {
+		return !now.Before(state.nextRetry)
+	}
+	b.accountRoleMutex.Lock()
+	cachedEntry, ok := b.accountRoleCache[accountName]
+	b.accountRoleMutex.Unlock()
+	if !ok {
+		return true
+	}
+	return cachedEntry.Expiration.Before(
+		now.Add(roleRefreshLeadTime + state.jitter))
+}
+
+func (b *Broker) refreshAccountRoles(accountName string) {
+	roles, err := b.getAWSRolesForAccountNonCached(accountName)
+	now := time.Now()
+	b.getRefreshState(accountName) // Ensure it exists.
+	b.refreshMutex.Lock()
+	state := b.refreshStates[accountName]
+	state.lastAttempt = now
+	if err != nil {
+		state.failures++
+		state.lastError = err.Error()
+		state.nextRetry = now.Add(roleRefreshBackoff(state.failures))
+	} else {
+		state.failures = 0
+		state.lastError = ""
+		state.lastSuccess = now
+	}
+	b.refreshMutex.Unlock()
+	b.accountRoleMutex.Lock()
+	cachedEntry, ok := b.accountRoleCache[accountName]
+	if err != nil {
+		if ok {
+			cachedEntry.LastBadTime = now
+			b.accountRoleCache[accountName] = cachedEntry
+		}
+		b.accountRoleMutex.Unlock()
+		b.logger.Printf("Background refresh of roles for account %s failed: %s",
+			accountName, err)
+		return
+	}
+	cachedEntry.Roles = roles
+	cachedEntry.Expiration = now.Add(roleCacheDuration)
+	b.accountRoleCache[accountName] = cachedEntry
+	b.accountRoleMutex.Unlock()
+	b.markCacheDirty()
+	b.checkAccountRolesTrust(accountName, roles)
+}
+
+func (b *Broker) refreshDueAccountRoles() {
+	config := b.getConfig()
+	if config == nil {
+		return
+	}
+	now := time.Now()
+	semaphore := make(chan struct{}, maxRoleRefreshesInFlight)
+	var wg sync.WaitGroup
+	for _, account := range config.AWS.Account {
+		if !b.isRoleRefreshDue(account.Name, now) {
+			continue
+		}
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(accountName string) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			b.refreshAccountRoles(accountName)
+		}(account.Name)
+	}
+	wg.Wait()
+}
+
+// roleRefreshLoop refreshes the roles of every account before the cached
+// roles expire, so that users do not wait for ListRoles.
+func (b *Broker) roleRefreshLoop() {
+	for {
+		b.refreshDueAccountRoles()
+		time.Sleep(roleRefreshInterval)
+	}
+}
+
+func formatAge(now, then time.Time) string {
+	if then.IsZero() {
+		return "never"
+	}
+	return now.Sub(then).Round(time.Second).String() + " ago"
+}
+
+func (b *Broker) writeHtml(writer io.Writer) {
+	config := b.getConfig()
+	if config == nil {
+		return
+	}
+	now := time.Now()
+	fmt.Fprintln(writer, "AWS account roles:<br>")
+	fmt.Fprintln(writer, `<table border="1">`)
+	fmt.Fprintln(writer, "  <tr><th>Account</th><th>Roles</th><th>Expires</th>"+
+		"<th>Last Refresh</th><th>Last Error</th></tr>")
+	for _, account := range config.AWS.Account {
+		b.accountRoleMutex.Lock()
+		cachedEntry, ok := b.accountRoleCache[account.Name]
+		b.accountRoleMutex.Unlock()
+		state := b.getRefreshState(account.Name)
+		expires := "not cached"
+		if ok {
+			if remaining := cachedEntry.Expiration.Sub(now); remaining > 0 {
+				expires = "in " + remaining.Round(time.Second).String()
+			} else {
+				expires = fmt.Sprintf("<font color=\"red\">stale for %s</font>",
+					(-remaining).Round(time.Second))
+			}
+		}
+		lastError := ""
+		if state.lastError != "" {
+			lastError = fmt.Sprintf("<font color=\"red\">%s (%d failures, %s)</font>",
+				html.EscapeString(state.lastError), state.failures,
+				formatAge(now, state.lastAttempt))
+		}
+		fmt.Fprintf(writer,
+			"  <tr><td>%s</td><td>%d</td><td>%s</td><td>%s</td><td>%s</td></tr>\n",
+			html.EscapeString(account.Name), len(cachedEntry.Roles), expires,
+			formatAge(now, state.lastSuccess), lastError)
+	}
+	fmt.Fprintln(writer, "</table>")
+}
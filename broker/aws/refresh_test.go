@@ -0,0 +1,78 @@
+package aws
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/cloud-gate/broker/configuration"
+)
+
+func TestRoleRefreshBackoff(t *testing.T) {
+	if backoff := roleRefreshBackoff(1); backoff != roleRefreshMinBackoff {
+		t.Fatalf("first failure: expected: %s, got: %s",
+			roleRefreshMinBackoff, backoff)
+	}
+	if backoff := roleRefreshBackoff(2); backoff != 2*roleRefreshMinBackoff {
+		t.Fatalf("second failure: expected: %s, got: %s",
+			2*roleRefreshMinBackoff, backoff)
+	}
+	if backoff := roleRefreshBackoff(100); backoff != roleRefreshMaxBackoff {
+		t.Fatalf("many failures: expected: %s, got: %s",
+			roleRefreshMaxBackoff, backoff)
+	}
+}
+
+func TestIsRoleRefreshDue(t *testing.T) {
+	b := setupCachedBroker(t)
+	now := time.Now()
+	if !b.isRoleRefreshDue("uncached", now) {
+		t.Fatal("uncached account should be due")
+	}
+	b.accountRoleCache["fresh"] = accountRoleCacheEntry{
+		Roles:      []string{"admin"},
+		Expiration: now.Add(roleCacheDuration),
+	}
+	if b.isRoleRefreshDue("fresh", now) {
+		t.Fatal("fresh account should not be due")
+	}
+	b.accountRoleCache["expiring"] = accountRoleCacheEntry{
+		Roles:      []string{"admin"},
+		Expiration: now.Add(roleRefreshLeadTime),
+	}
+	if !b.isRoleRefreshDue("expiring", now) {
+		t.Fatal("expiring account should be due")
+	}
+	b.refreshStates["expiring"].failures = 1
+	b.refreshStates["expiring"].nextRetry = now.Add(time.Minute)
+	if b.isRoleRefreshDue("expiring", now) {
+		t.Fatal("account should be backing off")
+	}
+	if !b.isRoleRefreshDue("expiring", now.Add(time.Minute)) {
+		t.Fatal("account should be due after backoff")
+	}
+}
+
+func TestWriteHtml(t *testing.T) {
+	b := setupCachedBroker(t)
+	b.config = &configuration.Configuration{}
+	b.config.AWS.Account = []configuration.AWSAccount{
+		{Name: "fresh"}, {Name: "broken"}}
+	b.accountRoleCache["fresh"] = accountRoleCacheEntry{
+		Roles:      []string{"admin"},
+		Expiration: time.Now().Add(roleCacheDuration),
+	}
+	b.getRefreshState("broken")
+	b.refreshStates["broken"].failures = 2
+	b.refreshStates["broken"].lastError = "<access denied>"
+	var buffer bytes.Buffer
+	b.writeHtml(&buffer)
+	output := buffer.String()
+	if !strings.Contains(output, "not cached") {
+		t.Fatalf("missing uncached account: %s", output)
+	}
+	if !strings.Contains(output, "&lt;access denied&gt; (2 failures") {
+		t.Fatalf("missing escaped error: %s", output)
+	}
+}
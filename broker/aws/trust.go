@@ -0,0 +1,364 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+
+	"github.com/Cloud-Foundations/cloud-gate/broker"
+)
+
+// stringOrSlice decodes policy elements which may be a string or a list.
+type stringOrSlice []string
+
+func (s *stringOrSlice) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err == nil {
+		*s = []string{value}
+		return nil
+	}
+	var values []string
+	if err := json.Unmarshal(data, &values); err != nil {
+		return err
+	}
+	*s = values
+	return nil
+}
+
+// policyPrincipal is either "*" or a map of principal types, of which only
+// the "AWS" type is relevant.
+type policyPrincipal struct {
+	AWS stringOrSlice
+}
+
+func (p *policyPrincipal) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err == nil {
+		p.AWS = []string{value}
+		return nil
+	}
+	var principals struct {
+		AWS stringOrSlice
+	}
+	if err := json.Unmarshal(data, &principals); err != nil {
+		return err
+	}
+	p.AWS = principals.AWS
+	return nil
+}
+
+type policyStatement struct {
+	Effect    string
+	Action    stringOrSlice
+	Principal *policyPrincipal
+}
+
+type statementList []policyStatement
+
+func (l *statementList) UnmarshalJSON(data []byte) error {
+	var statement policyStatement
+	if err := json.Unmarshal(data, &statement); err == nil {
+		*l = []policyStatement{statement}
+		return nil
+	}
+	var statements []policyStatement
+	if err := json.Unmarshal(data, &statements); err != nil {
+		return err
+	}
+	*l = statements
+	return nil
+}
+
+type trustPolicy struct {
+	Statement statementList
+}
+
+// splitARN returns the partition, service, account and resource of the ARN.
+func splitARN(arn string) (string, string, string, string, bool) {
+	fields := strings.SplitN(arn, ":", 6)
+	if len(fields) != 6 || fields[0] != "arn" {
+		return "", "", "", "", false
+	}
+	return fields[1], fields[2], fields[4], fields[5], true
+}
+
+// principalMatches returns true if the principal in a trust policy matches
+// the caller, either directly, through its account or, for an assumed role,
+// through the role.
+func principalMatches(principal string, callerARN string) bool {
+	if principal == "*" || principal == callerARN {
+		return true
+	}
+	partition, service, account, resource, ok := splitARN(callerARN)
+	if !ok {
+		return false
+	}
+	if principal == account ||
+		principal == fmt.Sprintf("arn:%s:iam::%s:root", partition, account) {
+		return true
+	}
+	if service != "sts" || !strings.HasPrefix(resource, "assumed-role/") {
+		return false
+	}
+	// arn:aws:sts::ACCOUNT:assumed-role/NAME/SESSION is trusted as
+	// arn:aws:iam::ACCOUNT:role/PATH/NAME.
+	fields := strings.Split(resource, "/")
+	if len(fields) != 3 {
+		return false
+	}
+	rolePrefix := fmt.Sprintf("arn:%s:iam::%s:role/", partition, account)
+	return strings.HasPrefix(principal, rolePrefix) &&
+		(principal == rolePrefix+fields[1] ||
+			strings.HasSuffix(principal, "/"+fields[1]))
+}
+
+func actionMatches(patterns []string, action string) bool {
+	for _, pattern := range patterns {
+		matched, err := path.Match(strings.ToLower(pattern),
+			strings.ToLower(action))
+		if err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+func statementApplies(statement policyStatement, callerARN string,
+	action string) bool {
+	if statement.Principal == nil || !actionMatches(statement.Action, action) {
+		return false
+	}
+	for _, principal := range statement.Principal.AWS {
+		if principalMatches(principal, callerARN) {
+			return true
+		}
+	}
+	return false
+}
+
+// getMissingActions returns the actions which the policy does not allow the
+// caller. Conditions are ignored.
+func (policy *trustPolicy) getMissingActions(callerARN string,
+	actions []string) []string {
+	var missing []string
+	for _, action := range actions {
+		allowed := false
+		denied := false
+		for _, statement := range policy.Statement {
+			if !statementApplies(statement, callerARN, action) {
+				continue
+			}
+			if strings.EqualFold(statement.Effect, "Deny") {
+				denied = true
+			} else if strings.EqualFold(statement.Effect, "Allow") {
+				allowed = true
+			}
+		}
+		if !allowed || denied {
+			missing = append(missing, action)
+		}
+	}
+	return missing
+}
+
+// checkTrustPolicy returns an error unless the URL encoded trust policy
+// document allows one of the callers all of the actions.
+func checkTrustPolicy(document string, callerARNs []string,
+	actions []string) error {
+	decoded, err := url.QueryUnescape(document)
+	if err != nil {
+		return err
+	}
+	var policy trustPolicy
+	if err := json.Unmarshal([]byte(decoded), &policy); err != nil {
+		return fmt.Errorf("cannot parse trust policy: %s", err)
+	}
+	if len(callerARNs) < 1 {
+		return fmt.Errorf("no broker principal to check")
+	}
+	var firstMissing []string
+	for index, callerARN := range callerARNs {
+		missing := policy.getMissingActions(callerARN, actions)
+		if len(missing) < 1 {
+			return nil
+		}
+		if index == 0 {
+			firstMissing = missing
+		}
+	}
+	return fmt.Errorf("trust policy does not allow %s for %s",
+		strings.Join(firstMissing, ", "), strings.Join(callerARNs, " or "))
+}
+
+// getRequiredTrustActions returns the actions the roles of the account must
+// trust the broker with.
+func (b *Broker) getRequiredTrustActions(accountName string) []string {
+	actions := []string{"sts:AssumeRole"}
+	if b.getConfig().AWS.SetSourceIdentity {
+		actions = append(actions, "sts:SetSourceIdentity")
+	}
+	if len(b.getSessionTagConfigs(accountName)) > 0 {
+		actions = append(actions, "sts:TagSession")
+	}
+	return actions
+}
+
+// getPrincipalARN returns the ARN of the principal of the profile, which is
+// looked up once.
+func (b *Broker) getPrincipalARN(profileName string) (string, error) {
+	b.roleHealthMutex.Lock()
+	principalARN, ok := b.principalARNs[profileName]
+	b.roleHealthMutex.Unlock()
+	if ok {
+		return principalARN, nil
+	}
+	stsClient, _, err := b.getStsClient(profileName)
+	if err != nil {
+		return "", err
+	}
+	output, err := stsClient.GetCallerIdentity(context.TODO(),
+		&sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", err
+	}
+	principalARN = aws.ToString(output.Arn)
+	b.roleHealthMutex.Lock()
+	if b.principalARNs == nil {
+		b.principalARNs = make(map[string]string)
+	}
+	b.principalARNs[profileName] = principalARN
+	b.roleHealthMutex.Unlock()
+	return principalARN, nil
+}
+
+// getTrustedCallerARNs returns the principals which assume roles in the
+// account: the master and, if present, the profile of the account.
+func (b *Broker) getTrustedCallerARNs(accountName string) ([]string, error) {
+	var callerARNs []string
+	masterARN, masterErr := b.getPrincipalARN(masterAWSProfileName)
+	if masterErr == nil {
+		callerARNs = append(callerARNs, masterARN)
+	}
+	if _, ok := b.profileCredentials[accountName]; ok {
+		accountARN, err := b.getPrincipalARN(accountName)
+		if err != nil {
+			return nil, err
+		}
+		callerARNs = append(callerARNs, accountARN)
+	}
+	if len(callerARNs) < 1 {
+		return nil, masterErr
+	}
+	return callerARNs, nil
+}
+
+func (b *Broker) getAccountIAMClient(accountName string) (*iam.Client, error) {
+	provider, region, err := b.masterGetListRolesCredentialsProvider(
+		accountName)
+	if err != nil {
+		provider, region, err = b.getCredentialsProviderFromProfile(
+			accountName)
+		if err != nil {
+			return nil, err
+		}
+	}
+	cfg, err := config.LoadDefaultConfig(context.TODO(),
+		config.WithCredentialsProvider(provider), config.WithRegion(region))
+	if err != nil {
+		return nil, err
+	}
+	return iam.NewFromConfig(cfg), nil
+}
+
+// checkAccountRolesTrust reads the trust policy of each role and records
+// whether the broker is trusted to assume it.
+func (b *Broker) checkAccountRolesTrust(accountName string, roles []string) {
+	callerARNs, err := b.getTrustedCallerARNs(accountName)
+	if err != nil {
+		b.logger.Printf("Cannot get broker principals for account %s: %s",
+			accountName, err)
+		return
+	}
+	iamClient, err := b.getAccountIAMClient(accountName)
+	if err != nil {
+		b.logger.Printf("Cannot check trust of roles in account %s: %s",
+			accountName, err)
+		return
+	}
+	accountHealth := b.getRolesHealth(accountName, roles,
+		func(roleName string) (string, error) {
+			output, err := iamClient.GetRole(context.TODO(),
+				&iam.GetRoleInput{RoleName: aws.String(roleName)})
+			if err != nil {
+				b.logger.Printf("Cannot get role %s in account %s: %s",
+					roleName, accountName, err)
+				return "", err
+			}
+			return aws.ToString(output.Role.AssumeRolePolicyDocument), nil
+		}, callerARNs)
+	b.roleHealthMutex.Lock()
+	if b.roleHealth == nil {
+		b.roleHealth = make(map[string]map[string]broker.RoleHealth)
+	}
+	b.roleHealth[accountName] = accountHealth
+	b.roleHealthMutex.Unlock()
+}
+
+// getRolesHealth checks the trust policy of each role, which getTrustPolicy
+// returns. Roles whose policy cannot be read are unhealthy.
+func (b *Broker) getRolesHealth(accountName string, roles []string,
+	getTrustPolicy func(roleName string) (string, error),
+	callerARNs []string) map[string]broker.RoleHealth {
+	actions := b.getRequiredTrustActions(accountName)
+	accountHealth := make(map[string]broker.RoleHealth, len(roles))
+	for _, roleName := range roles {
+		health := broker.RoleHealth{
+			Account:   accountName,
+			Role:      roleName,
+			Healthy:   true,
+			CheckedAt: time.Now(),
+		}
+		document, err := getTrustPolicy(roleName)
+		if err != nil {
+			err = fmt.Errorf("cannot get role: %s", err)
+		} else {
+			err = checkTrustPolicy(document, callerARNs, actions)
+		}
+		if err != nil {
+			health.Healthy = false
+			health.Message = err.Error()
+			b.logger.Debugf(1, "role %s in account %s is unhealthy: %s",
+				roleName, accountName, err)
+		}
+		accountHealth[roleName] = health
+	}
+	return accountHealth
+}
+
+func (b *Broker) getRoleHealth() []broker.RoleHealth {
+	b.roleHealthMutex.Lock()
+	defer b.roleHealthMutex.Unlock()
+	var report []broker.RoleHealth
+	for _, accountHealth := range b.roleHealth {
+		for _, health := range accountHealth {
+			report = append(report, health)
+		}
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Account != report[j].Account {
+			return report[i].Account < report[j].Account
+		}
+		return report[i].Role < report[j].Role
+	})
+	return report
+}
@@ -0,0 +1,136 @@
+package aws
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+
+	"github.com/Cloud-Foundations/cloud-gate/broker/configuration"
+)
+
+const (
+	testMasterARN  = "arn:aws:iam::111111111111:user/cloudgate"
+	testAccountARN = "arn:aws:iam::222222222222:user/cloudgate-direct"
+)
+
+func TestPrincipalMatches(t *testing.T) {
+	assumedRoleARN := "arn:aws:sts::111111111111:assumed-role/cloudgate/i-0123"
+	tests := []struct {
+		principal string
+		caller    string
+		matches   bool
+	}{
+		{"*", testMasterARN, true},
+		{testMasterARN, testMasterARN, true},
+		{"111111111111", testMasterARN, true},
+		{"arn:aws:iam::111111111111:root", testMasterARN, true},
+		{"arn:aws:iam::333333333333:root", testMasterARN, false},
+		{testAccountARN, testMasterARN, false},
+		{"arn:aws:iam::111111111111:role/cloudgate", assumedRoleARN, true},
+		{"arn:aws:iam::111111111111:role/infra/cloudgate", assumedRoleARN,
+			true},
+		{"arn:aws:iam::111111111111:role/other", assumedRoleARN, false},
+	}
+	for _, test := range tests {
+		if principalMatches(test.principal, test.caller) != test.matches {
+			t.Errorf("principalMatches(%s, %s): expected: %v",
+				test.principal, test.caller, test.matches)
+		}
+	}
+}
+
+func TestCheckTrustPolicy(t *testing.T) {
+	trustingMaster := url.QueryEscape(`{
+  "Version": "2012-10-17",
+  "Statement": [{
+    "Effect": "Allow",
+    "Principal": {"AWS": "arn:aws:iam::111111111111:user/cloudgate"},
+    "Action": ["sts:AssumeRole", "sts:SetSourceIdentity"]
+  }]
+}`)
+	err := checkTrustPolicy(trustingMaster, []string{testMasterARN},
+		[]string{"sts:AssumeRole"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkTrustPolicy(trustingMaster, []string{testMasterARN},
+		[]string{"sts:AssumeRole", "sts:TagSession"})
+	if err == nil {
+		t.Fatal("expected missing sts:TagSession")
+	}
+	err = checkTrustPolicy(trustingMaster,
+		[]string{testAccountARN, testMasterARN}, []string{"sts:AssumeRole"})
+	if err != nil {
+		t.Fatalf("second principal should be trusted: %s", err)
+	}
+	trustingAccount := url.QueryEscape(`{
+  "Statement": {
+    "Effect": "Allow",
+    "Principal": {"AWS": ["222222222222", "arn:aws:iam::444444444444:root"]},
+    "Action": "sts:*"
+  }
+}`)
+	err = checkTrustPolicy(trustingAccount, []string{testMasterARN},
+		[]string{"sts:AssumeRole"})
+	if err == nil {
+		t.Fatal("master should not be trusted")
+	}
+	err = checkTrustPolicy(trustingAccount, []string{testAccountARN},
+		[]string{"sts:AssumeRole", "sts:TagSession"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	denyingMaster := url.QueryEscape(`{
+  "Statement": [
+    {"Effect": "Allow", "Principal": "*", "Action": "sts:AssumeRole"},
+    {"Effect": "Deny", "Principal": {"AWS": "111111111111"},
+     "Action": "sts:AssumeRole"}
+  ]
+}`)
+	err = checkTrustPolicy(denyingMaster, []string{testMasterARN},
+		[]string{"sts:AssumeRole"})
+	if err == nil {
+		t.Fatal("master should be denied")
+	}
+	serviceRole := url.QueryEscape(`{
+  "Statement": [{"Effect": "Allow",
+    "Principal": {"Service": "ec2.amazonaws.com"},
+    "Action": "sts:AssumeRole"}]
+}`)
+	err = checkTrustPolicy(serviceRole, []string{testMasterARN},
+		[]string{"sts:AssumeRole"})
+	if err == nil {
+		t.Fatal("service role should not be trusted")
+	}
+}
+
+func TestGetRolesHealth(t *testing.T) {
+	b := setupCachedBroker(t)
+	b.config = &configuration.Configuration{}
+	trustingMaster := url.QueryEscape(`{
+  "Statement": {
+    "Effect": "Allow",
+    "Principal": {"AWS": "arn:aws:iam::111111111111:user/cloudgate"},
+    "Action": "sts:AssumeRole"
+  }
+}`)
+	health := b.getRolesHealth("prod", []string{"admin", "deleted", "readonly"},
+		func(roleName string) (string, error) {
+			if roleName == "deleted" {
+				return "", errors.New("NoSuchEntity")
+			}
+			return trustingMaster, nil
+		}, []string{testMasterARN})
+	if len(health) != 3 {
+		t.Fatalf("expected 3 roles, got: %+v", health)
+	}
+	for _, roleName := range []string{"admin", "readonly"} {
+		if !health[roleName].Healthy {
+			t.Errorf("%s: expected healthy: %+v", roleName, health[roleName])
+		}
+	}
+	if health["deleted"].Healthy ||
+		health["deleted"].Message != "cannot get role: NoSuchEntity" {
+		t.Errorf("deleted: unexpected: %+v", health["deleted"])
+	}
+}
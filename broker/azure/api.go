@@ -0,0 +1,86 @@
+package azure
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/Cloud-Foundations/cloud-gate/broker"
+	"github.com/Cloud-Foundations/cloud-gate/broker/configuration"
+	"github.com/Cloud-Foundations/golib/pkg/auth/userinfo"
+	"github.com/Cloud-Foundations/golib/pkg/log"
+)
+
+// Broker implements broker.Broker for Azure subscriptions. Each role of a
+// subscription maps onto an application registration which holds the
+// matching subscription-scoped role assignment and trusts the workload
+// identity of the broker through a federated credential. Tokens are obtained
+// with the client credentials flow, using the federated token as the client
+// assertion.
+//
+// The credentials returned by GenerateTokenCredentials carry the application
+// (client) ID in SessionId and the OAuth access token in SessionToken.
+type Broker struct {
+	config                 *configuration.Configuration
+	userInfo               userinfo.UserGroupsGetter
+	rawUserInfo            userinfo.UserGroupsGetter
+	staticAccounts         *broker.StaticAccounts
+	federatedTokenFilename string
+	logger                 log.DebugLogger
+	httpClient             *http.Client
+	isUnsealedChannel      chan error
+	authorityHost          string
+}
+
+// New creates a Broker. If federatedTokenFilename is empty the
+// AZURE_FEDERATED_TOKEN_FILE environment variable is used, as set up by the
+// Azure workload identity webhook.
+func New(userInfo userinfo.UserGroupsGetter, federatedTokenFilename string,
+	logger log.DebugLogger) *Broker {
+	return newBroker(userInfo, federatedTokenFilename, logger)
+}
+
+func (b *Broker) UpdateConfiguration(
+	config *configuration.Configuration) error {
+	return b.updateConfiguration(config)
+}
+
+func (b *Broker) GetUserAllowedAccounts(username string) ([]broker.PermittedAccount, error) {
+	return b.staticAccounts.GetUserAllowedAccounts(username)
+}
+
+func (b *Broker) IsUserAllowedToAssumeRole(username string, accountName string, roleName string) (bool, error) {
+	return b.staticAccounts.IsUserAllowedToAssumeRole(username, accountName,
+		roleName)
+}
+
+func (b *Broker) GetConsoleURLForAccountRole(accountName string, roleName string, userName string, issuerURL string) (string, error) {
+	return b.getConsoleURLForAccountRole(accountName, roleName, userName, issuerURL)
+}
+
+// GetAccountDisplayName returns the display name of the account.
+func (b *Broker) GetAccountDisplayName(accountName string) (string, error) {
+	return b.staticAccounts.GetAccountDisplayName(accountName)
+}
+
+// GetAccountRoles returns the roles of the account which may be brokered.
+func (b *Broker) GetAccountRoles(accountName string) ([]string, error) {
+	return b.staticAccounts.GetAccountRoles(accountName)
+}
+
+func (b *Broker) GenerateTokenCredentials(accountName string, roleName string, userName string, duration time.Duration) (*broker.AWSCredentialsJSON, error) {
+	return b.generateTokenCredentials(accountName, roleName, userName, duration)
+}
+
+// ProcessNewUnsealingSecret always reports ready: the federated token is not
+// sealed.
+func (b *Broker) ProcessNewUnsealingSecret(secret string) (ready bool, err error) {
+	return true, nil
+}
+
+func (b *Broker) GetIsUnsealedChannel() (<-chan error, error) {
+	return b.isUnsealedChannel, nil
+}
+
+func (b *Broker) LoadCredentialsFile() error {
+	return b.loadCredentialsFile()
+}
@@ -0,0 +1,247 @@
+package azure
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/Cloud-Foundations/cloud-gate/broker"
+	"github.com/Cloud-Foundations/cloud-gate/broker/configuration"
+	"github.com/Cloud-Foundations/golib/pkg/auth/userinfo"
+	"github.com/Cloud-Foundations/golib/pkg/auth/userinfo/filter"
+	"github.com/Cloud-Foundations/golib/pkg/log"
+)
+
+const (
+	clientAssertionType           = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+	consoleURLFormat              = "https://portal.azure.com/#@%s/resource/subscriptions/%s/overview"
+	defaultAuthorityHost          = "https://login.microsoftonline.com"
+	federatedTokenFileEnvVariable = "AZURE_FEDERATED_TOKEN_FILE"
+	managementScope               = "https://management.azure.com/.default"
+)
+
+var (
+	azureGetTokenAttempt = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cloudgate_azure_gettoken_attempt_counter",
+			Help: "Attempts to get a token from Azure",
+		},
+		[]string{"accountName", "roleName"},
+	)
+	azureGetTokenSuccess = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cloudgate_azure_gettoken_success_counter",
+			Help: "Success count of getting a token from Azure",
+		},
+		[]string{"accountName", "roleName"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(azureGetTokenAttempt)
+	prometheus.MustRegister(azureGetTokenSuccess)
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+	TokenType   string `json:"token_type"`
+}
+
+func newBroker(userInfo userinfo.UserGroupsGetter,
+	federatedTokenFilename string, logger log.DebugLogger) *Broker {
+	if federatedTokenFilename == "" {
+		federatedTokenFilename = os.Getenv(federatedTokenFileEnvVariable)
+	}
+	b := &Broker{
+		rawUserInfo:            userInfo,
+		federatedTokenFilename: federatedTokenFilename,
+		logger:                 logger,
+		httpClient:             &http.Client{Timeout: time.Second * 15},
+		isUnsealedChannel:      make(chan error, 1),
+		authorityHost:          defaultAuthorityHost,
+	}
+	b.staticAccounts = broker.NewStaticAccounts(b.getStaticAccounts,
+		b.getUserGroups, logger)
+	return b
+}
+
+func (b *Broker) loadCredentialsFile() error {
+	if b.federatedTokenFilename == "" {
+		return errors.New("no federated token file specified")
+	}
+	if _, err := b.readFederatedToken(); err != nil {
+		return err
+	}
+	b.isUnsealedChannel <- nil
+	return nil
+}
+
+// The federated token is rotated by the platform, so it is read on every use.
+func (b *Broker) readFederatedToken() (string, error) {
+	tokenBytes, err := ioutil.ReadFile(b.federatedTokenFilename)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(tokenBytes))
+	if token == "" {
+		return "", fmt.Errorf("empty federated token in: %s",
+			b.federatedTokenFilename)
+	}
+	return token, nil
+}
+
+func (b *Broker) subscriptionFromName(accountName string) (
+	*configuration.AzureSubscription, error) {
+	if b.config == nil {
+		return nil, errors.New("nil config")
+	}
+	for i, subscription := range b.config.Azure.Subscription {
+		if subscription.Name == accountName {
+			return &b.config.Azure.Subscription[i], nil
+		}
+	}
+	return nil, errors.New("accountName not found")
+}
+
+func (b *Broker) getTenantID(
+	subscription *configuration.AzureSubscription) string {
+	if subscription.TenantID != "" {
+		return subscription.TenantID
+	}
+	return b.config.Azure.TenantID
+}
+
+// getStaticAccounts is the accessor of the StaticAccounts of the broker.
+func (b *Broker) getStaticAccounts() ([]broker.StaticAccount, error) {
+	if b.config == nil {
+		return nil, errors.New("nil config")
+	}
+	accounts := make([]broker.StaticAccount, 0, len(b.config.Azure.Subscription))
+	for _, subscription := range b.config.Azure.Subscription {
+		roleNames := make([]string, 0, len(subscription.RoleClientIDs))
+		for roleName := range subscription.RoleClientIDs {
+			roleNames = append(roleNames, roleName)
+		}
+		accounts = append(accounts, broker.StaticAccount{
+			Name:           subscription.Name,
+			DisplayName:    subscription.DisplayName,
+			GroupName:      subscription.GroupName,
+			ExtraUserRoles: subscription.ExtraUserRoles,
+			RoleNames:      roleNames,
+		})
+	}
+	return accounts, nil
+}
+
+func (b *Broker) getUserGroups(username string) ([]string, error) {
+	return b.userInfo.GetUserGroups(username)
+}
+
+func (b *Broker) getConsoleURLForAccountRole(accountName string,
+	roleName string, userName string, issuerURL string) (string, error) {
+	subscription, err := b.subscriptionFromName(accountName)
+	if err != nil {
+		return "", err
+	}
+	// Like GCP, the portal is reached with the user's own identity.
+	targetURL := fmt.Sprintf(consoleURLFormat,
+		url.PathEscape(b.getTenantID(subscription)),
+		url.PathEscape(subscription.SubscriptionID))
+	return targetURL, nil
+}
+
+// The duration is ignored: the lifetime of the tokens is set by Entra ID.
+func (b *Broker) generateTokenCredentials(accountName string, roleName string,
+	userName string, duration time.Duration) (*broker.AWSCredentialsJSON, error) {
+	subscription, err := b.subscriptionFromName(accountName)
+	if err != nil {
+		return nil, err
+	}
+	clientID, ok := subscription.RoleClientIDs[roleName]
+	if !ok {
+		return nil, fmt.Errorf("no client ID for role: %s", roleName)
+	}
+	azureGetTokenAttempt.WithLabelValues(accountName, roleName).Inc()
+	token, err := b.getToken(b.getTenantID(subscription), clientID)
+	if err != nil {
+		b.logger.Printf("cannot get token for client %s for account %s, err=%s",
+			clientID, accountName, err)
+		return nil, err
+	}
+	azureGetTokenSuccess.WithLabelValues(accountName, roleName).Inc()
+	return &broker.AWSCredentialsJSON{
+		SessionId:    clientID,
+		SessionToken: token.AccessToken,
+		Expiration: time.Now().Add(
+			time.Duration(token.ExpiresIn) * time.Second),
+	}, nil
+}
+
+func (b *Broker) getToken(tenantID string, clientID string) (
+	*tokenResponse, error) {
+	if tenantID == "" {
+		return nil, errors.New("no tenant ID")
+	}
+	federatedToken, err := b.readFederatedToken()
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type":            {"client_credentials"},
+		"client_id":             {clientID},
+		"client_assertion_type": {clientAssertionType},
+		"client_assertion":      {federatedToken},
+		"scope":                 {managementScope},
+	}
+	tokenURL := fmt.Sprintf("%s/%s/oauth2/v2.0/token", b.authorityHost,
+		url.PathEscape(tenantID))
+	resp, err := b.httpClient.PostForm(tokenURL, form)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("resp=%s", string(body))
+	}
+	var token tokenResponse
+	if err := json.Unmarshal(body, &token); err != nil {
+		return nil, err
+	}
+	if token.AccessToken == "" {
+		return nil, errors.New("empty access token")
+	}
+	return &token, nil
+}
+
+func (b *Broker) updateConfiguration(
+	config *configuration.Configuration) error {
+	if config == nil {
+		return errors.New("nill config passed")
+	}
+	if config.Azure.GroupPrefix == "" {
+		b.userInfo = b.rawUserInfo
+	} else {
+		ui, err := filter.NewUserGroupsFilter(b.rawUserInfo,
+			"^"+config.Azure.GroupPrefix)
+		if err != nil {
+			return err
+		}
+		b.userInfo = ui
+	}
+	b.logger.Debugf(1, "config=%+v", *config)
+	b.config = config
+	return nil
+}
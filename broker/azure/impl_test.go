@@ -0,0 +1,97 @@
+package azure
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Cloud-Foundations/cloud-gate/broker/configuration"
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+)
+
+type staticUserInfo map[string][]string
+
+func (ui staticUserInfo) GetUserGroups(username string) ([]string, error) {
+	return ui[username], nil
+}
+
+var testConfig = &configuration.Configuration{
+	Azure: configuration.AzureConfiguration{
+		GroupPrefix: "AZ-",
+		TenantID:    "tenant-1",
+		Subscription: []configuration.AzureSubscription{
+			{
+				Name:           "sandbox",
+				SubscriptionID: "00000000-0000-0000-0000-000000000001",
+				RoleClientIDs: map[string]string{
+					"Reader":      "client-reader",
+					"Contributor": "client-contributor",
+				},
+			},
+		},
+	},
+}
+
+func TestGenerateTokenCredentials(t *testing.T) {
+	tokenFilename := filepath.Join(t.TempDir(), "token")
+	err := ioutil.WriteFile(tokenFilename, []byte("federated-jwt\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/tenant-1/oauth2/v2.0/token" {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			if r.FormValue("client_assertion") != "federated-jwt" ||
+				r.FormValue("client_assertion_type") != clientAssertionType {
+				http.Error(w, "bad assertion", http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprintf(w,
+				`{"access_token":"token-for-%s","expires_in":3599,"token_type":"Bearer"}`,
+				r.FormValue("client_id"))
+		}))
+	defer ts.Close()
+	userInfo := staticUserInfo{"user1": {"AZ-sandbox-reader", "other-group"}}
+	logger := testlogger.New(t)
+	b := newBroker(userInfo, tokenFilename, logger)
+	b.authorityHost = ts.URL
+	if err := b.UpdateConfiguration(testConfig); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.LoadCredentialsFile(); err != nil {
+		t.Fatal(err)
+	}
+	ok, err := b.IsUserAllowedToAssumeRole("user1", "sandbox", "Reader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("user1 should be allowed to assume Reader")
+	}
+	ok, err = b.IsUserAllowedToAssumeRole("user1", "sandbox", "Contributor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("user1 should not be allowed to assume Contributor")
+	}
+	creds, err := b.GenerateTokenCredentials("sandbox", "Reader", "user1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.SessionToken != "token-for-client-reader" ||
+		creds.SessionId != "client-reader" {
+		t.Fatalf("unexpected credentials: %+v", creds)
+	}
+	os.Remove(tokenFilename)
+	if _, err := b.GenerateTokenCredentials("sandbox", "Reader", "user1", 0); err == nil {
+		t.Fatal("should fail without a federated token")
+	}
+}
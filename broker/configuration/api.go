@@ -1,29 +1,128 @@
 package configuration
 
 import (
+	"regexp"
 	"time"
 
 	"github.com/Cloud-Foundations/golib/pkg/log"
 )
 
+// AWSSessionTag describes a session tag attached when assuming roles. The
+// value is taken from the user attribute named by Attribute, from the first
+// group of the user matching GroupRegex (the first submatch if the regex has
+// one), or else is the static Value. Tags with an empty value are omitted.
+// GroupRegexp is GroupRegex compiled when the configuration is loaded.
+type AWSSessionTag struct {
+	Key         string         `yaml:"key"`
+	Value       string         `yaml:"value"`
+	Attribute   string         `yaml:"attribute"`
+	GroupRegex  string         `yaml:"group_regex"`
+	GroupRegexp *regexp.Regexp `yaml:"-"`
+	Transitive  bool           `yaml:"transitive"`
+}
+
+// AWSRoleTag is an IAM tag which a role must carry to be brokered.
+type AWSRoleTag struct {
+	Key   string `yaml:"key"`
+	Value string `yaml:"value"`
+}
+
 type AWSAccount struct {
-	Name           string   `yaml:"name"`
-	AccountID      string   `yaml:"account_id"`
-	DisplayName    string   `yaml:"display_name"`
-	GroupName      string   `yaml:"group_name"`
-	ExtraUserRoles []string `yaml:"extra_user_roles"`
+	Name                   string                   `yaml:"name"`
+	AccountID              string                   `yaml:"account_id"`
+	DisplayName            string                   `yaml:"display_name"`
+	GroupName              string                   `yaml:"group_name"`
+	ExtraUserRoles         []string                 `yaml:"extra_user_roles"`
+	MaxSessionDuration     time.Duration            `yaml:"max_session_duration"`
+	RoleMaxSessionDuration map[string]time.Duration `yaml:"role_max_session_duration"` // K: role name
+	SessionTags            []AWSSessionTag          `yaml:"session_tags"`
+	RolePathPrefix         string                   `yaml:"role_path_prefix"`
+	RequiredRoleTag        AWSRoleTag               `yaml:"required_role_tag"`
+	Partition              string                   `yaml:"partition"` // Default: from region.
+	Region                 string                   `yaml:"region"`    // For STS.
 }
 
+// AWSOrganization enables discovery of the active accounts of the AWS
+// Organization of the master profile, limited to the accounts under
+// OrganizationalUnits (recursively) if set. Account names and display names
+// are taken from the NameTag and DisplayNameTag account tags if set, or else
+// from the name of the account. Statically configured accounts take
+// precedence.
+type AWSOrganization struct {
+	Enabled             bool     `yaml:"enabled"`
+	OrganizationalUnits []string `yaml:"organizational_units"`
+	NameTag             string   `yaml:"name_tag"`
+	DisplayNameTag      string   `yaml:"display_name_tag"`
+}
+
+// AWSConfiguration.RolePathPrefix and RequiredRoleTag restrict the roles
+// which are discovered in each account, unless the account overrides them.
 type AWSConfiguration struct {
+	GroupPrefix       string          `yaml:"group_prefix"`
+	SetSourceIdentity bool            `yaml:"set_source_identity"`
+	SessionTags       []AWSSessionTag `yaml:"session_tags"`
+	RolePathPrefix    string          `yaml:"role_path_prefix"`
+	RequiredRoleTag   AWSRoleTag      `yaml:"required_role_tag"`
+	Organization      AWSOrganization `yaml:"organization"`
+	Account           []AWSAccount    `yaml:"account"`
+}
+
+type GCPProject struct {
+	Name            string            `yaml:"name"`
+	ProjectID       string            `yaml:"project_id"`
+	DisplayName     string            `yaml:"display_name"`
+	GroupName       string            `yaml:"group_name"`
+	ExtraUserRoles  []string          `yaml:"extra_user_roles"`
+	ServiceAccounts map[string]string `yaml:"service_accounts"` // K: role name
+}
+
+type GCPConfiguration struct {
 	GroupPrefix string       `yaml:"group_prefix"`
-	Account     []AWSAccount `yaml:"account"`
+	Project     []GCPProject `yaml:"project"`
+}
+
+type AzureSubscription struct {
+	Name           string            `yaml:"name"`
+	SubscriptionID string            `yaml:"subscription_id"`
+	TenantID       string            `yaml:"tenant_id"`
+	DisplayName    string            `yaml:"display_name"`
+	GroupName      string            `yaml:"group_name"`
+	ExtraUserRoles []string          `yaml:"extra_user_roles"`
+	RoleClientIDs  map[string]string `yaml:"role_client_ids"` // K: role name
+}
+
+type AzureConfiguration struct {
+	GroupPrefix  string              `yaml:"group_prefix"`
+	TenantID     string              `yaml:"tenant_id"`
+	Subscription []AzureSubscription `yaml:"subscription"`
+}
+
+// BreakGlassUser may use Roles on Account of Cloud (default the first enabled
+// cloud) without any userinfo lookup, by presenting a client certificate for
+// Username and the secret whose bcrypt hash is SecretHash. It is meant for
+// outages of the directory or the identity provider.
+type BreakGlassUser struct {
+	Username   string   `yaml:"username"`
+	Cloud      string   `yaml:"cloud"`
+	Account    string   `yaml:"account"`
+	Roles      []string `yaml:"roles"`
+	SecretHash string   `yaml:"secret_hash"`
 }
 
 type Configuration struct {
-	AWS AWSConfiguration `yaml:"aws"`
+	AWS        AWSConfiguration   `yaml:"aws"`
+	GCP        GCPConfiguration   `yaml:"gcp"`
+	Azure      AzureConfiguration `yaml:"azure"`
+	BreakGlass []BreakGlassUser   `yaml:"break_glass"`
 }
 
 func Watch(configUrl string, cacheFilename string, checkInterval time.Duration,
 	logger log.DebugLogger) (<-chan *Configuration, error) {
 	return watch(configUrl, cacheFilename, checkInterval, logger)
 }
+
+// GetAccountNames returns the names of the accounts, projects or
+// subscriptions configured for the cloud.
+func (config *Configuration) GetAccountNames(cloudName string) []string {
+	return config.getAccountNames(cloudName)
+}
@@ -1,7 +1,9 @@
 package configuration
 
 import (
+	"fmt"
 	"io"
+	"regexp"
 	"time"
 
 	"github.com/Cloud-Foundations/Dominator/lib/configwatch"
@@ -10,6 +12,9 @@ import (
 	"gopkg.in/yaml.v2"
 )
 
+// minAWSSessionDuration is the shortest session AWS will issue.
+const minAWSSessionDuration = 15 * time.Minute
+
 func watch(configUrl string, cacheFilename string, checkInterval time.Duration,
 	logger log.DebugLogger) (<-chan *Configuration, error) {
 	configChannel := make(chan *Configuration, 1)
@@ -37,5 +42,67 @@ func decode(reader io.Reader) (interface{}, error) {
 	if err := decoder.Decode(&config); err != nil {
 		return nil, err
 	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
 	return &config, nil
 }
+
+// compileSessionTags compiles the group regular expressions of the tags.
+func compileSessionTags(tags []AWSSessionTag) error {
+	for index := range tags {
+		tag := &tags[index]
+		if tag.GroupRegex == "" {
+			continue
+		}
+		re, err := regexp.Compile(tag.GroupRegex)
+		if err != nil {
+			return fmt.Errorf("session tag: %s: group_regex: %s", tag.Key, err)
+		}
+		tag.GroupRegexp = re
+	}
+	return nil
+}
+
+func (config *Configuration) validate() error {
+	if err := compileSessionTags(config.AWS.SessionTags); err != nil {
+		return err
+	}
+	for _, account := range config.AWS.Account {
+		if err := compileSessionTags(account.SessionTags); err != nil {
+			return fmt.Errorf("account: %s: %s", account.Name, err)
+		}
+		if duration := account.MaxSessionDuration; duration != 0 &&
+			duration < minAWSSessionDuration {
+			return fmt.Errorf("account: %s: max_session_duration: %s is below %s",
+				account.Name, duration, minAWSSessionDuration)
+		}
+		for roleName, duration := range account.RoleMaxSessionDuration {
+			if duration != 0 && duration < minAWSSessionDuration {
+				return fmt.Errorf(
+					"account: %s: role_max_session_duration: %s: %s is below %s",
+					account.Name, roleName, duration, minAWSSessionDuration)
+			}
+		}
+	}
+	return nil
+}
+
+func (config *Configuration) getAccountNames(cloudName string) []string {
+	var names []string
+	switch cloudName {
+	case "aws":
+		for _, account := range config.AWS.Account {
+			names = append(names, account.Name)
+		}
+	case "gcp":
+		for _, project := range config.GCP.Project {
+			names = append(names, project.Name)
+		}
+	case "azure":
+		for _, subscription := range config.Azure.Subscription {
+			names = append(names, subscription.Name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,71 @@
+package configuration
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDecodeRejectsShortSessionDuration(t *testing.T) {
+	tests := map[string]string{
+		"account": `
+aws:
+  account:
+    - name: prod
+      max_session_duration: 10m
+`,
+		"role": `
+aws:
+  account:
+    - name: prod
+      role_max_session_duration:
+        Admin: 5m
+`,
+	}
+	for name, data := range tests {
+		if _, err := decode(strings.NewReader(data)); err == nil {
+			t.Errorf("%s: expected error for short session duration", name)
+		}
+	}
+	data := `
+aws:
+  account:
+    - name: prod
+      max_session_duration: 15m
+`
+	if _, err := decode(strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDecodeCompilesGroupRegex(t *testing.T) {
+	data := `
+aws:
+  session_tags:
+    - key: team
+      group_regex: "^team-(.*)$"
+  account:
+    - name: prod
+      session_tags:
+        - key: cost-center
+          value: "1234"
+`
+	config, err := decode(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag := config.(*Configuration).AWS.SessionTags[0]
+	if tag.GroupRegexp == nil || !tag.GroupRegexp.MatchString("team-storage") {
+		t.Fatalf("group_regex not compiled: %+v", tag)
+	}
+	data = `
+aws:
+  account:
+    - name: prod
+      session_tags:
+        - key: team
+          group_regex: "^team-(.*$"
+`
+	if _, err := decode(strings.NewReader(data)); err == nil {
+		t.Fatal("expected error for bad group_regex")
+	}
+}
@@ -0,0 +1,96 @@
+package gcp
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Cloud-Foundations/cloud-gate/broker"
+	"github.com/Cloud-Foundations/cloud-gate/broker/configuration"
+	"github.com/Cloud-Foundations/golib/pkg/auth/userinfo"
+	"github.com/Cloud-Foundations/golib/pkg/log"
+)
+
+// serviceAccountKey is the subset of a GCP service account JSON key file
+// that is needed to obtain access tokens for the broker itself.
+type serviceAccountKey struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// Broker implements broker.Broker for GCP projects. Roles map onto service
+// accounts, which the broker impersonates using the IAM Credentials API in
+// order to mint short-lived OAuth access tokens.
+//
+// The credentials returned by GenerateTokenCredentials carry the service
+// account email in SessionId and the OAuth access token in SessionToken.
+type Broker struct {
+	config              *configuration.Configuration
+	userInfo            userinfo.UserGroupsGetter
+	rawUserInfo         userinfo.UserGroupsGetter
+	staticAccounts      *broker.StaticAccounts
+	credentialsFilename string
+	logger              log.DebugLogger
+	httpClient          *http.Client
+	isUnsealedChannel   chan error
+	serviceAccountKey   *serviceAccountKey
+	brokerTokenMutex    sync.Mutex
+	brokerToken         string
+	brokerTokenExpires  time.Time
+	iamCredentialsURL   string
+	metadataTokenURL    string
+}
+
+func New(userInfo userinfo.UserGroupsGetter, credentialsFilename string,
+	logger log.DebugLogger) *Broker {
+	return newBroker(userInfo, credentialsFilename, logger)
+}
+
+func (b *Broker) UpdateConfiguration(
+	config *configuration.Configuration) error {
+	return b.updateConfiguration(config)
+}
+
+func (b *Broker) GetUserAllowedAccounts(username string) ([]broker.PermittedAccount, error) {
+	return b.staticAccounts.GetUserAllowedAccounts(username)
+}
+
+func (b *Broker) IsUserAllowedToAssumeRole(username string, accountName string, roleName string) (bool, error) {
+	return b.staticAccounts.IsUserAllowedToAssumeRole(username, accountName,
+		roleName)
+}
+
+func (b *Broker) GetConsoleURLForAccountRole(accountName string, roleName string, userName string, issuerURL string) (string, error) {
+	return b.getConsoleURLForAccountRole(accountName, roleName, userName, issuerURL)
+}
+
+// GetAccountDisplayName returns the display name of the account.
+func (b *Broker) GetAccountDisplayName(accountName string) (string, error) {
+	return b.staticAccounts.GetAccountDisplayName(accountName)
+}
+
+// GetAccountRoles returns the roles of the account which may be brokered.
+func (b *Broker) GetAccountRoles(accountName string) ([]string, error) {
+	return b.staticAccounts.GetAccountRoles(accountName)
+}
+
+func (b *Broker) GenerateTokenCredentials(accountName string, roleName string, userName string, duration time.Duration) (*broker.AWSCredentialsJSON, error) {
+	return b.generateTokenCredentials(accountName, roleName, userName, duration)
+}
+
+// ProcessNewUnsealingSecret always reports ready: the GCP credentials file
+// is not sealed.
+func (b *Broker) ProcessNewUnsealingSecret(secret string) (ready bool, err error) {
+	return true, nil
+}
+
+func (b *Broker) GetIsUnsealedChannel() (<-chan error, error) {
+	return b.isUnsealedChannel, nil
+}
+
+func (b *Broker) LoadCredentialsFile() error {
+	return b.loadCredentialsFile()
+}
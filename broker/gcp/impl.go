@@ -0,0 +1,360 @@
+package gcp
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+
+	"github.com/Cloud-Foundations/cloud-gate/broker"
+	"github.com/Cloud-Foundations/cloud-gate/broker/configuration"
+	"github.com/Cloud-Foundations/golib/pkg/auth/userinfo"
+	"github.com/Cloud-Foundations/golib/pkg/auth/userinfo/filter"
+	"github.com/Cloud-Foundations/golib/pkg/log"
+)
+
+const (
+	maxAccessTokenLifetime   = time.Hour
+	cloudPlatformScope       = "https://www.googleapis.com/auth/cloud-platform"
+	consoleURLFormat         = "https://console.cloud.google.com/home/dashboard?project=%s"
+	defaultIAMCredentialsURL = "https://iamcredentials.googleapis.com"
+	defaultMetadataTokenURL  = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+	defaultTokenURI          = "https://oauth2.googleapis.com/token"
+	jwtBearerGrantType       = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+	brokerTokenRefreshMargin = time.Minute * 5
+)
+
+var (
+	gcpGenerateAccessTokenAttempt = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cloudgate_gcp_generateaccesstoken_attempt_counter",
+			Help: "Attempts to generateAccessToken on GCP",
+		},
+		[]string{"accountName", "roleName"},
+	)
+	gcpGenerateAccessTokenSuccess = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cloudgate_gcp_generateaccesstoken_success_counter",
+			Help: "Success count of generateAccessToken on GCP",
+		},
+		[]string{"accountName", "roleName"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(gcpGenerateAccessTokenAttempt)
+	prometheus.MustRegister(gcpGenerateAccessTokenSuccess)
+}
+
+type oauth2TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+	TokenType   string `json:"token_type"`
+}
+
+type generateAccessTokenRequest struct {
+	Scope    []string `json:"scope"`
+	Lifetime string   `json:"lifetime"`
+}
+
+type generateAccessTokenResponse struct {
+	AccessToken string    `json:"accessToken"`
+	ExpireTime  time.Time `json:"expireTime"`
+}
+
+type assertionClaims struct {
+	Issuer    string `json:"iss"`
+	Scope     string `json:"scope"`
+	Audience  string `json:"aud"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+func newBroker(userInfo userinfo.UserGroupsGetter, credentialsFilename string,
+	logger log.DebugLogger) *Broker {
+	b := &Broker{
+		rawUserInfo:         userInfo,
+		credentialsFilename: credentialsFilename,
+		logger:              logger,
+		httpClient:          &http.Client{Timeout: time.Second * 15},
+		isUnsealedChannel:   make(chan error, 1),
+		iamCredentialsURL:   defaultIAMCredentialsURL,
+		metadataTokenURL:    defaultMetadataTokenURL,
+	}
+	b.staticAccounts = broker.NewStaticAccounts(b.getStaticAccounts,
+		b.getUserGroups, logger)
+	return b
+}
+
+func (b *Broker) loadCredentialsFile() error {
+	if b.credentialsFilename == "" {
+		// Use the metadata server.
+		b.isUnsealedChannel <- nil
+		return nil
+	}
+	keyBytes, err := ioutil.ReadFile(b.credentialsFilename)
+	if err != nil {
+		return err
+	}
+	var key serviceAccountKey
+	if err := json.Unmarshal(keyBytes, &key); err != nil {
+		return err
+	}
+	if key.Type != "service_account" || key.ClientEmail == "" ||
+		key.PrivateKey == "" {
+		return fmt.Errorf("%s is not a service account key file",
+			b.credentialsFilename)
+	}
+	if key.TokenURI == "" {
+		key.TokenURI = defaultTokenURI
+	}
+	b.serviceAccountKey = &key
+	b.isUnsealedChannel <- nil
+	return nil
+}
+
+func (b *Broker) projectFromName(accountName string) (
+	*configuration.GCPProject, error) {
+	if b.config == nil {
+		return nil, errors.New("nil config")
+	}
+	for i, project := range b.config.GCP.Project {
+		if project.Name == accountName {
+			return &b.config.GCP.Project[i], nil
+		}
+	}
+	return nil, errors.New("accountName not found")
+}
+
+// getStaticAccounts is the accessor of the StaticAccounts of the broker.
+func (b *Broker) getStaticAccounts() ([]broker.StaticAccount, error) {
+	if b.config == nil {
+		return nil, errors.New("nil config")
+	}
+	accounts := make([]broker.StaticAccount, 0, len(b.config.GCP.Project))
+	for _, project := range b.config.GCP.Project {
+		roleNames := make([]string, 0, len(project.ServiceAccounts))
+		for roleName := range project.ServiceAccounts {
+			roleNames = append(roleNames, roleName)
+		}
+		accounts = append(accounts, broker.StaticAccount{
+			Name:           project.Name,
+			DisplayName:    project.DisplayName,
+			GroupName:      project.GroupName,
+			ExtraUserRoles: project.ExtraUserRoles,
+			RoleNames:      roleNames,
+		})
+	}
+	return accounts, nil
+}
+
+func (b *Broker) getUserGroups(username string) ([]string, error) {
+	return b.userInfo.GetUserGroups(username)
+}
+
+func (b *Broker) getConsoleURLForAccountRole(accountName string,
+	roleName string, userName string, issuerURL string) (string, error) {
+	project, err := b.projectFromName(accountName)
+	if err != nil {
+		return "", err
+	}
+	// GCP has no federation endpoint comparable to the AWS one: the console
+	// is reached with the user's own Google identity.
+	targetURL := fmt.Sprintf(consoleURLFormat,
+		url.QueryEscape(project.ProjectID))
+	return targetURL, nil
+}
+
+func (b *Broker) generateTokenCredentials(accountName string, roleName string,
+	userName string, duration time.Duration) (*broker.AWSCredentialsJSON, error) {
+	project, err := b.projectFromName(accountName)
+	if err != nil {
+		return nil, err
+	}
+	serviceAccount, ok := project.ServiceAccounts[roleName]
+	if !ok {
+		return nil, fmt.Errorf("no service account for role: %s", roleName)
+	}
+	gcpGenerateAccessTokenAttempt.WithLabelValues(accountName, roleName).Inc()
+	// Lifetimes above one hour need an organization policy exception.
+	if duration <= 0 || duration > maxAccessTokenLifetime {
+		duration = maxAccessTokenLifetime
+	}
+	tokenResponse, err := b.generateAccessToken(serviceAccount, duration)
+	if err != nil {
+		b.logger.Printf("cannot impersonate %s for account %s, err=%s",
+			serviceAccount, accountName, err)
+		return nil, err
+	}
+	gcpGenerateAccessTokenSuccess.WithLabelValues(accountName, roleName).Inc()
+	return &broker.AWSCredentialsJSON{
+		SessionId:    serviceAccount,
+		SessionToken: tokenResponse.AccessToken,
+		Expiration:   tokenResponse.ExpireTime,
+	}, nil
+}
+
+func (b *Broker) generateAccessToken(serviceAccount string,
+	lifetime time.Duration) (
+	*generateAccessTokenResponse, error) {
+	brokerToken, err := b.getBrokerToken()
+	if err != nil {
+		return nil, err
+	}
+	requestBody, err := json.Marshal(generateAccessTokenRequest{
+		Scope:    []string{cloudPlatformScope},
+		Lifetime: fmt.Sprintf("%ds", int64(lifetime/time.Second)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	requestURL := fmt.Sprintf(
+		"%s/v1/projects/-/serviceAccounts/%s:generateAccessToken",
+		b.iamCredentialsURL, url.PathEscape(serviceAccount))
+	req, err := http.NewRequest("POST", requestURL,
+		bytes.NewReader(requestBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+brokerToken)
+	req.Header.Set("Content-Type", "application/json")
+	body, err := b.doRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	var tokenResponse generateAccessTokenResponse
+	if err := json.Unmarshal(body, &tokenResponse); err != nil {
+		return nil, err
+	}
+	if tokenResponse.AccessToken == "" {
+		return nil, errors.New("empty access token")
+	}
+	return &tokenResponse, nil
+}
+
+// getBrokerToken returns an access token for the identity of the broker
+// itself, either from the service account key or from the metadata server.
+func (b *Broker) getBrokerToken() (string, error) {
+	b.brokerTokenMutex.Lock()
+	defer b.brokerTokenMutex.Unlock()
+	if b.brokerToken != "" &&
+		time.Now().Add(brokerTokenRefreshMargin).Before(b.brokerTokenExpires) {
+		return b.brokerToken, nil
+	}
+	var req *http.Request
+	var err error
+	if b.serviceAccountKey == nil {
+		req, err = http.NewRequest("GET", b.metadataTokenURL, nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+	} else {
+		assertion, err := b.signAssertion()
+		if err != nil {
+			return "", err
+		}
+		form := url.Values{
+			"grant_type": {jwtBearerGrantType},
+			"assertion":  {assertion},
+		}
+		req, err = http.NewRequest("POST", b.serviceAccountKey.TokenURI,
+			strings.NewReader(form.Encode()))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	body, err := b.doRequest(req)
+	if err != nil {
+		return "", err
+	}
+	var tokenResponse oauth2TokenResponse
+	if err := json.Unmarshal(body, &tokenResponse); err != nil {
+		return "", err
+	}
+	if tokenResponse.AccessToken == "" {
+		return "", errors.New("empty broker access token")
+	}
+	b.brokerToken = tokenResponse.AccessToken
+	b.brokerTokenExpires = time.Now().Add(
+		time.Duration(tokenResponse.ExpiresIn) * time.Second)
+	return b.brokerToken, nil
+}
+
+func (b *Broker) signAssertion() (string, error) {
+	block, _ := pem.Decode([]byte(b.serviceAccountKey.PrivateKey))
+	if block == nil {
+		return "", errors.New("cannot decode service account private key")
+	}
+	privateKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	signerOptions := (&jose.SignerOptions{}).WithType("JWT")
+	if b.serviceAccountKey.PrivateKeyID != "" {
+		signerOptions = signerOptions.WithHeader("kid",
+			b.serviceAccountKey.PrivateKeyID)
+	}
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.RS256, Key: privateKey}, signerOptions)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims := assertionClaims{
+		Issuer:    b.serviceAccountKey.ClientEmail,
+		Scope:     cloudPlatformScope,
+		Audience:  b.serviceAccountKey.TokenURI,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(time.Hour).Unix(),
+	}
+	return jwt.Signed(signer).Claims(claims).CompactSerialize()
+}
+
+func (b *Broker) doRequest(req *http.Request) ([]byte, error) {
+	resp, err := b.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("resp=%s", string(body))
+	}
+	return body, nil
+}
+
+func (b *Broker) updateConfiguration(
+	config *configuration.Configuration) error {
+	if config == nil {
+		return errors.New("nill config passed")
+	}
+	if config.GCP.GroupPrefix == "" {
+		b.userInfo = b.rawUserInfo
+	} else {
+		ui, err := filter.NewUserGroupsFilter(b.rawUserInfo,
+			"^"+config.GCP.GroupPrefix)
+		if err != nil {
+			return err
+		}
+		b.userInfo = ui
+	}
+	b.logger.Debugf(1, "config=%+v", *config)
+	b.config = config
+	return nil
+}
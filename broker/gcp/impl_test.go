@@ -0,0 +1,126 @@
+package gcp
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/cloud-gate/broker/configuration"
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+)
+
+type staticUserInfo map[string][]string
+
+func (ui staticUserInfo) GetUserGroups(username string) ([]string, error) {
+	return ui[username], nil
+}
+
+var testConfig = &configuration.Configuration{
+	GCP: configuration.GCPConfiguration{
+		Project: []configuration.GCPProject{
+			{
+				Name:        "dev",
+				ProjectID:   "dev-12345",
+				DisplayName: "Development",
+				ServiceAccounts: map[string]string{
+					"viewer": "viewer@dev-12345.iam.gserviceaccount.com",
+					"admin":  "admin@dev-12345.iam.gserviceaccount.com",
+				},
+			},
+		},
+	},
+}
+
+func setupTestBroker(t *testing.T) *Broker {
+	userInfo := staticUserInfo{"user1": {"dev-viewer", "prod-admin"}}
+	logger := testlogger.New(t)
+	b := newBroker(userInfo, "", logger)
+	if err := b.UpdateConfiguration(testConfig); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestGetUserAllowedAccounts(t *testing.T) {
+	b := setupTestBroker(t)
+	accounts, err := b.GetUserAllowedAccounts("user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accounts) != 1 || accounts[0].Name != "dev" ||
+		len(accounts[0].PermittedRoleName) != 1 ||
+		accounts[0].PermittedRoleName[0] != "viewer" {
+		t.Fatalf("unexpected accounts: %+v", accounts)
+	}
+	ok, err := b.IsUserAllowedToAssumeRole("user1", "dev", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("user1 should not be allowed to assume admin")
+	}
+}
+
+func TestGenerateTokenCredentialsWithKeyFile(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expireTime := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.URL.Path == "/token":
+				if r.FormValue("grant_type") != jwtBearerGrantType {
+					http.Error(w, "bad grant", http.StatusBadRequest)
+					return
+				}
+				fmt.Fprintln(w, `{"access_token":"broker-token","expires_in":3600,"token_type":"Bearer"}`)
+			case strings.HasSuffix(r.URL.Path, ":generateAccessToken"):
+				if r.Header.Get("Authorization") != "Bearer broker-token" {
+					http.Error(w, "unauthorized", http.StatusUnauthorized)
+					return
+				}
+				json.NewEncoder(w).Encode(generateAccessTokenResponse{
+					AccessToken: "impersonated-token",
+					ExpireTime:  expireTime,
+				})
+			default:
+				http.Error(w, "not found", http.StatusNotFound)
+			}
+		}))
+	defer ts.Close()
+	b := setupTestBroker(t)
+	b.iamCredentialsURL = ts.URL
+	b.serviceAccountKey = &serviceAccountKey{
+		Type:        "service_account",
+		ClientEmail: "broker@infra.iam.gserviceaccount.com",
+		PrivateKey: string(pem.EncodeToMemory(
+			&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer})),
+		TokenURI: ts.URL + "/token",
+	}
+	creds, err := b.GenerateTokenCredentials("dev", "viewer", "user1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.SessionToken != "impersonated-token" ||
+		creds.SessionId != "viewer@dev-12345.iam.gserviceaccount.com" ||
+		!creds.Expiration.Equal(expireTime) {
+		t.Fatalf("unexpected credentials: %+v", creds)
+	}
+	if _, err := b.GenerateTokenCredentials("dev", "owner", "user1", 0); err == nil {
+		t.Fatal("should have failed for unknown role")
+	}
+}
@@ -0,0 +1,123 @@
+package grants
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Cloud-Foundations/cloud-gate/broker"
+	"github.com/Cloud-Foundations/golib/pkg/log"
+)
+
+const (
+	StatusApproved = "approved"
+	StatusDenied   = "denied"
+	StatusExpired  = "expired"
+	StatusPending  = "pending"
+)
+
+const (
+	// Requests which are not decided within PendingTimeout expire.
+	PendingTimeout = 24 * time.Hour
+	// Grants are forgotten once they have ended for Retention. The audit
+	// log keeps the full history.
+	Retention = 30 * 24 * time.Hour
+)
+
+var (
+	ErrNotFound     = errors.New("grant not found")
+	ErrNotPending   = errors.New("grant is not pending")
+	ErrSelfApproval = errors.New("cannot approve own grant")
+)
+
+// Grant is a request by a user for a role on an account for a limited time.
+// Once approved, the role is granted until ExpiresAt.
+type Grant struct {
+	ID            string        `json:"id"`
+	Username      string        `json:"username"`
+	Cloud         string        `json:"cloud"`
+	Account       string        `json:"account"`
+	Role          string        `json:"role"`
+	Duration      time.Duration `json:"duration"`
+	Justification string        `json:"justification"`
+	Status        string        `json:"status"`
+	RequestedAt   time.Time     `json:"requestedAt"`
+	Approver      string        `json:"approver,omitempty"`
+	DecidedAt     time.Time     `json:"decidedAt,omitempty"`
+	ExpiresAt     time.Time     `json:"expiresAt,omitempty"`
+}
+
+// Store keeps the grants and their requests, persisted to a local file.
+type Store struct {
+	filename string
+	logger   log.DebugLogger
+	mutex    sync.Mutex        // Protect everything below.
+	grants   map[string]*Grant // K: ID.
+}
+
+// NewStore creates a Store which loads and saves the grants in filename.
+func NewStore(filename string, logger log.DebugLogger) (*Store, error) {
+	return newStore(filename, logger)
+}
+
+// RequestGrant records a pending request.
+func (s *Store) RequestGrant(username, cloud, account, role string,
+	duration time.Duration, justification string) (Grant, error) {
+	return s.requestGrant(username, cloud, account, role, duration,
+		justification)
+}
+
+// ApproveGrant approves a pending request, which is granted from now for its
+// duration. Users may not approve their own requests.
+func (s *Store) ApproveGrant(id string, approver string) (Grant, error) {
+	return s.decideGrant(id, approver, StatusApproved)
+}
+
+// DenyGrant denies a pending request. Users may withdraw their own requests
+// by denying them.
+func (s *Store) DenyGrant(id string, approver string) (Grant, error) {
+	return s.decideGrant(id, approver, StatusDenied)
+}
+
+// GetGrant returns the grant with the given ID.
+func (s *Store) GetGrant(id string) (Grant, error) {
+	return s.getGrant(id)
+}
+
+// ListPendingGrants returns the pending requests, oldest first.
+func (s *Store) ListPendingGrants() []Grant {
+	return s.listGrants(func(g *Grant) bool {
+		return g.status(time.Now()) == StatusPending
+	})
+}
+
+// ListUserGrants returns the grants and requests of the user, oldest first.
+func (s *Store) ListUserGrants(username string) []Grant {
+	return s.listGrants(func(g *Grant) bool { return g.Username == username })
+}
+
+// GetActiveGrants returns the approved grants of the user for the cloud
+// which have not expired.
+func (s *Store) GetActiveGrants(cloud, username string) []Grant {
+	now := time.Now()
+	return s.listGrants(func(g *Grant) bool {
+		return g.Cloud == cloud && g.Username == username && g.IsActive(now)
+	})
+}
+
+// IsActive returns true if the grant is approved and not expired at t.
+func (g *Grant) IsActive(t time.Time) bool {
+	return g.Status == StatusApproved && t.Before(g.ExpiresAt)
+}
+
+// GetStatus returns the status of the grant, which is expired once an
+// approved grant or a pending request has timed out.
+func (g *Grant) GetStatus() string {
+	return g.status(time.Now())
+}
+
+// NewBroker returns a broker which also permits the roles of the active
+// grants for the cloud, on top of those that b permits.
+func NewBroker(b broker.Broker, cloud string, store *Store) broker.Broker {
+	return &grantBroker{Broker: b, cloud: cloud, store: store}
+}
@@ -0,0 +1,194 @@
+package grants
+
+import (
+	"errors"
+	"time"
+
+	"github.com/Cloud-Foundations/cloud-gate/broker"
+)
+
+// grantBroker passes everything through to the underlying broker, adding the
+// roles of active grants.
+type grantBroker struct {
+	broker.Broker
+	cloud string
+	store *Store
+}
+
+func (b *grantBroker) GetUserAllowedAccounts(username string) (
+	[]broker.PermittedAccount, error) {
+	accounts, err := b.Broker.GetUserAllowedAccounts(username)
+	if err != nil {
+		return nil, err
+	}
+	grants := b.store.GetActiveGrants(b.cloud, username)
+	if len(grants) < 1 {
+		return accounts, nil
+	}
+	// Copy, since the underlying broker may return its cached accounts.
+	merged := make([]broker.PermittedAccount, 0, len(accounts))
+	accountIndices := make(map[string]int, len(accounts))
+	for _, account := range accounts {
+		account.PermittedRoleName = append([]string(nil),
+			account.PermittedRoleName...)
+		accountIndices[account.Name] = len(merged)
+		merged = append(merged, account)
+	}
+	for _, grant := range grants {
+		index, ok := accountIndices[grant.Account]
+		if !ok {
+			index = len(merged)
+			accountIndices[grant.Account] = index
+			merged = append(merged, broker.PermittedAccount{
+				Name:      grant.Account,
+				HumanName: b.getAccountDisplayName(grant.Account),
+			})
+		}
+		account := &merged[index]
+		if !containsString(account.PermittedRoleName, grant.Role) {
+			account.PermittedRoleName = append(account.PermittedRoleName,
+				grant.Role)
+		}
+	}
+	return merged, nil
+}
+
+func (b *grantBroker) IsUserAllowedToAssumeRole(username string,
+	accountName string, roleName string) (bool, error) {
+	ok, err := b.Broker.IsUserAllowedToAssumeRole(username, accountName,
+		roleName)
+	if err != nil || ok {
+		return ok, err
+	}
+	_, ok = b.getActiveGrant(username, accountName, roleName)
+	return ok, nil
+}
+
+// GenerateTokenCredentials limits the credentials of roles which are only
+// permitted by a grant to the remaining time of the grant, as far as the
+// minimum duration of the cloud allows.
+func (b *grantBroker) GenerateTokenCredentials(accountName string,
+	roleName string, username string, duration time.Duration) (
+	*broker.AWSCredentialsJSON, error) {
+	ok, err := b.Broker.IsUserAllowedToAssumeRole(username, accountName,
+		roleName)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if grant, ok := b.getActiveGrant(username, accountName,
+			roleName); ok {
+			remaining := time.Until(grant.ExpiresAt)
+			if duration <= 0 || duration > remaining {
+				duration = remaining
+			}
+		}
+	}
+	return b.Broker.GenerateTokenCredentials(accountName, roleName, username,
+		duration)
+}
+
+// GetConsoleURLForAccountRole limits the console sessions of roles which are
+// only permitted by a grant to the remaining time of the grant, if the
+// underlying broker can.
+func (b *grantBroker) GetConsoleURLForAccountRole(accountName string,
+	roleName string, username string, issuerURL string) (string, error) {
+	ok, err := b.Broker.IsUserAllowedToAssumeRole(username, accountName,
+		roleName)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		grant, ok := b.getActiveGrant(username, accountName, roleName)
+		limiter, canLimit := b.Broker.(broker.LimitedConsoleURLGetter)
+		if ok && canLimit {
+			return limiter.GetLimitedConsoleURLForAccountRole(accountName,
+				roleName, username, issuerURL, time.Until(grant.ExpiresAt))
+		}
+	}
+	return b.Broker.GetConsoleURLForAccountRole(accountName, roleName,
+		username, issuerURL)
+}
+
+// getActiveGrant returns the active grant which lasts longest.
+func (b *grantBroker) getActiveGrant(username string, accountName string,
+	roleName string) (Grant, bool) {
+	var found Grant
+	for _, grant := range b.store.GetActiveGrants(b.cloud, username) {
+		if grant.Account == accountName && grant.Role == roleName &&
+			grant.ExpiresAt.After(found.ExpiresAt) {
+			found = grant
+		}
+	}
+	return found, found.ID != ""
+}
+
+func containsString(list []string, value string) bool {
+	for _, entry := range list {
+		if entry == value {
+			return true
+		}
+	}
+	return false
+}
+
+// GetRoleHealth passes through to the underlying broker, if it checks roles.
+func (b *grantBroker) GetRoleHealth() []broker.RoleHealth {
+	if checker, ok := b.Broker.(broker.RoleHealthChecker); ok {
+		return checker.GetRoleHealth()
+	}
+	return nil
+}
+
+// getAccountDisplayName falls back to the account name, for brokers which
+// have no display names or no longer know the account.
+func (b *grantBroker) getAccountDisplayName(accountName string) string {
+	if getter, ok := b.Broker.(broker.AccountDisplayNameGetter); ok {
+		if displayName, err := getter.GetAccountDisplayName(
+			accountName); err == nil {
+			return displayName
+		}
+	}
+	return accountName
+}
+
+// GetAccountDisplayName passes through to the underlying broker.
+func (b *grantBroker) GetAccountDisplayName(accountName string) (
+	string, error) {
+	if getter, ok := b.Broker.(broker.AccountDisplayNameGetter); ok {
+		return getter.GetAccountDisplayName(accountName)
+	}
+	return accountName, nil
+}
+
+// GetAccountRoles passes through to the underlying broker.
+func (b *grantBroker) GetAccountRoles(accountName string) ([]string, error) {
+	if getter, ok := b.Broker.(broker.AccountRolesGetter); ok {
+		return getter.GetAccountRoles(accountName)
+	}
+	return nil, errors.New("account roles not supported")
+}
+
+// GetBreakGlassConsoleURL passes through to the underlying broker, without
+// looking up grants.
+func (b *grantBroker) GetBreakGlassConsoleURL(accountName string,
+	roleName string, username string, issuerURL string) (string, error) {
+	if issuer, ok := b.Broker.(broker.BreakGlassIssuer); ok {
+		return issuer.GetBreakGlassConsoleURL(accountName, roleName, username,
+			issuerURL)
+	}
+	return b.Broker.GetConsoleURLForAccountRole(accountName, roleName,
+		username, issuerURL)
+}
+
+// GenerateBreakGlassTokenCredentials passes through to the underlying broker,
+// without looking up grants.
+func (b *grantBroker) GenerateBreakGlassTokenCredentials(accountName string,
+	roleName string, username string) (*broker.AWSCredentialsJSON, error) {
+	if issuer, ok := b.Broker.(broker.BreakGlassIssuer); ok {
+		return issuer.GenerateBreakGlassTokenCredentials(accountName, roleName,
+			username)
+	}
+	return b.Broker.GenerateTokenCredentials(accountName, roleName, username,
+		0)
+}
@@ -0,0 +1,167 @@
+package grants
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	libjson "github.com/Cloud-Foundations/Dominator/lib/json"
+	"github.com/Cloud-Foundations/golib/pkg/log"
+)
+
+const filePerms = 0600
+
+func newStore(filename string, logger log.DebugLogger) (*Store, error) {
+	s := &Store{
+		filename: filename,
+		logger:   logger,
+		grants:   make(map[string]*Grant),
+	}
+	if err := libjson.ReadFromFile(filename, &s.grants); err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	if s.grants == nil {
+		s.grants = make(map[string]*Grant)
+	}
+	return s, nil
+}
+
+func newID() (string, error) {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", id), nil
+}
+
+func (g *Grant) status(now time.Time) string {
+	switch g.Status {
+	case StatusPending:
+		if now.Sub(g.RequestedAt) >= PendingTimeout {
+			return StatusExpired
+		}
+	case StatusApproved:
+		if !now.Before(g.ExpiresAt) {
+			return StatusExpired
+		}
+	}
+	return g.Status
+}
+
+// endedAt returns when the grant stopped mattering, or the zero time if it
+// still matters.
+func (g *Grant) endedAt(now time.Time) time.Time {
+	switch {
+	case g.status(now) == StatusPending:
+		return time.Time{}
+	case g.Status == StatusPending:
+		return g.RequestedAt.Add(PendingTimeout)
+	case g.Status == StatusApproved:
+		if now.Before(g.ExpiresAt) {
+			return time.Time{}
+		}
+		return g.ExpiresAt
+	}
+	return g.DecidedAt
+}
+
+// save prunes old grants and writes the rest. The mutex must be held.
+func (s *Store) save() error {
+	now := time.Now()
+	for id, grant := range s.grants {
+		if endedAt := grant.endedAt(now); !endedAt.IsZero() &&
+			now.Sub(endedAt) > Retention {
+			delete(s.grants, id)
+		}
+	}
+	return libjson.WriteToFile(s.filename, filePerms, "    ", s.grants)
+}
+
+func (s *Store) requestGrant(username, cloud, account, role string,
+	duration time.Duration, justification string) (Grant, error) {
+	if duration <= 0 {
+		return Grant{}, errors.New("invalid duration")
+	}
+	id, err := newID()
+	if err != nil {
+		return Grant{}, err
+	}
+	grant := &Grant{
+		ID:            id,
+		Username:      username,
+		Cloud:         cloud,
+		Account:       account,
+		Role:          role,
+		Duration:      duration,
+		Justification: justification,
+		Status:        StatusPending,
+		RequestedAt:   time.Now(),
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.grants[id] = grant
+	if err := s.save(); err != nil {
+		delete(s.grants, id)
+		return Grant{}, err
+	}
+	return *grant, nil
+}
+
+func (s *Store) decideGrant(id string, approver string,
+	status string) (Grant, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	grant, ok := s.grants[id]
+	if !ok {
+		return Grant{}, ErrNotFound
+	}
+	now := time.Now()
+	if grant.status(now) != StatusPending {
+		return Grant{}, ErrNotPending
+	}
+	if status == StatusApproved && approver == grant.Username {
+		return Grant{}, ErrSelfApproval
+	}
+	oldGrant := *grant
+	grant.Status = status
+	grant.Approver = approver
+	grant.DecidedAt = now
+	if status == StatusApproved {
+		grant.ExpiresAt = now.Add(grant.Duration)
+	}
+	if err := s.save(); err != nil {
+		*grant = oldGrant
+		return Grant{}, err
+	}
+	return *grant, nil
+}
+
+func (s *Store) getGrant(id string) (Grant, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	grant, ok := s.grants[id]
+	if !ok {
+		return Grant{}, ErrNotFound
+	}
+	return *grant, nil
+}
+
+func (s *Store) listGrants(match func(*Grant) bool) []Grant {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var grants []Grant
+	for _, grant := range s.grants {
+		if match(grant) {
+			grants = append(grants, *grant)
+		}
+	}
+	sort.Slice(grants, func(i, j int) bool {
+		return grants[i].RequestedAt.Before(grants[j].RequestedAt)
+	})
+	return grants
+}
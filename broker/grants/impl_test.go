@@ -0,0 +1,214 @@
+package grants
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/cloud-gate/broker"
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+)
+
+// testBroker permits the "readonly" role on the "prod" account.
+type testBroker struct {
+	broker.Broker
+	duration time.Duration
+}
+
+func (b *testBroker) GetUserAllowedAccounts(string) (
+	[]broker.PermittedAccount, error) {
+	return []broker.PermittedAccount{{Name: "prod", HumanName: "Production",
+		PermittedRoleName: []string{"readonly"}}}, nil
+}
+
+func (b *testBroker) IsUserAllowedToAssumeRole(username, accountName,
+	roleName string) (bool, error) {
+	return accountName == "prod" && roleName == "readonly", nil
+}
+
+func (b *testBroker) GenerateTokenCredentials(accountName, roleName,
+	username string, duration time.Duration) (
+	*broker.AWSCredentialsJSON, error) {
+	b.duration = duration
+	return &broker.AWSCredentialsJSON{}, nil
+}
+
+func (b *testBroker) GetConsoleURLForAccountRole(accountName, roleName,
+	username, issuerURL string) (string, error) {
+	b.duration = 0
+	return "https://console.example.com/", nil
+}
+
+func (b *testBroker) GetLimitedConsoleURLForAccountRole(accountName, roleName,
+	username, issuerURL string, maxDuration time.Duration) (string, error) {
+	b.duration = maxDuration
+	return "https://console.example.com/", nil
+}
+
+func (b *testBroker) GetAccountDisplayName(accountName string) (
+	string, error) {
+	switch accountName {
+	case "prod":
+		return "Production", nil
+	case "staging":
+		return "Staging", nil
+	}
+	return "", errors.New("accountName not found")
+}
+
+func newTestStore(t *testing.T, filename string) *Store {
+	store, err := NewStore(filename, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestGrantLifecycle(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "grants.json")
+	store := newTestStore(t, filename)
+	grant, err := store.RequestGrant("user1", "aws", "prod", "admin",
+		2*time.Hour, "incident 42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if grant.GetStatus() != StatusPending {
+		t.Fatalf("unexpected status: %s", grant.GetStatus())
+	}
+	if _, err := store.ApproveGrant(grant.ID, "user1"); err != ErrSelfApproval {
+		t.Fatalf("expected self approval error, got: %v", err)
+	}
+	if len(store.GetActiveGrants("aws", "user1")) != 0 {
+		t.Fatal("pending grant is active")
+	}
+	if len(store.ListPendingGrants()) != 1 {
+		t.Fatal("expected one pending grant")
+	}
+	grant, err = store.ApproveGrant(grant.ID, "approver1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if grant.Approver != "approver1" ||
+		grant.ExpiresAt.Sub(grant.DecidedAt) != 2*time.Hour {
+		t.Fatalf("unexpected grant: %+v", grant)
+	}
+	if _, err := store.DenyGrant(grant.ID, "approver1"); err != ErrNotPending {
+		t.Fatalf("expected not pending error, got: %v", err)
+	}
+	// The grant survives a restart.
+	store = newTestStore(t, filename)
+	if active := store.GetActiveGrants("aws", "user1"); len(active) != 1 ||
+		active[0].ID != grant.ID {
+		t.Fatalf("unexpected active grants: %+v", active)
+	}
+	if len(store.GetActiveGrants("gcp", "user1")) != 0 {
+		t.Fatal("grant active on the wrong cloud")
+	}
+}
+
+func TestGrantExpiry(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		grant    Grant
+		expected string
+	}{
+		{"pending", Grant{Status: StatusPending, RequestedAt: now},
+			StatusPending},
+		{"pending too long", Grant{Status: StatusPending,
+			RequestedAt: now.Add(-PendingTimeout)}, StatusExpired},
+		{"approved", Grant{Status: StatusApproved,
+			ExpiresAt: now.Add(time.Minute)}, StatusApproved},
+		{"approved and ended", Grant{Status: StatusApproved,
+			ExpiresAt: now.Add(-time.Minute)}, StatusExpired},
+		{"denied", Grant{Status: StatusDenied, DecidedAt: now}, StatusDenied},
+	}
+	for _, test := range tests {
+		if status := test.grant.status(now); status != test.expected {
+			t.Errorf("%s: expected: %s, got: %s", test.name, test.expected,
+				status)
+		}
+	}
+}
+
+func TestBroker(t *testing.T) {
+	store := newTestStore(t, filepath.Join(t.TempDir(), "grants.json"))
+	for _, account := range []string{"prod", "staging", "retired"} {
+		grant, err := store.RequestGrant("user1", "aws", account, "admin",
+			time.Hour, "deploy")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.ApproveGrant(grant.ID, "approver1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	underlying := &testBroker{}
+	b := NewBroker(underlying, "aws", store)
+	accounts, err := b.GetUserAllowedAccounts("user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []broker.PermittedAccount{
+		{Name: "prod", HumanName: "Production",
+			PermittedRoleName: []string{"readonly", "admin"}},
+		{Name: "staging", HumanName: "Staging",
+			PermittedRoleName: []string{"admin"}},
+		{Name: "retired", HumanName: "retired",
+			PermittedRoleName: []string{"admin"}},
+	}
+	if !reflect.DeepEqual(accounts, expected) {
+		t.Fatalf("expected: %+v, got: %+v", expected, accounts)
+	}
+	for _, test := range []struct {
+		username, account, role string
+		expected                bool
+	}{
+		{"user1", "prod", "readonly", true},
+		{"user1", "staging", "admin", true},
+		{"user1", "staging", "readonly", false},
+		{"user2", "staging", "admin", false},
+	} {
+		ok, err := b.IsUserAllowedToAssumeRole(test.username, test.account,
+			test.role)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != test.expected {
+			t.Errorf("%s %s %s: expected: %v", test.username, test.account,
+				test.role, test.expected)
+		}
+	}
+	// Credentials from a grant do not outlast it.
+	if _, err := b.GenerateTokenCredentials("staging", "admin", "user1",
+		12*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if underlying.duration > time.Hour || underlying.duration <= 0 {
+		t.Fatalf("unexpected duration: %s", underlying.duration)
+	}
+	if _, err := b.GenerateTokenCredentials("prod", "readonly", "user1",
+		12*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if underlying.duration != 12*time.Hour {
+		t.Fatalf("unexpected duration: %s", underlying.duration)
+	}
+	// Nor do console sessions.
+	if _, err := b.GetConsoleURLForAccountRole("staging", "admin", "user1",
+		""); err != nil {
+		t.Fatal(err)
+	}
+	if underlying.duration > time.Hour || underlying.duration <= 0 {
+		t.Fatalf("unexpected console duration: %s", underlying.duration)
+	}
+	if _, err := b.GetConsoleURLForAccountRole("prod", "readonly", "user1",
+		""); err != nil {
+		t.Fatal(err)
+	}
+	if underlying.duration != 0 {
+		t.Fatalf("unexpected console duration: %s", underlying.duration)
+	}
+}
@@ -13,7 +13,6 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
-	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -21,8 +20,11 @@ import (
 	"github.com/Cloud-Foundations/Dominator/lib/log/serverlogger"
 	"github.com/Cloud-Foundations/Dominator/lib/logbuf"
 	"github.com/Cloud-Foundations/cloud-gate/broker"
+	"github.com/Cloud-Foundations/cloud-gate/broker/audit"
 	"github.com/Cloud-Foundations/cloud-gate/broker/configuration"
+	"github.com/Cloud-Foundations/cloud-gate/broker/grants"
 	"github.com/Cloud-Foundations/cloud-gate/broker/staticconfiguration"
+	"github.com/Cloud-Foundations/cloud-gate/lib/apiv1"
 	"github.com/Cloud-Foundations/cloud-gate/lib/constants"
 	"github.com/Cloud-Foundations/golib/pkg/auth/userinfo"
 	acmecfg "github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/config"
@@ -36,24 +38,29 @@ type HtmlWriter interface {
 
 type AuthCookie struct {
 	Username  string
+	Groups    []string `json:",omitempty"`
+	IssuedAt  time.Time
 	ExpiresAt time.Time
 }
 
 type Server struct {
-	brokers      map[string]broker.Broker
-	config       *configuration.Configuration
-	htmlWriters  []HtmlWriter
-	htmlTemplate *template.Template
-	logger       log.DebugLogger
-	cookieMutex  sync.Mutex
-	authCookie   map[string]AuthCookie
-	staticConfig *staticconfiguration.StaticConfiguration
-	userInfo     userinfo.UserInfo
-	netClient    *http.Client
-	accessLogger log.DebugLogger
-	tlsConfig    *tls.Config
-	serviceMux   *http.ServeMux
-	isReady      bool
+	auditSink        audit.AuditSink
+	brokers          map[string]broker.Broker
+	config           *configuration.Configuration
+	defaultCloudName string // The first of the enabled clouds.
+	grantStore       *grants.Store
+	htmlWriters      []HtmlWriter
+	htmlTemplate     *template.Template
+	logger           log.DebugLogger
+	sessionStore     SessionStore
+	oidcProvider     *oidcProvider
+	staticConfig     *staticconfiguration.StaticConfiguration
+	userInfo         userinfo.UserInfo
+	netClient        *http.Client
+	accessLogger     log.DebugLogger
+	tlsConfig        *tls.Config
+	serviceMux       *http.ServeMux
+	isReady          bool
 }
 
 var authCookieName = constants.AuthCookieName
@@ -88,15 +95,25 @@ func (s *Server) GetIsReady() bool {
 	return s.isReady
 }
 
+// getDefaultCloudName returns the cloud of requests which do not name one:
+// the first enabled cloud.
+func getDefaultCloudName(enabledClouds []string) string {
+	if len(enabledClouds) < 1 {
+		return constants.DefaultCloudName
+	}
+	return enabledClouds[0]
+}
+
 func StartServer(staticConfig *staticconfiguration.StaticConfiguration,
 	userInfo userinfo.UserInfo, brokers map[string]broker.Broker,
+	auditSink audit.AuditSink, grantStore *grants.Store,
 	logger log.DebugLogger) (*Server, error) {
 
-	authCookieSuffix, err := randomStringGeneration()
+	var err error
+	authCookieName, err = getAuthCookieName(staticConfig.Base.SessionStore)
 	if err != nil {
 		return nil, err
 	}
-	authCookieName = constants.AuthCookieName + "_" + authCookieSuffix[0:6]
 	cm, err := acmecfg.New(staticConfig.Base.TLSCertFilename,
 		staticConfig.Base.TLSKeyFilename, staticConfig.Base.HttpRedirectPort,
 		staticConfig.Base.ACME, logger)
@@ -108,16 +125,31 @@ func StartServer(staticConfig *staticconfiguration.StaticConfiguration,
 		return nil, err
 	}
 	server := &Server{
-		brokers:      brokers,
-		logger:       logger,
-		userInfo:     userInfo,
-		staticConfig: staticConfig,
+		auditSink:        auditSink,
+		brokers:          brokers,
+		defaultCloudName: getDefaultCloudName(staticConfig.Base.EnabledClouds),
+		grantStore:       grantStore,
+		logger:           logger,
+		userInfo:         userInfo,
+		staticConfig:     staticConfig,
 		netClient: &http.Client{
 			Timeout: time.Second * 15,
 		},
 	}
-	server.authCookie = make(map[string]AuthCookie)
+	server.sessionStore, err = newSessionStore(staticConfig.Base.SessionStore,
+		staticConfig.Base.SharedSecrets,
+		filepath.Join(staticConfig.Base.DataDirectory,
+			"session-revocations.json"))
+	if err != nil {
+		return nil, err
+	}
+	if staticConfig.OpenID.ProviderURL != "" {
+		server.oidcProvider = newOIDCProvider(staticConfig.OpenID.ProviderURL)
+	}
 	go server.performStateCleanup(constants.SecondsBetweenCleanup)
+	if len(staticConfig.Base.Peers) > 0 {
+		go server.peerSyncLoop()
+	}
 
 	logBufOptions := logbuf.GetStandardOptions()
 	accessLogDirectory := filepath.Join(logBufOptions.Directory, "access")
@@ -148,6 +180,8 @@ func StartServer(staticConfig *staticconfiguration.StaticConfiguration,
 		consoleAccessTemplateText,
 		generateTokaneTemplateText,
 		unsealingFormPageTemplateText,
+		grantsPageTemplateText,
+		breakGlassPageTemplateText,
 		headerTemplateText}
 	for _, templateString := range extraTemplates {
 		_, err = server.htmlTemplate.Parse(templateString)
@@ -158,13 +192,30 @@ func StartServer(staticConfig *staticconfiguration.StaticConfiguration,
 
 	http.HandleFunc("/", server.dashboardRootHandler)
 	http.HandleFunc("/status", server.statusHandler)
+	http.HandleFunc("/status/roleHealth", server.roleHealthHandler)
 	http.HandleFunc("/unseal", server.unsealingHandler)
+	http.HandleFunc("/admin/revokeSessions", server.revokeSessionsHandler)
+	http.HandleFunc(peerRevocationsPath, server.peerRevocationsHandler)
 	http.HandleFunc(constants.Oauth2redirectPath, server.oauth2RedirectPathHandler)
 	http.Handle("/prometheus_metrics", promhttp.Handler())
 	serviceMux := http.NewServeMux()
 	serviceMux.HandleFunc("/", server.mainEntryPointHandler)
 	serviceMux.HandleFunc("/getconsole", server.getConsoleUrlHandler)
 	serviceMux.HandleFunc("/generatetoken", server.generateTokenHandler)
+	serviceMux.HandleFunc("/logout", server.logoutHandler)
+	serviceMux.HandleFunc("/breakglass", server.breakGlassHandler)
+	serviceMux.HandleFunc(apiv1.PathPrefix, server.apiNotFoundHandler)
+	serviceMux.HandleFunc(apiv1.WhoAmIPath, server.apiWhoAmIHandler)
+	serviceMux.HandleFunc(apiv1.AccountsPath, server.apiAccountsHandler)
+	serviceMux.HandleFunc(apiv1.CredentialsPath, server.apiCredentialsHandler)
+	serviceMux.HandleFunc(apiv1.BatchPath, server.apiBatchCredentialsHandler)
+	serviceMux.HandleFunc(apiv1.ConsolePath, server.apiConsoleHandler)
+	if grantStore != nil {
+		serviceMux.HandleFunc("/grants", server.grantsHandler)
+		serviceMux.HandleFunc("/grants/request", server.requestGrantHandler)
+		serviceMux.HandleFunc("/grants/approve", server.decideGrantHandler)
+		serviceMux.HandleFunc("/grants/deny", server.decideGrantHandler)
+	}
 	serviceMux.HandleFunc("/static/", staticHandler)
 	customWebResourcesPath := filepath.Join(staticConfig.Base.SharedDataDirectory, "customization_data", "web_resources")
 	if _, err = os.Stat(customWebResourcesPath); err == nil {
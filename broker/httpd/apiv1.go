@@ -0,0 +1,289 @@
+package httpd
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/Cloud-Foundations/cloud-gate/broker"
+	"github.com/Cloud-Foundations/cloud-gate/broker/audit"
+	"github.com/Cloud-Foundations/cloud-gate/lib/apiv1"
+	"github.com/Cloud-Foundations/keymaster/lib/instrumentedwriter"
+)
+
+const (
+	apiMaxRequestSize     = 1 << 16
+	apiMaxDurationSeconds = 999999
+)
+
+var apiNameRegexp = regexp.MustCompile("^[A-Za-z0-9_.-]{2,40}$")
+
+func writeAPIResponse(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	writeAPIResponse(w, status, apiv1.Error{Error: message})
+}
+
+// apiAuthenticate returns the authenticated user, or writes an error and
+// returns false. Unlike the browser endpoints it never redirects to the
+// identity provider.
+func (s *Server) apiAuthenticate(w http.ResponseWriter,
+	r *http.Request, method string) (string, bool) {
+	setupSecurityHeaders(w)
+	authUser, err := s.getAuthenticatedUserName(r)
+	if err != nil {
+		writeAPIError(w, http.StatusUnauthorized, "not authenticated")
+		return "", false
+	}
+	w.(*instrumentedwriter.LoggingWriter).SetUsername(authUser)
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeAPIError(w, http.StatusMethodNotAllowed,
+			"method not allowed: "+r.Method)
+		return "", false
+	}
+	if method == "POST" && !isSameOrigin(r) {
+		writeAPIError(w, http.StatusForbidden, "cross-origin request denied")
+		return "", false
+	}
+	return authUser, true
+}
+
+// decodeAPIRequest decodes the JSON body of the request into v. Requiring
+// the JSON content type also prevents plain HTML forms from posting
+// cross-site.
+func decodeAPIRequest(w http.ResponseWriter, r *http.Request,
+	v interface{}) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		writeAPIError(w, http.StatusUnsupportedMediaType,
+			"content type must be application/json")
+		return false
+	}
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body,
+		apiMaxRequestSize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid request: "+err.Error())
+		return false
+	}
+	return true
+}
+
+func (s *Server) getAPIBroker(w http.ResponseWriter,
+	cloudName string) (string, broker.Broker, bool) {
+	if cloudName == "" {
+		cloudName = s.defaultCloudName
+	}
+	cloudBroker, ok := s.brokers[cloudName]
+	if !ok {
+		writeAPIError(w, http.StatusBadRequest, "unknown cloud: "+cloudName)
+		return "", nil, false
+	}
+	return cloudName, cloudBroker, true
+}
+
+func validateAPIAccountRole(w http.ResponseWriter, accountName string,
+	roleName string) bool {
+	if !apiNameRegexp.MatchString(accountName) {
+		writeAPIError(w, http.StatusBadRequest, "invalid accountName")
+		return false
+	}
+	if !apiNameRegexp.MatchString(roleName) {
+		writeAPIError(w, http.StatusBadRequest, "invalid roleName")
+		return false
+	}
+	return true
+}
+
+// apiAuthorizeRole checks that the user may assume the role, emitting the
+// audit event and writing an error if not.
+func (s *Server) apiAuthorizeRole(w http.ResponseWriter,
+	auditEvent *audit.Event, cloudBroker broker.Broker) bool {
+	ok, err := cloudBroker.IsUserAllowedToAssumeRole(auditEvent.Username,
+		auditEvent.Account, auditEvent.Role)
+	if err != nil {
+		s.logger.Printf("Failure checking user permissions: %s", err)
+		auditEvent.Outcome = audit.OutcomeFailure
+		auditEvent.Message = err.Error()
+		s.emitAuditEvent(auditEvent)
+		writeAPIError(w, http.StatusInternalServerError,
+			"error getting user permissions")
+		return false
+	}
+	if !ok {
+		auditEvent.Outcome = audit.OutcomeDenied
+		s.emitAuditEvent(auditEvent)
+		writeAPIError(w, http.StatusForbidden, "invalid account or role")
+		return false
+	}
+	return true
+}
+
+func newAPICredentials(cloudName string, accountName string, roleName string,
+	credentials *broker.AWSCredentialsJSON) *apiv1.Credentials {
+	return &apiv1.Credentials{
+		Cloud:           cloudName,
+		AccountName:     accountName,
+		RoleName:        roleName,
+		AccessKeyID:     credentials.SessionId,
+		SecretAccessKey: credentials.SessionKey,
+		SessionToken:    credentials.SessionToken,
+		Region:          credentials.Region,
+		Expiration:      credentials.Expiration,
+	}
+}
+
+func (s *Server) apiNotFoundHandler(w http.ResponseWriter, r *http.Request) {
+	writeAPIError(w, http.StatusNotFound, "unknown endpoint: "+r.URL.Path)
+}
+
+func (s *Server) apiWhoAmIHandler(w http.ResponseWriter, r *http.Request) {
+	authUser, ok := s.apiAuthenticate(w, r, "GET")
+	if !ok {
+		return
+	}
+	writeAPIResponse(w, http.StatusOK, apiv1.WhoAmIResponse{
+		Username: authUser,
+		Clouds:   s.getCloudNames(),
+	})
+}
+
+func (s *Server) apiAccountsHandler(w http.ResponseWriter, r *http.Request) {
+	authUser, ok := s.apiAuthenticate(w, r, "GET")
+	if !ok {
+		return
+	}
+	cloudName, cloudBroker, ok := s.getAPIBroker(w,
+		r.URL.Query().Get("cloud"))
+	if !ok {
+		return
+	}
+	userAccounts, err := cloudBroker.GetUserAllowedAccounts(authUser)
+	if err != nil {
+		s.logger.Printf("Failed to get %s accounts for %s, err=%v",
+			cloudName, authUser, err)
+		writeAPIError(w, http.StatusInternalServerError,
+			"error getting accounts")
+		return
+	}
+	response := apiv1.AccountsResponse{
+		Cloud:    cloudName,
+		Accounts: make([]apiv1.Account, 0, len(userAccounts)),
+	}
+	for _, account := range userAccounts {
+		roles := make([]string, len(account.PermittedRoleName))
+		copy(roles, account.PermittedRoleName)
+		sort.Strings(roles)
+		response.Accounts = append(response.Accounts, apiv1.Account{
+			Name:        account.Name,
+			DisplayName: account.HumanName,
+			Roles:       roles,
+		})
+	}
+	sort.Slice(response.Accounts, func(i, j int) bool {
+		return response.Accounts[i].Name < response.Accounts[j].Name
+	})
+	writeAPIResponse(w, http.StatusOK, response)
+}
+
+func (s *Server) apiCredentialsHandler(w http.ResponseWriter,
+	r *http.Request) {
+	authUser, ok := s.apiAuthenticate(w, r, "POST")
+	if !ok {
+		return
+	}
+	var request apiv1.CredentialsRequest
+	if !decodeAPIRequest(w, r, &request) {
+		return
+	}
+	if !validateAPIAccountRole(w, request.AccountName, request.RoleName) {
+		return
+	}
+	if request.DurationSeconds < 0 ||
+		request.DurationSeconds > apiMaxDurationSeconds {
+		writeAPIError(w, http.StatusBadRequest, "invalid durationSeconds")
+		return
+	}
+	cloudName, cloudBroker, ok := s.getAPIBroker(w, request.Cloud)
+	if !ok {
+		return
+	}
+	auditEvent := s.newAuditEvent(r, audit.ActionTokenCredentials, authUser)
+	auditEvent.Cloud = cloudName
+	auditEvent.Account = request.AccountName
+	auditEvent.Role = request.RoleName
+	if !s.apiAuthorizeRole(w, auditEvent, cloudBroker) {
+		return
+	}
+	tempCredentials, err := cloudBroker.GenerateTokenCredentials(
+		request.AccountName, request.RoleName, authUser,
+		time.Duration(request.DurationSeconds)*time.Second)
+	if err != nil {
+		s.logger.Printf("Failed to generate %s Token for account: %s role: %s user: %s, err: %v",
+			cloudName, request.AccountName, request.RoleName, authUser, err)
+		auditEvent.Outcome = audit.OutcomeFailure
+		auditEvent.Message = err.Error()
+		s.emitAuditEvent(auditEvent)
+		writeAPIError(w, http.StatusInternalServerError,
+			"failed to generate credentials for account/role (missing/invalid trust?)")
+		return
+	}
+	auditEvent.AccessKeyID = tempCredentials.SessionId
+	auditEvent.Outcome = audit.OutcomeSuccess
+	s.emitAuditEvent(auditEvent)
+	writeAPIResponse(w, http.StatusOK, newAPICredentials(cloudName,
+		request.AccountName, request.RoleName, tempCredentials))
+}
+
+func (s *Server) apiConsoleHandler(w http.ResponseWriter, r *http.Request) {
+	authUser, ok := s.apiAuthenticate(w, r, "POST")
+	if !ok {
+		return
+	}
+	var request apiv1.ConsoleRequest
+	if !decodeAPIRequest(w, r, &request) {
+		return
+	}
+	if !validateAPIAccountRole(w, request.AccountName, request.RoleName) {
+		return
+	}
+	cloudName, cloudBroker, ok := s.getAPIBroker(w, request.Cloud)
+	if !ok {
+		return
+	}
+	auditEvent := s.newAuditEvent(r, audit.ActionConsoleURL, authUser)
+	auditEvent.Cloud = cloudName
+	auditEvent.Account = request.AccountName
+	auditEvent.Role = request.RoleName
+	if !s.apiAuthorizeRole(w, auditEvent, cloudBroker) {
+		return
+	}
+	issuerURL := fmt.Sprintf("https://%s/", r.Host)
+	consoleURL, err := cloudBroker.GetConsoleURLForAccountRole(
+		request.AccountName, request.RoleName, authUser, issuerURL)
+	if err != nil {
+		s.logger.Printf("Failed to generate %s console for account: %s role: %s user: %s, err: %v",
+			cloudName, request.AccountName, request.RoleName, authUser, err)
+		auditEvent.Outcome = audit.OutcomeFailure
+		auditEvent.Message = err.Error()
+		s.emitAuditEvent(auditEvent)
+		writeAPIError(w, http.StatusInternalServerError,
+			"failed to generate console URL for account/role (missing/invalid trust?)")
+		return
+	}
+	auditEvent.Outcome = audit.OutcomeSuccess
+	s.emitAuditEvent(auditEvent)
+	writeAPIResponse(w, http.StatusOK, apiv1.ConsoleResponse{URL: consoleURL})
+}
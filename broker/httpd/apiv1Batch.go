@@ -0,0 +1,135 @@
+package httpd
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Cloud-Foundations/cloud-gate/broker"
+	"github.com/Cloud-Foundations/cloud-gate/broker/audit"
+	"github.com/Cloud-Foundations/cloud-gate/lib/apiv1"
+)
+
+const (
+	maxBatchIssuesInFlight = 8
+)
+
+// getPermittedRoles returns the roles the user may assume, keyed by account
+// name, so that a batch needs only one authorisation lookup.
+func getPermittedRoles(
+	accounts []broker.PermittedAccount) map[string]map[string]struct{} {
+	permitted := make(map[string]map[string]struct{}, len(accounts))
+	for _, account := range accounts {
+		roles := permitted[account.Name]
+		if roles == nil {
+			roles = make(map[string]struct{}, len(account.PermittedRoleName))
+			permitted[account.Name] = roles
+		}
+		for _, roleName := range account.PermittedRoleName {
+			roles[roleName] = struct{}{}
+		}
+	}
+	return permitted
+}
+
+func (s *Server) apiBatchCredentialsHandler(w http.ResponseWriter,
+	r *http.Request) {
+	authUser, ok := s.apiAuthenticate(w, r, "POST")
+	if !ok {
+		return
+	}
+	var request apiv1.BatchCredentialsRequest
+	if !decodeAPIRequest(w, r, &request) {
+		return
+	}
+	if len(request.Roles) < 1 {
+		writeAPIError(w, http.StatusBadRequest, "no roles requested")
+		return
+	}
+	if len(request.Roles) > apiv1.MaxBatchSize {
+		writeAPIError(w, http.StatusBadRequest, "too many roles requested")
+		return
+	}
+	if request.DurationSeconds < 0 ||
+		request.DurationSeconds > apiMaxDurationSeconds {
+		writeAPIError(w, http.StatusBadRequest, "invalid durationSeconds")
+		return
+	}
+	cloudName, cloudBroker, ok := s.getAPIBroker(w, request.Cloud)
+	if !ok {
+		return
+	}
+	userAccounts, err := cloudBroker.GetUserAllowedAccounts(authUser)
+	if err != nil {
+		s.logger.Printf("Failed to get %s accounts for %s, err=%v",
+			cloudName, authUser, err)
+		writeAPIError(w, http.StatusInternalServerError,
+			"error getting user permissions")
+		return
+	}
+	permittedRoles := getPermittedRoles(userAccounts)
+	duration := time.Duration(request.DurationSeconds) * time.Second
+	response := apiv1.BatchCredentialsResponse{
+		Cloud:   cloudName,
+		Results: make([]apiv1.BatchCredentialsResult, len(request.Roles)),
+	}
+	semaphore := make(chan struct{}, maxBatchIssuesInFlight)
+	var wg sync.WaitGroup
+	for index, role := range request.Roles {
+		result := &response.Results[index]
+		result.AccountName = role.AccountName
+		result.RoleName = role.RoleName
+		if !apiNameRegexp.MatchString(role.AccountName) ||
+			!apiNameRegexp.MatchString(role.RoleName) {
+			result.Status = http.StatusBadRequest
+			result.Error = "invalid accountName or roleName"
+			continue
+		}
+		auditEvent := s.newAuditEvent(r, audit.ActionTokenCredentials,
+			authUser)
+		auditEvent.Cloud = cloudName
+		auditEvent.Account = role.AccountName
+		auditEvent.Role = role.RoleName
+		if _, ok := permittedRoles[role.AccountName][role.RoleName]; !ok {
+			auditEvent.Outcome = audit.OutcomeDenied
+			s.emitAuditEvent(auditEvent)
+			result.Status = http.StatusForbidden
+			result.Error = "invalid account or role"
+			continue
+		}
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(result *apiv1.BatchCredentialsResult,
+			auditEvent *audit.Event) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			s.issueBatchCredentials(cloudName, cloudBroker, authUser,
+				duration, result, auditEvent)
+		}(result, auditEvent)
+	}
+	wg.Wait()
+	writeAPIResponse(w, http.StatusOK, response)
+}
+
+func (s *Server) issueBatchCredentials(cloudName string,
+	cloudBroker broker.Broker, authUser string, duration time.Duration,
+	result *apiv1.BatchCredentialsResult, auditEvent *audit.Event) {
+	tempCredentials, err := cloudBroker.GenerateTokenCredentials(
+		result.AccountName, result.RoleName, authUser, duration)
+	if err != nil {
+		s.logger.Printf("Failed to generate %s Token for account: %s role: %s user: %s, err: %v",
+			cloudName, result.AccountName, result.RoleName, authUser, err)
+		auditEvent.Outcome = audit.OutcomeFailure
+		auditEvent.Message = err.Error()
+		s.emitAuditEvent(auditEvent)
+		result.Status = http.StatusInternalServerError
+		result.Error = "failed to generate credentials for account/role (missing/invalid trust?)"
+		return
+	}
+	auditEvent.AccessKeyID = tempCredentials.SessionId
+	auditEvent.Outcome = audit.OutcomeSuccess
+	s.emitAuditEvent(auditEvent)
+	result.Status = http.StatusOK
+	result.Credentials = newAPICredentials(cloudName, result.AccountName,
+		result.RoleName, tempCredentials)
+}
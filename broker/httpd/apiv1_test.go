@@ -0,0 +1,226 @@
+package httpd
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/cloud-gate/broker"
+	"github.com/Cloud-Foundations/cloud-gate/broker/audit"
+	"github.com/Cloud-Foundations/cloud-gate/lib/apiv1"
+	"github.com/Cloud-Foundations/keymaster/lib/instrumentedwriter"
+)
+
+// testBatchBroker also permits the "broken" role on "prod", which fails.
+type testBatchBroker struct {
+	testBroker
+}
+
+func (testBatchBroker) GetUserAllowedAccounts(string) (
+	[]broker.PermittedAccount, error) {
+	return []broker.PermittedAccount{{Name: "prod", HumanName: "prod",
+		PermittedRoleName: []string{"admin", "broken"}}}, nil
+}
+
+func (testBatchBroker) GenerateTokenCredentials(accountName string,
+	roleName string, username string,
+	duration time.Duration) (*broker.AWSCredentialsJSON, error) {
+	if roleName == "broken" {
+		return nil, errors.New("AccessDenied")
+	}
+	return &broker.AWSCredentialsJSON{SessionId: "AKIATEST"}, nil
+}
+
+func postJSON(server *Server, handler http.HandlerFunc, path string,
+	body string, cookieValue string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.AddCookie(&http.Cookie{Name: authCookieName, Value: cookieValue})
+	rr := httptest.NewRecorder()
+	instrumentedwriter.NewLoggingHandler(handler,
+		httpLogger{}).ServeHTTP(rr, req)
+	return rr
+}
+
+func decodeAPIError(t *testing.T, rr *httptest.ResponseRecorder,
+	expectedStatus int) string {
+	if rr.Code != expectedStatus {
+		t.Fatalf("expected status %d, got %d: %s", expectedStatus, rr.Code,
+			rr.Body.String())
+	}
+	var apiError apiv1.Error
+	if err := json.Unmarshal(rr.Body.Bytes(), &apiError); err != nil {
+		t.Fatalf("error is not JSON: %s: %s", err, rr.Body.String())
+	}
+	if apiError.Error == "" {
+		t.Fatal("empty error message")
+	}
+	return apiError.Error
+}
+
+func TestAPIv1Unauthenticated(t *testing.T) {
+	server, _ := newTestServer(t)
+	rr := serveWithCookie(server, server.apiWhoAmIHandler, "GET",
+		apiv1.WhoAmIPath, "badCookie")
+	decodeAPIError(t, rr, http.StatusUnauthorized)
+	if location := rr.Header().Get("Location"); location != "" {
+		t.Fatalf("API should not redirect, got: %s", location)
+	}
+}
+
+func TestAPIv1WhoAmIAndAccounts(t *testing.T) {
+	server, _ := newTestServer(t)
+	rr := serveAuthenticated(server, server.apiWhoAmIHandler,
+		apiv1.WhoAmIPath)
+	var whoAmI apiv1.WhoAmIResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &whoAmI); err != nil {
+		t.Fatal(err)
+	}
+	if whoAmI.Username != "user1" || len(whoAmI.Clouds) != 1 ||
+		whoAmI.Clouds[0] != "aws" {
+		t.Fatalf("unexpected whoami: %+v", whoAmI)
+	}
+	rr = serveAuthenticated(server, server.apiAccountsHandler,
+		apiv1.AccountsPath)
+	var accounts apiv1.AccountsResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &accounts); err != nil {
+		t.Fatal(err)
+	}
+	if accounts.Cloud != "aws" || len(accounts.Accounts) != 1 ||
+		accounts.Accounts[0].Name != "prod" ||
+		len(accounts.Accounts[0].Roles) != 1 {
+		t.Fatalf("unexpected accounts: %+v", accounts)
+	}
+	rr = serveAuthenticated(server, server.apiAccountsHandler,
+		apiv1.AccountsPath+"?cloud=gcp")
+	decodeAPIError(t, rr, http.StatusBadRequest)
+	rr = serveWithCookie(server, server.apiAccountsHandler, "POST",
+		apiv1.AccountsPath, "cookieValue")
+	decodeAPIError(t, rr, http.StatusMethodNotAllowed)
+}
+
+func TestAPIv1Credentials(t *testing.T) {
+	server, auditSink := newTestServer(t)
+	rr := postJSON(server, server.apiCredentialsHandler, apiv1.CredentialsPath,
+		`{"accountName": "prod", "roleName": "readonly"}`, "cookieValue")
+	decodeAPIError(t, rr, http.StatusForbidden)
+	rr = postJSON(server, server.apiCredentialsHandler, apiv1.CredentialsPath,
+		`{"accountName": "prod", "roleName": "a b"}`, "cookieValue")
+	decodeAPIError(t, rr, http.StatusBadRequest)
+	rr = postJSON(server, server.apiCredentialsHandler, apiv1.CredentialsPath,
+		`{"accountName": "prod", "roleName": "admin", "extra": 1}`,
+		"cookieValue")
+	decodeAPIError(t, rr, http.StatusBadRequest)
+	rr = postJSON(server, server.apiCredentialsHandler, apiv1.CredentialsPath,
+		`{"accountName": "prod", "roleName": "admin", "durationSeconds": 900}`,
+		"cookieValue")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected OK, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var credentials apiv1.Credentials
+	if err := json.Unmarshal(rr.Body.Bytes(), &credentials); err != nil {
+		t.Fatal(err)
+	}
+	if credentials.AccessKeyID != "AKIATEST" ||
+		credentials.AccountName != "prod" || credentials.Cloud != "aws" {
+		t.Fatalf("unexpected credentials: %+v", credentials)
+	}
+	if len(auditSink.events) != 2 {
+		t.Fatalf("expected 2 audit events, got %d", len(auditSink.events))
+	}
+	if event := auditSink.events[0]; event.Outcome != audit.OutcomeDenied ||
+		event.Action != audit.ActionTokenCredentials {
+		t.Fatalf("unexpected denied event: %+v", event)
+	}
+	if event := auditSink.events[1]; event.Outcome != audit.OutcomeSuccess ||
+		event.AccessKeyID != "AKIATEST" {
+		t.Fatalf("unexpected success event: %+v", event)
+	}
+	req := httptest.NewRequest("POST", apiv1.CredentialsPath,
+		strings.NewReader("accountName=prod&roleName=admin"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{Name: authCookieName, Value: "cookieValue"})
+	rr = httptest.NewRecorder()
+	instrumentedwriter.NewLoggingHandler(
+		http.HandlerFunc(server.apiCredentialsHandler),
+		httpLogger{}).ServeHTTP(rr, req)
+	decodeAPIError(t, rr, http.StatusUnsupportedMediaType)
+}
+
+func TestAPIv1Console(t *testing.T) {
+	server, auditSink := newTestServer(t)
+	rr := postJSON(server, server.apiConsoleHandler, apiv1.ConsolePath,
+		`{"cloud": "aws", "accountName": "prod", "roleName": "admin"}`,
+		"cookieValue")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected OK, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var console apiv1.ConsoleResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &console); err != nil {
+		t.Fatal(err)
+	}
+	if console.URL != "https://console.example.com/" {
+		t.Fatalf("unexpected console URL: %s", console.URL)
+	}
+	if len(auditSink.events) != 1 ||
+		auditSink.events[0].Action != audit.ActionConsoleURL {
+		t.Fatalf("unexpected audit events: %+v", auditSink.events)
+	}
+}
+
+func TestAPIv1BatchCredentials(t *testing.T) {
+	server, auditSink := newTestServer(t)
+	server.brokers["aws"] = testBatchBroker{}
+	rr := postJSON(server, server.apiBatchCredentialsHandler, apiv1.BatchPath,
+		`{"roles": []}`, "cookieValue")
+	decodeAPIError(t, rr, http.StatusBadRequest)
+	rr = postJSON(server, server.apiBatchCredentialsHandler, apiv1.BatchPath,
+		`{"roles": [
+			{"accountName": "prod", "roleName": "admin"},
+			{"accountName": "prod", "roleName": "broken"},
+			{"accountName": "prod", "roleName": "readonly"},
+			{"accountName": "prod", "roleName": "a b"},
+			{"accountName": "prod", "roleName": "admin"}
+		]}`, "cookieValue")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected OK, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var response apiv1.BatchCredentialsResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	expectedStatuses := []int{http.StatusOK, http.StatusInternalServerError,
+		http.StatusForbidden, http.StatusBadRequest, http.StatusOK}
+	if len(response.Results) != len(expectedStatuses) {
+		t.Fatalf("expected %d results, got %d", len(expectedStatuses),
+			len(response.Results))
+	}
+	for index, result := range response.Results {
+		if result.Status != expectedStatuses[index] {
+			t.Fatalf("result %d: expected status %d, got: %+v", index,
+				expectedStatuses[index], result)
+		}
+		if (result.Credentials != nil) != (result.Status == http.StatusOK) {
+			t.Fatalf("result %d: unexpected credentials: %+v", index, result)
+		}
+		if (result.Error == "") != (result.Status == http.StatusOK) {
+			t.Fatalf("result %d: unexpected error: %+v", index, result)
+		}
+	}
+	if response.Results[4].Credentials.AccessKeyID != "AKIATEST" {
+		t.Fatalf("unexpected credentials: %+v", response.Results[4])
+	}
+	outcomes := make(map[string]int)
+	for _, event := range auditSink.events {
+		outcomes[event.Outcome]++
+	}
+	if outcomes[audit.OutcomeSuccess] != 2 ||
+		outcomes[audit.OutcomeFailure] != 1 ||
+		outcomes[audit.OutcomeDenied] != 1 {
+		t.Fatalf("unexpected audit events: %+v", auditSink.events)
+	}
+}
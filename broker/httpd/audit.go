@@ -0,0 +1,47 @@
+package httpd
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/Cloud-Foundations/cloud-gate/broker/audit"
+)
+
+// getAuthMethod mirrors the checks in getRemoteUserName: a verified client
+// certificate takes precedence over the auth cookie.
+func getAuthMethod(r *http.Request) string {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return audit.AuthMethodClientCert
+	}
+	return audit.AuthMethodOIDCCookie
+}
+
+func getSourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (s *Server) newAuditEvent(r *http.Request, action string,
+	authUser string) *audit.Event {
+	return &audit.Event{
+		Time:       time.Now().UTC(),
+		Action:     action,
+		Username:   authUser,
+		SourceIP:   getSourceIP(r),
+		UserAgent:  r.UserAgent(),
+		AuthMethod: getAuthMethod(r),
+	}
+}
+
+func (s *Server) emitAuditEvent(event *audit.Event) {
+	if s.auditSink == nil {
+		return
+	}
+	if err := s.auditSink.Emit(event); err != nil {
+		s.logger.Printf("Failed to emit audit event: %s", err)
+	}
+}
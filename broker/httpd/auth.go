@@ -3,6 +3,7 @@ package httpd
 import (
 	"bytes"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -16,19 +17,29 @@ import (
 	"gopkg.in/square/go-jose.v2"
 	"gopkg.in/square/go-jose.v2/jwt"
 
+	"github.com/Cloud-Foundations/cloud-gate/broker/userinfo/claims"
 	"github.com/Cloud-Foundations/cloud-gate/lib/constants"
 )
 
 type oauth2StateJWT struct {
-	Issuer     string   `json:"iss,omitempty"`
-	Subject    string   `json:"sub,omitempty"`
-	Audience   []string `json:"aud,omitempty"`
-	Expiration int64    `json:"exp,omitempty"`
-	NotBefore  int64    `json:"nbf,omitempty"`
-	IssuedAt   int64    `json:"iat,omitempty"`
-	ReturnURL  string   `json:"return_url,omitempty"`
+	Issuer       string   `json:"iss,omitempty"`
+	Subject      string   `json:"sub,omitempty"`
+	Audience     []string `json:"aud,omitempty"`
+	Expiration   int64    `json:"exp,omitempty"`
+	NotBefore    int64    `json:"nbf,omitempty"`
+	IssuedAt     int64    `json:"iat,omitempty"`
+	ReturnURL    string   `json:"return_url,omitempty"`
+	Nonce        string   `json:"nonce,omitempty"`
+	CodeVerifier string   `json:"code_verifier,omitempty"`
 }
 
+const (
+	TokenAuthMethodClientSecretBasic = "client_secret_basic"
+	TokenAuthMethodClientSecretPost  = "client_secret_post"
+
+	stateKeyDerivationPrefix = "cloud-gate state:"
+)
+
 type accessToken struct {
 	AccessToken string `json:"access_token"`
 	TokenType   string `json:"token_type"`
@@ -36,6 +47,12 @@ type accessToken struct {
 	IDToken     string `json:"id_token"`
 }
 
+// userGroupsSetter is implemented by userinfo backends which learn the groups
+// of users from their sessions.
+type userGroupsSetter interface {
+	SetUserGroups(username string, groups []string, expiresAt time.Time)
+}
+
 type openidConnectUserInfo struct {
 	Subject           string `json:"sub"`
 	Name              string `json:"name"`
@@ -55,19 +72,42 @@ func randomStringGeneration() (string, error) {
 	return base64.URLEncoding.EncodeToString(bytes), nil
 }
 
-func (s *Server) setAndStoreAuthCookie(w http.ResponseWriter, username string) error {
-	randomString, err := randomStringGeneration()
+// generatePKCECodeVerifier returns a verifier made only of the unreserved
+// characters allowed by RFC 7636.
+func generatePKCECodeVerifier() (string, error) {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(bytes), nil
+}
+
+func getPKCECodeChallenge(codeVerifier string) string {
+	hash := sha256.Sum256([]byte(codeVerifier))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+func deriveStateKey(sharedSecret string) []byte {
+	key := sha256.Sum256([]byte(stateKeyDerivationPrefix + sharedSecret))
+	return key[:]
+}
+
+func (s *Server) setAndStoreAuthCookie(w http.ResponseWriter, username string,
+	groups []string) error {
+	now := time.Now()
+	expires := now.Add(time.Hour * constants.CookieExpirationHours)
+	cookieValue, err := s.sessionStore.NewSession(AuthCookie{
+		Username:  username,
+		Groups:    groups,
+		IssuedAt:  now,
+		ExpiresAt: expires,
+	})
 	if err != nil {
 		s.logger.Println(err)
 		return err
 	}
-	expires := time.Now().Add(time.Hour * constants.CookieExpirationHours)
-	userCookie := http.Cookie{Name: authCookieName, Value: randomString, Path: "/", Expires: expires, HttpOnly: true, Secure: true}
+	userCookie := http.Cookie{Name: authCookieName, Value: cookieValue, Path: "/", Expires: expires, HttpOnly: true, Secure: true}
 	http.SetCookie(w, &userCookie)
-	Cookieinfo := AuthCookie{username, userCookie.Expires}
-	s.cookieMutex.Lock()
-	s.authCookie[userCookie.Value] = Cookieinfo
-	s.cookieMutex.Unlock()
 	return nil
 }
 
@@ -75,59 +115,101 @@ func (s *Server) getRedirURL(r *http.Request) string {
 	return "https://" + r.Host + constants.Oauth2redirectPath
 }
 
-func (s *Server) generateAuthCodeURL(state string, r *http.Request) string {
+func (s *Server) generateAuthCodeURL(state string, nonce string,
+	codeVerifier string, r *http.Request) (string, error) {
+	authURL, err := s.getOpenIDAuthURL()
+	if err != nil {
+		return "", err
+	}
 	var buf bytes.Buffer
-	buf.WriteString(s.staticConfig.OpenID.AuthURL)
+	buf.WriteString(authURL)
 	redirectURL := s.getRedirURL(r)
 	v := url.Values{
 		"response_type": {"code"},
 		"client_id":     {s.staticConfig.OpenID.ClientID},
 		"scope":         {s.staticConfig.OpenID.Scopes},
 		"redirect_uri":  {redirectURL},
+		"nonce":         {nonce},
+	}
+	if codeVerifier != "" {
+		v.Set("code_challenge", getPKCECodeChallenge(codeVerifier))
+		v.Set("code_challenge_method", "S256")
 	}
 
 	if state != "" {
 		// TODO(light): Docs say never to omit state; don't allow empty.
 		v.Set("state", state)
 	}
-	if strings.Contains(s.staticConfig.OpenID.AuthURL, "?") {
+	if strings.Contains(authURL, "?") {
 		buf.WriteByte('&')
 	} else {
 		buf.WriteByte('?')
 	}
 	buf.WriteString(v.Encode())
-	return buf.String()
+	return buf.String(), nil
 }
 
-func (s *Server) generateValidStateString(r *http.Request) (string, error) {
+// The state is encrypted as well as signed, since the PKCE verifier it carries
+// must not be readable from the authorization request.
+func (s *Server) generateValidStateString(r *http.Request,
+	nonce string, codeVerifier string) (string, error) {
 	key := []byte(s.staticConfig.Base.SharedSecrets[0])
 	sig, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: key}, (&jose.SignerOptions{}).WithType("JWT"))
 	if err != nil {
 		s.logger.Debugf(1, "New jose signer error err: %s", err)
 		return "", err
 	}
+	enc, err := jose.NewEncrypter(jose.A256GCM,
+		jose.Recipient{Algorithm: jose.DIRECT,
+			Key: deriveStateKey(s.staticConfig.Base.SharedSecrets[0])},
+		(&jose.EncrypterOptions{}).WithType("JWT").WithContentType("JWT"))
+	if err != nil {
+		s.logger.Debugf(1, "New jose encrypter error err: %s", err)
+		return "", err
+	}
 	issuer := "cloud-gate"
 	subject := "state:" + constants.RedirCookieName
 	now := time.Now().Unix()
 	stateToken := oauth2StateJWT{Issuer: issuer,
-		Subject:    subject,
-		Audience:   []string{issuer},
-		ReturnURL:  r.URL.String(),
-		NotBefore:  now,
-		IssuedAt:   now,
-		Expiration: now + constants.MaxAgeSecondsRedirCookie}
-	return jwt.Signed(sig).Claims(stateToken).CompactSerialize()
+		Subject:      subject,
+		Audience:     []string{issuer},
+		ReturnURL:    r.URL.String(),
+		Nonce:        nonce,
+		CodeVerifier: codeVerifier,
+		NotBefore:    now,
+		IssuedAt:     now,
+		Expiration:   now + constants.MaxAgeSecondsRedirCookie}
+	return jwt.SignedAndEncrypted(sig, enc).Claims(stateToken).CompactSerialize()
 }
 
 // This is where the redirect to the oath2 provider is computed.
 func (s *Server) oauth2DoRedirectoToProviderHandler(w http.ResponseWriter, r *http.Request) {
-	stateString, err := s.generateValidStateString(r)
+	nonce, err := randomStringGeneration()
+	if err != nil {
+		s.logger.Println(err)
+		http.Error(w, "Internal Error ", http.StatusInternalServerError)
+		return
+	}
+	codeVerifier, err := generatePKCECodeVerifier()
+	if err != nil {
+		s.logger.Println(err)
+		http.Error(w, "Internal Error ", http.StatusInternalServerError)
+		return
+	}
+	stateString, err := s.generateValidStateString(r, nonce, codeVerifier)
 	if err != nil {
 		s.logger.Printf("Error from generateValidStateString err: %s\n", err)
 		http.Error(w, "Internal Error ", http.StatusInternalServerError)
 		return
 	}
-	http.Redirect(w, r, s.generateAuthCodeURL(stateString, r), http.StatusFound)
+	authCodeURL, err := s.generateAuthCodeURL(stateString, nonce, codeVerifier,
+		r)
+	if err != nil {
+		s.logger.Printf("Error from generateAuthCodeURL err: %s\n", err)
+		http.Error(w, "Internal Error ", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, authCodeURL, http.StatusFound)
 }
 
 // Next are the functions for checking the callback
@@ -167,17 +249,40 @@ const maxPostRetryCount = 3
 // unexpected EOF message. Since all of our uses por gettingPost bytes are idempotent we
 // implement retry logic on only this case.
 func (s *Server) getBytesFromSuccessfullPost(url string, data url.Values) ([]byte, error) {
-	return s.getBytesFromSuccessfullPostWithRetries(url, data, maxPostRetryCount)
+	return s.getBytesFromSuccessfullPostWithRetries(url, data, nil, maxPostRetryCount)
 }
 
-func (s *Server) getBytesFromSuccessfullPostWithRetries(url string, data url.Values, maxRetries int) ([]byte, error) {
+// getBytesFromSuccessfullPostWithBasicAuth is like getBytesFromSuccessfullPost,
+// with the client credentials sent using HTTP basic authentication. As
+// required by RFC 6749 section 2.3.1, they are form encoded first.
+func (s *Server) getBytesFromSuccessfullPostWithBasicAuth(postURL string,
+	data url.Values, clientID string, clientSecret string) ([]byte, error) {
+	setBasicAuth := func(req *http.Request) {
+		req.SetBasicAuth(url.QueryEscape(clientID),
+			url.QueryEscape(clientSecret))
+	}
+	return s.getBytesFromSuccessfullPostWithRetries(postURL, data,
+		setBasicAuth, maxPostRetryCount)
+}
+
+// getBytesFromSuccessfullPostWithRetries calls setAuth, unless nil, on every
+// request before sending it.
+func (s *Server) getBytesFromSuccessfullPostWithRetries(url string, data url.Values, setAuth func(*http.Request), maxRetries int) ([]byte, error) {
 	if maxRetries <= 0 {
 		return nil, fmt.Errorf("Too many reties for getBytesFromSuccessfullPostWithRetries, url=%s", url)
 	}
-	response, err := s.netClient.PostForm(url, data)
+	req, err := http.NewRequest("POST", url, strings.NewReader(data.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	if setAuth != nil {
+		setAuth(req)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	response, err := s.netClient.Do(req)
 	if err != nil {
 		if strings.Contains(err.Error(), "unexpected EOF") {
-			return s.getBytesFromSuccessfullPostWithRetries(url, data, maxRetries-1)
+			return s.getBytesFromSuccessfullPostWithRetries(url, data, setAuth, maxRetries-1)
 		}
 		s.logger.Debugf(1, "client post error err: %s\n", err)
 		return nil, err
@@ -203,8 +308,19 @@ func (s *Server) getVerifyReturnStateJWT(r *http.Request) (oauth2StateJWT, error
 	if len(serializedState) < 1 {
 		return inboundJWT, errors.New("null inbound state")
 	}
-	tok, err := jwt.ParseSigned(serializedState)
+	nestedTok, err := jwt.ParseSignedAndEncrypted(serializedState)
+	if err != nil {
+		return inboundJWT, err
+	}
+	var tok *jwt.JSONWebToken
+	for _, sharedSecret := range s.staticConfig.Base.SharedSecrets {
+		tok, err = nestedTok.Decrypt(deriveStateKey(sharedSecret))
+		if err == nil {
+			break
+		}
+	}
 	if err != nil {
+		s.logger.Debugf(1, "error decrypting state err: %s\n", err)
 		return inboundJWT, err
 	}
 	if err := s.JWTClaims(tok, &inboundJWT); err != nil {
@@ -242,14 +358,30 @@ func (s *Server) oauth2RedirectPathHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 	// OK state  is valid.. now we perform the token exchange
+	tokenURL, err := s.getOpenIDTokenURL()
+	if err != nil {
+		s.logger.Printf("Error getting token URL err: %s", err)
+		http.Error(w, "bad transaction with openic context ", http.StatusInternalServerError)
+		return
+	}
 	redirectURL := s.getRedirURL(r)
-	tokenRespBody, err := s.getBytesFromSuccessfullPost(s.staticConfig.OpenID.TokenURL,
-		url.Values{"redirect_uri": {redirectURL},
-			"code":          {authCode},
-			"grant_type":    {"authorization_code"},
-			"client_id":     {s.staticConfig.OpenID.ClientID},
-			"client_secret": {s.staticConfig.OpenID.ClientSecret},
-		})
+	tokenRequest := url.Values{"redirect_uri": {redirectURL},
+		"code":       {authCode},
+		"grant_type": {"authorization_code"},
+	}
+	if inboundJWT.CodeVerifier != "" {
+		tokenRequest.Set("code_verifier", inboundJWT.CodeVerifier)
+	}
+	var tokenRespBody []byte
+	if s.staticConfig.OpenID.TokenAuthMethod == TokenAuthMethodClientSecretBasic {
+		tokenRespBody, err = s.getBytesFromSuccessfullPostWithBasicAuth(tokenURL,
+			tokenRequest, s.staticConfig.OpenID.ClientID,
+			s.staticConfig.OpenID.ClientSecret)
+	} else {
+		tokenRequest.Set("client_id", s.staticConfig.OpenID.ClientID)
+		tokenRequest.Set("client_secret", s.staticConfig.OpenID.ClientSecret)
+		tokenRespBody, err = s.getBytesFromSuccessfullPost(tokenURL, tokenRequest)
+	}
 	if err != nil {
 		s.logger.Printf("Error getting byes fom post err: %s", err)
 		http.Error(w, "bad transaction with openic context ", http.StatusInternalServerError)
@@ -269,25 +401,79 @@ func (s *Server) oauth2RedirectPathHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	// Now we use the access_token (from token exchange) to get userinfo
-	userInfoRespBody, err := s.getBytesFromSuccessfullPost(s.staticConfig.OpenID.UserinfoURL,
-		url.Values{"access_token": {oauth2AccessToken.AccessToken}})
+	// With a provider URL we have the keys to verify the ID token, which
+	// then takes precedence over the userinfo response.
+	var idTokenUserInfo *openidConnectUserInfo
+	var groups []string
+	groupsClaim := s.staticConfig.OpenID.GroupsClaim
+	if s.oidcProvider != nil {
+		var userInfo openidConnectUserInfo
+		var rawClaims map[string]interface{}
+		_, err = s.verifyIDToken(oauth2AccessToken.IDToken, inboundJWT.Nonce,
+			&userInfo, &rawClaims)
+		if err != nil {
+			s.logger.Printf("invalid ID token err: %s", err)
+			http.Error(w, "invalid ID token ", http.StatusUnauthorized)
+			return
+		}
+		idTokenUserInfo = &userInfo
+		if groupsClaim != "" {
+			groups, _ = claims.GetGroupsFromClaim(rawClaims, groupsClaim)
+		}
+	}
+	userinfoURL, err := s.getOpenIDUserinfoURL()
 	if err != nil {
-		s.logger.Println(err)
+		s.logger.Printf("Error getting userinfo URL err: %s", err)
 		http.Error(w, "bad transaction with openic context ", http.StatusInternalServerError)
 		return
 	}
-	var userInfo openidConnectUserInfo
-	err = json.Unmarshal(userInfoRespBody, &userInfo)
-	if err != nil {
-		s.logger.Printf("Error unmarshalling userinfo ")
-		s.logger.Debugf(1, "unmarshal error %s\n", string(tokenRespBody))
-		http.Error(w, "cannot decode oath2 userinfo token ", http.StatusInternalServerError)
+	var username string
+	if idTokenUserInfo != nil {
+		username = getUsernameFromUserinfo(*idTokenUserInfo)
+	}
+	if userinfoURL != "" {
+		// Now we use the access_token (from token exchange) to get userinfo
+		userInfoRespBody, err := s.getBytesFromSuccessfullPost(userinfoURL,
+			url.Values{"access_token": {oauth2AccessToken.AccessToken}})
+		if err != nil {
+			s.logger.Println(err)
+			http.Error(w, "bad transaction with openic context ", http.StatusInternalServerError)
+			return
+		}
+		var userInfo openidConnectUserInfo
+		err = json.Unmarshal(userInfoRespBody, &userInfo)
+		if err != nil {
+			s.logger.Printf("Error unmarshalling userinfo ")
+			s.logger.Debugf(1, "unmarshal error %s\n", string(tokenRespBody))
+			http.Error(w, "cannot decode oath2 userinfo token ", http.StatusInternalServerError)
+			return
+		}
+		if idTokenUserInfo != nil && userInfo.Subject != idTokenUserInfo.Subject {
+			s.logger.Printf("userinfo subject %s does not match ID token subject %s",
+				userInfo.Subject, idTokenUserInfo.Subject)
+			http.Error(w, "invalid userinfo ", http.StatusUnauthorized)
+			return
+		}
+		if userinfoUsername := getUsernameFromUserinfo(userInfo); userinfoUsername != "" {
+			username = userinfoUsername
+		}
+		if groupsClaim != "" {
+			var rawClaims map[string]interface{}
+			if err := json.Unmarshal(userInfoRespBody, &rawClaims); err == nil {
+				if userinfoGroups, ok := claims.GetGroupsFromClaim(rawClaims,
+					groupsClaim); ok {
+					groups = userinfoGroups
+				}
+			}
+		}
+	}
+	if username == "" {
+		s.logger.Printf("no username in ID token or userinfo")
+		http.Error(w, "no username ", http.StatusUnauthorized)
 		return
 	}
-	username := getUsernameFromUserinfo(userInfo)
 
-	err = s.setAndStoreAuthCookie(w, username)
+	err = s.setAndStoreAuthCookie(w, username, groups)
 	if err != nil {
 		s.logger.Println(err)
 		http.Error(w, "cannot set auth Cookie", http.StatusInternalServerError)
@@ -318,23 +504,40 @@ func (s *Server) getRemoteUserName(w http.ResponseWriter, r *http.Request) (stri
 
 	setupSecurityHeaders(w)
 
-	remoteCookie, err := r.Cookie(authCookieName)
+	username, err := s.getSessionUserName(r)
 	if err != nil {
-		s.logger.Debugf(1, "Err cookie %s", err)
 		s.oauth2DoRedirectoToProviderHandler(w, r)
 		return "", err
 	}
-	s.cookieMutex.Lock()
-	defer s.cookieMutex.Unlock()
-	authInfo, ok := s.authCookie[remoteCookie.Value]
+	return username, nil
+}
 
-	if !ok {
-		s.oauth2DoRedirectoToProviderHandler(w, r)
-		return "", errors.New("Cookie not found")
+// getAuthenticatedUserName is like getRemoteUserName but does not redirect
+// to the identity provider, for clients which are not browsers.
+func (s *Server) getAuthenticatedUserName(r *http.Request) (string, error) {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return r.TLS.VerifiedChains[0][0].Subject.CommonName, nil
 	}
-	if authInfo.ExpiresAt.Before(time.Now()) {
-		s.oauth2DoRedirectoToProviderHandler(w, r)
-		return "", errors.New("Expired Cookie")
+	return s.getSessionUserName(r)
+}
+
+// getSessionUserName returns the user of the session in the auth cookie.
+func (s *Server) getSessionUserName(r *http.Request) (string, error) {
+	remoteCookie, err := r.Cookie(authCookieName)
+	if err != nil {
+		s.logger.Debugf(1, "Err cookie %s", err)
+		return "", err
+	}
+	authInfo, err := s.sessionStore.GetSession(remoteCookie.Value)
+	if err != nil {
+		s.logger.Debugf(1, "Err session %s", err)
+		return "", err
+	}
+	// The session may have been created by another node, so teach the
+	// userinfo backend the groups it carries.
+	if setter, ok := s.userInfo.(userGroupsSetter); ok && authInfo.Groups != nil {
+		setter.SetUserGroups(authInfo.Username, authInfo.Groups,
+			authInfo.ExpiresAt)
 	}
 	return authInfo.Username, nil
 }
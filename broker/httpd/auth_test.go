@@ -18,13 +18,14 @@ func TestOauth2RedirectHandlerSucccess(t *testing.T) {
 		logger:       testlogger.New(t),
 		staticConfig: &staticconfiguration.StaticConfiguration{},
 	}
-	server.authCookie = make(map[string]AuthCookie)
+	sessionStore := newMemorySessionStore()
+	server.sessionStore = sessionStore
 	server.staticConfig.Base.SharedSecrets = []string{"secret"}
 	req, err := http.NewRequest("GET", "/", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
-	stateString, err := server.generateValidStateString(req)
+	stateString, err := server.generateValidStateString(req, "", "")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -59,7 +60,8 @@ func TestGetRemoteUserNameHandler(t *testing.T) {
 		logger:       testlogger.New(t),
 		staticConfig: &staticconfiguration.StaticConfiguration{},
 	}
-	server.authCookie = make(map[string]AuthCookie)
+	sessionStore := newMemorySessionStore()
+	server.sessionStore = sessionStore
 	server.staticConfig.Base.SharedSecrets = []string{"secret"}
 	// Test with no cookies... inmediate redirect
 	urlList := []string{"/", "/static/foo"}
@@ -99,8 +101,8 @@ func TestGetRemoteUserNameHandler(t *testing.T) {
 		}, http.StatusFound)
 	//now succeed with known cookie
 	expires := time.Now().Add(time.Hour * constants.CookieExpirationHours)
-	Cookieinfo := AuthCookie{"username", expires}
-	server.authCookie[cookieVal] = Cookieinfo
+	Cookieinfo := AuthCookie{Username: "username", ExpiresAt: expires}
+	sessionStore.sessions[cookieVal] = Cookieinfo
 	knownCookieReq, err := http.NewRequest("GET", "/", nil)
 	if err != nil {
 		t.Fatal(err)
@@ -116,8 +118,8 @@ func TestGetRemoteUserNameHandler(t *testing.T) {
 		}, http.StatusFound)
 	//now fail with expired cookie
 	expired := time.Now().Add(-1 * time.Hour * constants.CookieExpirationHours)
-	Cookieinfo = AuthCookie{"username", expired}
-	server.authCookie[cookieVal] = Cookieinfo
+	Cookieinfo = AuthCookie{Username: "username", ExpiresAt: expired}
+	sessionStore.sessions[cookieVal] = Cookieinfo
 	expiredCookieReq, err := http.NewRequest("GET", "/", nil)
 	if err != nil {
 		t.Fatal(err)
@@ -0,0 +1,229 @@
+package httpd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/Cloud-Foundations/cloud-gate/broker"
+	"github.com/Cloud-Foundations/cloud-gate/broker/audit"
+	"github.com/Cloud-Foundations/cloud-gate/broker/configuration"
+	"github.com/Cloud-Foundations/keymaster/lib/instrumentedwriter"
+)
+
+// bcrypt ignores anything beyond 72 bytes.
+const maxBreakGlassSecretLength = 72
+
+var (
+	breakGlassUse = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cloudgate_break_glass_use_counter",
+			Help: "Credentials issued through break-glass access",
+		},
+		[]string{"cloud", "account", "role"},
+	)
+	breakGlassFailure = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cloudgate_break_glass_failure_counter",
+			Help: "Rejected break-glass access attempts",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(breakGlassUse)
+	prometheus.MustRegister(breakGlassFailure)
+}
+
+// getClientCertUsername returns the user of a verified client certificate,
+// or an empty string.
+func getClientCertUsername(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) < 1 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
+
+// findBreakGlassUser returns the break-glass entry for the user which grants
+// the role, or nil. Entries without a cloud are for defaultCloudName.
+func findBreakGlassUser(config *configuration.Configuration,
+	defaultCloudName string, username string, cloudName string,
+	accountName string, roleName string) *configuration.BreakGlassUser {
+	if config == nil {
+		return nil
+	}
+	for index := range config.BreakGlass {
+		entry := &config.BreakGlass[index]
+		entryCloud := entry.Cloud
+		if entryCloud == "" {
+			entryCloud = defaultCloudName
+		}
+		if entry.Username != username || entryCloud != cloudName ||
+			entry.Account != accountName {
+			continue
+		}
+		for _, role := range entry.Roles {
+			if role == roleName {
+				return entry
+			}
+		}
+	}
+	return nil
+}
+
+// getBreakGlassConsoleURL bypasses the grants and userinfo lookups of the
+// broker where it can.
+func getBreakGlassConsoleURL(cloudBroker broker.Broker, accountName string,
+	roleName string, username string, issuerURL string) (string, error) {
+	if issuer, ok := cloudBroker.(broker.BreakGlassIssuer); ok {
+		return issuer.GetBreakGlassConsoleURL(accountName, roleName, username,
+			issuerURL)
+	}
+	return cloudBroker.GetConsoleURLForAccountRole(accountName, roleName,
+		username, issuerURL)
+}
+
+// generateBreakGlassTokenCredentials bypasses the grants and userinfo
+// lookups of the broker where it can.
+func generateBreakGlassTokenCredentials(cloudBroker broker.Broker,
+	accountName string, roleName string, username string) (
+	*broker.AWSCredentialsJSON, error) {
+	if issuer, ok := cloudBroker.(broker.BreakGlassIssuer); ok {
+		return issuer.GenerateBreakGlassTokenCredentials(accountName,
+			roleName, username)
+	}
+	return cloudBroker.GenerateTokenCredentials(accountName, roleName,
+		username, 0)
+}
+
+func (s *Server) displayBreakGlassForm(w http.ResponseWriter, authUser string,
+	errorMessage string) {
+	displayData := breakGlassPageTemplateData{
+		Title:        "Cloud-Gate break-glass access",
+		AuthUsername: authUser,
+		ErrorMessage: errorMessage,
+		Clouds:       s.getCloudNames(),
+	}
+	err := s.htmlTemplate.ExecuteTemplate(w, "breakGlassPage", displayData)
+	if err != nil {
+		s.logger.Printf("Failed to execute %v", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+	}
+}
+
+// breakGlassHandler issues console URLs or credentials to the break-glass
+// users declared in the accounts configuration, without consulting userinfo.
+// It requires a client certificate and the break-glass secret of the user.
+func (s *Server) breakGlassHandler(w http.ResponseWriter, r *http.Request) {
+	setupSecurityHeaders(w)
+	authUser := getClientCertUsername(r)
+	if authUser == "" {
+		http.Error(w, "A client certificate is required", http.StatusForbidden)
+		return
+	}
+	w.(*instrumentedwriter.LoggingWriter).SetUsername(authUser)
+	switch r.Method {
+	case "GET":
+		s.displayBreakGlassForm(w, authUser, "")
+		return
+	case "POST":
+		if err := r.ParseForm(); err != nil {
+			s.logger.Println(err)
+			http.Error(w, "Error parsing form", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+	validatedParams, err := s.getVerifyFormValues(r,
+		[]string{"accountName", "roleName"}, "^[A-Za-z0-9_.-]{2,40}$")
+	if err != nil {
+		s.logger.Println(err)
+		http.Error(w, "Error parsing form", http.StatusBadRequest)
+		return
+	}
+	accountName := validatedParams["accountName"][0]
+	roleName := validatedParams["roleName"][0]
+	cloudName, cloudBroker, err := s.getBrokerFromForm(r)
+	if err != nil {
+		s.logger.Println(err)
+		http.Error(w, "Invalid cloud", http.StatusBadRequest)
+		return
+	}
+	secret := r.Form.Get("secret")
+	if len(secret) > maxBreakGlassSecretLength {
+		http.Error(w, "Error parsing form", http.StatusBadRequest)
+		return
+	}
+	isToken := r.Form.Get("mode") == "genToken"
+	auditEvent := s.newAuditEvent(r, audit.ActionBreakGlass, authUser)
+	auditEvent.Cloud = cloudName
+	auditEvent.Account = accountName
+	auditEvent.Role = roleName
+	entry := findBreakGlassUser(s.config, s.defaultCloudName, authUser,
+		cloudName, accountName, roleName)
+	if entry == nil || secret == "" || bcrypt.CompareHashAndPassword(
+		[]byte(entry.SecretHash), []byte(secret)) != nil {
+		breakGlassFailure.Inc()
+		s.logger.Printf("BREAK-GLASS: rejected %s for %s/%s/%s", authUser,
+			cloudName, accountName, roleName)
+		auditEvent.Outcome = audit.OutcomeDenied
+		s.emitAuditEvent(auditEvent)
+		w.WriteHeader(http.StatusForbidden)
+		s.displayBreakGlassForm(w, authUser, "Access denied")
+		return
+	}
+	s.logger.Printf("BREAK-GLASS: %s is using %s/%s/%s", authUser, cloudName,
+		accountName, roleName)
+	var destURL string
+	var credentials []byte
+	if isToken {
+		auditEvent.Message = "break-glass token credentials"
+		tempCredentials, err := generateBreakGlassTokenCredentials(
+			cloudBroker, accountName, roleName, authUser)
+		if err == nil {
+			auditEvent.AccessKeyID = tempCredentials.SessionId
+			credentials, err = json.MarshalIndent(tempCredentials, "", "  ")
+		}
+		if err != nil {
+			s.failBreakGlass(w, auditEvent, err)
+			return
+		}
+	} else {
+		auditEvent.Message = "break-glass console access"
+		issuerURL := fmt.Sprintf("https://%s%s", r.Host, r.URL.Path)
+		destURL, err = getBreakGlassConsoleURL(cloudBroker, accountName,
+			roleName, authUser, issuerURL)
+		if err != nil {
+			s.failBreakGlass(w, auditEvent, err)
+			return
+		}
+	}
+	breakGlassUse.WithLabelValues(cloudName, accountName, roleName).Inc()
+	auditEvent.Outcome = audit.OutcomeSuccess
+	s.emitAuditEvent(auditEvent)
+	if !isToken {
+		http.Redirect(w, r, destURL, http.StatusFound)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(credentials); err != nil {
+		s.logger.Printf("Write Error: %v", err)
+	}
+}
+
+func (s *Server) failBreakGlass(w http.ResponseWriter,
+	auditEvent *audit.Event, err error) {
+	s.logger.Printf("BREAK-GLASS: failed for %s on %s/%s/%s: %s",
+		auditEvent.Username, auditEvent.Cloud, auditEvent.Account,
+		auditEvent.Role, err)
+	auditEvent.Outcome = audit.OutcomeFailure
+	auditEvent.Message = err.Error()
+	s.emitAuditEvent(auditEvent)
+	http.Error(w, "Failed to get access for account/role", http.StatusInternalServerError)
+}
@@ -0,0 +1,215 @@
+package httpd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/Cloud-Foundations/cloud-gate/broker"
+	"github.com/Cloud-Foundations/cloud-gate/broker/audit"
+	"github.com/Cloud-Foundations/cloud-gate/broker/configuration"
+	"github.com/Cloud-Foundations/cloud-gate/broker/grants"
+	"github.com/Cloud-Foundations/keymaster/lib/instrumentedwriter"
+)
+
+// failingUserInfo is a userinfo backend which is unavailable.
+type failingUserInfo struct{}
+
+func (failingUserInfo) GetUserGroups(string) ([]string, error) {
+	return nil, errors.New("userinfo unavailable")
+}
+
+// testUserInfoBroker consults userinfo like the AWS broker does, except when
+// issuing break-glass access.
+type testUserInfoBroker struct {
+	testBroker
+	userInfo failingUserInfo
+}
+
+func (b testUserInfoBroker) IsUserAllowedToAssumeRole(username, accountName,
+	roleName string) (bool, error) {
+	_, err := b.userInfo.GetUserGroups(username)
+	return false, err
+}
+
+func (b testUserInfoBroker) GetConsoleURLForAccountRole(accountName, roleName,
+	username, issuerURL string) (string, error) {
+	_, err := b.userInfo.GetUserGroups(username)
+	return "", err
+}
+
+func (b testUserInfoBroker) GenerateTokenCredentials(accountName, roleName,
+	username string, duration time.Duration) (
+	*broker.AWSCredentialsJSON, error) {
+	_, err := b.userInfo.GetUserGroups(username)
+	return nil, err
+}
+
+func (b testUserInfoBroker) GetBreakGlassConsoleURL(accountName, roleName,
+	username, issuerURL string) (string, error) {
+	return b.testBroker.GetConsoleURLForAccountRole(accountName, roleName,
+		username, issuerURL)
+}
+
+func (b testUserInfoBroker) GenerateBreakGlassTokenCredentials(accountName,
+	roleName, username string) (*broker.AWSCredentialsJSON, error) {
+	return b.testBroker.GenerateTokenCredentials(accountName, roleName,
+		username, 0)
+}
+
+func newTestBreakGlassServer(t *testing.T) (*Server, *testAuditSink) {
+	server, auditSink := newTestServer(t)
+	secretHash, err := bcrypt.GenerateFromPassword([]byte("open sesame"),
+		bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.config = &configuration.Configuration{
+		BreakGlass: []configuration.BreakGlassUser{{
+			Username:   "oncall",
+			Account:    "prod",
+			Roles:      []string{"admin"},
+			SecretHash: string(secretHash),
+		}},
+	}
+	server.htmlTemplate = template.Must(template.New("main").Parse(
+		`{{define "header_extra"}}{{end}}{{define "footer_extra"}}{{end}}`))
+	for _, text := range []string{headerTemplateText, footerTemplateText,
+		breakGlassPageTemplateText} {
+		template.Must(server.htmlTemplate.Parse(text))
+	}
+	return server, auditSink
+}
+
+func postBreakGlass(server *Server, form url.Values,
+	certUsername string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/breakglass?"+form.Encode(), nil)
+	if certUsername != "" {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: certUsername}}
+		req.TLS = &tls.ConnectionState{
+			VerifiedChains: [][]*x509.Certificate{{cert}},
+		}
+	}
+	rr := httptest.NewRecorder()
+	instrumentedwriter.NewLoggingHandler(
+		http.HandlerFunc(server.breakGlassHandler),
+		httpLogger{}).ServeHTTP(rr, req)
+	return rr
+}
+
+func TestFindBreakGlassUser(t *testing.T) {
+	config := &configuration.Configuration{
+		BreakGlass: []configuration.BreakGlassUser{
+			{Username: "oncall", Account: "prod", Roles: []string{"admin"}},
+			{Username: "oncall", Cloud: "gcp", Account: "core-dev",
+				Roles: []string{"viewer"}},
+		},
+	}
+	if findBreakGlassUser(config, "aws", "oncall", "aws", "prod", "admin") == nil {
+		t.Fatal("expected entry for default cloud")
+	}
+	if findBreakGlassUser(config, "aws", "oncall", "gcp", "core-dev",
+		"viewer") == nil {
+		t.Fatal("expected entry for gcp")
+	}
+	if findBreakGlassUser(config, "aws", "oncall", "gcp", "prod", "admin") != nil {
+		t.Fatal("unexpected entry for wrong cloud")
+	}
+	if findBreakGlassUser(config, "aws", "other", "aws", "prod", "admin") != nil {
+		t.Fatal("unexpected entry for wrong user")
+	}
+	if findBreakGlassUser(config, "aws", "oncall", "aws", "prod", "poweruser") != nil {
+		t.Fatal("unexpected entry for wrong role")
+	}
+	if findBreakGlassUser(nil, "aws", "oncall", "aws", "prod", "admin") != nil {
+		t.Fatal("unexpected entry without configuration")
+	}
+}
+
+func TestBreakGlassHandler(t *testing.T) {
+	server, auditSink := newTestBreakGlassServer(t)
+	form := url.Values{"accountName": {"prod"}, "roleName": {"admin"},
+		"mode": {"genToken"}, "secret": {"open sesame"}}
+	rr := postBreakGlass(server, form, "")
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("no certificate: expected: %d, got: %d",
+			http.StatusForbidden, rr.Code)
+	}
+	rr = postBreakGlass(server, form, "user1")
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("wrong user: expected: %d, got: %d",
+			http.StatusForbidden, rr.Code)
+	}
+	form.Set("secret", "wrong")
+	rr = postBreakGlass(server, form, "oncall")
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("wrong secret: expected: %d, got: %d",
+			http.StatusForbidden, rr.Code)
+	}
+	form.Set("secret", "open sesame")
+	rr = postBreakGlass(server, form, "oncall")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("valid request: expected: %d, got: %d",
+			http.StatusOK, rr.Code)
+	}
+	if len(auditSink.events) != 3 {
+		t.Fatalf("expected 3 audit events, got: %d", len(auditSink.events))
+	}
+	for index, event := range auditSink.events[:2] {
+		if event.Action != audit.ActionBreakGlass ||
+			event.Outcome != audit.OutcomeDenied {
+			t.Fatalf("event %d: unexpected: %+v", index, event)
+		}
+	}
+	event := auditSink.events[2]
+	if event.Outcome != audit.OutcomeSuccess || event.Username != "oncall" ||
+		event.AccessKeyID != "AKIATEST" {
+		t.Fatalf("unexpected success event: %+v", event)
+	}
+	form.Set("mode", "console")
+	rr = postBreakGlass(server, form, "oncall")
+	if rr.Code != http.StatusFound {
+		t.Fatalf("console request: expected: %d, got: %d",
+			http.StatusFound, rr.Code)
+	}
+}
+
+func TestBreakGlassWithoutUserInfo(t *testing.T) {
+	server, auditSink := newTestBreakGlassServer(t)
+	server.userInfo = failingUserInfo{}
+	store, err := grants.NewStore(filepath.Join(t.TempDir(), "grants.json"),
+		server.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.brokers["aws"] = grants.NewBroker(testUserInfoBroker{}, "aws",
+		store)
+	form := url.Values{"accountName": {"prod"}, "roleName": {"admin"},
+		"mode": {"genToken"}, "secret": {"open sesame"}}
+	rr := postBreakGlass(server, form, "oncall")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("token request: expected: %d, got: %d", http.StatusOK,
+			rr.Code)
+	}
+	form.Set("mode", "console")
+	rr = postBreakGlass(server, form, "oncall")
+	if rr.Code != http.StatusFound {
+		t.Fatalf("console request: expected: %d, got: %d",
+			http.StatusFound, rr.Code)
+	}
+	for index, event := range auditSink.events {
+		if event.Outcome != audit.OutcomeSuccess {
+			t.Fatalf("event %d: unexpected: %+v", index, event)
+		}
+	}
+}
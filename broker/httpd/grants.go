@@ -0,0 +1,342 @@
+package httpd
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Cloud-Foundations/cloud-gate/broker"
+	"github.com/Cloud-Foundations/cloud-gate/broker/audit"
+	"github.com/Cloud-Foundations/cloud-gate/broker/grants"
+	"github.com/Cloud-Foundations/keymaster/lib/instrumentedwriter"
+)
+
+const maxJustificationLength = 512
+
+// isSameOrigin protects the forms which change state from cross-site
+// requests, since browsers send the auth cookie with those. Clients which
+// are not browsers send neither header.
+func isSameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Header.Get("Referer")
+	}
+	if origin == "" {
+		return true
+	}
+	originURL, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return originURL.Host == r.Host
+}
+
+func (s *Server) isGrantApprover(username string) (bool, error) {
+	if len(s.staticConfig.Grants.ApproverGroups) < 1 {
+		return false, nil
+	}
+	userGroups, err := s.userInfo.GetUserGroups(username)
+	if err != nil {
+		return false, err
+	}
+	return len(broker.StringIntersectionNoDups(userGroups,
+		s.staticConfig.Grants.ApproverGroups)) > 0, nil
+}
+
+// isConfiguredAccount checks the accounts in the configuration, which do
+// not include those which the broker discovers.
+func (s *Server) isConfiguredAccount(cloudName string, accountName string) bool {
+	if s.config == nil {
+		return false
+	}
+	for _, name := range s.config.GetAccountNames(cloudName) {
+		if name == accountName {
+			return true
+		}
+	}
+	return false
+}
+
+// getAccountRoleName returns the name by which the broker knows the role of
+// the account, so that grants match the role names which are later assumed.
+// It returns false if the broker does not know the account or the role.
+func (s *Server) getAccountRoleName(cloudBroker broker.Broker,
+	cloudName string, accountName string, roleName string) (string, bool) {
+	getter, ok := cloudBroker.(broker.AccountRolesGetter)
+	if !ok {
+		return roleName, s.isConfiguredAccount(cloudName, accountName)
+	}
+	roleNames, err := getter.GetAccountRoles(accountName)
+	if err != nil {
+		s.logger.Printf("Cannot get roles of account %s: %s", accountName,
+			err)
+		return "", false
+	}
+	for _, name := range roleNames {
+		if strings.EqualFold(name, roleName) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+func newGrantTemplateData(grant grants.Grant) grantTemplateData {
+	data := grantTemplateData{
+		ID:            grant.ID,
+		Username:      grant.Username,
+		Cloud:         grant.Cloud,
+		Account:       grant.Account,
+		Role:          grant.Role,
+		Hours:         int(grant.Duration / time.Hour),
+		Justification: grant.Justification,
+		Status:        grant.GetStatus(),
+		Approver:      grant.Approver,
+		RequestedAt:   grant.RequestedAt.UTC().Format(time.RFC3339),
+	}
+	if !grant.ExpiresAt.IsZero() {
+		data.ExpiresAt = grant.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+	return data
+}
+
+func (s *Server) grantsHandler(w http.ResponseWriter, r *http.Request) {
+	authUser, err := s.getRemoteUserName(w, r)
+	if err != nil {
+		return
+	}
+	w.(*instrumentedwriter.LoggingWriter).SetUsername(authUser)
+	if r.Method != "GET" {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+	isApprover, err := s.isGrantApprover(authUser)
+	if err != nil {
+		s.logger.Printf("Failure checking approver permissions: %s", err)
+		http.Error(w, "Error getting user permissions.", http.StatusInternalServerError)
+		return
+	}
+	displayData := grantsPageTemplateData{
+		Title:        "Cloud-Gate elevated access",
+		AuthUsername: authUser,
+		Clouds:       s.getCloudNames(),
+		MaxHours:     int(s.staticConfig.Grants.MaxDuration / time.Hour),
+		IsApprover:   isApprover,
+	}
+	for _, grant := range s.grantStore.ListUserGrants(authUser) {
+		displayData.UserGrants = append(displayData.UserGrants,
+			newGrantTemplateData(grant))
+	}
+	if isApprover {
+		for _, grant := range s.grantStore.ListPendingGrants() {
+			displayData.PendingGrants = append(displayData.PendingGrants,
+				newGrantTemplateData(grant))
+		}
+	}
+	switch s.getPreferredAcceptType(r) {
+	case "text/html":
+		err = s.htmlTemplate.ExecuteTemplate(w, "grantsPage", displayData)
+		if err != nil {
+			s.logger.Printf("Failed to execute %v", err)
+			http.Error(w, "error", http.StatusInternalServerError)
+			return
+		}
+	default:
+		displayData.Title = ""
+		displayData.Clouds = nil
+		b, err := json.MarshalIndent(displayData, "", "  ")
+		if err != nil {
+			s.logger.Printf("Failed marshal %v", err)
+			http.Error(w, "error", http.StatusInternalServerError)
+			return
+		}
+		if _, err := w.Write(b); err != nil {
+			s.logger.Printf("Incomplete write? %v", err)
+		}
+	}
+}
+
+// writeGrant sends browsers back to the grants page and other clients the
+// grant.
+func (s *Server) writeGrant(w http.ResponseWriter, r *http.Request,
+	grant grants.Grant) {
+	if s.getPreferredAcceptType(r) == "text/html" {
+		http.Redirect(w, r, "/grants", http.StatusFound)
+		return
+	}
+	b, err := json.MarshalIndent(newGrantTemplateData(grant), "", "  ")
+	if err != nil {
+		s.logger.Printf("Failed marshal %v", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	if _, err := w.Write(b); err != nil {
+		s.logger.Printf("Incomplete write? %v", err)
+	}
+}
+
+func (s *Server) requestGrantHandler(w http.ResponseWriter, r *http.Request) {
+	authUser, err := s.getRemoteUserName(w, r)
+	if err != nil {
+		return
+	}
+	w.(*instrumentedwriter.LoggingWriter).SetUsername(authUser)
+	if r.Method != "POST" {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isSameOrigin(r) {
+		http.Error(w, "Cross-origin request", http.StatusForbidden)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		s.logger.Println(err)
+		http.Error(w, "Error parsing form", http.StatusBadRequest)
+		return
+	}
+	validatedParams, err := s.getVerifyFormValues(r,
+		[]string{"accountName", "roleName"}, "^[A-Za-z0-9_.-]{2,40}$")
+	if err != nil {
+		s.logger.Println(err)
+		http.Error(w, "Error parsing form", http.StatusBadRequest)
+		return
+	}
+	hoursParams, err := s.getVerifyFormValues(r, []string{"hours"},
+		"^[0-9]{1,4}$")
+	if err != nil {
+		s.logger.Println(err)
+		http.Error(w, "Error parsing form", http.StatusBadRequest)
+		return
+	}
+	hours, _ := strconv.Atoi(hoursParams["hours"][0])
+	duration := time.Duration(hours) * time.Hour
+	if duration <= 0 || duration > s.staticConfig.Grants.MaxDuration {
+		http.Error(w, "Invalid duration", http.StatusBadRequest)
+		return
+	}
+	justification := r.Form.Get("justification")
+	if justification == "" || len(justification) > maxJustificationLength {
+		http.Error(w, "A justification is required", http.StatusBadRequest)
+		return
+	}
+	cloudName, cloudBroker, err := s.getBrokerFromForm(r)
+	if err != nil {
+		s.logger.Println(err)
+		http.Error(w, "Invalid cloud", http.StatusBadRequest)
+		return
+	}
+	accountName := validatedParams["accountName"][0]
+	roleName, ok := s.getAccountRoleName(cloudBroker, cloudName, accountName,
+		validatedParams["roleName"][0])
+	if !ok {
+		http.Error(w, "Invalid account or role", http.StatusBadRequest)
+		return
+	}
+	auditEvent := s.newAuditEvent(r, audit.ActionRequestGrant, authUser)
+	auditEvent.Cloud = cloudName
+	auditEvent.Account = accountName
+	auditEvent.Role = roleName
+	auditEvent.Message = justification
+	grant, err := s.grantStore.RequestGrant(authUser, cloudName, accountName,
+		auditEvent.Role, duration, justification)
+	if err != nil {
+		s.logger.Printf("Failed to record grant request: %s", err)
+		auditEvent.Outcome = audit.OutcomeFailure
+		auditEvent.Message = err.Error()
+		s.emitAuditEvent(auditEvent)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	auditEvent.GrantID = grant.ID
+	auditEvent.Outcome = audit.OutcomeSuccess
+	s.emitAuditEvent(auditEvent)
+	s.writeGrant(w, r, grant)
+}
+
+// decideGrantHandler approves or denies a pending request. Approvers decide
+// on the requests of others, and users may withdraw their own.
+func (s *Server) decideGrantHandler(w http.ResponseWriter, r *http.Request) {
+	authUser, err := s.getRemoteUserName(w, r)
+	if err != nil {
+		return
+	}
+	w.(*instrumentedwriter.LoggingWriter).SetUsername(authUser)
+	if r.Method != "POST" {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isSameOrigin(r) {
+		http.Error(w, "Cross-origin request", http.StatusForbidden)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		s.logger.Println(err)
+		http.Error(w, "Error parsing form", http.StatusBadRequest)
+		return
+	}
+	validatedParams, err := s.getVerifyFormValues(r, []string{"id"},
+		"^[0-9a-f]{32}$")
+	if err != nil {
+		s.logger.Println(err)
+		http.Error(w, "Error parsing form", http.StatusBadRequest)
+		return
+	}
+	grant, err := s.grantStore.GetGrant(validatedParams["id"][0])
+	if err != nil {
+		http.Error(w, "Unknown grant", http.StatusNotFound)
+		return
+	}
+	action := audit.ActionDenyGrant
+	decide := s.grantStore.DenyGrant
+	if r.URL.Path == "/grants/approve" {
+		action = audit.ActionApproveGrant
+		decide = s.grantStore.ApproveGrant
+	}
+	auditEvent := s.newAuditEvent(r, action, authUser)
+	auditEvent.TargetUser = grant.Username
+	auditEvent.Cloud = grant.Cloud
+	auditEvent.Account = grant.Account
+	auditEvent.Role = grant.Role
+	auditEvent.GrantID = grant.ID
+	isApprover, err := s.isGrantApprover(authUser)
+	if err != nil {
+		s.logger.Printf("Failure checking approver permissions: %s", err)
+		http.Error(w, "Error getting user permissions.", http.StatusInternalServerError)
+		return
+	}
+	isWithdrawal := action == audit.ActionDenyGrant &&
+		grant.Username == authUser
+	if !isApprover && !isWithdrawal {
+		auditEvent.Outcome = audit.OutcomeDenied
+		s.emitAuditEvent(auditEvent)
+		http.Error(w, "Not an approver", http.StatusForbidden)
+		return
+	}
+	grant, err = decide(grant.ID, authUser)
+	if err != nil {
+		auditEvent.Message = err.Error()
+		switch {
+		case errors.Is(err, grants.ErrSelfApproval):
+			auditEvent.Outcome = audit.OutcomeDenied
+			s.emitAuditEvent(auditEvent)
+			http.Error(w, err.Error(), http.StatusForbidden)
+		case errors.Is(err, grants.ErrNotPending):
+			auditEvent.Outcome = audit.OutcomeFailure
+			s.emitAuditEvent(auditEvent)
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			s.logger.Printf("Failed to decide grant %s: %s", auditEvent.GrantID,
+				err)
+			auditEvent.Outcome = audit.OutcomeFailure
+			s.emitAuditEvent(auditEvent)
+			http.Error(w, "error", http.StatusInternalServerError)
+		}
+		return
+	}
+	auditEvent.Outcome = audit.OutcomeSuccess
+	s.emitAuditEvent(auditEvent)
+	s.writeGrant(w, r, grant)
+}
@@ -0,0 +1,172 @@
+package httpd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/cloud-gate/broker/audit"
+	"github.com/Cloud-Foundations/cloud-gate/broker/configuration"
+	"github.com/Cloud-Foundations/cloud-gate/broker/grants"
+	"github.com/Cloud-Foundations/keymaster/lib/instrumentedwriter"
+)
+
+func newTestGrantsServer(t *testing.T) (*Server, *testAuditSink) {
+	server, auditSink := newTestServer(t)
+	store, err := grants.NewStore(filepath.Join(t.TempDir(), "grants.json"),
+		server.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.grantStore = store
+	server.brokers["aws"] = grants.NewBroker(server.brokers["aws"], "aws",
+		store)
+	server.config = &configuration.Configuration{}
+	server.config.AWS.Account = []configuration.AWSAccount{{Name: "prod"}}
+	server.staticConfig.Grants.ApproverGroups = []string{"cloud-gate-admins"}
+	server.staticConfig.Grants.MaxDuration = 12 * time.Hour
+	server.sessionStore.(*memorySessionStore).sessions["adminCookie"] =
+		AuthCookie{Username: "admin1", ExpiresAt: time.Now().Add(time.Hour)}
+	return server, auditSink
+}
+
+func postForm(server *Server, handler http.HandlerFunc, path string,
+	form url.Values, cookieValue string,
+	origin string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", path+"?"+form.Encode(), nil)
+	req.AddCookie(&http.Cookie{Name: authCookieName, Value: cookieValue})
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	rr := httptest.NewRecorder()
+	instrumentedwriter.NewLoggingHandler(handler,
+		httpLogger{}).ServeHTTP(rr, req)
+	return rr
+}
+
+func TestGrantRequestAndApproval(t *testing.T) {
+	server, auditSink := newTestGrantsServer(t)
+	request := url.Values{"accountName": {"prod"}, "roleName": {"poweruser"},
+		"hours": {"2"}, "justification": {"incident 42"}}
+	rr := postForm(server, server.requestGrantHandler, "/grants/request",
+		request, "cookieValue", "https://evil.example.com")
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("cross-origin request: expected: %d, got: %d",
+			http.StatusForbidden, rr.Code)
+	}
+	request.Set("hours", "13")
+	rr = postForm(server, server.requestGrantHandler, "/grants/request",
+		request, "cookieValue", "")
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("long request: expected: %d, got: %d",
+			http.StatusBadRequest, rr.Code)
+	}
+	request.Set("hours", "2")
+	request.Set("roleName", "owner")
+	rr = postForm(server, server.requestGrantHandler, "/grants/request",
+		request, "cookieValue", "")
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("unknown role: expected: %d, got: %d",
+			http.StatusBadRequest, rr.Code)
+	}
+	request.Set("roleName", "PowerUser")
+	rr = postForm(server, server.requestGrantHandler, "/grants/request",
+		request, "cookieValue", "https://example.com")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("request: expected: %d, got: %d", http.StatusOK, rr.Code)
+	}
+	pending := server.grantStore.ListPendingGrants()
+	if len(pending) != 1 {
+		t.Fatalf("expected one pending grant, got: %d", len(pending))
+	}
+	if pending[0].Role != "poweruser" {
+		t.Fatalf("expected role: poweruser, got: %s", pending[0].Role)
+	}
+	decision := url.Values{"id": {pending[0].ID}}
+	rr = postForm(server, server.decideGrantHandler, "/grants/approve",
+		decision, "cookieValue", "")
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("self approval: expected: %d, got: %d",
+			http.StatusForbidden, rr.Code)
+	}
+	rr = postForm(server, server.decideGrantHandler, "/grants/approve",
+		decision, "adminCookie", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("approval: expected: %d, got: %d", http.StatusOK, rr.Code)
+	}
+	rr = serveAuthenticated(server, server.getConsoleUrlHandler,
+		"/getconsole?accountName=prod&roleName=poweruser")
+	if rr.Code != http.StatusFound {
+		t.Fatalf("granted role: expected: %d, got: %d", http.StatusFound,
+			rr.Code)
+	}
+	var actions []string
+	for _, event := range auditSink.events {
+		actions = append(actions, event.Action+":"+event.Outcome)
+	}
+	expected := []string{
+		audit.ActionRequestGrant + ":" + audit.OutcomeSuccess,
+		audit.ActionApproveGrant + ":" + audit.OutcomeDenied,
+		audit.ActionApproveGrant + ":" + audit.OutcomeSuccess,
+		audit.ActionConsoleURL + ":" + audit.OutcomeSuccess,
+	}
+	if len(actions) != len(expected) {
+		t.Fatalf("expected: %v, got: %v", expected, actions)
+	}
+	for index := range expected {
+		if actions[index] != expected[index] {
+			t.Fatalf("expected: %v, got: %v", expected, actions)
+		}
+	}
+	approval := auditSink.events[2]
+	if approval.TargetUser != "user1" || approval.GrantID != pending[0].ID ||
+		approval.Role != "poweruser" {
+		t.Fatalf("unexpected approval event: %+v", approval)
+	}
+}
+
+func TestGrantRequestDiscoveredAccount(t *testing.T) {
+	server, _ := newTestGrantsServer(t)
+	// The broker knows accounts which are not in the configuration, such as
+	// those of an AWS Organization.
+	server.config.AWS.Account = nil
+	request := url.Values{"accountName": {"prod"}, "roleName": {"admin"},
+		"hours": {"2"}, "justification": {"incident 42"}}
+	rr := postForm(server, server.requestGrantHandler, "/grants/request",
+		request, "cookieValue", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("discovered account: expected: %d, got: %d", http.StatusOK,
+			rr.Code)
+	}
+	request.Set("accountName", "staging")
+	rr = postForm(server, server.requestGrantHandler, "/grants/request",
+		request, "cookieValue", "")
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("unknown account: expected: %d, got: %d",
+			http.StatusBadRequest, rr.Code)
+	}
+}
+
+func TestGrantApproverGroups(t *testing.T) {
+	server, _ := newTestGrantsServer(t)
+	server.userInfo = testUserInfo{"admin1": {"other-group"}}
+	grant, err := server.grantStore.RequestGrant("user1", "aws", "prod",
+		"poweruser", time.Hour, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := postForm(server, server.decideGrantHandler, "/grants/approve",
+		url.Values{"id": {grant.ID}}, "adminCookie", "")
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("expected: %d, got: %d", http.StatusForbidden, rr.Code)
+	}
+	// Users may withdraw their own requests.
+	rr = postForm(server, server.decideGrantHandler, "/grants/deny",
+		url.Values{"id": {grant.ID}}, "cookieValue", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected: %d, got: %d", http.StatusOK, rr.Code)
+	}
+}
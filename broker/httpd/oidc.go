@@ -0,0 +1,234 @@
+package httpd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const (
+	oidcDiscoveryPath       = "/.well-known/openid-configuration"
+	oidcJWKSRefreshInterval = time.Hour
+	oidcJWKSMinRefetchDelay = time.Minute
+	oidcIDTokenLeeway       = time.Minute
+)
+
+type oidcProviderMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcProvider caches the discovery document and the signing keys of the
+// OpenID provider.
+type oidcProvider struct {
+	providerURL string
+	mutex       sync.Mutex
+	metadata    *oidcProviderMetadata
+	jwks        *jose.JSONWebKeySet
+	jwksFetched time.Time
+}
+
+type idTokenClaims struct {
+	jwt.Claims
+	Nonce string `json:"nonce,omitempty"`
+}
+
+func newOIDCProvider(providerURL string) *oidcProvider {
+	return &oidcProvider{providerURL: strings.TrimSuffix(providerURL, "/")}
+}
+
+func (s *Server) getJSON(url string, dest interface{}) error {
+	resp, err := s.netClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("bad status code %d from: %s", resp.StatusCode, url)
+	}
+	return json.Unmarshal(body, dest)
+}
+
+// getOIDCMetadata returns the discovery document, fetching it on first use.
+// It returns nil if no provider is configured.
+func (s *Server) getOIDCMetadata() (*oidcProviderMetadata, error) {
+	if s.oidcProvider == nil {
+		return nil, nil
+	}
+	p := s.oidcProvider
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.metadata != nil {
+		return p.metadata, nil
+	}
+	var metadata oidcProviderMetadata
+	if err := s.getJSON(p.providerURL+oidcDiscoveryPath, &metadata); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(metadata.Issuer, "/") != p.providerURL {
+		return nil, fmt.Errorf("issuer mismatch: %s != %s", metadata.Issuer,
+			p.providerURL)
+	}
+	if metadata.JWKSURI == "" {
+		return nil, errors.New("no jwks_uri in provider metadata")
+	}
+	p.metadata = &metadata
+	return p.metadata, nil
+}
+
+// The endpoints configured explicitly take precedence over the discovered
+// ones.
+func (s *Server) getOpenIDAuthURL() (string, error) {
+	if s.staticConfig.OpenID.AuthURL != "" || s.oidcProvider == nil {
+		return s.staticConfig.OpenID.AuthURL, nil
+	}
+	metadata, err := s.getOIDCMetadata()
+	if err != nil {
+		return "", err
+	}
+	if metadata.AuthorizationEndpoint == "" {
+		return "", errors.New("no authorization endpoint")
+	}
+	return metadata.AuthorizationEndpoint, nil
+}
+
+func (s *Server) getOpenIDTokenURL() (string, error) {
+	if s.staticConfig.OpenID.TokenURL != "" || s.oidcProvider == nil {
+		return s.staticConfig.OpenID.TokenURL, nil
+	}
+	metadata, err := s.getOIDCMetadata()
+	if err != nil {
+		return "", err
+	}
+	if metadata.TokenEndpoint == "" {
+		return "", errors.New("no token endpoint")
+	}
+	return metadata.TokenEndpoint, nil
+}
+
+// getOpenIDUserinfoURL returns an empty URL if the provider has no userinfo
+// endpoint, in which case the ID token alone identifies the user.
+func (s *Server) getOpenIDUserinfoURL() (string, error) {
+	if s.staticConfig.OpenID.UserinfoURL != "" || s.oidcProvider == nil {
+		return s.staticConfig.OpenID.UserinfoURL, nil
+	}
+	metadata, err := s.getOIDCMetadata()
+	if err != nil {
+		return "", err
+	}
+	return metadata.UserinfoEndpoint, nil
+}
+
+// getOIDCSigningKeys returns the cached signing keys of the provider. The
+// keys are refetched periodically, or when forced because a key ID is
+// unknown, as happens after the provider rotates its keys.
+func (s *Server) getOIDCSigningKeys(force bool) (*jose.JSONWebKeySet, error) {
+	metadata, err := s.getOIDCMetadata()
+	if err != nil {
+		return nil, err
+	}
+	p := s.oidcProvider
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	age := time.Since(p.jwksFetched)
+	if p.jwks != nil && age < oidcJWKSRefreshInterval &&
+		!(force && age >= oidcJWKSMinRefetchDelay) {
+		return p.jwks, nil
+	}
+	var jwks jose.JSONWebKeySet
+	if err := s.getJSON(metadata.JWKSURI, &jwks); err != nil {
+		if p.jwks != nil {
+			s.logger.Printf("Failed to refresh OIDC keys, using cached: %s", err)
+			return p.jwks, nil
+		}
+		return nil, err
+	}
+	p.jwks = &jwks
+	p.jwksFetched = time.Now()
+	return p.jwks, nil
+}
+
+func (s *Server) getIDTokenKeys(token *jwt.JSONWebToken) (
+	[]jose.JSONWebKey, error) {
+	var keyID string
+	if len(token.Headers) > 0 {
+		keyID = token.Headers[0].KeyID
+	}
+	for _, force := range []bool{false, true} {
+		jwks, err := s.getOIDCSigningKeys(force)
+		if err != nil {
+			return nil, err
+		}
+		if keyID == "" {
+			return jwks.Keys, nil
+		}
+		if keys := jwks.Key(keyID); len(keys) > 0 {
+			return keys, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown key ID: %s", keyID)
+}
+
+// verifyIDToken checks the signature, issuer, audience, expiry and nonce of
+// the ID token and returns its claims, which are also decoded into dest.
+func (s *Server) verifyIDToken(rawIDToken string, nonce string,
+	dest ...interface{}) (*idTokenClaims, error) {
+	if rawIDToken == "" {
+		return nil, errors.New("no ID token")
+	}
+	metadata, err := s.getOIDCMetadata()
+	if err != nil {
+		return nil, err
+	}
+	token, err := jwt.ParseSigned(rawIDToken)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := s.getIDTokenKeys(token)
+	if err != nil {
+		return nil, err
+	}
+	var claims idTokenClaims
+	dest = append([]interface{}{&claims}, dest...)
+	err = errors.New("no signing keys")
+	for _, key := range keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		if err = token.Claims(key.Key, dest...); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = claims.ValidateWithLeeway(jwt.Expected{
+		Issuer:   metadata.Issuer,
+		Audience: jwt.Audience{s.staticConfig.OpenID.ClientID},
+		Time:     time.Now(),
+	}, oidcIDTokenLeeway)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Expiry == nil {
+		return nil, errors.New("ID token without expiry")
+	}
+	if claims.Nonce != nonce {
+		return nil, errors.New("ID token nonce mismatch")
+	}
+	return &claims, nil
+}
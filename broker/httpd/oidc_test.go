@@ -0,0 +1,270 @@
+package httpd
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+
+	"github.com/Cloud-Foundations/cloud-gate/broker/staticconfiguration"
+	"github.com/Cloud-Foundations/cloud-gate/broker/userinfo/claims"
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+)
+
+type testIDTokenClaims struct {
+	jwt.Claims
+	Nonce             string   `json:"nonce,omitempty"`
+	PreferredUsername string   `json:"preferred_username,omitempty"`
+	Groups            []string `json:"groups,omitempty"`
+}
+
+// fakeIdP is an in-process OpenID provider. The ID token it returns is
+// built from idTokenClaims and signed with signingKey.
+type fakeIdP struct {
+	*httptest.Server
+	signingKey    *rsa.PrivateKey
+	publishedKey  *rsa.PrivateKey
+	idTokenClaims testIDTokenClaims
+	userinfoSub   string
+	useBasicAuth  bool
+}
+
+func newFakeIdP(t *testing.T) *fakeIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &fakeIdP{signingKey: key, publishedKey: key}
+	idp.Server = httptest.NewTLSServer(http.HandlerFunc(idp.serveHTTP))
+	idp.idTokenClaims = testIDTokenClaims{
+		Claims: jwt.Claims{
+			Issuer:   idp.URL,
+			Subject:  "subject1",
+			Audience: jwt.Audience{"client1"},
+			Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+			IssuedAt: jwt.NewNumericDate(time.Now()),
+		},
+		Nonce:             "nonce1",
+		PreferredUsername: "user1",
+		Groups:            []string{"group1", "group2"},
+	}
+	idp.userinfoSub = "subject1"
+	return idp
+}
+
+func (idp *fakeIdP) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case oidcDiscoveryPath:
+		json.NewEncoder(w).Encode(oidcProviderMetadata{
+			Issuer:                idp.URL,
+			AuthorizationEndpoint: idp.URL + "/authorize",
+			TokenEndpoint:         idp.URL + "/token",
+			UserinfoEndpoint:      idp.URL + "/userinfo",
+			JWKSURI:               idp.URL + "/jwks",
+		})
+	case "/jwks":
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{
+			Keys: []jose.JSONWebKey{{
+				Key:       &idp.publishedKey.PublicKey,
+				KeyID:     "key1",
+				Algorithm: string(jose.RS256),
+				Use:       "sig",
+			}},
+		})
+	case "/token":
+		if getPKCECodeChallenge(r.FormValue("code_verifier")) !=
+			getPKCECodeChallenge("verifier1") {
+			http.Error(w, "bad code_verifier", http.StatusBadRequest)
+			return
+		}
+		clientID, clientSecret, ok := r.BasicAuth()
+		if idp.useBasicAuth {
+			// The credentials must be form encoded.
+			if clientSecret != "secret%2F1" {
+				ok = false
+			}
+			clientID, _ = url.QueryUnescape(clientID)
+			clientSecret, _ = url.QueryUnescape(clientSecret)
+		} else {
+			clientID = r.FormValue("client_id")
+			clientSecret = r.FormValue("client_secret")
+			ok = !ok
+		}
+		if !ok || clientID != "client1" || clientSecret != "secret/1" {
+			http.Error(w, "bad client credentials", http.StatusUnauthorized)
+			return
+		}
+		signer, err := jose.NewSigner(
+			jose.SigningKey{Algorithm: jose.RS256, Key: idp.signingKey},
+			(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", "key1"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		idToken, err := jwt.Signed(signer).Claims(idp.idTokenClaims).
+			CompactSerialize()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(accessToken{
+			AccessToken: "access1",
+			TokenType:   "Bearer",
+			ExpiresIn:   3600,
+			IDToken:     idToken,
+		})
+	case "/userinfo":
+		json.NewEncoder(w).Encode(openidConnectUserInfo{
+			Subject:  idp.userinfoSub,
+			Username: "user1",
+		})
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func (idp *fakeIdP) newServer(t *testing.T) *Server {
+	server := &Server{
+		logger:       testlogger.New(t),
+		netClient:    idp.Client(),
+		oidcProvider: newOIDCProvider(idp.URL),
+		sessionStore: newMemorySessionStore(),
+		staticConfig: &staticconfiguration.StaticConfiguration{},
+	}
+	server.staticConfig.Base.SharedSecrets = []string{"secret"}
+	server.staticConfig.OpenID.ClientID = "client1"
+	server.staticConfig.OpenID.ClientSecret = "secret/1"
+	if idp.useBasicAuth {
+		server.staticConfig.OpenID.TokenAuthMethod =
+			TokenAuthMethodClientSecretBasic
+	}
+	return server
+}
+
+func (idp *fakeIdP) login(t *testing.T, server *Server,
+	nonce string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/", nil)
+	stateString, err := server.generateValidStateString(req, nonce, "verifier1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := url.Values{"state": {stateString}, "code": {"12345"}}
+	redirReq := httptest.NewRequest("GET", "/?"+v.Encode(), nil)
+	rr := httptest.NewRecorder()
+	server.oauth2RedirectPathHandler(rr, redirReq)
+	return rr
+}
+
+func TestGenerateAuthCodeURLFromDiscovery(t *testing.T) {
+	idp := newFakeIdP(t)
+	defer idp.Close()
+	server := idp.newServer(t)
+	authCodeURL, err := server.generateAuthCodeURL("state1", "nonce1",
+		"verifier1", httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsedURL, err := url.Parse(authCodeURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := parsedURL.Query()
+	if parsedURL.Path != "/authorize" ||
+		query.Get("nonce") != "nonce1" ||
+		query.Get("code_challenge") != getPKCECodeChallenge("verifier1") ||
+		query.Get("code_challenge_method") != "S256" {
+		t.Fatalf("unexpected auth code URL: %s", authCodeURL)
+	}
+}
+
+func TestOauth2RedirectHandlerIDTokenValidation(t *testing.T) {
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name         string
+		modify       func(idp *fakeIdP)
+		nonce        string
+		expectedCode int
+	}{
+		{"valid", func(idp *fakeIdP) {}, "nonce1", http.StatusFound},
+		{"valid with basic auth", func(idp *fakeIdP) {
+			idp.useBasicAuth = true
+		}, "nonce1", http.StatusFound},
+		{"bad nonce", func(idp *fakeIdP) {}, "nonce2", http.StatusUnauthorized},
+		{"bad audience", func(idp *fakeIdP) {
+			idp.idTokenClaims.Audience = jwt.Audience{"client2"}
+		}, "nonce1", http.StatusUnauthorized},
+		{"bad issuer", func(idp *fakeIdP) {
+			idp.idTokenClaims.Issuer = "https://evil.example.com"
+		}, "nonce1", http.StatusUnauthorized},
+		{"expired", func(idp *fakeIdP) {
+			idp.idTokenClaims.Expiry = jwt.NewNumericDate(
+				time.Now().Add(-time.Hour))
+		}, "nonce1", http.StatusUnauthorized},
+		{"bad signature", func(idp *fakeIdP) {
+			idp.signingKey = otherKey
+		}, "nonce1", http.StatusUnauthorized},
+		{"userinfo subject mismatch", func(idp *fakeIdP) {
+			idp.userinfoSub = "subject2"
+		}, "nonce1", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		idp := newFakeIdP(t)
+		test.modify(idp)
+		server := idp.newServer(t)
+		rr := idp.login(t, server, test.nonce)
+		idp.Close()
+		if rr.Code != test.expectedCode {
+			t.Errorf("%s: expected: %d, got: %d", test.name,
+				test.expectedCode, rr.Code)
+		}
+	}
+}
+
+func TestOauth2RedirectHandlerGroupsClaim(t *testing.T) {
+	idp := newFakeIdP(t)
+	defer idp.Close()
+	server := idp.newServer(t)
+	server.staticConfig.OpenID.GroupsClaim = "groups"
+	userInfo := claims.New()
+	server.userInfo = userInfo
+	rr := idp.login(t, server, "nonce1")
+	if rr.Code != http.StatusFound {
+		t.Fatalf("expected: %d, got: %d", http.StatusFound, rr.Code)
+	}
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected one cookie, got: %d", len(cookies))
+	}
+	session, err := server.sessionStore.GetSession(cookies[0].Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(session.Groups, []string{"group1", "group2"}) {
+		t.Fatalf("unexpected session groups: %v", session.Groups)
+	}
+	// The groups reach the userinfo backend when the session is used.
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cookies[0])
+	username, err := server.getRemoteUserName(httptest.NewRecorder(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups, err := userInfo.GetUserGroups(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(groups, []string{"group1", "group2"}) {
+		t.Fatalf("unexpected user groups: %v", groups)
+	}
+}
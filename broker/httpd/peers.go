@@ -0,0 +1,173 @@
+package httpd
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	peerRevocationsPath = "/peer/sessionRevocations"
+	peerTokenInfo       = "cloud-gate peer"
+	peerSyncInterval    = time.Minute
+
+	maxPeerRevocationsSize = 16 << 20
+)
+
+// revocationSharer is implemented by the session stores whose revocations
+// must reach every node.
+type revocationSharer interface {
+	getRevocations() sessionRevocations
+	mergeRevocations(revocations sessionRevocations) error
+}
+
+// getPeerToken derives the token with which the nodes authenticate to each
+// other from a shared secret.
+func getPeerToken(sharedSecret string) string {
+	mac := hmac.New(sha256.New, []byte(sharedSecret))
+	mac.Write([]byte(peerTokenInfo))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// isPeerRequest accepts the token of any shared secret, so that secrets can
+// be rotated one node at a time.
+func (s *Server) isPeerRequest(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		return false
+	}
+	for _, sharedSecret := range s.staticConfig.Base.SharedSecrets {
+		if hmac.Equal([]byte(token), []byte(getPeerToken(sharedSecret))) {
+			return true
+		}
+	}
+	return false
+}
+
+// peerRevocationsHandler serves the session revocations of this node to the
+// other nodes on GET, and merges theirs on POST.
+func (s *Server) peerRevocationsHandler(w http.ResponseWriter,
+	r *http.Request) {
+	sharer, ok := s.sessionStore.(revocationSharer)
+	if !ok {
+		http.Error(w, "error not found", http.StatusNotFound)
+		return
+	}
+	if !s.isPeerRequest(r) {
+		http.Error(w, "Not a peer", http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(
+			sharer.getRevocations()); err != nil {
+			s.logger.Printf("Write Error: %v", err)
+		}
+	case "POST":
+		var revocations sessionRevocations
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body,
+			maxPeerRevocationsSize)).Decode(&revocations)
+		if err != nil {
+			http.Error(w, "Error parsing revocations", http.StatusBadRequest)
+			return
+		}
+		if err := sharer.mergeRevocations(revocations); err != nil {
+			s.logger.Printf("Failed to save revocations: %s", err)
+			http.Error(w, "error", http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) doPeerRequest(method string, peerURL string,
+	revocations *sessionRevocations) (*http.Response, error) {
+	var body bytes.Buffer
+	if revocations != nil {
+		if err := json.NewEncoder(&body).Encode(revocations); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest(method,
+		strings.TrimSuffix(peerURL, "/")+peerRevocationsPath, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization",
+		"Bearer "+getPeerToken(s.staticConfig.Base.SharedSecrets[0]))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.netClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", peerURL, resp.Status)
+	}
+	return resp, nil
+}
+
+// sendRevocationsToPeers sends all the revocations of this node to the other
+// nodes, and returns the peers which could not be reached. Those catch up
+// when they next pull the revocations.
+func (s *Server) sendRevocationsToPeers() []string {
+	sharer, ok := s.sessionStore.(revocationSharer)
+	if !ok {
+		return nil
+	}
+	revocations := sharer.getRevocations()
+	var failedPeers []string
+	for _, peerURL := range s.staticConfig.Base.Peers {
+		resp, err := s.doPeerRequest("POST", peerURL, &revocations)
+		if err != nil {
+			s.logger.Printf("Cannot send revocations to %s: %s", peerURL, err)
+			failedPeers = append(failedPeers, peerURL)
+			continue
+		}
+		resp.Body.Close()
+	}
+	return failedPeers
+}
+
+// pullRevocationsFromPeers merges the revocations of the other nodes, which
+// this node may have missed while it was down or unreachable.
+func (s *Server) pullRevocationsFromPeers() {
+	sharer, ok := s.sessionStore.(revocationSharer)
+	if !ok {
+		return
+	}
+	for _, peerURL := range s.staticConfig.Base.Peers {
+		resp, err := s.doPeerRequest("GET", peerURL, nil)
+		if err != nil {
+			s.logger.Debugf(1, "Cannot get revocations from %s: %s", peerURL,
+				err)
+			continue
+		}
+		var revocations sessionRevocations
+		err = json.NewDecoder(resp.Body).Decode(&revocations)
+		resp.Body.Close()
+		if err != nil {
+			s.logger.Printf("Cannot decode revocations from %s: %s", peerURL,
+				err)
+			continue
+		}
+		if err := sharer.mergeRevocations(revocations); err != nil {
+			s.logger.Printf("Failed to save revocations: %s", err)
+		}
+	}
+}
+
+func (s *Server) peerSyncLoop() {
+	for {
+		s.pullRevocationsFromPeers()
+		time.Sleep(peerSyncInterval)
+	}
+}
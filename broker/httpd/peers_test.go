@@ -0,0 +1,49 @@
+package httpd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPeerRevocations(t *testing.T) {
+	nodeA := newTestStatelessServer(t)
+	nodeB := newTestStatelessServer(t)
+	nodeC := newTestStatelessServer(t)
+	cookieValue, err := nodeA.sessionStore.NewSession(AuthCookie{
+		Username: "user1", IssuedAt: time.Now(),
+		ExpiresAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewTLSServer(http.HandlerFunc(nodeB.peerRevocationsHandler))
+	defer ts.Close()
+	// A revocation on node A is sent to node B.
+	nodeA.staticConfig.Base.Peers = []string{ts.URL}
+	nodeA.netClient = ts.Client()
+	if err := nodeA.sessionStore.RevokeUserSessions("user1"); err != nil {
+		t.Fatal(err)
+	}
+	if failedPeers := nodeA.sendRevocationsToPeers(); len(failedPeers) > 0 {
+		t.Fatalf("cannot reach peers: %v", failedPeers)
+	}
+	if _, err := nodeB.sessionStore.GetSession(cookieValue); err == nil {
+		t.Fatal("session should have been revoked on node B")
+	}
+	// Node C, which missed it, pulls it from node B.
+	if _, err := nodeC.sessionStore.GetSession(cookieValue); err != nil {
+		t.Fatal(err)
+	}
+	nodeC.staticConfig.Base.Peers = []string{ts.URL}
+	nodeC.netClient = ts.Client()
+	nodeC.pullRevocationsFromPeers()
+	if _, err := nodeC.sessionStore.GetSession(cookieValue); err == nil {
+		t.Fatal("session should have been revoked on node C")
+	}
+	// Nodes with another secret are refused.
+	nodeC.staticConfig.Base.SharedSecrets = []string{"other"}
+	if failedPeers := nodeC.sendRevocationsToPeers(); len(failedPeers) != 1 {
+		t.Fatal("node with another secret should have been refused")
+	}
+}
@@ -6,9 +6,13 @@ import (
 	"fmt"
 	"net/http"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/Cloud-Foundations/cloud-gate/broker"
+	"github.com/Cloud-Foundations/cloud-gate/broker/audit"
 	"github.com/Cloud-Foundations/keymaster/lib/instrumentedwriter"
 )
 
@@ -26,6 +30,48 @@ func (s *Server) getPreferredAcceptType(r *http.Request) string {
 	return preferredAcceptType
 }
 
+// Assumes the form is already parsed.
+func (s *Server) getBrokerFromForm(r *http.Request) (string, broker.Broker, error) {
+	cloudName := s.defaultCloudName
+	if valueArr, ok := r.Form["cloud"]; ok && len(valueArr) > 0 {
+		cloudName = valueArr[0]
+	}
+	cloudBroker, ok := s.brokers[cloudName]
+	if !ok {
+		return "", nil, fmt.Errorf("unknown cloud: %s", cloudName)
+	}
+	return cloudName, cloudBroker, nil
+}
+
+func (s *Server) getCloudNames() []string {
+	cloudNames := make([]string, 0, len(s.brokers))
+	for cloudName := range s.brokers {
+		cloudNames = append(cloudNames, cloudName)
+	}
+	sort.Strings(cloudNames)
+	return cloudNames
+}
+
+// getRoleWarnings returns the messages of the unhealthy roles of the broker,
+// keyed by account and role name.
+func getRoleWarnings(cloudBroker broker.Broker) map[string]map[string]string {
+	checker, ok := cloudBroker.(broker.RoleHealthChecker)
+	if !ok {
+		return nil
+	}
+	warnings := make(map[string]map[string]string)
+	for _, health := range checker.GetRoleHealth() {
+		if health.Healthy {
+			continue
+		}
+		if warnings[health.Account] == nil {
+			warnings[health.Account] = make(map[string]string)
+		}
+		warnings[health.Account][health.Role] = health.Message
+	}
+	return warnings
+}
+
 func (s *Server) consoleAccessHandler(w http.ResponseWriter, r *http.Request) {
 	authUser, err := s.getRemoteUserName(w, r)
 	if err != nil {
@@ -44,24 +90,36 @@ func (s *Server) consoleAccessHandler(w http.ResponseWriter, r *http.Request) {
 	if ok {
 		mode = valueArr[0]
 	}
+	cloudName, cloudBroker, err := s.getBrokerFromForm(r)
+	if err != nil {
+		s.logger.Println(err)
+		http.Error(w, "Invalid cloud", http.StatusBadRequest)
+		return
+	}
 
-	userAccounts, err := s.brokers["aws"].GetUserAllowedAccounts(authUser)
+	userAccounts, err := cloudBroker.GetUserAllowedAccounts(authUser)
 	if err != nil {
-		s.logger.Printf("Failed to get aws accounts for %s, err=%v", authUser, err)
+		s.logger.Printf("Failed to get %s accounts for %s, err=%v", cloudName, authUser, err)
 		http.Error(w, "error", http.StatusInternalServerError)
 		return
 	}
 
+	roleWarnings := getRoleWarnings(cloudBroker)
 	cloudAccounts := make(map[string]cloudAccountInfo)
 	for _, account := range userAccounts {
 		cloudAccounts[account.HumanName] = cloudAccountInfo{Name: account.Name,
-			AvailableRoles: account.PermittedRoleName}
+			AvailableRoles: account.PermittedRoleName,
+			RoleWarnings:   roleWarnings[account.Name]}
 	}
 
 	displayData := consolePageTemplateData{
-		Title:         "Cloud-Gate console access",
-		AuthUsername:  authUser,
-		CloudAccounts: cloudAccounts,
+		Title:            "Cloud-Gate console access",
+		AuthUsername:     authUser,
+		CloudAccounts:    cloudAccounts,
+		Cloud:            cloudName,
+		Clouds:           s.getCloudNames(),
+		CloudDisplayName: getCloudDisplayName(cloudName),
+		GrantsEnabled:    s.grantStore != nil,
 	}
 	if mode == "genToken" {
 		displayData.TokenConsole = true
@@ -69,7 +127,6 @@ func (s *Server) consoleAccessHandler(w http.ResponseWriter, r *http.Request) {
 	returnAcceptType := s.getPreferredAcceptType(r)
 	switch returnAcceptType {
 	case "text/html":
-
 		w.Header().Set("Cache-Control", "private, max-age=30")
 		err = s.htmlTemplate.ExecuteTemplate(w, "consoleAccessPage", displayData)
 		if err != nil {
@@ -79,6 +136,7 @@ func (s *Server) consoleAccessHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	default:
 		displayData.Title = ""
+		displayData.Clouds = nil
 		b, err := json.MarshalIndent(displayData, "", "  ")
 		if err != nil {
 			s.logger.Printf("Failed marshal %v", err)
@@ -145,25 +203,45 @@ func (s *Server) getConsoleUrlHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	accountName := validatedParams["accountName"][0]
 	roleName := validatedParams["roleName"][0]
+	cloudName, cloudBroker, err := s.getBrokerFromForm(r)
+	if err != nil {
+		s.logger.Println(err)
+		http.Error(w, "Invalid cloud", http.StatusBadRequest)
+		return
+	}
 
-	ok, err := s.brokers["aws"].IsUserAllowedToAssumeRole(authUser, accountName, roleName)
+	auditEvent := s.newAuditEvent(r, audit.ActionConsoleURL, authUser)
+	auditEvent.Cloud = cloudName
+	auditEvent.Account = accountName
+	auditEvent.Role = roleName
+	ok, err := cloudBroker.IsUserAllowedToAssumeRole(authUser, accountName, roleName)
 	if err != nil {
 		s.logger.Printf("Failure checking user permissions: %s", err)
+		auditEvent.Outcome = audit.OutcomeFailure
+		auditEvent.Message = err.Error()
+		s.emitAuditEvent(auditEvent)
 		http.Error(w, "Error getting user permissions.", http.StatusInternalServerError)
 		return
 	}
 	if !ok {
+		auditEvent.Outcome = audit.OutcomeDenied
+		s.emitAuditEvent(auditEvent)
 		http.Error(w, "Invalid account or Role", http.StatusForbidden)
 		return
 	}
 	issuerURL := fmt.Sprintf("https://%s%s", r.Host, r.URL.String())
-	destUrl, err := s.brokers["aws"].GetConsoleURLForAccountRole(accountName, roleName, authUser, issuerURL)
+	destUrl, err := cloudBroker.GetConsoleURLForAccountRole(accountName, roleName, authUser, issuerURL)
 	if err != nil {
-		s.logger.Printf("Failed to generate console for account: %s role: %s user: %s, err: %v", accountName, roleName, authUser, err)
+		s.logger.Printf("Failed to generate %s console for account: %s role: %s user: %s, err: %v", cloudName, accountName, roleName, authUser, err)
+		auditEvent.Outcome = audit.OutcomeFailure
+		auditEvent.Message = err.Error()
+		s.emitAuditEvent(auditEvent)
 		http.Error(w, "Failed to Generate Console URL for account/role (Missing/invalid trust?)", http.StatusInternalServerError)
 		return
 
 	}
+	auditEvent.Outcome = audit.OutcomeSuccess
+	s.emitAuditEvent(auditEvent)
 	http.Redirect(w, r, destUrl, 302)
 	return
 }
@@ -189,24 +267,61 @@ func (s *Server) generateTokenHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	accountName := validatedParams["accountName"][0]
 	roleName := validatedParams["roleName"][0]
+	cloudName, cloudBroker, err := s.getBrokerFromForm(r)
+	if err != nil {
+		s.logger.Println(err)
+		http.Error(w, "Invalid cloud", http.StatusBadRequest)
+		return
+	}
 
-	ok, err := s.brokers["aws"].IsUserAllowedToAssumeRole(authUser, accountName, roleName)
+	auditEvent := s.newAuditEvent(r, audit.ActionTokenCredentials, authUser)
+	auditEvent.Cloud = cloudName
+	auditEvent.Account = accountName
+	auditEvent.Role = roleName
+	ok, err := cloudBroker.IsUserAllowedToAssumeRole(authUser, accountName, roleName)
 	if err != nil {
 		s.logger.Printf("Failure checking user permissions: %s", err)
+		auditEvent.Outcome = audit.OutcomeFailure
+		auditEvent.Message = err.Error()
+		s.emitAuditEvent(auditEvent)
 		http.Error(w, "Error getting user permissions.", http.StatusInternalServerError)
 		return
 	}
 	if !ok {
+		auditEvent.Outcome = audit.OutcomeDenied
+		s.emitAuditEvent(auditEvent)
 		http.Error(w, "Invalid account or Role", http.StatusForbidden)
 		return
 	}
-	tempCredentials, err := s.brokers["aws"].GenerateTokenCredentials(accountName, roleName, authUser)
+	var duration time.Duration
+	if _, ok := r.Form["durationSeconds"]; ok {
+		durationParams, err := s.getVerifyFormValues(r, []string{"durationSeconds"}, "^[0-9]{1,6}$")
+		if err != nil {
+			s.logger.Println(err)
+			http.Error(w, "Error parsing form", http.StatusBadRequest)
+			return
+		}
+		durationSeconds, err := strconv.ParseInt(durationParams["durationSeconds"][0], 10, 64)
+		if err != nil {
+			s.logger.Println(err)
+			http.Error(w, "Error parsing form", http.StatusBadRequest)
+			return
+		}
+		duration = time.Duration(durationSeconds) * time.Second
+	}
+	tempCredentials, err := cloudBroker.GenerateTokenCredentials(accountName, roleName, authUser, duration)
 	if err != nil {
-		s.logger.Printf("Failed to generate Token for account: %s role: %s user: %s, err: %v", accountName, roleName, authUser, err)
+		s.logger.Printf("Failed to generate %s Token for account: %s role: %s user: %s, err: %v", cloudName, accountName, roleName, authUser, err)
+		auditEvent.Outcome = audit.OutcomeFailure
+		auditEvent.Message = err.Error()
+		s.emitAuditEvent(auditEvent)
 		http.Error(w, "Failed to Generate Token for account/role (Missing/invalid trust?)", http.StatusInternalServerError)
 		return
 
 	}
+	auditEvent.AccessKeyID = tempCredentials.SessionId
+	auditEvent.Outcome = audit.OutcomeSuccess
+	s.emitAuditEvent(auditEvent)
 
 	returnAcceptType := s.getPreferredAcceptType(r)
 	switch returnAcceptType {
@@ -214,6 +329,7 @@ func (s *Server) generateTokenHandler(w http.ResponseWriter, r *http.Request) {
 		displayData := generateTokenPageTemplateData{
 			Title:           "Cloud-Gate credential output",
 			AuthUsername:    authUser,
+			Cloud:           cloudName,
 			AccountName:     accountName,
 			RoleName:        roleName,
 			SessionId:       tempCredentials.SessionId,
@@ -243,3 +359,41 @@ func (s *Server) generateTokenHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	return
 }
+
+// logoutHandler only accepts POSTs from the same origin, so that other sites
+// cannot log users out.
+func (s *Server) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "error", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isSameOrigin(r) {
+		http.Error(w, "cross-origin request refused", http.StatusForbidden)
+		return
+	}
+	setupSecurityHeaders(w)
+	remoteCookie, err := r.Cookie(authCookieName)
+	if err == nil {
+		session, err := s.sessionStore.GetSession(remoteCookie.Value)
+		if err == nil {
+			w.(*instrumentedwriter.LoggingWriter).SetUsername(session.Username)
+			if err := s.sessionStore.DeleteSession(remoteCookie.Value); err != nil {
+				s.logger.Printf("Failed to delete session for %s: %s",
+					session.Username, err)
+				http.Error(w, "error", http.StatusInternalServerError)
+				return
+			}
+			go s.sendRevocationsToPeers()
+			auditEvent := s.newAuditEvent(r, audit.ActionLogout,
+				session.Username)
+			auditEvent.Outcome = audit.OutcomeSuccess
+			s.emitAuditEvent(auditEvent)
+		}
+	}
+	http.SetCookie(w, &http.Cookie{Name: authCookieName, Value: "", Path: "/",
+		MaxAge: -1, HttpOnly: true, Secure: true})
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintln(w, "<title>cloud-gate</title>")
+	fmt.Fprintln(w, "<body><center><h2>You have been logged out</h2>")
+	fmt.Fprintln(w, "<a href=\"/\">Log in again</a></center></body>")
+}
@@ -0,0 +1,264 @@
+package httpd
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/cloud-gate/broker"
+	"github.com/Cloud-Foundations/cloud-gate/broker/audit"
+	"github.com/Cloud-Foundations/cloud-gate/broker/configuration"
+	"github.com/Cloud-Foundations/cloud-gate/broker/staticconfiguration"
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+	"github.com/Cloud-Foundations/keymaster/lib/instrumentedwriter"
+)
+
+// testBroker allows only the "admin" role on the "prod" account, which also
+// has the "poweruser" and "readonly" roles.
+type testBroker struct{}
+
+func (testBroker) UpdateConfiguration(*configuration.Configuration) error {
+	return nil
+}
+
+func (testBroker) GetUserAllowedAccounts(string) (
+	[]broker.PermittedAccount, error) {
+	return []broker.PermittedAccount{{Name: "prod", HumanName: "prod",
+		PermittedRoleName: []string{"admin"}}}, nil
+}
+
+func (testBroker) IsUserAllowedToAssumeRole(username, accountName,
+	roleName string) (bool, error) {
+	return accountName == "prod" && roleName == "admin", nil
+}
+
+func (testBroker) GetConsoleURLForAccountRole(string, string, string,
+	string) (string, error) {
+	return "https://console.example.com/", nil
+}
+
+func (testBroker) GenerateTokenCredentials(string, string, string,
+	time.Duration) (*broker.AWSCredentialsJSON, error) {
+	return &broker.AWSCredentialsJSON{SessionId: "AKIATEST"}, nil
+}
+
+func (testBroker) GetAccountRoles(accountName string) ([]string, error) {
+	if accountName != "prod" {
+		return nil, errors.New("unknown account")
+	}
+	return []string{"admin", "poweruser", "readonly"}, nil
+}
+
+func (testBroker) ProcessNewUnsealingSecret(string) (bool, error) {
+	return true, nil
+}
+
+func (testBroker) GetIsUnsealedChannel() (<-chan error, error) {
+	return nil, nil
+}
+
+func (testBroker) LoadCredentialsFile() error { return nil }
+
+// testHealthBroker reports the "admin" role on "prod" as unhealthy.
+type testHealthBroker struct {
+	testBroker
+}
+
+func (testHealthBroker) GetRoleHealth() []broker.RoleHealth {
+	return []broker.RoleHealth{{Account: "prod", Role: "admin",
+		Message: "trust policy does not allow sts:AssumeRole"}}
+}
+
+type testUserInfo map[string][]string
+
+func (ui testUserInfo) GetUserGroups(username string) ([]string, error) {
+	return ui[username], nil
+}
+
+type testAuditSink struct {
+	mutex  sync.Mutex
+	events []audit.Event
+}
+
+func (s *testAuditSink) Emit(event *audit.Event) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.events = append(s.events, *event)
+	return nil
+}
+
+func newTestServer(t *testing.T) (*Server, *testAuditSink) {
+	auditSink := &testAuditSink{}
+	server := &Server{
+		auditSink:        auditSink,
+		brokers:          map[string]broker.Broker{"aws": testBroker{}},
+		defaultCloudName: "aws",
+		logger:           testlogger.New(t),
+		staticConfig:     &staticconfiguration.StaticConfiguration{},
+		userInfo:         testUserInfo{"admin1": {"cloud-gate-admins"}},
+	}
+	server.staticConfig.Base.AdminGroups = []string{"cloud-gate-admins"}
+	sessionStore := newMemorySessionStore()
+	sessionStore.sessions["cookieValue"] = AuthCookie{Username: "user1",
+		ExpiresAt: time.Now().Add(time.Hour)}
+	server.sessionStore = sessionStore
+	return server, auditSink
+}
+
+func serveAuthenticated(server *Server, handler http.HandlerFunc,
+	url string) *httptest.ResponseRecorder {
+	return serveWithCookie(server, handler, "GET", url, "cookieValue")
+}
+
+func serveWithCookie(server *Server, handler http.HandlerFunc, method string,
+	url string, cookieValue string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, url, nil)
+	req.AddCookie(&http.Cookie{Name: authCookieName, Value: cookieValue})
+	rr := httptest.NewRecorder()
+	instrumentedwriter.NewLoggingHandler(handler,
+		httpLogger{}).ServeHTTP(rr, req)
+	return rr
+}
+
+func TestGetConsoleUrlHandlerAudit(t *testing.T) {
+	server, auditSink := newTestServer(t)
+	rr := serveAuthenticated(server, server.getConsoleUrlHandler,
+		"/getconsole?accountName=prod&roleName=readonly")
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("expected forbidden, got %d", rr.Code)
+	}
+	rr = serveAuthenticated(server, server.getConsoleUrlHandler,
+		"/getconsole?accountName=prod&roleName=admin")
+	if rr.Code != http.StatusFound {
+		t.Fatalf("expected redirect, got %d", rr.Code)
+	}
+	if len(auditSink.events) != 2 {
+		t.Fatalf("expected 2 audit events, got %d", len(auditSink.events))
+	}
+	denied := auditSink.events[0]
+	if denied.Outcome != audit.OutcomeDenied || denied.Role != "readonly" ||
+		denied.Username != "user1" || denied.Cloud != "aws" ||
+		denied.AuthMethod != audit.AuthMethodOIDCCookie {
+		t.Fatalf("unexpected denied event: %+v", denied)
+	}
+	if auditSink.events[1].Outcome != audit.OutcomeSuccess {
+		t.Fatalf("unexpected event: %+v", auditSink.events[1])
+	}
+}
+
+func TestGenerateTokenHandlerAudit(t *testing.T) {
+	server, auditSink := newTestServer(t)
+	rr := serveAuthenticated(server, server.generateTokenHandler,
+		"/generatetoken?accountName=prod&roleName=admin")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected OK, got %d", rr.Code)
+	}
+	if len(auditSink.events) != 1 {
+		t.Fatalf("expected 1 audit event, got %d", len(auditSink.events))
+	}
+	event := auditSink.events[0]
+	if event.Outcome != audit.OutcomeSuccess ||
+		event.Action != audit.ActionTokenCredentials ||
+		event.AccessKeyID != "AKIATEST" || event.SourceIP != "192.0.2.1" {
+		t.Fatalf("unexpected event: %+v", event)
+	}
+}
+
+func TestLogoutHandler(t *testing.T) {
+	server, auditSink := newTestServer(t)
+	rr := serveAuthenticated(server, server.logoutHandler, "/logout")
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("GET: expected method not allowed, got %d", rr.Code)
+	}
+	req := httptest.NewRequest("POST", "/logout", nil)
+	req.Header.Set("Origin", "https://attacker.example.com")
+	req.AddCookie(&http.Cookie{Name: authCookieName, Value: "cookieValue"})
+	rr = httptest.NewRecorder()
+	instrumentedwriter.NewLoggingHandler(
+		http.HandlerFunc(server.logoutHandler),
+		httpLogger{}).ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("cross-origin: expected forbidden, got %d", rr.Code)
+	}
+	if _, err := server.sessionStore.GetSession("cookieValue"); err != nil {
+		t.Fatal("cross-origin logout should keep the session")
+	}
+	rr = serveWithCookie(server, server.logoutHandler, "POST", "/logout",
+		"cookieValue")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected OK, got %d", rr.Code)
+	}
+	if _, err := server.sessionStore.GetSession("cookieValue"); err == nil {
+		t.Fatal("session should have been deleted")
+	}
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].MaxAge >= 0 {
+		t.Fatalf("cookie should have been cleared: %+v", cookies)
+	}
+	if len(auditSink.events) != 1 ||
+		auditSink.events[0].Action != audit.ActionLogout {
+		t.Fatalf("unexpected audit events: %+v", auditSink.events)
+	}
+}
+
+func TestRoleHealth(t *testing.T) {
+	server, _ := newTestServer(t)
+	server.brokers["aws"] = testHealthBroker{}
+	rr := serveAuthenticated(server, server.consoleAccessHandler, "/")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("console: expected: %d, got: %d", http.StatusOK, rr.Code)
+	}
+	var displayData consolePageTemplateData
+	if err := json.Unmarshal(rr.Body.Bytes(), &displayData); err != nil {
+		t.Fatal(err)
+	}
+	warning := displayData.CloudAccounts["prod"].RoleWarnings["admin"]
+	if warning == "" {
+		t.Fatalf("expected admin role to be flagged: %+v", displayData)
+	}
+	rr = serveAuthenticated(server, server.roleHealthHandler,
+		"/status/roleHealth")
+	var report map[string][]broker.RoleHealth
+	if err := json.Unmarshal(rr.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report["aws"]) != 1 || report["aws"][0].Healthy {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+}
+
+func TestDefaultCloudIsFirstEnabled(t *testing.T) {
+	server, _ := newTestServer(t)
+	server.brokers = map[string]broker.Broker{"gcp": testBroker{}}
+	server.defaultCloudName = getDefaultCloudName([]string{"gcp"})
+	req := httptest.NewRequest("GET", "/getconsole", nil)
+	req.ParseForm()
+	cloudName, _, err := server.getBrokerFromForm(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cloudName != "gcp" {
+		t.Fatalf("expected gcp, got %s", cloudName)
+	}
+	rr := httptest.NewRecorder()
+	cloudName, _, ok := server.getAPIBroker(rr, "")
+	if !ok || cloudName != "gcp" {
+		t.Fatalf("expected gcp, got %s (%d)", cloudName, rr.Code)
+	}
+	config := &configuration.Configuration{
+		BreakGlass: []configuration.BreakGlassUser{
+			{Username: "oncall", Account: "prod", Roles: []string{"admin"}},
+		},
+	}
+	if findBreakGlassUser(config, server.defaultCloudName, "oncall", "gcp",
+		"prod", "admin") == nil {
+		t.Fatal("expected entry without a cloud to be for gcp")
+	}
+	if getDefaultCloudName(nil) != "aws" {
+		t.Fatal("expected aws without enabled clouds")
+	}
+}
@@ -0,0 +1,326 @@
+package httpd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+
+	libjson "github.com/Cloud-Foundations/Dominator/lib/json"
+	"github.com/Cloud-Foundations/cloud-gate/lib/constants"
+)
+
+const (
+	SessionStoreMemory    = "memory"
+	SessionStoreStateless = "stateless"
+
+	sessionKeyDerivationPrefix = "cloud-gate session:"
+
+	revocationsFilePerms = 0600
+)
+
+// SessionStore is the interface that wraps the methods used to keep the
+// authenticated sessions behind the auth cookie.
+//
+// NewSession stores the session and returns the value to set in the cookie.
+// GetSession returns the session for the cookie value, or an error if it is
+// unknown, expired or revoked. DeleteSession ends the session for the cookie
+// value. RevokeUserSessions ends all the sessions of the user. Cleanup removes
+// expired sessions.
+type SessionStore interface {
+	NewSession(session AuthCookie) (string, error)
+	GetSession(cookieValue string) (*AuthCookie, error)
+	DeleteSession(cookieValue string) error
+	RevokeUserSessions(username string) error
+	Cleanup()
+}
+
+// memorySessionStore keeps the sessions in this process only.
+type memorySessionStore struct {
+	mutex    sync.Mutex
+	sessions map[string]AuthCookie // K: cookie value.
+}
+
+// sessionRevocations are the deleted sessions and revoked users which a
+// stateless session store remembers, and which the nodes exchange.
+type sessionRevocations struct {
+	DeletedSessions map[string]time.Time `json:"deletedSessions"` // K: cookie hash, V: expiration.
+	RevokedUsers    map[string]time.Time `json:"revokedUsers"`    // K: username, V: revocation time.
+}
+
+// statelessSessionStore seals the session into the cookie value, so that any
+// node holding the shared secrets can open it. Since the cookies cannot be
+// recalled, deleted sessions and revoked users are remembered, in filename
+// if it is not empty, until the sessions they affect would have expired
+// anyway.
+type statelessSessionStore struct {
+	sharedSecrets []string
+	filename      string
+	mutex         sync.Mutex // Protect everything below.
+	revocations   sessionRevocations
+}
+
+// newSessionStore creates the session store. Stateless stores keep their
+// revocations in revocationsFilename.
+func newSessionStore(storeType string, sharedSecrets []string,
+	revocationsFilename string) (SessionStore, error) {
+	switch storeType {
+	case "", SessionStoreMemory:
+		return newMemorySessionStore(), nil
+	case SessionStoreStateless:
+		if len(sharedSecrets) < 1 {
+			return nil, errors.New("stateless sessions need shared secrets")
+		}
+		s := &statelessSessionStore{
+			sharedSecrets: sharedSecrets,
+			filename:      revocationsFilename,
+		}
+		if revocationsFilename != "" {
+			err := libjson.ReadFromFile(revocationsFilename, &s.revocations)
+			if err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+		if s.revocations.DeletedSessions == nil {
+			s.revocations.DeletedSessions = make(map[string]time.Time)
+		}
+		if s.revocations.RevokedUsers == nil {
+			s.revocations.RevokedUsers = make(map[string]time.Time)
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("unknown session store: %s", storeType)
+}
+
+// getAuthCookieName returns the name of the auth cookie. Stateless sessions
+// are opened by every node, so their cookie name is the same everywhere.
+// In-memory sessions do not survive a restart, so their cookie name has a
+// random suffix which keeps browsers from presenting stale cookies.
+func getAuthCookieName(storeType string) (string, error) {
+	if storeType == SessionStoreStateless {
+		return constants.AuthCookieName, nil
+	}
+	authCookieSuffix, err := randomStringGeneration()
+	if err != nil {
+		return "", err
+	}
+	return constants.AuthCookieName + "_" + authCookieSuffix[0:6], nil
+}
+
+func newMemorySessionStore() *memorySessionStore {
+	return &memorySessionStore{sessions: make(map[string]AuthCookie)}
+}
+
+func (s *memorySessionStore) NewSession(session AuthCookie) (string, error) {
+	cookieValue, err := randomStringGeneration()
+	if err != nil {
+		return "", err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.sessions[cookieValue] = session
+	return cookieValue, nil
+}
+
+func (s *memorySessionStore) GetSession(cookieValue string) (
+	*AuthCookie, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	session, ok := s.sessions[cookieValue]
+	if !ok {
+		return nil, errors.New("Cookie not found")
+	}
+	if session.ExpiresAt.Before(time.Now()) {
+		return nil, errors.New("Expired Cookie")
+	}
+	return &session, nil
+}
+
+func (s *memorySessionStore) DeleteSession(cookieValue string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.sessions, cookieValue)
+	return nil
+}
+
+func (s *memorySessionStore) RevokeUserSessions(username string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for key, session := range s.sessions {
+		if session.Username == username {
+			delete(s.sessions, key)
+		}
+	}
+	return nil
+}
+
+func (s *memorySessionStore) Cleanup() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for key, session := range s.sessions {
+		if session.ExpiresAt.Before(time.Now()) {
+			delete(s.sessions, key)
+		}
+	}
+}
+
+// The shared secrets are not necessarily 32 bytes long, so the AES keys are
+// derived from them.
+func deriveSessionKey(sharedSecret string) []byte {
+	key := sha256.Sum256([]byte(sessionKeyDerivationPrefix + sharedSecret))
+	return key[:]
+}
+
+func (s *statelessSessionStore) NewSession(session AuthCookie) (
+	string, error) {
+	encrypter, err := jose.NewEncrypter(jose.A256GCM,
+		jose.Recipient{
+			Algorithm: jose.DIRECT,
+			Key:       deriveSessionKey(s.sharedSecrets[0]),
+		},
+		(&jose.EncrypterOptions{}).WithType("JWT"))
+	if err != nil {
+		return "", err
+	}
+	return jwt.Encrypted(encrypter).Claims(session).CompactSerialize()
+}
+
+func hashCookieValue(cookieValue string) string {
+	hash := sha256.Sum256([]byte(cookieValue))
+	return hex.EncodeToString(hash[:])
+}
+
+// GetSession tries every shared secret, so that secrets can be rotated
+// without logging users out.
+func (s *statelessSessionStore) GetSession(cookieValue string) (
+	*AuthCookie, error) {
+	token, err := jwt.ParseEncrypted(cookieValue)
+	if err != nil {
+		return nil, err
+	}
+	var session AuthCookie
+	for _, sharedSecret := range s.sharedSecrets {
+		err = token.Claims(deriveSessionKey(sharedSecret), &session)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if session.ExpiresAt.Before(time.Now()) {
+		return nil, errors.New("Expired Cookie")
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.revocations.DeletedSessions[hashCookieValue(
+		cookieValue)]; ok {
+		return nil, errors.New("Deleted Cookie")
+	}
+	if revokedAt, ok := s.revocations.RevokedUsers[session.Username]; ok &&
+		!session.IssuedAt.After(revokedAt) {
+		return nil, errors.New("Revoked Cookie")
+	}
+	return &session, nil
+}
+
+func (s *statelessSessionStore) DeleteSession(cookieValue string) error {
+	session, err := s.GetSession(cookieValue)
+	if err != nil {
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.revocations.DeletedSessions[hashCookieValue(cookieValue)] =
+		session.ExpiresAt
+	return s.save()
+}
+
+func (s *statelessSessionStore) RevokeUserSessions(username string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.revocations.RevokedUsers[username] = time.Now()
+	return s.save()
+}
+
+func (s *statelessSessionStore) Cleanup() {
+	now := time.Now()
+	maxSessionAge := time.Hour * constants.CookieExpirationHours
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	changed := false
+	for key, expiresAt := range s.revocations.DeletedSessions {
+		if expiresAt.Before(now) {
+			delete(s.revocations.DeletedSessions, key)
+			changed = true
+		}
+	}
+	for username, revokedAt := range s.revocations.RevokedUsers {
+		if revokedAt.Add(maxSessionAge).Before(now) {
+			delete(s.revocations.RevokedUsers, username)
+			changed = true
+		}
+	}
+	if changed {
+		s.save()
+	}
+}
+
+// getRevocations returns a copy of the revocations, to send to other nodes.
+func (s *statelessSessionStore) getRevocations() sessionRevocations {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	revocations := sessionRevocations{
+		DeletedSessions: make(map[string]time.Time,
+			len(s.revocations.DeletedSessions)),
+		RevokedUsers: make(map[string]time.Time,
+			len(s.revocations.RevokedUsers)),
+	}
+	for key, expiresAt := range s.revocations.DeletedSessions {
+		revocations.DeletedSessions[key] = expiresAt
+	}
+	for username, revokedAt := range s.revocations.RevokedUsers {
+		revocations.RevokedUsers[username] = revokedAt
+	}
+	return revocations
+}
+
+// mergeRevocations adds the revocations of another node, keeping the latest
+// revocation of each user.
+func (s *statelessSessionStore) mergeRevocations(
+	revocations sessionRevocations) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	changed := false
+	for key, expiresAt := range revocations.DeletedSessions {
+		if _, ok := s.revocations.DeletedSessions[key]; !ok {
+			s.revocations.DeletedSessions[key] = expiresAt
+			changed = true
+		}
+	}
+	for username, revokedAt := range revocations.RevokedUsers {
+		if revokedAt.After(s.revocations.RevokedUsers[username]) {
+			s.revocations.RevokedUsers[username] = revokedAt
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return s.save()
+}
+
+// save must be called with the lock held.
+func (s *statelessSessionStore) save() error {
+	if s.filename == "" {
+		return nil
+	}
+	return libjson.WriteToFile(s.filename, revocationsFilePerms, "    ",
+		s.revocations)
+}
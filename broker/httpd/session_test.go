@@ -0,0 +1,200 @@
+package httpd
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/cloud-gate/broker/staticconfiguration"
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+)
+
+func testSessionStore(t *testing.T, store SessionStore) {
+	cookieValue, err := store.NewSession(AuthCookie{Username: "user1",
+		ExpiresAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := store.GetSession(cookieValue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.Username != "user1" {
+		t.Fatalf("unexpected username: %s", session.Username)
+	}
+	if _, err := store.GetSession("unknown"); err == nil {
+		t.Fatal("unknown session should fail")
+	}
+	expiredValue, err := store.NewSession(AuthCookie{Username: "user1",
+		ExpiresAt: time.Now().Add(-time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetSession(expiredValue); err == nil {
+		t.Fatal("expired session should fail")
+	}
+	if err := store.DeleteSession(cookieValue); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetSession(cookieValue); err == nil {
+		t.Fatal("deleted session should fail")
+	}
+	var cookieValues []string
+	for _, username := range []string{"user1", "user1", "user2"} {
+		cookieValue, err := store.NewSession(AuthCookie{Username: username,
+			IssuedAt: time.Now(), ExpiresAt: time.Now().Add(time.Hour)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cookieValues = append(cookieValues, cookieValue)
+	}
+	if err := store.RevokeUserSessions("user1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, cookieValue := range cookieValues[:2] {
+		if _, err := store.GetSession(cookieValue); err == nil {
+			t.Fatal("revoked session should fail")
+		}
+	}
+	if _, err := store.GetSession(cookieValues[2]); err != nil {
+		t.Fatal(err)
+	}
+	// Sessions started after the revocation are accepted.
+	time.Sleep(time.Millisecond)
+	cookieValue, err = store.NewSession(AuthCookie{Username: "user1",
+		IssuedAt: time.Now(), ExpiresAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetSession(cookieValue); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemorySessionStore(t *testing.T) {
+	testSessionStore(t, newMemorySessionStore())
+}
+
+func TestStatelessSessionStore(t *testing.T) {
+	store, err := newSessionStore(SessionStoreStateless,
+		[]string{"secret1", "secret2"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSessionStore(t, store)
+	// A session sealed by a node with an older list of secrets can still be
+	// opened after the secrets are rotated.
+	cookieValue, err := store.NewSession(AuthCookie{Username: "user1",
+		ExpiresAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotatedStore, err := newSessionStore(SessionStoreStateless,
+		[]string{"secret3", "secret1"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rotatedStore.GetSession(cookieValue); err != nil {
+		t.Fatal(err)
+	}
+	otherStore, err := newSessionStore(SessionStoreStateless,
+		[]string{"other"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := otherStore.GetSession(cookieValue); err == nil {
+		t.Fatal("session sealed with another secret should fail")
+	}
+}
+
+func TestStatelessSessionStoreRevocationsPersist(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "session-revocations.json")
+	store, err := newSessionStore(SessionStoreStateless,
+		[]string{"secret1"}, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deletedCookie, err := store.NewSession(AuthCookie{Username: "user1",
+		ExpiresAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	revokedCookie, err := store.NewSession(AuthCookie{Username: "user2",
+		IssuedAt: time.Now(), ExpiresAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteSession(deletedCookie); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RevokeUserSessions("user2"); err != nil {
+		t.Fatal(err)
+	}
+	// The same node after a restart.
+	restartedStore, err := newSessionStore(SessionStoreStateless,
+		[]string{"secret1"}, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := restartedStore.GetSession(deletedCookie); err == nil {
+		t.Fatal("deleted session should stay deleted after a restart")
+	}
+	if _, err := restartedStore.GetSession(revokedCookie); err == nil {
+		t.Fatal("revoked session should stay revoked after a restart")
+	}
+}
+
+func newTestStatelessServer(t *testing.T) *Server {
+	server := &Server{
+		logger:       testlogger.New(t),
+		staticConfig: &staticconfiguration.StaticConfiguration{},
+	}
+	server.staticConfig.Base.SessionStore = SessionStoreStateless
+	server.staticConfig.Base.SharedSecrets = []string{"secret1"}
+	var err error
+	server.sessionStore, err = newSessionStore(
+		server.staticConfig.Base.SessionStore,
+		server.staticConfig.Base.SharedSecrets, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func TestStatelessSessionsSharedByNodes(t *testing.T) {
+	savedCookieName := authCookieName
+	defer func() { authCookieName = savedCookieName }()
+	// Each node computes the cookie name when it starts.
+	var cookieNames []string
+	for i := 0; i < 2; i++ {
+		cookieName, err := getAuthCookieName(SessionStoreStateless)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cookieNames = append(cookieNames, cookieName)
+	}
+	if cookieNames[0] != cookieNames[1] {
+		t.Fatalf("cookie names differ: %v", cookieNames)
+	}
+	authCookieName = cookieNames[0]
+	nodeA := newTestStatelessServer(t)
+	nodeB := newTestStatelessServer(t)
+	rr := httptest.NewRecorder()
+	if err := nodeA.setAndStoreAuthCookie(rr, "user1", nil); err != nil {
+		t.Fatal(err)
+	}
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != cookieNames[1] {
+		t.Fatalf("unexpected cookies: %v", cookies)
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cookies[0])
+	username, err := nodeB.getSessionUserName(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if username != "user1" {
+		t.Fatalf("unexpected username: %s", username)
+	}
+}
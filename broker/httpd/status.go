@@ -2,11 +2,13 @@ package httpd
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 
 	"github.com/Cloud-Foundations/Dominator/lib/html"
+	"github.com/Cloud-Foundations/cloud-gate/broker"
 )
 
 func (s *Server) statusHandler(w http.ResponseWriter, req *http.Request) {
@@ -36,3 +38,26 @@ func (s *Server) statusHandler(w http.ResponseWriter, req *http.Request) {
 
 func (s *Server) writeDashboard(writer io.Writer) {
 }
+
+// roleHealthHandler writes the trust policy health of the roles of each
+// cloud, as JSON.
+func (s *Server) roleHealthHandler(w http.ResponseWriter, req *http.Request) {
+	report := make(map[string][]broker.RoleHealth)
+	for cloudName, cloudBroker := range s.brokers {
+		checker, ok := cloudBroker.(broker.RoleHealthChecker)
+		if !ok {
+			continue
+		}
+		report[cloudName] = checker.GetRoleHealth()
+	}
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		s.logger.Printf("Failed marshal %v", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(b); err != nil {
+		s.logger.Printf("Incomplete write? %v", err)
+	}
+}
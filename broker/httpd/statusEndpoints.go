@@ -4,7 +4,10 @@ import (
 	"bufio"
 	"fmt"
 	"net/http"
+	"strings"
 
+	"github.com/Cloud-Foundations/cloud-gate/broker"
+	"github.com/Cloud-Foundations/cloud-gate/broker/audit"
 	"github.com/Cloud-Foundations/keymaster/lib/instrumentedwriter"
 )
 
@@ -71,6 +74,85 @@ func (s *Server) unsealingHandler(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+func (s *Server) isAdmin(username string) (bool, error) {
+	if len(s.staticConfig.Base.AdminGroups) < 1 {
+		return false, nil
+	}
+	userGroups, err := s.userInfo.GetUserGroups(username)
+	if err != nil {
+		return false, err
+	}
+	return len(broker.StringIntersectionNoDups(userGroups,
+		s.staticConfig.Base.AdminGroups)) > 0, nil
+}
+
+// revokeSessionsHandler ends all the sessions of a user, and sends the
+// revocation to the peer nodes.
+func (s *Server) revokeSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	authUser, err := s.getRemoteUserName(w, r)
+	if err != nil {
+		return
+	}
+	w.(*instrumentedwriter.LoggingWriter).SetUsername(authUser)
+	if r.Method != "POST" {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isSameOrigin(r) {
+		http.Error(w, "Cross-origin request", http.StatusForbidden)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		s.logger.Printf("revokeSessionsHandler: error parsing form: %s\n", err)
+		http.Error(w, "Error parsing form", http.StatusBadRequest)
+		return
+	}
+	validatedParams, err := s.getVerifyFormValues(r, []string{"username"},
+		"^[-A-Za-z0-9_.@+=]{1,128}$")
+	if err != nil {
+		s.logger.Printf("revokeSessionsHandler: validation error: %s\n", err)
+		http.Error(w, "Error parsing form", http.StatusBadRequest)
+		return
+	}
+	auditEvent := s.newAuditEvent(r, audit.ActionRevokeSessions, authUser)
+	auditEvent.TargetUser = validatedParams["username"][0]
+	ok, err := s.isAdmin(authUser)
+	if err != nil {
+		s.logger.Printf("Failure checking admin permissions: %s", err)
+		http.Error(w, "Error getting user permissions.", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		auditEvent.Outcome = audit.OutcomeDenied
+		s.emitAuditEvent(auditEvent)
+		http.Error(w, "Not an admin", http.StatusForbidden)
+		return
+	}
+	err = s.sessionStore.RevokeUserSessions(auditEvent.TargetUser)
+	if err != nil {
+		s.logger.Printf("Failed to revoke sessions for %s: %s",
+			auditEvent.TargetUser, err)
+		auditEvent.Outcome = audit.OutcomeFailure
+		auditEvent.Message = err.Error()
+		s.emitAuditEvent(auditEvent)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	failedPeers := s.sendRevocationsToPeers()
+	auditEvent.Outcome = audit.OutcomeSuccess
+	if len(failedPeers) > 0 {
+		auditEvent.Message = "unreachable peers: " +
+			strings.Join(failedPeers, ", ")
+	}
+	s.emitAuditEvent(auditEvent)
+	fmt.Fprintf(w, "Revoked sessions for %s\n", auditEvent.TargetUser)
+	if len(failedPeers) > 0 {
+		fmt.Fprintf(w,
+			"Could not reach %s: they will pull the revocation within %s\n",
+			strings.Join(failedPeers, ", "), peerSyncInterval)
+	}
+}
+
 func (s *Server) rootHandler(w http.ResponseWriter, req *http.Request) {
 	writer := bufio.NewWriter(w)
 	defer writer.Flush()
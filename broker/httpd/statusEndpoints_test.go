@@ -3,12 +3,15 @@ package httpd
 import (
 	"html/template"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
+	"github.com/Cloud-Foundations/cloud-gate/broker/audit"
 	"github.com/Cloud-Foundations/cloud-gate/broker/staticconfiguration"
 	"github.com/Cloud-Foundations/cloud-gate/lib/constants"
 	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+	"github.com/Cloud-Foundations/keymaster/lib/instrumentedwriter"
 )
 
 var test_footer_extra = `{{define "footer_extra"}}{{end}}`
@@ -19,7 +22,8 @@ func TestUnsealingHandler(t *testing.T) {
 		logger:       testlogger.New(t),
 		staticConfig: &staticconfiguration.StaticConfiguration{},
 	}
-	server.authCookie = make(map[string]AuthCookie)
+	sessionStore := newMemorySessionStore()
+	server.sessionStore = sessionStore
 	server.staticConfig.Base.SharedSecrets = []string{"secret"}
 	server.htmlTemplate = template.New("main")
 	// Also add templates
@@ -40,8 +44,8 @@ func TestUnsealingHandler(t *testing.T) {
 	// Now succeed with known cookie
 	cookieVal := "xxxxx"
 	expires := time.Now().Add(time.Hour * constants.CookieExpirationHours)
-	Cookieinfo := AuthCookie{"username", expires}
-	server.authCookie[cookieVal] = Cookieinfo
+	Cookieinfo := AuthCookie{Username: "username", ExpiresAt: expires}
+	sessionStore.sessions[cookieVal] = Cookieinfo
 	knownCookieReq, err := http.NewRequest("GET", "/unseal", nil)
 	if err != nil {
 		t.Fatal(err)
@@ -54,3 +58,51 @@ func TestUnsealingHandler(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestRevokeSessionsHandler(t *testing.T) {
+	server, auditSink := newTestServer(t)
+	adminCookie, err := server.sessionStore.NewSession(AuthCookie{
+		Username: "admin1", ExpiresAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "/admin/revokeSessions?username=user1"
+	// Non admins are denied.
+	rr := serveAuthenticated(server, server.revokeSessionsHandler, url)
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected method not allowed, got %d", rr.Code)
+	}
+	rr = serveWithCookie(server, server.revokeSessionsHandler, "POST", url,
+		"cookieValue")
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("expected forbidden, got %d", rr.Code)
+	}
+	// Cross-origin requests are refused, since browsers send the cookie.
+	req := httptest.NewRequest("POST", url, nil)
+	req.AddCookie(&http.Cookie{Name: authCookieName, Value: adminCookie})
+	req.Header.Set("Origin", "https://evil.example.com")
+	rr = httptest.NewRecorder()
+	handler := http.HandlerFunc(server.revokeSessionsHandler)
+	instrumentedwriter.NewLoggingHandler(handler,
+		httpLogger{}).ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("expected forbidden, got %d", rr.Code)
+	}
+	rr = serveWithCookie(server, server.revokeSessionsHandler, "POST", url,
+		adminCookie)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected OK, got %d", rr.Code)
+	}
+	if _, err := server.sessionStore.GetSession("cookieValue"); err == nil {
+		t.Fatal("session of user1 should have been revoked")
+	}
+	if _, err := server.sessionStore.GetSession(adminCookie); err != nil {
+		t.Fatal(err)
+	}
+	if len(auditSink.events) != 2 ||
+		auditSink.events[0].Outcome != audit.OutcomeDenied ||
+		auditSink.events[1].Outcome != audit.OutcomeSuccess ||
+		auditSink.events[1].TargetUser != "user1" {
+		t.Fatalf("unexpected audit events: %+v", auditSink.events)
+	}
+}
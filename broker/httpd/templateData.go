@@ -1,20 +1,38 @@
 package httpd
 
+var cloudDisplayNames = map[string]string{
+	"aws":   "AWS",
+	"azure": "Azure",
+	"gcp":   "GCP",
+}
+
+func getCloudDisplayName(cloudName string) string {
+	if displayName, ok := cloudDisplayNames[cloudName]; ok {
+		return displayName
+	}
+	return cloudName
+}
+
 type cloudAccountInfo struct {
 	Name           string
 	AvailableRoles []string
+	RoleWarnings   map[string]string `json:",omitempty"` // K: role name
 }
 
 type consolePageTemplateData struct {
-	Title         string `json:",omitempty"`
-	AuthUsername  string
-	JSSources     []string `json:",omitempty"`
-	ErrorMessage  string   `json:",omitempty"`
-	CloudAccounts map[string]cloudAccountInfo
-	TokenConsole  bool
+	Title            string `json:",omitempty"`
+	AuthUsername     string
+	JSSources        []string `json:",omitempty"`
+	ErrorMessage     string   `json:",omitempty"`
+	CloudAccounts    map[string]cloudAccountInfo
+	TokenConsole     bool
+	Cloud            string
+	Clouds           []string `json:",omitempty"`
+	CloudDisplayName string   `json:"-"`
+	GrantsEnabled    bool     `json:"-"`
 }
 
-//Should be a template
+// Should be a template
 const consoleAccessTemplateText = `
 {{define "consoleAccessPage"}}
 <!DOCTYPE html>
@@ -31,13 +49,19 @@ const consoleAccessTemplateText = `
     <div style="min-height:100%;position:relative;">
     {{template "header" .}}
         <div style="padding-bottom:60px; margin:1em auto; max-width:80em; padding-left:20px ">
-        <h2> {{if .TokenConsole}} AWS Token Access {{else}}AWS Console Access {{end}} </h2>
+        <h2> {{.CloudDisplayName}} {{if .TokenConsole}}Token Access {{else}}Console Access {{end}} </h2>
         {{if .ErrorMessage}}
         <p style="color:red;">{{.ErrorMessage}} </p>
         {{end}}
         <p>
-	Go to:  {{if .TokenConsole}} <a href="/">Web Console</a> {{else}} <a href="/?mode=genToken">Token Console </a> {{end}} 
+	Go to:  {{if .TokenConsole}} <a href="/?cloud={{.Cloud}}">Web Console</a> {{else}} <a href="/?cloud={{.Cloud}}&mode=genToken">Token Console </a> {{end}} 
+	{{if .GrantsEnabled}} <a href="/grants">Elevated Access</a> {{end}}
+	</p>
+	{{if gt (len .Clouds) 1}}
+	<p>
+	Clouds: {{range $index, $cloud := .Clouds}} <a href="/?cloud={{$cloud}}">{{$cloud}}</a> {{end}}
 	</p>
+	{{end}}
 
         {{with $top := . }}
 	<div id="accounts">
@@ -50,15 +74,24 @@ const consoleAccessTemplateText = `
 	     <tr>
 	     <form action={{if $top.TokenConsole}}"/generatetoken"{{else}}"/getconsole" target="_blank"{{end}}>
 		<input type="hidden" name="accountName" value="{{$value.Name}}">
+		<input type="hidden" name="cloud" value="{{$top.Cloud}}">
 	        <td>{{$key}}
 		</td>
 		<td>
 		{{range $index, $role:= $value.AvailableRoles}}
+		  {{with $warning := index $value.RoleWarnings $role}}
+		    <button class="btn btn-warning ml-1 mr-1 btn-sm"
+		            style="margin-bottom: .1rem !important;margin-top: .1rem !important;"
+		            type="submit" name="roleName" value="{{$role}}" title="{{$warning}}">
+	            {{$role}} (trust misconfigured)
+		    </button>
+		  {{else}}
 		    <button class="btn btn-info ml-1 mr-1 btn-sm"
 		            style="background-color:#00a4b7;margin-bottom: .1rem !important;margin-top: .1rem !important;"
 		            type="submit" name="roleName" value="{{$role}}">
 	            {{$role}}
 		    </button>
+		  {{end}}
 		{{end}}
 		</td>
 		</form>
@@ -80,6 +113,7 @@ type generateTokenPageTemplateData struct {
 	AuthUsername    string
 	JSSources       []string `json:",omitempty"`
 	ErrorMessage    string   `json:",omitempty"`
+	Cloud           string
 	AccountName     string
 	RoleName        string
 	SessionId       string `json:"sessionId"`
@@ -110,9 +144,16 @@ const generateTokaneTemplateText = `
         <p style="color:red;">{{.ErrorMessage}} </p>
         {{end}}
         <p>
-	Go to:  <a href="/?mode=genToken">Token Console </a>
+	Go to:  <a href="/?cloud={{.Cloud}}&mode=genToken">Token Console </a>
 	</p>
 	<div>
+	{{if ne .Cloud "aws"}}
+	<code class="access_token_text">
+	principal = {{.SessionId}}<br>
+	access_token = {{.SessionToken}}<br>
+	token_expiration = {{.TokenExpiration}}<br>
+	</code>
+	{{else}}
 	<code class="aws_token_text">
 	[{{.AccountName}}-{{.RoleName}}] <br>
 	{{if .Region}}<p>region = {{.Region}}<br>{{end}}
@@ -121,6 +162,7 @@ const generateTokaneTemplateText = `
 	aws_session_token = {{.SessionToken}}<br>
 	token_expiration = {{.TokenExpiration}}<br>
 	</code>
+	{{end}}
 	</div>
         </div>
     {{template "footer" . }}
@@ -177,6 +219,144 @@ const unsealingFormPageTemplateText = `
 {{end}}
 `
 
+type grantTemplateData struct {
+	ID            string `json:"id"`
+	Username      string `json:"username"`
+	Cloud         string `json:"cloud"`
+	Account       string `json:"account"`
+	Role          string `json:"role"`
+	Hours         int    `json:"hours"`
+	Justification string `json:"justification"`
+	Status        string `json:"status"`
+	Approver      string `json:"approver,omitempty"`
+	RequestedAt   string `json:"requestedAt"`
+	ExpiresAt     string `json:"expiresAt,omitempty"`
+}
+
+type grantsPageTemplateData struct {
+	Title         string `json:",omitempty"`
+	AuthUsername  string
+	JSSources     []string `json:",omitempty"`
+	ErrorMessage  string   `json:",omitempty"`
+	Clouds        []string `json:",omitempty"`
+	MaxHours      int
+	IsApprover    bool
+	UserGrants    []grantTemplateData
+	PendingGrants []grantTemplateData `json:",omitempty"`
+}
+
+const grantsPageTemplateText = `
+{{define "grantsPage"}}
+<!DOCTYPE html>
+<html style="height:100%; padding:0;border:0;margin:0">
+    <head>
+        <meta charset="UTF-8">
+        <title>{{.Title}}</title>
+        <link rel="stylesheet" href="https://maxcdn.bootstrapcdn.com/bootstrap/4.0.0/css/bootstrap.min.css" integrity="sha384-Gn5384xqQ1aoWXA+058RXPxPg6fy4IWvTNh0E263XmFcJlSAwiGgFAW/dAiS6JXm" crossorigin="anonymous">
+        <link rel="stylesheet" type="text/css" href="//fonts.googleapis.com/css?family=Droid+Sans" />
+        <link rel="stylesheet" type="text/css" href="/custom_static/customization.css">
+        <link rel="stylesheet" type="text/css" href="/static/common.css">
+    </head>
+    <body>
+    <div style="min-height:100%;position:relative;">
+    {{template "header" .}}
+        <div style="padding-bottom:60px; margin:1em auto; max-width:80em; padding-left:20px ">
+        <h2> Elevated Access </h2>
+        {{if .ErrorMessage}}
+        <p style="color:red;">{{.ErrorMessage}} </p>
+        {{end}}
+        <p>
+        Go to:  <a href="/">Web Console</a>
+        </p>
+        <h4> Request a role </h4>
+        <form action="/grants/request" method="post">
+          <p>Cloud: <select name="cloud">{{range .Clouds}}<option value="{{.}}">{{.}}</option>{{end}}</select>
+          Account: <input type="text" name="accountName" size=20 required>
+          Role: <input type="text" name="roleName" size=20 required>
+          Hours: <input type="number" name="hours" min="1" max="{{.MaxHours}}" value="1" required></p>
+          <p>Justification: <input type="text" name="justification" size=60 maxlength="512" required>
+          <input type="submit" value="Request"></p>
+        </form>
+        {{if .IsApprover}}
+        <h4> Pending requests </h4>
+        <table class="table table-striped table-sm">
+          <tr><th>User</th><th>Cloud</th><th>Account</th><th>Role</th><th>Hours</th><th>Justification</th><th>Requested</th><th></th></tr>
+          {{range .PendingGrants}}
+          <tr>
+            <td>{{.Username}}</td><td>{{.Cloud}}</td><td>{{.Account}}</td><td>{{.Role}}</td><td>{{.Hours}}</td><td>{{.Justification}}</td><td>{{.RequestedAt}}</td>
+            <td>
+              <form action="/grants/approve" method="post" style="display:inline"><input type="hidden" name="id" value="{{.ID}}"><input type="submit" value="Approve"></form>
+              <form action="/grants/deny" method="post" style="display:inline"><input type="hidden" name="id" value="{{.ID}}"><input type="submit" value="Deny"></form>
+            </td>
+          </tr>
+          {{end}}
+        </table>
+        {{end}}
+        <h4> Your requests </h4>
+        <table class="table table-striped table-sm">
+          <tr><th>Cloud</th><th>Account</th><th>Role</th><th>Hours</th><th>Status</th><th>Approver</th><th>Expires</th><th></th></tr>
+          {{range .UserGrants}}
+          <tr>
+            <td>{{.Cloud}}</td><td>{{.Account}}</td><td>{{.Role}}</td><td>{{.Hours}}</td><td>{{.Status}}</td><td>{{.Approver}}</td><td>{{.ExpiresAt}}</td>
+            <td>{{if eq .Status "pending"}}<form action="/grants/deny" method="post"><input type="hidden" name="id" value="{{.ID}}"><input type="submit" value="Withdraw"></form>{{end}}</td>
+          </tr>
+          {{end}}
+        </table>
+        </div>
+    {{template "footer" . }}
+    </div>
+    </body>
+</html>
+{{end}}
+`
+
+type breakGlassPageTemplateData struct {
+	Title        string `json:",omitempty"`
+	AuthUsername string
+	JSSources    []string `json:",omitempty"`
+	ErrorMessage string   `json:",omitempty"`
+	Clouds       []string `json:",omitempty"`
+}
+
+const breakGlassPageTemplateText = `
+{{define "breakGlassPage"}}
+<!DOCTYPE html>
+<html style="height:100%; padding:0;border:0;margin:0">
+    <head>
+        <meta charset="UTF-8">
+        <title>{{.Title}}</title>
+        <link rel="stylesheet" href="https://maxcdn.bootstrapcdn.com/bootstrap/4.0.0/css/bootstrap.min.css" integrity="sha384-Gn5384xqQ1aoWXA+058RXPxPg6fy4IWvTNh0E263XmFcJlSAwiGgFAW/dAiS6JXm" crossorigin="anonymous">
+        <link rel="stylesheet" type="text/css" href="//fonts.googleapis.com/css?family=Droid+Sans" />
+        <link rel="stylesheet" type="text/css" href="/custom_static/customization.css">
+        <link rel="stylesheet" type="text/css" href="/static/common.css">
+    </head>
+    <body>
+    <div style="min-height:100%;position:relative;">
+    {{template "header" .}}
+        <div style="padding-bottom:60px; margin:1em auto; max-width:80em; padding-left:20px ">
+        <h2> Break-Glass Access </h2>
+        {{if .ErrorMessage}}
+        <p style="color:red;">{{.ErrorMessage}} </p>
+        {{end}}
+        <p>
+        Every use of this page is audited and alerted on.
+        </p>
+        <form enctype="application/x-www-form-urlencoded" action="/breakglass" method="post">
+          <p>Cloud: <select name="cloud">{{range .Clouds}}<option value="{{.}}">{{.}}</option>{{end}}</select>
+          Account: <input type="text" name="accountName" size=20 required>
+          Role: <input type="text" name="roleName" size=20 required></p>
+          <p>Break-Glass Secret: <INPUT TYPE="password" NAME="secret" SIZE=18 autocomplete="off" required></p>
+          <p><select name="mode"><option value="console">Console</option><option value="genToken">Credentials</option></select>
+          <input type="submit" value="Submit" /></p>
+        </form>
+        </div>
+    {{template "footer" . }}
+    </div>
+    </body>
+</html>
+{{end}}
+`
+
 const commonCSS = `
 body{
     padding:0;
@@ -203,7 +383,7 @@ const headerTemplateText = `
 {{define "header"}}
    <nav class="navbar pt-0 pb-0" style="background-color: #213c60; color: #f4f4f4;">
       {{template "header_extra"}}
-     <span class="navbar-text navbar-right h6 mb-0">{{if .AuthUsername}} {{.AuthUsername}}  {{end}} </span>
+     <span class="navbar-text navbar-right h6 mb-0">{{if .AuthUsername}} {{.AuthUsername}} <form method="post" action="/logout" style="display: inline;"><button type="submit" class="btn btn-link p-0 align-baseline" style="color: #f4f4f4;">Logout</button></form> {{end}} </span>
    </nav>
 {{end}}
 `
@@ -0,0 +1,154 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+func getAllowedRolesFromGroups(accounts []AccountGroup,
+	userGroups []string) (map[string][]string, error) {
+	allowedRoles := make(map[string][]string)
+	for _, account := range accounts {
+		groupName := account.GroupName
+		if len(groupName) == 0 {
+			groupName = account.AccountName
+		}
+		reString := fmt.Sprintf("(?i)^%s-(.*)$", regexp.QuoteMeta(groupName))
+		re, err := regexp.Compile(reString)
+		if err != nil {
+			return nil, err
+		}
+		for _, group := range userGroups {
+			matches := re.FindStringSubmatch(group)
+			if len(matches) == 2 {
+				allowedRoles[account.AccountName] = append(
+					allowedRoles[account.AccountName], matches[1])
+			}
+		}
+		if len(account.ExtraUserRoles) > 0 {
+			allowedRoles[account.AccountName] = append(
+				allowedRoles[account.AccountName], account.ExtraUserRoles...)
+		}
+	}
+	return allowedRoles, nil
+}
+
+func (sa *StaticAccounts) getUserAllowedAccountsFromGroups(
+	userGroups []string) ([]PermittedAccount, error) {
+	accounts, err := sa.getAccounts()
+	if err != nil {
+		return nil, err
+	}
+	accountGroups := make([]AccountGroup, 0, len(accounts))
+	for _, account := range accounts {
+		accountGroups = append(accountGroups, AccountGroup{
+			AccountName:    account.Name,
+			GroupName:      account.GroupName,
+			ExtraUserRoles: account.ExtraUserRoles,
+		})
+	}
+	allowedRoles, err := getAllowedRolesFromGroups(accountGroups, userGroups)
+	if err != nil {
+		return nil, err
+	}
+	var permittedAccounts []PermittedAccount
+	for _, account := range accounts {
+		allowedAndAvailable := stringIntersectionNoDups(account.RoleNames,
+			allowedRoles[account.Name])
+		if len(allowedAndAvailable) < 1 {
+			continue
+		}
+		sort.Strings(allowedAndAvailable)
+		humanName := account.DisplayName
+		if humanName == "" {
+			humanName = account.Name
+		}
+		permittedAccounts = append(permittedAccounts, PermittedAccount{
+			Name:              account.Name,
+			HumanName:         humanName,
+			PermittedRoleName: allowedAndAvailable,
+		})
+	}
+	sa.logger.Debugf(1, "permittedAccounts=%+v", permittedAccounts)
+	return permittedAccounts, nil
+}
+
+func (sa *StaticAccounts) getUserAllowedAccounts(username string) (
+	[]PermittedAccount, error) {
+	userGroups, err := sa.getUserGroups(username)
+	if err != nil {
+		return nil, err
+	}
+	sa.logger.Debugf(1, "UserGroups for '%s' =%+v", username, userGroups)
+	return sa.getUserAllowedAccountsFromGroups(userGroups)
+}
+
+func (sa *StaticAccounts) isUserAllowedToAssumeRole(username string,
+	accountName string, roleName string) (bool, error) {
+	permittedAccounts, err := sa.getUserAllowedAccounts(username)
+	if err != nil {
+		return false, err
+	}
+	for _, account := range permittedAccounts {
+		if account.Name != accountName {
+			continue
+		}
+		for _, permittedRoleName := range account.PermittedRoleName {
+			if permittedRoleName == roleName {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func (sa *StaticAccounts) getAccountDisplayName(accountName string) (
+	string, error) {
+	accounts, err := sa.getAccounts()
+	if err != nil {
+		return "", err
+	}
+	for _, account := range accounts {
+		if account.Name == accountName {
+			if account.DisplayName != "" {
+				return account.DisplayName, nil
+			}
+			return account.Name, nil
+		}
+	}
+	return "", errors.New("accountName not found")
+}
+
+func (sa *StaticAccounts) getAccountRoles(accountName string) (
+	[]string, error) {
+	accounts, err := sa.getAccounts()
+	if err != nil {
+		return nil, err
+	}
+	for _, account := range accounts {
+		if account.Name == accountName {
+			roleNames := append([]string(nil), account.RoleNames...)
+			sort.Strings(roleNames)
+			return roleNames, nil
+		}
+	}
+	return nil, errors.New("accountName not found")
+}
+
+func stringIntersectionNoDups(set1, set2 []string) (intersection []string) {
+	stringMap := make(map[string]string, len(set1))
+	for _, v1 := range set1 {
+		stringMap[strings.ToLower(v1)] = v1
+	}
+	for _, v2 := range set2 {
+		v1, ok := stringMap[strings.ToLower(v2)]
+		if ok {
+			intersection = append(intersection, v1)
+			delete(stringMap, strings.ToLower(v2))
+		}
+	}
+	return intersection
+}
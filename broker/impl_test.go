@@ -0,0 +1,127 @@
+package broker
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+)
+
+func TestGetAllowedRolesFromGroups(t *testing.T) {
+	accounts := []AccountGroup{
+		{AccountName: "prod"},
+		{AccountName: "dev", GroupName: "Development",
+			ExtraUserRoles: []string{"ReadOnly"}},
+		{AccountName: "qa.env"},
+		{AccountName: "ops", GroupName: "ops+"},
+	}
+	// Group names are literal, not regular expressions.
+	userGroups := []string{"prod-admin", "PROD-Billing", "development-admin",
+		"qaXenv-admin", "opsss-admin", "unrelated"}
+	allowedRoles, err := GetAllowedRolesFromGroups(accounts, userGroups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]string{
+		"prod": {"Billing", "admin"},
+		"dev":  {"ReadOnly", "admin"},
+	}
+	for _, roles := range allowedRoles {
+		sort.Strings(roles)
+	}
+	if !reflect.DeepEqual(allowedRoles, expected) {
+		t.Fatalf("expected: %v, got: %v", expected, allowedRoles)
+	}
+}
+
+func TestStringIntersectionNoDups(t *testing.T) {
+	intersection := StringIntersectionNoDups(
+		[]string{"Admin", "ReadOnly", "Billing"},
+		[]string{"admin", "ADMIN", "readonly", "other"})
+	expected := []string{"Admin", "ReadOnly"}
+	if !reflect.DeepEqual(intersection, expected) {
+		t.Fatalf("expected: %v, got: %v", expected, intersection)
+	}
+}
+
+func TestStaticAccounts(t *testing.T) {
+	accounts := []StaticAccount{
+		{Name: "prod", DisplayName: "Production",
+			RoleNames: []string{"viewer", "admin"}},
+		{Name: "dev", ExtraUserRoles: []string{"viewer"},
+			RoleNames: []string{"viewer", "editor"}},
+		{Name: "qa", RoleNames: []string{"admin"}},
+	}
+	userGroups := map[string][]string{"user1": {"prod-admin", "prod-owner"}}
+	staticAccounts := NewStaticAccounts(
+		func() ([]StaticAccount, error) { return accounts, nil },
+		func(username string) ([]string, error) {
+			if username == "broken" {
+				return nil, errors.New("userinfo failed")
+			}
+			return userGroups[username], nil
+		},
+		testlogger.New(t))
+	permittedAccounts, err := staticAccounts.GetUserAllowedAccounts("user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []PermittedAccount{
+		{Name: "prod", HumanName: "Production",
+			PermittedRoleName: []string{"admin"}},
+		{Name: "dev", HumanName: "dev", PermittedRoleName: []string{"viewer"}},
+	}
+	if !reflect.DeepEqual(permittedAccounts, expected) {
+		t.Fatalf("expected: %v, got: %v", expected, permittedAccounts)
+	}
+	for _, test := range []struct {
+		accountName string
+		roleName    string
+		allowed     bool
+	}{
+		{"prod", "admin", true},
+		{"prod", "viewer", false},
+		{"dev", "viewer", true},
+		{"qa", "admin", false},
+	} {
+		allowed, err := staticAccounts.IsUserAllowedToAssumeRole("user1",
+			test.accountName, test.roleName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed != test.allowed {
+			t.Errorf("%s/%s: expected %v", test.accountName, test.roleName,
+				test.allowed)
+		}
+	}
+	if _, err := staticAccounts.IsUserAllowedToAssumeRole("broken", "prod",
+		"admin"); err == nil {
+		t.Fatal("expected userinfo error")
+	}
+	roleNames, err := staticAccounts.GetAccountRoles("prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(roleNames, []string{"admin", "viewer"}) {
+		t.Fatalf("unexpected roles: %v", roleNames)
+	}
+	if _, err := staticAccounts.GetAccountRoles("missing"); err == nil {
+		t.Fatal("expected error for unknown account")
+	}
+	for accountName, expected := range map[string]string{
+		"prod": "Production", "dev": "dev"} {
+		displayName, err := staticAccounts.GetAccountDisplayName(accountName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if displayName != expected {
+			t.Errorf("%s: expected %s, got %s", accountName, expected,
+				displayName)
+		}
+	}
+	if _, err := staticAccounts.GetAccountDisplayName("missing"); err == nil {
+		t.Fatal("expected error for unknown account")
+	}
+}
@@ -9,6 +9,42 @@ import (
 	"github.com/Cloud-Foundations/golib/pkg/watchdog"
 )
 
+type AuditConfig struct {
+	Filename   string `yaml:"filename"`
+	WebhookURL string `yaml:"webhook_url"`
+}
+
+// GrantsConfig enables time-bound grants of roles, approved by members of
+// ApproverGroups.
+type GrantsConfig struct {
+	ApproverGroups []string      `yaml:"approver_groups"`
+	MaxDuration    time.Duration `yaml:"max_duration"`
+}
+
+type SCIMConfig struct {
+	BearerTokenFilename string `yaml:"bearer_token_filename"`
+	BearerToken         string `yaml:"-"`
+}
+
+const (
+	UserInfoSourceGitDB      = "gitdb"
+	UserInfoSourceLDAP       = "ldap"
+	UserInfoSourceOIDCClaims = "oidc_claims"
+	UserInfoSourceSCIM       = "scim"
+)
+
+// UserInfoSourceConfig selects one of the configured userinfo backends. The
+// backend itself is configured in its own section.
+type UserInfoSourceConfig struct {
+	Type    string        `yaml:"type"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+type UserInfoConfig struct {
+	Policy  string                 `yaml:"policy"`
+	Sources []UserInfoSourceConfig `yaml:"sources"`
+}
+
 type BaseConfig struct {
 	ACME                              acmecfg.AcmeConfig
 	HttpRedirectPort                  uint16        `yaml:"http_redirect_port"`
@@ -18,12 +54,18 @@ type BaseConfig struct {
 	TLSKeyFilename                    string        `yaml:"tls_key_filename"`
 	AWSCredentialsFilename            string        `yaml:"aws_credentials_filename"`
 	AWSListRolesRoleName              string        `yaml:"aws_list_roles_role_name"`
+	GCPCredentialsFilename            string        `yaml:"gcp_credentials_filename"`
+	AzureFederatedTokenFilename       string        `yaml:"azure_federated_token_filename"`
+	EnabledClouds                     []string      `yaml:"enabled_clouds"`
 	AccountConfigurationUrl           string        `yaml:"account_configuration_url"`
 	AccountConfigurationCheckInterval time.Duration `yaml:"account_configuration_check_interval"`
 	ClientCAFilename                  string        `yaml:"client_ca_filename"`
+	AdminGroups                       []string      `yaml:"admin_groups"`
 	DataDirectory                     string        `yaml:"data_directory"`
 	SharedDataDirectory               string        `yaml:"shared_data_directory"`
 	ClusterSharedSecretFilename       string        `yaml:"cluster_shared_secret_filename"`
+	SessionStore                      string        `yaml:"session_store"`
+	Peers                             []string      `yaml:"peers"`
 	SharedSecrets                     []string
 }
 
@@ -32,13 +74,15 @@ type GitDatabaseConfig struct {
 }
 
 type OpenIDConfig struct {
-	ClientID     string `yaml:"client_id"`
-	ClientSecret string `yaml:"client_secret"`
-	ProviderURL  string `yaml:"provider_url"`
-	AuthURL      string `yaml:"auth_url"`
-	TokenURL     string `yaml:"token_url"`
-	UserinfoURL  string `yaml:"userinfo_url"`
-	Scopes       string `yaml:"scopes"`
+	ClientID        string `yaml:"client_id"`
+	ClientSecret    string `yaml:"client_secret"`
+	ProviderURL     string `yaml:"provider_url"`
+	AuthURL         string `yaml:"auth_url"`
+	TokenURL        string `yaml:"token_url"`
+	UserinfoURL     string `yaml:"userinfo_url"`
+	Scopes          string `yaml:"scopes"`
+	TokenAuthMethod string `yaml:"token_auth_method"`
+	GroupsClaim     string `yaml:"groups_claim"`
 }
 
 type UserInfoLDAPSource struct {
@@ -52,10 +96,14 @@ type UserInfoLDAPSource struct {
 }
 
 type StaticConfiguration struct {
+	Audit           AuditConfig `yaml:"audit"`
 	Base            BaseConfig
 	DnsLoadBalancer dnslbcfg.Config `yaml:"dns_load_balancer"`
 	GitDB           GitDatabaseConfig
+	Grants          GrantsConfig `yaml:"grants"`
 	Ldap            UserInfoLDAPSource
 	OpenID          OpenIDConfig
+	SCIM            SCIMConfig      `yaml:"scim"`
+	UserInfo        UserInfoConfig  `yaml:"userinfo"`
 	Watchdog        watchdog.Config `yaml:"watchdog"`
 }
@@ -3,6 +3,7 @@ package staticconfiguration
 import (
 	"bufio"
 	"errors"
+	"fmt"
 	"os"
 
 	"github.com/Cloud-Foundations/cloud-gate/lib/constants"
@@ -63,14 +64,31 @@ func LoadVerifyConfigFile(configFilename string) (*StaticConfiguration, error) {
 		config.Base.AccountConfigurationCheckInterval =
 			constants.DefaultAccountConfigurationCheckInterval
 	}
-	// Verify oauth2 setup
-	if len(config.OpenID.AuthURL) < 1 ||
-		len(config.OpenID.TokenURL) < 1 ||
-		len(config.OpenID.UserinfoURL) < 1 ||
-		len(config.OpenID.Scopes) < 1 ||
+	if config.Grants.MaxDuration <= 0 {
+		config.Grants.MaxDuration = constants.DefaultMaxGrantDuration
+	}
+	if len(config.Base.EnabledClouds) < 1 {
+		config.Base.EnabledClouds = []string{constants.DefaultCloudName}
+	}
+	// Verify oauth2 setup. With a provider URL the endpoints are discovered.
+	if len(config.OpenID.Scopes) < 1 ||
 		len(config.OpenID.ClientID) < 1 {
 		return nil, errors.New("invalid openid config")
 	}
+	switch config.OpenID.TokenAuthMethod {
+	case "", "client_secret_basic", "client_secret_post":
+	default:
+		return nil, errors.New("invalid openid token_auth_method")
+	}
+	if len(config.OpenID.ProviderURL) < 1 &&
+		(len(config.OpenID.AuthURL) < 1 ||
+			len(config.OpenID.TokenURL) < 1 ||
+			len(config.OpenID.UserinfoURL) < 1) {
+		return nil, errors.New("invalid openid config")
+	}
+	if err := config.checkUserInfoSources(); err != nil {
+		return nil, err
+	}
 	if err := config.setupHA(); err != nil {
 		return nil, err
 	}
@@ -83,18 +101,62 @@ func LoadVerifyConfigFile(configFilename string) (*StaticConfiguration, error) {
 	if err != nil {
 		return nil, err
 	}
+	if config.SCIM.BearerTokenFilename != "" {
+		tokens, err := getClusterSecretsFile(config.SCIM.BearerTokenFilename)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load SCIM bearer token: %s", err)
+		}
+		config.SCIM.BearerToken = tokens[0]
+	}
 	return &config, nil
 }
 
+func (config *StaticConfiguration) checkUserInfoSources() error {
+	seen := make(map[string]struct{})
+	for _, source := range config.UserInfo.Sources {
+		var configured bool
+		switch source.Type {
+		case UserInfoSourceGitDB:
+			configured = config.GitDB.LocalRepositoryDirectory != ""
+		case UserInfoSourceLDAP:
+			configured = config.Ldap.LDAPTargetURLs != ""
+		case UserInfoSourceOIDCClaims:
+			configured = config.OpenID.GroupsClaim != ""
+		case UserInfoSourceSCIM:
+			configured = config.SCIM.BearerTokenFilename != ""
+		default:
+			return fmt.Errorf("unknown userinfo source: %s", source.Type)
+		}
+		if !configured {
+			return fmt.Errorf("userinfo source %s is not configured",
+				source.Type)
+		}
+		if _, ok := seen[source.Type]; ok {
+			return fmt.Errorf("duplicate userinfo source: %s", source.Type)
+		}
+		seen[source.Type] = struct{}{}
+	}
+	return nil
+}
+
+// setupHA refuses SCIM in a cluster, since its state is kept by each node
+// and the identity provider would only update the node which it reaches.
 func (config *StaticConfiguration) setupHA() error {
-	if hasDnsLB, err := config.DnsLoadBalancer.Check(); err != nil {
+	hasDnsLB, err := config.DnsLoadBalancer.Check()
+	if err != nil {
 		return err
-	} else if hasDnsLB {
+	}
+	if hasDnsLB {
 		config.DnsLoadBalancer.DoTLS = true
 		if config.DnsLoadBalancer.TcpPort < 1 {
 			config.DnsLoadBalancer.TcpPort = config.Base.StatusPort
 		}
 	}
+	if config.SCIM.BearerTokenFilename != "" &&
+		(hasDnsLB || len(config.Base.Peers) > 0) {
+		return errors.New(
+			"scim cannot be used with dns_load_balancer or peers")
+	}
 	config.Watchdog.DoTLS = true
 	if config.Watchdog.CheckInterval > 0 && config.Watchdog.TcpPort < 1 {
 		config.Watchdog.TcpPort = config.Base.StatusPort
@@ -0,0 +1,42 @@
+package staticconfiguration
+
+import (
+	"testing"
+)
+
+func TestCheckUserInfoSources(t *testing.T) {
+	config := &StaticConfiguration{}
+	config.Ldap.LDAPTargetURLs = "ldaps://ldap.example.com"
+	config.SCIM.BearerTokenFilename = "/etc/cloud-gate/scim-token"
+	config.UserInfo.Sources = []UserInfoSourceConfig{
+		{Type: UserInfoSourceSCIM}, {Type: UserInfoSourceLDAP}}
+	if err := config.checkUserInfoSources(); err != nil {
+		t.Fatal(err)
+	}
+	config.UserInfo.Sources = append(config.UserInfo.Sources,
+		UserInfoSourceConfig{Type: UserInfoSourceSCIM})
+	if err := config.checkUserInfoSources(); err == nil {
+		t.Fatal("expected error for duplicate source")
+	}
+	config.UserInfo.Sources = []UserInfoSourceConfig{
+		{Type: UserInfoSourceGitDB}}
+	if err := config.checkUserInfoSources(); err == nil {
+		t.Fatal("expected error for unconfigured source")
+	}
+}
+
+func TestSetupHARejectsSCIMInCluster(t *testing.T) {
+	config := &StaticConfiguration{}
+	config.SCIM.BearerTokenFilename = "/etc/cloud-gate/scim-token"
+	if err := config.setupHA(); err != nil {
+		t.Fatal(err)
+	}
+	config.Base.Peers = []string{"https://cloud-gate-2.example.com:6930"}
+	if err := config.setupHA(); err == nil {
+		t.Fatal("expected error for SCIM with peers")
+	}
+	config.SCIM.BearerTokenFilename = ""
+	if err := config.setupHA(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,68 @@
+package chain
+
+import (
+	"time"
+
+	"github.com/Cloud-Foundations/golib/pkg/auth/userinfo"
+	"github.com/Cloud-Foundations/golib/pkg/log"
+)
+
+const (
+	// PolicyUnion grants the groups from every source which answers. It
+	// fails only if no source answers.
+	PolicyUnion = "union"
+	// PolicyFirstMatch grants the groups from the first source, in order,
+	// which has groups for the user.
+	PolicyFirstMatch = "first_match"
+	// PolicyRequireAll grants only the groups which every source has for the
+	// user, and fails if any source fails.
+	PolicyRequireAll = "require_all"
+)
+
+// Source is a userinfo backend in a chain. A zero Timeout means the chain
+// waits for as long as the backend takes.
+type Source struct {
+	Name     string
+	UserInfo userinfo.UserGroupsGetter
+	Timeout  time.Duration
+}
+
+// UserInfo queries an ordered list of userinfo backends concurrently and
+// merges their answers according to a policy. The optional interfaces of the
+// backends, such as broker.UserAttributesGetter, are passed through.
+type UserInfo struct {
+	logger  log.DebugLogger
+	policy  string
+	sources []Source
+}
+
+func New(sources []Source, policy string,
+	logger log.DebugLogger) (*UserInfo, error) {
+	return newUserInfo(sources, policy, logger)
+}
+
+// GetUserGroups returns the groups of the user, merged according to the
+// policy.
+func (ui *UserInfo) GetUserGroups(username string) ([]string, error) {
+	return ui.getUserGroups(username)
+}
+
+// GetUserAttributes returns the attributes of the user from the sources
+// which have them. The earlier sources take precedence.
+func (ui *UserInfo) GetUserAttributes(username string) (
+	map[string]string, error) {
+	return ui.getUserAttributes(username)
+}
+
+// NotifyUserGroupsChange registers notifier with every source which notifies
+// of group changes.
+func (ui *UserInfo) NotifyUserGroupsChange(notifier func(username string)) {
+	ui.notifyUserGroupsChange(notifier)
+}
+
+// SetUserGroups passes the groups learnt at login to every source which
+// accepts them.
+func (ui *UserInfo) SetUserGroups(username string, groups []string,
+	expiresAt time.Time) {
+	ui.setUserGroups(username, groups, expiresAt)
+}
@@ -0,0 +1,197 @@
+package chain
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Cloud-Foundations/cloud-gate/broker"
+	"github.com/Cloud-Foundations/golib/pkg/log"
+)
+
+type userGroupsSetter interface {
+	SetUserGroups(username string, groups []string, expiresAt time.Time)
+}
+
+type result struct {
+	groups []string
+	err    error
+}
+
+func newUserInfo(sources []Source, policy string,
+	logger log.DebugLogger) (*UserInfo, error) {
+	if len(sources) < 1 {
+		return nil, errors.New("no userinfo sources")
+	}
+	switch policy {
+	case "":
+		policy = PolicyUnion
+	case PolicyUnion, PolicyFirstMatch, PolicyRequireAll:
+	default:
+		return nil, fmt.Errorf("unknown userinfo policy: %s", policy)
+	}
+	return &UserInfo{logger: logger, policy: policy, sources: sources}, nil
+}
+
+// querySource returns a channel which yields the groups from the source, or
+// a timeout error. A source which times out finishes in the background.
+func querySource(source Source, username string) <-chan result {
+	resultChannel := make(chan result, 1)
+	queryChannel := make(chan result, 1)
+	go func() {
+		groups, err := source.UserInfo.GetUserGroups(username)
+		queryChannel <- result{groups, err}
+	}()
+	go func() {
+		if source.Timeout <= 0 {
+			resultChannel <- <-queryChannel
+			return
+		}
+		timer := time.NewTimer(source.Timeout)
+		defer timer.Stop()
+		select {
+		case r := <-queryChannel:
+			resultChannel <- r
+		case <-timer.C:
+			resultChannel <- result{
+				err: fmt.Errorf("timed out after %s", source.Timeout)}
+		}
+	}()
+	return resultChannel
+}
+
+func (ui *UserInfo) getUserGroups(username string) ([]string, error) {
+	resultChannels := make([]<-chan result, 0, len(ui.sources))
+	for _, source := range ui.sources {
+		resultChannels = append(resultChannels, querySource(source, username))
+	}
+	switch ui.policy {
+	case PolicyFirstMatch:
+		return ui.firstMatch(username, resultChannels)
+	case PolicyRequireAll:
+		return ui.requireAll(username, resultChannels)
+	}
+	return ui.union(username, resultChannels)
+}
+
+func (ui *UserInfo) union(username string,
+	resultChannels []<-chan result) ([]string, error) {
+	groups := make(map[string]struct{})
+	var lastErr error
+	numAnswered := 0
+	for index, resultChannel := range resultChannels {
+		r := <-resultChannel
+		if r.err != nil {
+			lastErr = r.err
+			ui.logSourceError(index, username, r.err)
+			continue
+		}
+		numAnswered++
+		for _, group := range r.groups {
+			groups[group] = struct{}{}
+		}
+	}
+	if numAnswered < 1 {
+		return nil, fmt.Errorf("no userinfo source answered: %s", lastErr)
+	}
+	return sortedKeys(groups), nil
+}
+
+// firstMatch skips sources which fail, so that a broken source does not stop
+// the users of the later sources.
+func (ui *UserInfo) firstMatch(username string,
+	resultChannels []<-chan result) ([]string, error) {
+	var lastErr error
+	numAnswered := 0
+	for index, resultChannel := range resultChannels {
+		r := <-resultChannel
+		if r.err != nil {
+			lastErr = r.err
+			ui.logSourceError(index, username, r.err)
+			continue
+		}
+		numAnswered++
+		if len(r.groups) > 0 {
+			return r.groups, nil
+		}
+	}
+	if numAnswered < 1 {
+		return nil, fmt.Errorf("no userinfo source answered: %s", lastErr)
+	}
+	return nil, nil
+}
+
+func (ui *UserInfo) requireAll(username string,
+	resultChannels []<-chan result) ([]string, error) {
+	var groups map[string]struct{}
+	for index, resultChannel := range resultChannels {
+		r := <-resultChannel
+		if r.err != nil {
+			return nil, fmt.Errorf("userinfo source %s: %s",
+				ui.sources[index].Name, r.err)
+		}
+		sourceGroups := make(map[string]struct{}, len(r.groups))
+		for _, group := range r.groups {
+			if _, ok := groups[group]; ok || groups == nil {
+				sourceGroups[group] = struct{}{}
+			}
+		}
+		groups = sourceGroups
+	}
+	return sortedKeys(groups), nil
+}
+
+func (ui *UserInfo) logSourceError(index int, username string, err error) {
+	ui.logger.Printf("userinfo source %s failed for %s: %s\n",
+		ui.sources[index].Name, username, err)
+}
+
+func sortedKeys(set map[string]struct{}) []string {
+	if len(set) < 1 {
+		return nil
+	}
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (ui *UserInfo) getUserAttributes(username string) (
+	map[string]string, error) {
+	attributes := make(map[string]string)
+	for index := len(ui.sources) - 1; index >= 0; index-- {
+		getter, ok := ui.sources[index].UserInfo.(broker.UserAttributesGetter)
+		if !ok {
+			continue
+		}
+		sourceAttributes, err := getter.GetUserAttributes(username)
+		if err != nil {
+			ui.logSourceError(index, username, err)
+			continue
+		}
+		for key, value := range sourceAttributes {
+			attributes[key] = value
+		}
+	}
+	return attributes, nil
+}
+
+func (ui *UserInfo) notifyUserGroupsChange(notifier func(username string)) {
+	for _, source := range ui.sources {
+		if n, ok := source.UserInfo.(broker.UserGroupsChangeNotifier); ok {
+			n.NotifyUserGroupsChange(notifier)
+		}
+	}
+}
+
+func (ui *UserInfo) setUserGroups(username string, groups []string,
+	expiresAt time.Time) {
+	for _, source := range ui.sources {
+		if setter, ok := source.UserInfo.(userGroupsSetter); ok {
+			setter.SetUserGroups(username, groups, expiresAt)
+		}
+	}
+}
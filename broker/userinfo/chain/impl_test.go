@@ -0,0 +1,139 @@
+package chain
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+)
+
+type testSource struct {
+	groups     map[string][]string
+	attributes map[string]string
+	delay      time.Duration
+	err        error
+	setGroups  []string
+}
+
+func (s *testSource) GetUserGroups(username string) ([]string, error) {
+	time.Sleep(s.delay)
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.groups[username], nil
+}
+
+func (s *testSource) GetUserAttributes(username string) (
+	map[string]string, error) {
+	return s.attributes, nil
+}
+
+func (s *testSource) SetUserGroups(username string, groups []string,
+	expiresAt time.Time) {
+	s.setGroups = groups
+}
+
+func TestGetUserGroups(t *testing.T) {
+	ldap := &testSource{groups: map[string][]string{
+		"employee1": {"group1", "group2"},
+		"both1":     {"group1"},
+	}}
+	gitdb := &testSource{groups: map[string][]string{
+		"contractor1": {"group3"},
+		"both1":       {"group1", "group3"},
+	}}
+	broken := &testSource{err: errors.New("broken")}
+	slow := &testSource{delay: time.Second,
+		groups: map[string][]string{"employee1": {"group4"}}}
+	tests := []struct {
+		name      string
+		policy    string
+		sources   []Source
+		username  string
+		expected  []string
+		expectErr bool
+	}{
+		{"union employee", PolicyUnion,
+			[]Source{{"ldap", ldap, 0}, {"gitdb", gitdb, 0}},
+			"employee1", []string{"group1", "group2"}, false},
+		{"union contractor", PolicyUnion,
+			[]Source{{"ldap", ldap, 0}, {"gitdb", gitdb, 0}},
+			"contractor1", []string{"group3"}, false},
+		{"union both", PolicyUnion,
+			[]Source{{"ldap", ldap, 0}, {"gitdb", gitdb, 0}},
+			"both1", []string{"group1", "group3"}, false},
+		{"union with broken source", PolicyUnion,
+			[]Source{{"broken", broken, 0}, {"gitdb", gitdb, 0}},
+			"contractor1", []string{"group3"}, false},
+		{"union all broken", PolicyUnion,
+			[]Source{{"broken", broken, 0}},
+			"contractor1", nil, true},
+		{"union with slow source", PolicyUnion,
+			[]Source{{"slow", slow, 10 * time.Millisecond},
+				{"ldap", ldap, 0}},
+			"employee1", []string{"group1", "group2"}, false},
+		{"first match", PolicyFirstMatch,
+			[]Source{{"ldap", ldap, 0}, {"gitdb", gitdb, 0}},
+			"both1", []string{"group1"}, false},
+		{"first match later source", PolicyFirstMatch,
+			[]Source{{"broken", broken, 0}, {"ldap", ldap, 0},
+				{"gitdb", gitdb, 0}},
+			"contractor1", []string{"group3"}, false},
+		{"require all", PolicyRequireAll,
+			[]Source{{"ldap", ldap, 0}, {"gitdb", gitdb, 0}},
+			"both1", []string{"group1"}, false},
+		{"require all unknown", PolicyRequireAll,
+			[]Source{{"ldap", ldap, 0}, {"gitdb", gitdb, 0}},
+			"contractor1", nil, false},
+		{"require all with slow source", PolicyRequireAll,
+			[]Source{{"ldap", ldap, 0}, {"slow", slow, 10 * time.Millisecond}},
+			"employee1", nil, true},
+	}
+	for _, test := range tests {
+		ui, err := New(test.sources, test.policy, testlogger.New(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		groups, err := ui.GetUserGroups(test.username)
+		if (err != nil) != test.expectErr {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(groups, test.expected) {
+			t.Errorf("%s: expected: %v, got: %v", test.name, test.expected,
+				groups)
+		}
+	}
+}
+
+func TestNewBadPolicy(t *testing.T) {
+	_, err := New([]Source{{"ldap", &testSource{}, 0}}, "majority",
+		testlogger.New(t))
+	if err == nil {
+		t.Fatal("expected error for unknown policy")
+	}
+}
+
+func TestPassThrough(t *testing.T) {
+	source1 := &testSource{attributes: map[string]string{"a": "1", "b": "1"}}
+	source2 := &testSource{attributes: map[string]string{"b": "2", "c": "2"}}
+	ui, err := New([]Source{{"source1", source1, 0},
+		{"source2", source2, 0}}, PolicyUnion, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	attributes, err := ui.GetUserAttributes("user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"a": "1", "b": "1", "c": "2"}
+	if !reflect.DeepEqual(attributes, expected) {
+		t.Fatalf("expected: %v, got: %v", expected, attributes)
+	}
+	ui.SetUserGroups("user1", []string{"group1"}, time.Now().Add(time.Hour))
+	if len(source1.setGroups) != 1 || len(source2.setGroups) != 1 {
+		t.Fatal("groups not passed to sources")
+	}
+}
@@ -0,0 +1,53 @@
+package claims
+
+import (
+	"sync"
+	"time"
+)
+
+type userEntry struct {
+	groups    []string
+	expiresAt time.Time
+}
+
+// UserInfo is a userinfo backend which learns the groups of users from the
+// claims presented by the OpenID provider when they log in. A user is only
+// known while they have a session: unknown users have no groups. Used alone,
+// it therefore grants nothing to users who only present a client certificate,
+// such as those of cg-client.
+type UserInfo struct {
+	mutex     sync.Mutex // Protect everything below.
+	notifiers []func(username string)
+	users     map[string]userEntry // K: username.
+}
+
+func New() *UserInfo {
+	return newUserInfo()
+}
+
+// GetUserGroups returns the groups of the user from their last login, if it
+// has not expired.
+func (ui *UserInfo) GetUserGroups(username string) ([]string, error) {
+	return ui.getUserGroups(username)
+}
+
+// SetUserGroups records the groups of the user until expiresAt.
+func (ui *UserInfo) SetUserGroups(username string, groups []string,
+	expiresAt time.Time) {
+	ui.setUserGroups(username, groups, expiresAt)
+}
+
+// NotifyUserGroupsChange registers a function to call with the username
+// whenever a login changes the groups of a user, or they expire.
+func (ui *UserInfo) NotifyUserGroupsChange(notifier func(username string)) {
+	ui.mutex.Lock()
+	defer ui.mutex.Unlock()
+	ui.notifiers = append(ui.notifiers, notifier)
+}
+
+// GetGroupsFromClaim extracts the groups from the claim, which may be a list
+// of strings or a string of space or comma separated groups.
+func GetGroupsFromClaim(claims map[string]interface{},
+	claimName string) ([]string, bool) {
+	return getGroupsFromClaim(claims, claimName)
+}
@@ -0,0 +1,124 @@
+package claims
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+func newUserInfo() *UserInfo {
+	ui := &UserInfo{users: make(map[string]userEntry)}
+	go ui.cleanupLoop()
+	return ui
+}
+
+func (ui *UserInfo) getUserGroups(username string) ([]string, error) {
+	ui.mutex.Lock()
+	defer ui.mutex.Unlock()
+	entry, ok := ui.users[username]
+	if !ok || entry.expiresAt.Before(time.Now()) {
+		return nil, nil
+	}
+	groups := make([]string, len(entry.groups))
+	copy(groups, entry.groups)
+	return groups, nil
+}
+
+func sameGroups(left, right []string) bool {
+	if len(left) != len(right) {
+		return false
+	}
+	sortedLeft := append([]string(nil), left...)
+	sortedRight := append([]string(nil), right...)
+	sort.Strings(sortedLeft)
+	sort.Strings(sortedRight)
+	for index := range sortedLeft {
+		if sortedLeft[index] != sortedRight[index] {
+			return false
+		}
+	}
+	return true
+}
+
+func (ui *UserInfo) setUserGroups(username string, groups []string,
+	expiresAt time.Time) {
+	ui.mutex.Lock()
+	// Keep the groups of the most recent login, which expires last.
+	entry, ok := ui.users[username]
+	if ok && entry.expiresAt.After(expiresAt) {
+		ui.mutex.Unlock()
+		return
+	}
+	now := time.Now()
+	var oldGroups, newGroups []string
+	if ok && entry.expiresAt.After(now) {
+		oldGroups = entry.groups
+	}
+	if expiresAt.After(now) {
+		newGroups = groups
+	}
+	ui.users[username] = userEntry{groups: groups, expiresAt: expiresAt}
+	notifiers := ui.notifiers
+	ui.mutex.Unlock()
+	if !sameGroups(oldGroups, newGroups) {
+		ui.notify(notifiers, []string{username})
+	}
+}
+
+// notify must be called without the mutex held.
+func (ui *UserInfo) notify(notifiers []func(username string),
+	usernames []string) {
+	for _, username := range usernames {
+		for _, notifier := range notifiers {
+			notifier(username)
+		}
+	}
+}
+
+func (ui *UserInfo) cleanupLoop() {
+	for {
+		time.Sleep(time.Minute)
+		ui.cleanup()
+	}
+}
+
+func (ui *UserInfo) cleanup() {
+	now := time.Now()
+	var expiredUsernames []string
+	ui.mutex.Lock()
+	for username, entry := range ui.users {
+		if entry.expiresAt.Before(now) {
+			delete(ui.users, username)
+			if len(entry.groups) > 0 {
+				expiredUsernames = append(expiredUsernames, username)
+			}
+		}
+	}
+	notifiers := ui.notifiers
+	ui.mutex.Unlock()
+	ui.notify(notifiers, expiredUsernames)
+}
+
+func getGroupsFromClaim(claims map[string]interface{},
+	claimName string) ([]string, bool) {
+	value, ok := claims[claimName]
+	if !ok {
+		return nil, false
+	}
+	var groups []string
+	switch value := value.(type) {
+	case []interface{}:
+		for _, group := range value {
+			if group, ok := group.(string); ok && group != "" {
+				groups = append(groups, group)
+			}
+		}
+	case string:
+		groups = strings.FieldsFunc(value, func(r rune) bool {
+			return r == ' ' || r == ','
+		})
+	default:
+		return nil, false
+	}
+	return groups, true
+}
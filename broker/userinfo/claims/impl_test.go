@@ -0,0 +1,83 @@
+package claims
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGetGroupsFromClaim(t *testing.T) {
+	var claims map[string]interface{}
+	err := json.Unmarshal([]byte(`{
+		"groups": ["group1", "", "group2"],
+		"roles": "group1 group2,group3",
+		"number": 1
+	}`), &claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		claimName string
+		expected  []string
+		found     bool
+	}{
+		{"groups", []string{"group1", "group2"}, true},
+		{"roles", []string{"group1", "group2", "group3"}, true},
+		{"number", nil, false},
+		{"missing", nil, false},
+	}
+	for _, test := range tests {
+		groups, found := GetGroupsFromClaim(claims, test.claimName)
+		if found != test.found || !reflect.DeepEqual(groups, test.expected) {
+			t.Errorf("%s: expected: %v %v, got: %v %v", test.claimName,
+				test.expected, test.found, groups, found)
+		}
+	}
+}
+
+func TestUserGroups(t *testing.T) {
+	ui := &UserInfo{users: make(map[string]userEntry)}
+	ui.SetUserGroups("user1", []string{"group1"}, time.Now().Add(time.Hour))
+	ui.SetUserGroups("user2", []string{"group2"}, time.Now().Add(-time.Hour))
+	// An older session does not replace the groups.
+	ui.SetUserGroups("user1", []string{"group3"}, time.Now().Add(time.Minute))
+	groups, err := ui.GetUserGroups("user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(groups, []string{"group1"}) {
+		t.Fatalf("unexpected groups: %v", groups)
+	}
+	for _, username := range []string{"user2", "user3"} {
+		if groups, _ := ui.GetUserGroups(username); len(groups) > 0 {
+			t.Errorf("%s: unexpected groups: %v", username, groups)
+		}
+	}
+	ui.cleanup()
+	if _, ok := ui.users["user2"]; ok {
+		t.Fatal("expired user not cleaned up")
+	}
+}
+
+func TestNotifyUserGroupsChange(t *testing.T) {
+	ui := &UserInfo{users: make(map[string]userEntry)}
+	var notified []string
+	ui.NotifyUserGroupsChange(func(username string) {
+		notified = append(notified, username)
+	})
+	ui.SetUserGroups("user1", []string{"group1", "group2"},
+		time.Now().Add(time.Hour))
+	// The same groups in another order are not a change.
+	ui.SetUserGroups("user1", []string{"group2", "group1"},
+		time.Now().Add(2*time.Hour))
+	ui.SetUserGroups("user1", []string{"group1"}, time.Now().Add(3*time.Hour))
+	// An older session does not replace the groups.
+	ui.SetUserGroups("user1", []string{"group3"}, time.Now().Add(time.Minute))
+	ui.SetUserGroups("user2", []string{"group2"}, time.Now().Add(-time.Hour))
+	ui.cleanup()
+	expected := []string{"user1", "user1", "user2"}
+	if !reflect.DeepEqual(notified, expected) {
+		t.Fatalf("expected notifications: %v, got: %v", expected, notified)
+	}
+}
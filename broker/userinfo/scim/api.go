@@ -0,0 +1,87 @@
+package scim
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Cloud-Foundations/golib/pkg/log"
+)
+
+// PathPrefix is where the SCIM 2.0 resources are served.
+const PathPrefix = "/scim/v2/"
+
+type userEntry struct {
+	ID           string            `json:"id"`
+	ExternalID   string            `json:"externalId,omitempty"`
+	UserName     string            `json:"userName"`
+	Active       bool              `json:"active"`
+	Attributes   map[string]string `json:"attributes,omitempty"`
+	Created      time.Time         `json:"created"`
+	LastModified time.Time         `json:"lastModified"`
+}
+
+type groupEntry struct {
+	ID           string    `json:"id"`
+	ExternalID   string    `json:"externalId,omitempty"`
+	DisplayName  string    `json:"displayName"`
+	Members      []string  `json:"members,omitempty"` // User IDs.
+	Created      time.Time `json:"created"`
+	LastModified time.Time `json:"lastModified"`
+}
+
+type state struct {
+	Users  map[string]*userEntry  `json:"users"`  // K: ID.
+	Groups map[string]*groupEntry `json:"groups"` // K: ID.
+}
+
+// UserInfo is a userinfo backend whose users and groups are pushed by an
+// identity provider using SCIM 2.0 (RFC 7643 and RFC 7644). The group names
+// are the display names of the SCIM groups. The user attributes are the
+// primary email as "mail", "displayName", and the attributes of the
+// enterprise user extension: "employeeNumber", "costCenter", "organization",
+// "division" and "department". The state is persisted to a local file, so
+// that it survives restarts. It is not shared with other instances, so the
+// static configuration refuses SCIM in a cluster.
+type UserInfo struct {
+	bearerToken string
+	filename    string
+	logger      log.DebugLogger
+	mutex       sync.Mutex // Protect everything below.
+	state       state
+	userIDs     map[string]string // K: lower case userName, V: ID.
+	notifiers   []func(username string)
+}
+
+// New creates a UserInfo which loads and saves its state in filename, and
+// only serves requests which present bearerToken.
+func New(filename string, bearerToken string,
+	logger log.DebugLogger) (*UserInfo, error) {
+	return newUserInfo(filename, bearerToken, logger)
+}
+
+// GetUserGroups returns the groups of the user. Unknown and inactive users
+// have no groups.
+func (ui *UserInfo) GetUserGroups(username string) ([]string, error) {
+	return ui.getUserGroups(username)
+}
+
+// GetUserAttributes returns the attributes of the user. Unknown and inactive
+// users have no attributes.
+func (ui *UserInfo) GetUserAttributes(username string) (
+	map[string]string, error) {
+	return ui.getUserAttributes(username)
+}
+
+// NotifyUserGroupsChange registers a function to call with the username
+// whenever the groups of a user may have changed.
+func (ui *UserInfo) NotifyUserGroupsChange(notifier func(username string)) {
+	ui.mutex.Lock()
+	defer ui.mutex.Unlock()
+	ui.notifiers = append(ui.notifiers, notifier)
+}
+
+// ServeHTTP serves the SCIM Users and Groups resources below PathPrefix.
+func (ui *UserInfo) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ui.serveHTTP(w, r)
+}
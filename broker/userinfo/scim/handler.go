@@ -0,0 +1,831 @@
+package scim
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	schemaError          = "urn:ietf:params:scim:api:messages:2.0:Error"
+	schemaGroup          = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	schemaListResponse   = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	schemaPatchOp        = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	schemaProviderConfig = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	schemaUser           = "urn:ietf:params:scim:schemas:core:2.0:User"
+	schemaEnterpriseUser = "urn:ietf:params:scim:schemas:extension:enterprise:2.0:User"
+
+	contentType        = "application/scim+json"
+	maxRequestSize     = 1 << 20
+	defaultMaxResults  = 100
+	maxResultsPageSize = 1000
+)
+
+// Only the "eq" operator is supported, which is what identity providers use
+// to look up resources before they create them.
+var filterRegex = regexp.MustCompile(`^(\w+)\s+(?i:eq)\s+("(?:[^"\\]|\\.)*")$`)
+
+// Member filters in paths, such as: members[value eq "2819c223"].
+var memberPathRegex = regexp.MustCompile(
+	`^(?i:members)\[\s*(?i:value)\s+(?i:eq)\s+("(?:[^"\\]|\\.)*")\s*\]$`)
+
+type resourceMeta struct {
+	ResourceType string    `json:"resourceType"`
+	Created      time.Time `json:"created"`
+	LastModified time.Time `json:"lastModified"`
+	Location     string    `json:"location"`
+}
+
+// The names of the stored user attributes.
+const (
+	attributeCostCenter     = "costCenter"
+	attributeDepartment     = "department"
+	attributeDisplayName    = "displayName"
+	attributeDivision       = "division"
+	attributeEmployeeNumber = "employeeNumber"
+	attributeMail           = "mail"
+	attributeOrganization   = "organization"
+)
+
+// Paths of the primary email, such as: emails[type eq "work"].value.
+var emailValuePathRegex = regexp.MustCompile(
+	`^(?i:emails)\[[^\]]*\]\.(?i:value)$`)
+
+type emailResource struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+type enterpriseUserResource struct {
+	EmployeeNumber string `json:"employeeNumber,omitempty"`
+	CostCenter     string `json:"costCenter,omitempty"`
+	Organization   string `json:"organization,omitempty"`
+	Division       string `json:"division,omitempty"`
+	Department     string `json:"department,omitempty"`
+}
+
+type userResource struct {
+	Schemas     []string                `json:"schemas"`
+	ID          string                  `json:"id,omitempty"`
+	ExternalID  string                  `json:"externalId,omitempty"`
+	UserName    string                  `json:"userName"`
+	DisplayName string                  `json:"displayName,omitempty"`
+	Active      *bool                   `json:"active,omitempty"`
+	Emails      []emailResource         `json:"emails,omitempty"`
+	Enterprise  *enterpriseUserResource `json:"urn:ietf:params:scim:schemas:extension:enterprise:2.0:User,omitempty"`
+	Meta        *resourceMeta           `json:"meta,omitempty"`
+}
+
+type memberResource struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+}
+
+type groupResource struct {
+	Schemas     []string         `json:"schemas"`
+	ID          string           `json:"id,omitempty"`
+	ExternalID  string           `json:"externalId,omitempty"`
+	DisplayName string           `json:"displayName"`
+	Members     []memberResource `json:"members"`
+	Meta        *resourceMeta    `json:"meta,omitempty"`
+}
+
+type listResponse struct {
+	Schemas      []string      `json:"schemas"`
+	TotalResults int           `json:"totalResults"`
+	StartIndex   int           `json:"startIndex"`
+	ItemsPerPage int           `json:"itemsPerPage"`
+	Resources    []interface{} `json:"Resources"`
+}
+
+type errorResponse struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	ScimType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail,omitempty"`
+}
+
+type patchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+type patchRequest struct {
+	Schemas    []string         `json:"schemas"`
+	Operations []patchOperation `json:"Operations"`
+}
+
+type supported struct {
+	Supported bool `json:"supported"`
+}
+
+type filterSupported struct {
+	Supported  bool `json:"supported"`
+	MaxResults int  `json:"maxResults"`
+}
+
+type bulkSupported struct {
+	Supported      bool `json:"supported"`
+	MaxOperations  int  `json:"maxOperations"`
+	MaxPayloadSize int  `json:"maxPayloadSize"`
+}
+
+type authenticationScheme struct {
+	Type        string `json:"type"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+type serviceProviderConfig struct {
+	Schemas               []string               `json:"schemas"`
+	Patch                 supported              `json:"patch"`
+	Bulk                  bulkSupported          `json:"bulk"`
+	Filter                filterSupported        `json:"filter"`
+	ChangePassword        supported              `json:"changePassword"`
+	Sort                  supported              `json:"sort"`
+	Etag                  supported              `json:"etag"`
+	AuthenticationSchemes []authenticationScheme `json:"authenticationSchemes"`
+}
+
+func writeResponse(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	response := errorResponse{
+		Schemas: []string{schemaError},
+		Status:  strconv.Itoa(http.StatusInternalServerError),
+		Detail:  "internal error",
+	}
+	var scimErr *scimError
+	if errors.As(err, &scimErr) {
+		response.Status = strconv.Itoa(scimErr.status)
+		response.ScimType = scimErr.scimType
+		response.Detail = scimErr.detail
+	}
+	status, _ := strconv.Atoi(response.Status)
+	writeResponse(w, status, response)
+}
+
+func (ui *UserInfo) isAuthorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if ui.bearerToken == "" || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token),
+		[]byte(ui.bearerToken)) == 1
+}
+
+func (ui *UserInfo) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if !ui.isAuthorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="scim"`)
+		writeError(w, errorf(http.StatusUnauthorized, "", "unauthorized"))
+		return
+	}
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, PathPrefix), "/")
+	resourceType, id, _ := strings.Cut(path, "/")
+	if strings.Contains(id, "/") {
+		writeError(w, errorf(http.StatusNotFound, "", "not found"))
+		return
+	}
+	switch resourceType {
+	case "Users":
+		ui.serveUsers(w, r, id)
+	case "Groups":
+		ui.serveGroups(w, r, id)
+	case "ServiceProviderConfig":
+		serveServiceProviderConfig(w, r)
+	default:
+		writeError(w, errorf(http.StatusNotFound, "", "not found"))
+	}
+}
+
+func serveServiceProviderConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, errorf(http.StatusMethodNotAllowed, "",
+			"method not allowed"))
+		return
+	}
+	writeResponse(w, http.StatusOK, serviceProviderConfig{
+		Schemas: []string{schemaProviderConfig},
+		Patch:   supported{true},
+		Filter:  filterSupported{true, maxResultsPageSize},
+		AuthenticationSchemes: []authenticationScheme{{
+			Type:        "oauthbearertoken",
+			Name:        "OAuth Bearer Token",
+			Description: "Authentication using a static bearer token",
+		}},
+	})
+}
+
+func decodeRequest(r *http.Request, value interface{}) error {
+	decoder := json.NewDecoder(io.LimitReader(r.Body, maxRequestSize))
+	if err := decoder.Decode(value); err != nil {
+		return errorf(http.StatusBadRequest, "invalidSyntax",
+			"cannot decode request: %s", err)
+	}
+	return nil
+}
+
+// parseFilter returns the attribute name and the value of an "eq" filter.
+func parseFilter(filter string) (string, string, error) {
+	matches := filterRegex.FindStringSubmatch(strings.TrimSpace(filter))
+	if matches == nil {
+		return "", "", errorf(http.StatusBadRequest, "invalidFilter",
+			"unsupported filter: %s", filter)
+	}
+	value, err := strconv.Unquote(matches[2])
+	if err != nil {
+		return "", "", errorf(http.StatusBadRequest, "invalidFilter",
+			"bad filter value: %s", matches[2])
+	}
+	return matches[1], value, nil
+}
+
+func writeList(w http.ResponseWriter, r *http.Request,
+	resources []interface{}) {
+	startIndex, count := 1, defaultMaxResults
+	if value, err := strconv.Atoi(r.FormValue("startIndex")); err == nil &&
+		value > 1 {
+		startIndex = value
+	}
+	if value, err := strconv.Atoi(r.FormValue("count")); err == nil &&
+		value >= 0 {
+		count = value
+	}
+	if count > maxResultsPageSize {
+		count = maxResultsPageSize
+	}
+	total := len(resources)
+	start := startIndex - 1
+	if start > total {
+		start = total
+	}
+	end := start + count
+	if end > total {
+		end = total
+	}
+	writeResponse(w, http.StatusOK, listResponse{
+		Schemas:      []string{schemaListResponse},
+		TotalResults: total,
+		StartIndex:   startIndex,
+		ItemsPerPage: end - start,
+		Resources:    append([]interface{}{}, resources[start:end]...),
+	})
+}
+
+func (ui *UserInfo) serveUsers(w http.ResponseWriter, r *http.Request,
+	id string) {
+	var user userEntry
+	var err error
+	status := http.StatusOK
+	switch {
+	case id == "" && r.Method == "GET":
+		ui.listUsersHandler(w, r)
+		return
+	case id == "" && r.Method == "POST":
+		var resource userResource
+		if err := decodeRequest(r, &resource); err != nil {
+			writeError(w, err)
+			return
+		}
+		user, err = ui.putUser("", resource.replace)
+		status = http.StatusCreated
+	case id == "":
+		err = errorf(http.StatusMethodNotAllowed, "", "method not allowed")
+	case r.Method == "GET":
+		user, err = ui.getUser(id)
+	case r.Method == "PUT":
+		var resource userResource
+		if err := decodeRequest(r, &resource); err != nil {
+			writeError(w, err)
+			return
+		}
+		user, err = ui.putUser(id, resource.replace)
+	case r.Method == "PATCH":
+		var request patchRequest
+		if err := decodeRequest(r, &request); err != nil {
+			writeError(w, err)
+			return
+		}
+		user, err = ui.putUser(id, func(user *userEntry) error {
+			return request.applyToUser(user)
+		})
+	case r.Method == "DELETE":
+		if err := ui.deleteUser(id); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		err = errorf(http.StatusMethodNotAllowed, "", "method not allowed")
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeResponse(w, status, newUserResource(user))
+}
+
+func (ui *UserInfo) listUsersHandler(w http.ResponseWriter, r *http.Request) {
+	match := func(*userEntry) bool { return true }
+	if filter := r.FormValue("filter"); filter != "" {
+		attribute, value, err := parseFilter(filter)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		switch strings.ToLower(attribute) {
+		case "username":
+			match = func(user *userEntry) bool {
+				return strings.EqualFold(user.UserName, value)
+			}
+		case "externalid":
+			match = func(user *userEntry) bool {
+				return user.ExternalID == value
+			}
+		case "id":
+			match = func(user *userEntry) bool { return user.ID == value }
+		default:
+			writeError(w, errorf(http.StatusBadRequest, "invalidFilter",
+				"unsupported filter attribute: %s", attribute))
+			return
+		}
+	}
+	users := ui.listUsers(match)
+	resources := make([]interface{}, 0, len(users))
+	for _, user := range users {
+		resources = append(resources, newUserResource(user))
+	}
+	writeList(w, r, resources)
+}
+
+func newUserResource(user userEntry) userResource {
+	active := user.Active
+	resource := userResource{
+		Schemas:     []string{schemaUser},
+		ID:          user.ID,
+		ExternalID:  user.ExternalID,
+		UserName:    user.UserName,
+		DisplayName: user.Attributes[attributeDisplayName],
+		Active:      &active,
+		Meta: &resourceMeta{
+			ResourceType: "User",
+			Created:      user.Created,
+			LastModified: user.LastModified,
+			Location:     PathPrefix + "Users/" + user.ID,
+		},
+	}
+	if mail := user.Attributes[attributeMail]; mail != "" {
+		resource.Emails = []emailResource{{Value: mail, Primary: true}}
+	}
+	enterprise := enterpriseUserResource{
+		EmployeeNumber: user.Attributes[attributeEmployeeNumber],
+		CostCenter:     user.Attributes[attributeCostCenter],
+		Organization:   user.Attributes[attributeOrganization],
+		Division:       user.Attributes[attributeDivision],
+		Department:     user.Attributes[attributeDepartment],
+	}
+	if enterprise != (enterpriseUserResource{}) {
+		resource.Schemas = append(resource.Schemas, schemaEnterpriseUser)
+		resource.Enterprise = &enterprise
+	}
+	return resource
+}
+
+// getPrimaryEmail returns the primary email, or else the first one.
+func getPrimaryEmail(emails []emailResource) string {
+	for _, email := range emails {
+		if email.Primary {
+			return email.Value
+		}
+	}
+	if len(emails) > 0 {
+		return emails[0].Value
+	}
+	return ""
+}
+
+// setAttribute stores the value of the user attribute, or removes the
+// attribute if the value is empty.
+func setAttribute(user *userEntry, name string, value string) {
+	if value == "" {
+		delete(user.Attributes, name)
+		return
+	}
+	if user.Attributes == nil {
+		user.Attributes = make(map[string]string)
+	}
+	user.Attributes[name] = value
+}
+
+func (resource *enterpriseUserResource) setAttributes(user *userEntry) {
+	setAttribute(user, attributeEmployeeNumber, resource.EmployeeNumber)
+	setAttribute(user, attributeCostCenter, resource.CostCenter)
+	setAttribute(user, attributeOrganization, resource.Organization)
+	setAttribute(user, attributeDivision, resource.Division)
+	setAttribute(user, attributeDepartment, resource.Department)
+}
+
+// getEnterpriseAttributeName returns the name of the stored attribute of the
+// enterprise user extension, or "" if it is not stored.
+func getEnterpriseAttributeName(name string) string {
+	for _, attribute := range []string{attributeEmployeeNumber,
+		attributeCostCenter, attributeOrganization, attributeDivision,
+		attributeDepartment} {
+		if strings.EqualFold(name, attribute) {
+			return attribute
+		}
+	}
+	return ""
+}
+
+// replace sets the attributes of the user to those in the resource. A missing
+// active attribute means the user is active.
+func (resource userResource) replace(user *userEntry) error {
+	user.UserName = resource.UserName
+	user.ExternalID = resource.ExternalID
+	user.Active = resource.Active == nil || *resource.Active
+	user.Attributes = nil
+	setAttribute(user, attributeDisplayName, resource.DisplayName)
+	setAttribute(user, attributeMail, getPrimaryEmail(resource.Emails))
+	if resource.Enterprise != nil {
+		resource.Enterprise.setAttributes(user)
+	}
+	return nil
+}
+
+// parseBool accepts booleans and the strings "true" and "false", which some
+// identity providers send in PATCH operations.
+func parseBool(value json.RawMessage) (bool, error) {
+	var result bool
+	if err := json.Unmarshal(value, &result); err == nil {
+		return result, nil
+	}
+	var str string
+	if err := json.Unmarshal(value, &str); err == nil {
+		if result, err := strconv.ParseBool(str); err == nil {
+			return result, nil
+		}
+	}
+	return false, errorf(http.StatusBadRequest, "invalidValue",
+		"bad boolean: %s", string(value))
+}
+
+func parseString(value json.RawMessage) (string, error) {
+	var result string
+	if err := json.Unmarshal(value, &result); err != nil {
+		return "", errorf(http.StatusBadRequest, "invalidValue",
+			"bad string: %s", string(value))
+	}
+	return result, nil
+}
+
+func (request patchRequest) checkOperations() error {
+	if len(request.Operations) < 1 {
+		return errorf(http.StatusBadRequest, "invalidSyntax",
+			"no operations")
+	}
+	for _, operation := range request.Operations {
+		switch strings.ToLower(operation.Op) {
+		case "add", "remove", "replace":
+		default:
+			return errorf(http.StatusBadRequest, "invalidSyntax",
+				"unsupported operation: %s", operation.Op)
+		}
+	}
+	return nil
+}
+
+func (request patchRequest) applyToUser(user *userEntry) error {
+	if err := request.checkOperations(); err != nil {
+		return err
+	}
+	for _, operation := range request.Operations {
+		if strings.ToLower(operation.Op) == "remove" {
+			if err := removeUserAttribute(user, operation.Path); err != nil {
+				return err
+			}
+			continue
+		}
+		values := map[string]json.RawMessage{operation.Path: operation.Value}
+		if operation.Path == "" {
+			values = nil
+			if err := json.Unmarshal(operation.Value, &values); err != nil {
+				return errorf(http.StatusBadRequest, "invalidValue",
+					"bad value: %s", string(operation.Value))
+			}
+		}
+		for path, value := range values {
+			if err := applyUserAttribute(user, path, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// getStoredAttributeName returns the name of the stored attribute for the
+// path of a PATCH operation, or "" if it is not stored.
+func getStoredAttributeName(path string) string {
+	lowerPath := strings.ToLower(path)
+	enterprisePrefix := strings.ToLower(schemaEnterpriseUser) + ":"
+	switch {
+	case lowerPath == "displayname":
+		return attributeDisplayName
+	case emailValuePathRegex.MatchString(path):
+		return attributeMail
+	case strings.HasPrefix(lowerPath, enterprisePrefix):
+		return getEnterpriseAttributeName(path[len(enterprisePrefix):])
+	}
+	return ""
+}
+
+func removeUserAttribute(user *userEntry, path string) error {
+	if strings.ToLower(path) == "emails" {
+		setAttribute(user, attributeMail, "")
+		return nil
+	}
+	if name := getStoredAttributeName(path); name != "" {
+		setAttribute(user, name, "")
+		return nil
+	}
+	switch strings.ToLower(path) {
+	case "", "active", "username", "externalid":
+		return errorf(http.StatusBadRequest, "mutability",
+			"cannot remove user attribute: %s", path)
+	}
+	return nil
+}
+
+func applyUserAttribute(user *userEntry, path string,
+	value json.RawMessage) error {
+	var err error
+	switch lowerPath := strings.ToLower(path); {
+	case lowerPath == "active":
+		user.Active, err = parseBool(value)
+	case lowerPath == "username":
+		user.UserName, err = parseString(value)
+	case lowerPath == "externalid":
+		user.ExternalID, err = parseString(value)
+	case lowerPath == "emails":
+		var emails []emailResource
+		if json.Unmarshal(value, &emails) != nil {
+			return errorf(http.StatusBadRequest, "invalidValue",
+				"bad emails: %s", string(value))
+		}
+		setAttribute(user, attributeMail, getPrimaryEmail(emails))
+	case lowerPath == strings.ToLower(schemaEnterpriseUser):
+		var enterprise enterpriseUserResource
+		if json.Unmarshal(value, &enterprise) != nil {
+			return errorf(http.StatusBadRequest, "invalidValue",
+				"bad enterprise user: %s", string(value))
+		}
+		enterprise.setAttributes(user)
+	default:
+		// Attributes which are not stored, such as names, are ignored.
+		if name := getStoredAttributeName(path); name != "" {
+			var str string
+			if str, err = parseString(value); err == nil {
+				setAttribute(user, name, str)
+			}
+		}
+	}
+	return err
+}
+
+func (ui *UserInfo) serveGroups(w http.ResponseWriter, r *http.Request,
+	id string) {
+	var group groupEntry
+	var err error
+	status := http.StatusOK
+	switch {
+	case id == "" && r.Method == "GET":
+		ui.listGroupsHandler(w, r)
+		return
+	case id == "" && r.Method == "POST":
+		var resource groupResource
+		if err := decodeRequest(r, &resource); err != nil {
+			writeError(w, err)
+			return
+		}
+		group, err = ui.putGroup("", resource.replace)
+		status = http.StatusCreated
+	case id == "":
+		err = errorf(http.StatusMethodNotAllowed, "", "method not allowed")
+	case r.Method == "GET":
+		group, err = ui.getGroup(id)
+	case r.Method == "PUT":
+		var resource groupResource
+		if err := decodeRequest(r, &resource); err != nil {
+			writeError(w, err)
+			return
+		}
+		group, err = ui.putGroup(id, resource.replace)
+	case r.Method == "PATCH":
+		var request patchRequest
+		if err := decodeRequest(r, &request); err != nil {
+			writeError(w, err)
+			return
+		}
+		group, err = ui.putGroup(id, func(group *groupEntry) error {
+			return request.applyToGroup(group)
+		})
+	case r.Method == "DELETE":
+		if err := ui.deleteGroup(id); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		err = errorf(http.StatusMethodNotAllowed, "", "method not allowed")
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeResponse(w, status, ui.newGroupResource(group, true))
+}
+
+func (ui *UserInfo) listGroupsHandler(w http.ResponseWriter,
+	r *http.Request) {
+	match := func(*groupEntry) bool { return true }
+	if filter := r.FormValue("filter"); filter != "" {
+		attribute, value, err := parseFilter(filter)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		switch strings.ToLower(attribute) {
+		case "displayname":
+			match = func(group *groupEntry) bool {
+				return group.DisplayName == value
+			}
+		case "externalid":
+			match = func(group *groupEntry) bool {
+				return group.ExternalID == value
+			}
+		case "id":
+			match = func(group *groupEntry) bool { return group.ID == value }
+		default:
+			writeError(w, errorf(http.StatusBadRequest, "invalidFilter",
+				"unsupported filter attribute: %s", attribute))
+			return
+		}
+	}
+	// Identity providers list groups to look them up, so leave out the
+	// members unless asked for, as they may be many.
+	withMembers := !strings.Contains(r.FormValue("excludedAttributes"),
+		"members")
+	groups := ui.listGroups(match)
+	resources := make([]interface{}, 0, len(groups))
+	for _, group := range groups {
+		resources = append(resources, ui.newGroupResource(group, withMembers))
+	}
+	writeList(w, r, resources)
+}
+
+func (ui *UserInfo) newGroupResource(group groupEntry,
+	withMembers bool) groupResource {
+	members := make([]memberResource, 0, len(group.Members))
+	if withMembers {
+		for _, member := range group.Members {
+			members = append(members, memberResource{
+				Value:   member,
+				Display: ui.getUsername(member),
+			})
+		}
+	}
+	return groupResource{
+		Schemas:     []string{schemaGroup},
+		ID:          group.ID,
+		ExternalID:  group.ExternalID,
+		DisplayName: group.DisplayName,
+		Members:     members,
+		Meta: &resourceMeta{
+			ResourceType: "Group",
+			Created:      group.Created,
+			LastModified: group.LastModified,
+			Location:     PathPrefix + "Groups/" + group.ID,
+		},
+	}
+}
+
+func getMemberIDs(members []memberResource) []string {
+	ids := make([]string, 0, len(members))
+	for _, member := range members {
+		ids = append(ids, member.Value)
+	}
+	return ids
+}
+
+func (resource groupResource) replace(group *groupEntry) error {
+	group.DisplayName = resource.DisplayName
+	group.ExternalID = resource.ExternalID
+	group.Members = getMemberIDs(resource.Members)
+	return nil
+}
+
+func parseMembers(value json.RawMessage) ([]string, error) {
+	var members []memberResource
+	if err := json.Unmarshal(value, &members); err != nil {
+		return nil, errorf(http.StatusBadRequest, "invalidValue",
+			"bad members: %s", string(value))
+	}
+	return getMemberIDs(members), nil
+}
+
+func (request patchRequest) applyToGroup(group *groupEntry) error {
+	if err := request.checkOperations(); err != nil {
+		return err
+	}
+	for _, operation := range request.Operations {
+		op := strings.ToLower(operation.Op)
+		if matches := memberPathRegex.FindStringSubmatch(
+			operation.Path); matches != nil {
+			if op != "remove" {
+				return errorf(http.StatusBadRequest, "invalidPath",
+					"unsupported path for %s: %s", operation.Op,
+					operation.Path)
+			}
+			member, err := strconv.Unquote(matches[1])
+			if err != nil {
+				return errorf(http.StatusBadRequest, "invalidPath",
+					"bad path: %s", operation.Path)
+			}
+			group.Members = removeMembers(group.Members, []string{member})
+			continue
+		}
+		values := map[string]json.RawMessage{operation.Path: operation.Value}
+		if operation.Path == "" {
+			if op == "remove" {
+				return errorf(http.StatusBadRequest, "noTarget",
+					"remove requires a path")
+			}
+			values = nil
+			if err := json.Unmarshal(operation.Value, &values); err != nil {
+				return errorf(http.StatusBadRequest, "invalidValue",
+					"bad value: %s", string(operation.Value))
+			}
+		}
+		for path, value := range values {
+			err := applyGroupAttribute(group, op, path, value)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func applyGroupAttribute(group *groupEntry, op string, path string,
+	value json.RawMessage) error {
+	var err error
+	switch strings.ToLower(path) {
+	case "members":
+		var members []string
+		if op == "remove" && len(value) == 0 {
+			group.Members = nil
+			return nil
+		}
+		if members, err = parseMembers(value); err != nil {
+			return err
+		}
+		switch op {
+		case "add":
+			group.Members = addMembers(group.Members, members)
+		case "remove":
+			group.Members = removeMembers(group.Members, members)
+		case "replace":
+			group.Members = members
+		}
+	case "displayname":
+		if op == "remove" {
+			return errorf(http.StatusBadRequest, "mutability",
+				"cannot remove displayName")
+		}
+		group.DisplayName, err = parseString(value)
+	case "externalid":
+		if op == "remove" {
+			group.ExternalID = ""
+			return nil
+		}
+		group.ExternalID, err = parseString(value)
+	default:
+		return errorf(http.StatusBadRequest, "invalidPath",
+			"unsupported path: %s", path)
+	}
+	return err
+}
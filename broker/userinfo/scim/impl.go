@@ -0,0 +1,404 @@
+package scim
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	libjson "github.com/Cloud-Foundations/Dominator/lib/json"
+	"github.com/Cloud-Foundations/golib/pkg/log"
+)
+
+const filePerms = 0600
+
+// scimError is an error which is returned to the client with the given
+// HTTP status and SCIM error type.
+type scimError struct {
+	status   int
+	scimType string
+	detail   string
+}
+
+func (e *scimError) Error() string {
+	return e.detail
+}
+
+func errorf(status int, scimType string, format string,
+	args ...interface{}) error {
+	return &scimError{
+		status:   status,
+		scimType: scimType,
+		detail:   fmt.Sprintf(format, args...),
+	}
+}
+
+func newUserInfo(filename string, bearerToken string,
+	logger log.DebugLogger) (*UserInfo, error) {
+	ui := &UserInfo{
+		bearerToken: bearerToken,
+		filename:    filename,
+		logger:      logger,
+		state: state{
+			Users:  make(map[string]*userEntry),
+			Groups: make(map[string]*groupEntry),
+		},
+		userIDs: make(map[string]string),
+	}
+	if err := libjson.ReadFromFile(filename, &ui.state); err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	if ui.state.Users == nil {
+		ui.state.Users = make(map[string]*userEntry)
+	}
+	if ui.state.Groups == nil {
+		ui.state.Groups = make(map[string]*groupEntry)
+	}
+	for id, user := range ui.state.Users {
+		ui.userIDs[strings.ToLower(user.UserName)] = id
+	}
+	return ui, nil
+}
+
+func newID() (string, error) {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", err
+	}
+	id[6] = (id[6] & 0x0f) | 0x40 // Version 4.
+	id[8] = (id[8] & 0x3f) | 0x80 // Variant RFC 4122.
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10],
+		id[10:]), nil
+}
+
+func (ui *UserInfo) getUserGroups(username string) ([]string, error) {
+	ui.mutex.Lock()
+	defer ui.mutex.Unlock()
+	id, ok := ui.userIDs[strings.ToLower(username)]
+	if !ok {
+		return nil, nil
+	}
+	if !ui.state.Users[id].Active {
+		return nil, nil
+	}
+	var groups []string
+	for _, group := range ui.state.Groups {
+		for _, member := range group.Members {
+			if member == id {
+				groups = append(groups, group.DisplayName)
+				break
+			}
+		}
+	}
+	sort.Strings(groups)
+	return groups, nil
+}
+
+func (ui *UserInfo) getUserAttributes(username string) (
+	map[string]string, error) {
+	ui.mutex.Lock()
+	defer ui.mutex.Unlock()
+	attributes := make(map[string]string)
+	id, ok := ui.userIDs[strings.ToLower(username)]
+	if !ok || !ui.state.Users[id].Active {
+		return attributes, nil
+	}
+	for name, value := range ui.state.Users[id].Attributes {
+		attributes[name] = value
+	}
+	return attributes, nil
+}
+
+// save writes the state. Since the change has already been made in memory, a
+// failure is only logged: the next change will write the state again.
+// The mutex must be held.
+func (ui *UserInfo) save() {
+	err := libjson.WriteToFile(ui.filename, filePerms, "    ", ui.state)
+	if err != nil {
+		ui.logger.Printf("error saving SCIM state: %s\n", err)
+	}
+}
+
+// notify must be called without the mutex held.
+func (ui *UserInfo) notify(usernames []string) {
+	ui.mutex.Lock()
+	notifiers := ui.notifiers
+	ui.mutex.Unlock()
+	for _, username := range usernames {
+		for _, notifier := range notifiers {
+			notifier(username)
+		}
+	}
+}
+
+// getMemberUsernames must be called with the mutex held.
+func (ui *UserInfo) getMemberUsernames(members []string) []string {
+	usernames := make([]string, 0, len(members))
+	for _, id := range members {
+		if user, ok := ui.state.Users[id]; ok {
+			usernames = append(usernames, user.UserName)
+		}
+	}
+	return usernames
+}
+
+func (ui *UserInfo) listUsers(match func(*userEntry) bool) []userEntry {
+	ui.mutex.Lock()
+	defer ui.mutex.Unlock()
+	users := make([]userEntry, 0, len(ui.state.Users))
+	for _, user := range ui.state.Users {
+		if match(user) {
+			users = append(users, *user)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Created.Before(users[j].Created)
+	})
+	return users
+}
+
+func (ui *UserInfo) getUser(id string) (userEntry, error) {
+	ui.mutex.Lock()
+	defer ui.mutex.Unlock()
+	user, ok := ui.state.Users[id]
+	if !ok {
+		return userEntry{}, errorf(http.StatusNotFound, "",
+			"user %s not found", id)
+	}
+	return *user, nil
+}
+
+// putUser creates the user if id is empty, otherwise it modifies a copy of
+// the existing user, which replaces it if the change is valid.
+func (ui *UserInfo) putUser(id string,
+	modify func(*userEntry) error) (userEntry, error) {
+	ui.mutex.Lock()
+	user, oldUsername, err := ui.putUserLocked(id, modify)
+	ui.mutex.Unlock()
+	if err != nil {
+		return userEntry{}, err
+	}
+	if oldUsername != "" && oldUsername != user.UserName {
+		ui.notify([]string{oldUsername, user.UserName})
+	} else {
+		ui.notify([]string{user.UserName})
+	}
+	return user, nil
+}
+
+func (ui *UserInfo) putUserLocked(id string,
+	modify func(*userEntry) error) (userEntry, string, error) {
+	now := time.Now()
+	var user userEntry
+	var oldUsername string
+	if id == "" {
+		var err error
+		if user.ID, err = newID(); err != nil {
+			return userEntry{}, "", err
+		}
+		user.Active = true
+		user.Created = now
+	} else {
+		old, ok := ui.state.Users[id]
+		if !ok {
+			return userEntry{}, "", errorf(http.StatusNotFound, "",
+				"user %s not found", id)
+		}
+		user = *old
+		user.Attributes = make(map[string]string, len(old.Attributes))
+		for name, value := range old.Attributes {
+			user.Attributes[name] = value
+		}
+		oldUsername = old.UserName
+	}
+	if err := modify(&user); err != nil {
+		return userEntry{}, "", err
+	}
+	if user.UserName == "" {
+		return userEntry{}, "", errorf(http.StatusBadRequest, "invalidValue",
+			"userName is required")
+	}
+	key := strings.ToLower(user.UserName)
+	if otherID, ok := ui.userIDs[key]; ok && otherID != user.ID {
+		return userEntry{}, "", errorf(http.StatusConflict, "uniqueness",
+			"userName %s already exists", user.UserName)
+	}
+	if oldUsername != "" {
+		delete(ui.userIDs, strings.ToLower(oldUsername))
+	}
+	user.LastModified = now
+	ui.state.Users[user.ID] = &user
+	ui.userIDs[key] = user.ID
+	ui.save()
+	return user, oldUsername, nil
+}
+
+func (ui *UserInfo) deleteUser(id string) error {
+	ui.mutex.Lock()
+	user, ok := ui.state.Users[id]
+	if !ok {
+		ui.mutex.Unlock()
+		return errorf(http.StatusNotFound, "", "user %s not found", id)
+	}
+	delete(ui.state.Users, id)
+	delete(ui.userIDs, strings.ToLower(user.UserName))
+	for _, group := range ui.state.Groups {
+		group.Members = removeMembers(group.Members, []string{id})
+	}
+	ui.save()
+	ui.mutex.Unlock()
+	ui.notify([]string{user.UserName})
+	return nil
+}
+
+func (ui *UserInfo) listGroups(match func(*groupEntry) bool) []groupEntry {
+	ui.mutex.Lock()
+	defer ui.mutex.Unlock()
+	groups := make([]groupEntry, 0, len(ui.state.Groups))
+	for _, group := range ui.state.Groups {
+		if match(group) {
+			groups = append(groups, *group)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Created.Before(groups[j].Created)
+	})
+	return groups
+}
+
+func (ui *UserInfo) getGroup(id string) (groupEntry, error) {
+	ui.mutex.Lock()
+	defer ui.mutex.Unlock()
+	group, ok := ui.state.Groups[id]
+	if !ok {
+		return groupEntry{}, errorf(http.StatusNotFound, "",
+			"group %s not found", id)
+	}
+	return *group, nil
+}
+
+// getUsername returns the userName of the user with the given ID, or an empty
+// string if there is no such user.
+func (ui *UserInfo) getUsername(id string) string {
+	ui.mutex.Lock()
+	defer ui.mutex.Unlock()
+	if user, ok := ui.state.Users[id]; ok {
+		return user.UserName
+	}
+	return ""
+}
+
+// putGroup creates the group if id is empty, otherwise it modifies a copy of
+// the existing group, which replaces it if the change is valid.
+func (ui *UserInfo) putGroup(id string,
+	modify func(*groupEntry) error) (groupEntry, error) {
+	ui.mutex.Lock()
+	group, changedUsernames, err := ui.putGroupLocked(id, modify)
+	ui.mutex.Unlock()
+	if err != nil {
+		return groupEntry{}, err
+	}
+	ui.notify(changedUsernames)
+	return group, nil
+}
+
+func (ui *UserInfo) putGroupLocked(id string,
+	modify func(*groupEntry) error) (groupEntry, []string, error) {
+	now := time.Now()
+	var group groupEntry
+	var oldMembers []string
+	if id == "" {
+		var err error
+		if group.ID, err = newID(); err != nil {
+			return groupEntry{}, nil, err
+		}
+		group.Created = now
+	} else {
+		old, ok := ui.state.Groups[id]
+		if !ok {
+			return groupEntry{}, nil, errorf(http.StatusNotFound, "",
+				"group %s not found", id)
+		}
+		group = *old
+		group.Members = append([]string(nil), old.Members...)
+		oldMembers = old.Members
+	}
+	if err := modify(&group); err != nil {
+		return groupEntry{}, nil, err
+	}
+	if group.DisplayName == "" {
+		return groupEntry{}, nil, errorf(http.StatusBadRequest,
+			"invalidValue", "displayName is required")
+	}
+	for otherID, other := range ui.state.Groups {
+		if otherID != group.ID && other.DisplayName == group.DisplayName {
+			return groupEntry{}, nil, errorf(http.StatusConflict,
+				"uniqueness", "displayName %s already exists",
+				group.DisplayName)
+		}
+	}
+	for _, member := range group.Members {
+		if _, ok := ui.state.Users[member]; !ok {
+			return groupEntry{}, nil, errorf(http.StatusBadRequest,
+				"invalidValue", "unknown member: %s", member)
+		}
+	}
+	group.Members = addMembers(nil, group.Members)
+	group.LastModified = now
+	ui.state.Groups[group.ID] = &group
+	ui.save()
+	// A rename affects all members, so notify them all.
+	changedUsernames := ui.getMemberUsernames(
+		addMembers(oldMembers, group.Members))
+	return group, changedUsernames, nil
+}
+
+func (ui *UserInfo) deleteGroup(id string) error {
+	ui.mutex.Lock()
+	group, ok := ui.state.Groups[id]
+	if !ok {
+		ui.mutex.Unlock()
+		return errorf(http.StatusNotFound, "", "group %s not found", id)
+	}
+	delete(ui.state.Groups, id)
+	ui.save()
+	changedUsernames := ui.getMemberUsernames(group.Members)
+	ui.mutex.Unlock()
+	ui.notify(changedUsernames)
+	return nil
+}
+
+// addMembers returns members with the new members appended, without
+// duplicates.
+func addMembers(members []string, newMembers []string) []string {
+	present := make(map[string]struct{}, len(members))
+	var result []string
+	for _, member := range append(append([]string(nil), members...),
+		newMembers...) {
+		if _, ok := present[member]; ok {
+			continue
+		}
+		present[member] = struct{}{}
+		result = append(result, member)
+	}
+	return result
+}
+
+func removeMembers(members []string, removedMembers []string) []string {
+	removed := make(map[string]struct{}, len(removedMembers))
+	for _, member := range removedMembers {
+		removed[member] = struct{}{}
+	}
+	var result []string
+	for _, member := range members {
+		if _, ok := removed[member]; !ok {
+			result = append(result, member)
+		}
+	}
+	return result
+}
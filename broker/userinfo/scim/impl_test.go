@@ -0,0 +1,242 @@
+package scim
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+)
+
+const testToken = "token1"
+
+func newTestUserInfo(t *testing.T, filename string) *UserInfo {
+	ui, err := New(filename, testToken, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ui
+}
+
+func doRequest(t *testing.T, ui *UserInfo, method string, path string,
+	body interface{}, expectedStatus int, response interface{}) {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest(method, PathPrefix+path, &reqBody)
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	rr := httptest.NewRecorder()
+	ui.ServeHTTP(rr, req)
+	if rr.Code != expectedStatus {
+		t.Fatalf("%s %s: expected: %d, got: %d: %s", method, path,
+			expectedStatus, rr.Code, rr.Body.String())
+	}
+	if response != nil {
+		if err := json.Unmarshal(rr.Body.Bytes(), response); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func checkGroups(t *testing.T, ui *UserInfo, username string,
+	expected []string) {
+	groups, err := ui.GetUserGroups(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Fatalf("%s: expected groups: %v, got: %v", username, expected,
+			groups)
+	}
+}
+
+func TestUnauthorized(t *testing.T) {
+	ui := newTestUserInfo(t, filepath.Join(t.TempDir(), "state.json"))
+	for _, authorization := range []string{"", "Bearer", "Bearer token2"} {
+		req := httptest.NewRequest("GET", PathPrefix+"Users", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		rr := httptest.NewRecorder()
+		ui.ServeHTTP(rr, req)
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("%q: expected: %d, got: %d", authorization,
+				http.StatusUnauthorized, rr.Code)
+		}
+	}
+}
+
+func TestProvisioning(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "state.json")
+	ui := newTestUserInfo(t, filename)
+	var notified []string
+	ui.NotifyUserGroupsChange(func(username string) {
+		notified = append(notified, username)
+	})
+	var user1, user2 userResource
+	doRequest(t, ui, "POST", "Users",
+		userResource{Schemas: []string{schemaUser}, UserName: "user1"},
+		http.StatusCreated, &user1)
+	doRequest(t, ui, "POST", "Users",
+		userResource{Schemas: []string{schemaUser}, UserName: "user2"},
+		http.StatusCreated, &user2)
+	doRequest(t, ui, "POST", "Users",
+		userResource{Schemas: []string{schemaUser}, UserName: "USER1"},
+		http.StatusConflict, nil)
+	var list listResponse
+	doRequest(t, ui, "GET", `Users?filter=userName+eq+"User1"`, nil,
+		http.StatusOK, &list)
+	if list.TotalResults != 1 {
+		t.Fatalf("expected one user, got: %d", list.TotalResults)
+	}
+	var group groupResource
+	doRequest(t, ui, "POST", "Groups", groupResource{
+		Schemas:     []string{schemaGroup},
+		DisplayName: "group1",
+		Members:     []memberResource{{Value: user1.ID}},
+	}, http.StatusCreated, &group)
+	checkGroups(t, ui, "user1", []string{"group1"})
+	checkGroups(t, ui, "user2", nil)
+	doRequest(t, ui, "POST", "Groups", groupResource{
+		Schemas:     []string{schemaGroup},
+		DisplayName: "group2",
+		Members:     []memberResource{{Value: "unknown"}},
+	}, http.StatusBadRequest, nil)
+
+	// The operations of Azure AD use capitalised ops and string booleans.
+	notified = nil
+	doRequest(t, ui, "PATCH", "Groups/"+group.ID, patchRequest{
+		Schemas: []string{schemaPatchOp},
+		Operations: []patchOperation{
+			{Op: "Add", Path: "members",
+				Value: json.RawMessage(`[{"value":"` + user2.ID + `"}]`)},
+			{Op: "Remove", Path: `members[value eq "` + user1.ID + `"]`},
+			{Op: "Replace", Path: "displayName",
+				Value: json.RawMessage(`"group2"`)},
+		},
+	}, http.StatusOK, &group)
+	checkGroups(t, ui, "user1", nil)
+	checkGroups(t, ui, "user2", []string{"group2"})
+	if !reflect.DeepEqual(notified, []string{"user1", "user2"}) {
+		t.Fatalf("unexpected notifications: %v", notified)
+	}
+	doRequest(t, ui, "PATCH", "Users/"+user2.ID, patchRequest{
+		Schemas: []string{schemaPatchOp},
+		Operations: []patchOperation{{Op: "Replace",
+			Value: json.RawMessage(`{"active":"False"}`)}},
+	}, http.StatusOK, nil)
+	checkGroups(t, ui, "user2", nil)
+
+	// The state survives a restart.
+	doRequest(t, ui, "PATCH", "Users/"+user2.ID, patchRequest{
+		Schemas: []string{schemaPatchOp},
+		Operations: []patchOperation{{Op: "replace", Path: "active",
+			Value: json.RawMessage(`true`)}},
+	}, http.StatusOK, nil)
+	ui = newTestUserInfo(t, filename)
+	checkGroups(t, ui, "user2", []string{"group2"})
+	doRequest(t, ui, "DELETE", "Users/"+user2.ID, nil,
+		http.StatusNoContent, nil)
+	checkGroups(t, ui, "user2", nil)
+	doRequest(t, ui, "GET", "Groups/"+group.ID, nil, http.StatusOK, &group)
+	if len(group.Members) != 0 {
+		t.Fatalf("deleted user still a member: %v", group.Members)
+	}
+	doRequest(t, ui, "DELETE", "Groups/"+group.ID, nil,
+		http.StatusNoContent, nil)
+	doRequest(t, ui, "GET", "Groups/"+group.ID, nil, http.StatusNotFound,
+		nil)
+}
+
+func checkAttributes(t *testing.T, ui *UserInfo, username string,
+	expected map[string]string) {
+	attributes, err := ui.GetUserAttributes(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(attributes, expected) {
+		t.Fatalf("%s: expected attributes: %v, got: %v", username, expected,
+			attributes)
+	}
+}
+
+func TestUserAttributes(t *testing.T) {
+	ui := newTestUserInfo(t, filepath.Join(t.TempDir(), "state.json"))
+	var user userResource
+	doRequest(t, ui, "POST", "Users", userResource{
+		Schemas:     []string{schemaUser, schemaEnterpriseUser},
+		UserName:    "user1",
+		DisplayName: "User One",
+		Emails: []emailResource{
+			{Value: "other@example.com"},
+			{Value: "user1@example.com", Primary: true},
+		},
+		Enterprise: &enterpriseUserResource{CostCenter: "1000"},
+	}, http.StatusCreated, &user)
+	checkAttributes(t, ui, "user1", map[string]string{
+		"displayName": "User One",
+		"mail":        "user1@example.com",
+		"costCenter":  "1000",
+	})
+	if user.Enterprise == nil || user.Enterprise.CostCenter != "1000" ||
+		len(user.Emails) != 1 {
+		t.Fatalf("unexpected resource: %+v", user)
+	}
+
+	// The operations of Azure AD use filtered and extension paths.
+	doRequest(t, ui, "PATCH", "Users/"+user.ID, patchRequest{
+		Schemas: []string{schemaPatchOp},
+		Operations: []patchOperation{
+			{Op: "Replace", Path: `emails[type eq "work"].value`,
+				Value: json.RawMessage(`"new@example.com"`)},
+			{Op: "Add",
+				Path:  schemaEnterpriseUser + ":department",
+				Value: json.RawMessage(`"Storage"`)},
+			{Op: "Remove", Path: "displayName"},
+			{Op: "Replace", Value: json.RawMessage(
+				`{"name.givenName":"User","` + schemaEnterpriseUser +
+					`:costCenter":"2000"}`)},
+		},
+	}, http.StatusOK, nil)
+	checkAttributes(t, ui, "user1", map[string]string{
+		"mail":       "new@example.com",
+		"department": "Storage",
+		"costCenter": "2000",
+	})
+	doRequest(t, ui, "PATCH", "Users/"+user.ID, patchRequest{
+		Schemas:    []string{schemaPatchOp},
+		Operations: []patchOperation{{Op: "Remove", Path: "userName"}},
+	}, http.StatusBadRequest, nil)
+	doRequest(t, ui, "PATCH", "Users/"+user.ID, patchRequest{
+		Schemas: []string{schemaPatchOp},
+		Operations: []patchOperation{{Op: "Replace", Path: "active",
+			Value: json.RawMessage(`false`)}},
+	}, http.StatusOK, nil)
+	checkAttributes(t, ui, "user1", map[string]string{})
+	checkAttributes(t, ui, "unknown", map[string]string{})
+}
+
+func TestListPagination(t *testing.T) {
+	ui := newTestUserInfo(t, filepath.Join(t.TempDir(), "state.json"))
+	for _, username := range []string{"user1", "user2", "user3"} {
+		doRequest(t, ui, "POST", "Users",
+			userResource{Schemas: []string{schemaUser}, UserName: username},
+			http.StatusCreated, nil)
+	}
+	var list listResponse
+	doRequest(t, ui, "GET", "Users?startIndex=2&count=5", nil, http.StatusOK,
+		&list)
+	if list.TotalResults != 3 || list.StartIndex != 2 ||
+		list.ItemsPerPage != 2 || len(list.Resources) != 2 {
+		t.Fatalf("unexpected list: %+v", list)
+	}
+	doRequest(t, ui, "GET", `Users?filter=name.familyName+co+"x"`, nil,
+		http.StatusBadRequest, nil)
+}
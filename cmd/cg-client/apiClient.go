@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Cloud-Foundations/cloud-gate/lib/apiv1"
+)
+
+const batchTimeout = 120 * time.Second
+
+var (
+	errAPIUnsupported   = errors.New("v1 API not supported")
+	errBatchUnsupported = errors.New("batch credentials not supported")
+)
+
+// apiStatusError is returned for a non-2xx response from the API.
+type apiStatusError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *apiStatusError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("status=%d", e.StatusCode)
+	}
+	return fmt.Sprintf("status=%d: %s", e.StatusCode, e.Message)
+}
+
+// doAPIRequest sends the request, which is JSON encoded unless nil, and
+// decodes the JSON response into response.
+func doAPIRequest(client *http.Client, method string, requestURL string,
+	request interface{}, response interface{}) error {
+	var body io.Reader
+	if request != nil {
+		encoded, err := json.Marshal(request)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequest(method, requestURL, body)
+	if err != nil {
+		return err
+	}
+	if request != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", userAgentString)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		var apiError apiv1.Error
+		json.NewDecoder(resp.Body).Decode(&apiError)
+		return &apiStatusError{StatusCode: resp.StatusCode,
+			Message: apiError.Error}
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+func getAPIAccounts(client *http.Client, baseUrl string) (
+	*apiv1.AccountsResponse, error) {
+	var response apiv1.AccountsResponse
+	err := doAPIRequest(client, "GET", baseUrl+apiv1.AccountsPath+"?"+
+		url.Values{"cloud": {"aws"}}.Encode(), nil, &response)
+	if err != nil {
+		if statusErr, ok := err.(*apiStatusError); ok &&
+			statusErr.StatusCode == http.StatusNotFound {
+			return nil, errAPIUnsupported
+		}
+		return nil, fmt.Errorf("getAPIAccounts: %s", err)
+	}
+	return &response, nil
+}
+
+func getRoleCredentials(client *http.Client, baseUrl string,
+	accountName string, roleName string,
+	duration time.Duration) (*apiv1.Credentials, error) {
+	loggerPrintf(2, "Getting creds for account=%s, role=%s", accountName,
+		roleName)
+	var credentials apiv1.Credentials
+	err := doAPIRequest(client, "POST", baseUrl+apiv1.CredentialsPath,
+		apiv1.CredentialsRequest{
+			AccountName:     accountName,
+			RoleName:        roleName,
+			DurationSeconds: int64(duration / time.Second),
+		}, &credentials)
+	if err != nil {
+		if statusErr, ok := err.(*apiStatusError); ok &&
+			statusErr.StatusCode == http.StatusNotFound {
+			return getLegacyRoleCredentials(client, baseUrl, accountName,
+				roleName, duration)
+		}
+		return nil, fmt.Errorf("getRoleCredentials: %s", err)
+	}
+	return &credentials, nil
+}
+
+// getLegacyRoleCredentials gets the credentials from /generatetoken, for
+// servers which predate the v1 API.
+func getLegacyRoleCredentials(client *http.Client, baseUrl string,
+	accountName string, roleName string,
+	duration time.Duration) (*apiv1.Credentials, error) {
+	values := url.Values{"accountName": {accountName}, "roleName": {roleName}}
+	if duration > 0 {
+		values.Set("durationSeconds",
+			strconv.FormatInt(int64(duration/time.Second), 10))
+	}
+	req, err := http.NewRequest("POST", baseUrl+"/generatetoken",
+		strings.NewReader(values.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", userAgentString)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("getLegacyRoleCredentials: %s", resp.Status)
+	}
+	var awsCreds AWSCredentialsJSON
+	if err := json.NewDecoder(resp.Body).Decode(&awsCreds); err != nil {
+		return nil, fmt.Errorf("getLegacyRoleCredentials: %s", err)
+	}
+	return &apiv1.Credentials{
+		Cloud:           "aws",
+		AccountName:     accountName,
+		RoleName:        roleName,
+		AccessKeyID:     awsCreds.SessionId,
+		SecretAccessKey: awsCreds.SessionKey,
+		SessionToken:    awsCreds.SessionToken,
+		Region:          awsCreds.Region,
+		Expiration:      awsCreds.Expiration,
+	}, nil
+}
+
+// getBatchCreds gets the credentials for all of the roles, in requests of at
+// most apiv1.MaxBatchSize roles. It returns errBatchUnsupported if the server
+// predates the batch endpoint.
+func getBatchCreds(client *http.Client, baseUrl string,
+	roles []apiv1.Role) ([]apiv1.BatchCredentialsResult, error) {
+	loggerPrintf(1, "Getting creds for %d roles", len(roles))
+	batchClient := *client
+	batchClient.Timeout = batchTimeout
+	results := make([]apiv1.BatchCredentialsResult, 0, len(roles))
+	for start := 0; start < len(roles); start += apiv1.MaxBatchSize {
+		end := start + apiv1.MaxBatchSize
+		if end > len(roles) {
+			end = len(roles)
+		}
+		batch := roles[start:end]
+		var response apiv1.BatchCredentialsResponse
+		err := doAPIRequest(&batchClient, "POST", baseUrl+apiv1.BatchPath,
+			apiv1.BatchCredentialsRequest{Roles: batch}, &response)
+		if err != nil {
+			if statusErr, ok := err.(*apiStatusError); ok &&
+				statusErr.StatusCode == http.StatusNotFound {
+				return nil, errBatchUnsupported
+			}
+			return nil, fmt.Errorf("getBatchCreds: %s", err)
+		}
+		if len(response.Results) != len(batch) {
+			return nil, fmt.Errorf(
+				"getBatchCreds: expected %d results, got %d",
+				len(batch), len(response.Results))
+		}
+		results = append(results, response.Results...)
+	}
+	return results, nil
+}
+
+func getConsoleURL(client *http.Client, baseUrl string, accountName string,
+	roleName string) (string, error) {
+	var response apiv1.ConsoleResponse
+	err := doAPIRequest(client, "POST", baseUrl+apiv1.ConsolePath,
+		apiv1.ConsoleRequest{AccountName: accountName, RoleName: roleName},
+		&response)
+	if err != nil {
+		return "", fmt.Errorf("getConsoleURL: %s", err)
+	}
+	return response.URL, nil
+}
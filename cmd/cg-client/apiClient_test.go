@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/cloud-gate/lib/apiv1"
+)
+
+func TestGetRoleCredentialsLegacyFallback(t *testing.T) {
+	expiration := time.Now().Add(time.Hour).Truncate(time.Second)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/generatetoken", func(w http.ResponseWriter,
+		r *http.Request) {
+		if r.FormValue("accountName") != "prod" ||
+			r.FormValue("roleName") != "admin" ||
+			r.FormValue("durationSeconds") != "3600" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		writeImdsJSON(w, AWSCredentialsJSON{SessionId: "AKIATEST",
+			SessionKey: "secret", SessionToken: "session",
+			Expiration: expiration})
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	credentials, err := getRoleCredentials(server.Client(), server.URL,
+		"prod", "admin", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := apiv1.Credentials{Cloud: "aws", AccountName: "prod",
+		RoleName: "admin", AccessKeyID: "AKIATEST",
+		SecretAccessKey: "secret", SessionToken: "session",
+		Expiration: expiration}
+	if !credentials.Expiration.Equal(expiration) {
+		t.Fatalf("unexpected expiration: %s", credentials.Expiration)
+	}
+	credentials.Expiration = expiration
+	if *credentials != expected {
+		t.Fatalf("unexpected credentials: %+v", credentials)
+	}
+}
+
+func TestGetBatchCredsSplitsBatches(t *testing.T) {
+	var batchSizes []int
+	mux := http.NewServeMux()
+	mux.HandleFunc(apiv1.BatchPath, func(w http.ResponseWriter,
+		r *http.Request) {
+		var request apiv1.BatchCredentialsRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if len(request.Roles) > apiv1.MaxBatchSize {
+			w.WriteHeader(http.StatusBadRequest)
+			writeImdsJSON(w, apiv1.Error{Error: "too many roles requested"})
+			return
+		}
+		batchSizes = append(batchSizes, len(request.Roles))
+		var response apiv1.BatchCredentialsResponse
+		for _, role := range request.Roles {
+			response.Results = append(response.Results,
+				apiv1.BatchCredentialsResult{AccountName: role.AccountName,
+					RoleName: role.RoleName, Status: http.StatusOK})
+		}
+		writeImdsJSON(w, response)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	var roles []apiv1.Role
+	for i := 0; i < 2*apiv1.MaxBatchSize+1; i++ {
+		roles = append(roles, apiv1.Role{AccountName: fmt.Sprintf("a%d", i),
+			RoleName: "admin"})
+	}
+	results, err := getBatchCreds(server.Client(), server.URL, roles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batchSizes) != 3 || batchSizes[2] != 1 {
+		t.Fatalf("unexpected batch sizes: %v", batchSizes)
+	}
+	if len(results) != len(roles) {
+		t.Fatalf("expected %d results, got %d", len(roles), len(results))
+	}
+	for i, result := range results {
+		if result.AccountName != roles[i].AccountName {
+			t.Fatalf("result %d is for %s", i, result.AccountName)
+		}
+	}
+}
+
+func TestGetAccounts(t *testing.T) {
+	legacy := true
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == apiv1.AccountsPath && !legacy:
+			writeImdsJSON(w, apiv1.AccountsResponse{Cloud: "aws",
+				Accounts: []apiv1.Account{{Name: "dev",
+					Roles: []string{"admin"}}}})
+		case r.URL.Path == "/" && legacy:
+			writeImdsJSON(w, getAccountInfo{AuthUsername: "user1",
+				CloudAccounts: map[string]cloudAccountInfo{
+					"prod": {Name: "prod", AvailableRoles: []string{"admin"}},
+					"dev":  {Name: "dev", AvailableRoles: []string{"readonly"}},
+				}})
+		default:
+			http.NotFound(w, r)
+		}
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+	// Servers which predate the v1 API only have the main page.
+	accounts, err := getAccounts(server.Client(), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []apiv1.Account{
+		{Name: "dev", Roles: []string{"readonly"}},
+		{Name: "prod", Roles: []string{"admin"}},
+	}
+	if !reflect.DeepEqual(accounts, expected) {
+		t.Fatalf("expected: %v, got: %v", expected, accounts)
+	}
+	legacy = false
+	accounts, err = getAccounts(server.Client(), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []apiv1.Account{{Name: "dev", Roles: []string{"admin"}}}
+	if !reflect.DeepEqual(accounts, expected) {
+		t.Fatalf("expected: %v, got: %v", expected, accounts)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Cloud-Foundations/cloud-gate/lib/apiv1"
+)
+
+type command struct {
+	name        string
+	description string
+	run         func(config AppConfigFile, filter roleFilter,
+		args []string) error
+}
+
+var commands = []command{
+	{"sync", "keep the credentials file up to date (the default)", syncMain},
+	{"list", "list the accounts and roles you may use", listMain},
+	{"env", "print shell statements which export credentials for a role",
+		envMain},
+	{"exec", "run a command with credentials for a role: exec [flags] -- cmd",
+		execMain},
+	{"console", "open the web console for a role", consoleMain},
+	{"credential-process", "print credentials for an AWS credential_process",
+		credentialProcessMain},
+	{"serve-imds", "serve credentials like the EC2 metadata service",
+		serveImdsMain},
+	{"setup", "write credential_process profiles to the AWS config",
+		setupMain},
+}
+
+// credentialEnvironmentVariables are removed from the environment of exec,
+// since they would conflict with the injected credentials.
+var credentialEnvironmentVariables = []string{
+	"AWS_ACCESS_KEY_ID",
+	"AWS_CREDENTIAL_EXPIRATION",
+	"AWS_DEFAULT_PROFILE",
+	"AWS_PROFILE",
+	"AWS_SECRET_ACCESS_KEY",
+	"AWS_SECURITY_TOKEN",
+	"AWS_SESSION_TOKEN",
+}
+
+// roleFlags are the flags of the commands which act on one role.
+type roleFlags struct {
+	accountName string
+	roleName    string
+	duration    time.Duration
+}
+
+type environmentVariable struct {
+	name  string
+	value string
+}
+
+func addRoleFlags(flagSet *flag.FlagSet) *roleFlags {
+	role := &roleFlags{}
+	flagSet.StringVar(&role.accountName, "account", "", "account name")
+	flagSet.StringVar(&role.roleName, "role", "", "role name")
+	flagSet.DurationVar(&role.duration, "duration", 0,
+		"session duration to request (default: the server default)")
+	return role
+}
+
+func (role *roleFlags) check(commandName string) error {
+	if role.accountName == "" || role.roleName == "" {
+		return fmt.Errorf("%s: -account and -role are required", commandName)
+	}
+	return nil
+}
+
+func listMain(config AppConfigFile, filter roleFilter, args []string) error {
+	flagSet := flag.NewFlagSet("list", flag.ExitOnError)
+	flagSet.Parse(args)
+	client, err := newHttpClientFromFlags()
+	if err != nil {
+		return err
+	}
+	accounts, err := getAPIAccounts(client, config.BaseURL)
+	if err != nil {
+		return err
+	}
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "ACCOUNT\tDISPLAY NAME\tROLES")
+	for _, account := range accounts.Accounts {
+		fmt.Fprintf(writer, "%s\t%s\t%s\n", account.Name, account.DisplayName,
+			strings.Join(account.Roles, ", "))
+	}
+	return writer.Flush()
+}
+
+func getCredentialEnvironment(
+	credentials *apiv1.Credentials) []environmentVariable {
+	variables := []environmentVariable{
+		{"AWS_ACCESS_KEY_ID", credentials.AccessKeyID},
+		{"AWS_SECRET_ACCESS_KEY", credentials.SecretAccessKey},
+		{"AWS_SESSION_TOKEN", credentials.SessionToken},
+	}
+	if !credentials.Expiration.IsZero() {
+		variables = append(variables, environmentVariable{
+			"AWS_CREDENTIAL_EXPIRATION",
+			credentials.Expiration.UTC().Format(time.RFC3339)})
+	}
+	if credentials.Region != "" {
+		variables = append(variables,
+			environmentVariable{"AWS_REGION", credentials.Region},
+			environmentVariable{"AWS_DEFAULT_REGION", credentials.Region})
+	}
+	return variables
+}
+
+func getDefaultShell() string {
+	if runtime.GOOS == "windows" {
+		return "powershell"
+	}
+	if filepath.Base(os.Getenv("SHELL")) == "fish" {
+		return "fish"
+	}
+	return "bash"
+}
+
+// formatExport returns the statement which exports the variable in the
+// syntax of the shell.
+func formatExport(shell string, variable environmentVariable) (string, error) {
+	switch shell {
+	case "bash", "sh", "zsh":
+		return fmt.Sprintf("export %s='%s'", variable.name,
+			strings.Replace(variable.value, "'", `'\''`, -1)), nil
+	case "fish":
+		value := strings.Replace(variable.value, `\`, `\\`, -1)
+		return fmt.Sprintf("set -gx %s '%s';", variable.name,
+			strings.Replace(value, "'", `\'`, -1)), nil
+	case "powershell":
+		return fmt.Sprintf("$Env:%s = '%s'", variable.name,
+			strings.Replace(variable.value, "'", "''", -1)), nil
+	}
+	return "", fmt.Errorf("unsupported shell: %s", shell)
+}
+
+func envMain(config AppConfigFile, filter roleFilter, args []string) error {
+	flagSet := flag.NewFlagSet("env", flag.ExitOnError)
+	role := addRoleFlags(flagSet)
+	shell := flagSet.String("shell", getDefaultShell(),
+		"syntax of the output: bash, fish or powershell")
+	flagSet.Parse(args)
+	if err := role.check(flagSet.Name()); err != nil {
+		return err
+	}
+	// Check the shell before fetching credentials.
+	if _, err := formatExport(*shell, environmentVariable{}); err != nil {
+		return err
+	}
+	credentials, err := getCachedRoleCredentials(config, role.accountName,
+		role.roleName, role.duration)
+	if err != nil {
+		return err
+	}
+	for _, variable := range getCredentialEnvironment(credentials) {
+		line, _ := formatExport(*shell, variable)
+		fmt.Println(line)
+	}
+	return nil
+}
+
+// getExecEnvironment returns the environment with the credential variables
+// replaced.
+func getExecEnvironment(environment []string,
+	variables []environmentVariable) []string {
+	removed := make(map[string]struct{})
+	for _, name := range credentialEnvironmentVariables {
+		removed[name] = struct{}{}
+	}
+	for _, variable := range variables {
+		removed[variable.name] = struct{}{}
+	}
+	result := make([]string, 0, len(environment)+len(variables))
+	for _, entry := range environment {
+		name := strings.SplitN(entry, "=", 2)[0]
+		if _, ok := removed[name]; !ok {
+			result = append(result, entry)
+		}
+	}
+	for _, variable := range variables {
+		result = append(result, variable.name+"="+variable.value)
+	}
+	return result
+}
+
+func execMain(config AppConfigFile, filter roleFilter, args []string) error {
+	flagSet := flag.NewFlagSet("exec", flag.ExitOnError)
+	role := addRoleFlags(flagSet)
+	flagSet.Parse(args)
+	if err := role.check(flagSet.Name()); err != nil {
+		return err
+	}
+	commandArgs := flagSet.Args()
+	if len(commandArgs) < 1 {
+		return errors.New("exec: no command given")
+	}
+	credentials, err := getCachedRoleCredentials(config, role.accountName,
+		role.roleName, role.duration)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(commandArgs[0], commandArgs[1:]...)
+	cmd.Env = getExecEnvironment(os.Environ(),
+		getCredentialEnvironment(credentials))
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// The command gets interrupts from the terminal too, so leave it to
+	// decide when to exit.
+	signal.Ignore(os.Interrupt)
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			os.Exit(exitErr.ExitCode())
+		}
+		return err
+	}
+	return nil
+}
+
+func openBrowser(url string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", url)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+	return cmd.Start()
+}
+
+func consoleMain(config AppConfigFile, filter roleFilter, args []string) error {
+	flagSet := flag.NewFlagSet("console", flag.ExitOnError)
+	accountName := flagSet.String("account", "", "account name")
+	roleName := flagSet.String("role", "", "role name")
+	printURL := flagSet.Bool("print", false,
+		"print the sign-in URL rather than opening a browser")
+	flagSet.Parse(args)
+	if *accountName == "" || *roleName == "" {
+		return errors.New("console: -account and -role are required")
+	}
+	client, err := newHttpClientFromFlags()
+	if err != nil {
+		return err
+	}
+	consoleURL, err := getConsoleURL(client, config.BaseURL, *accountName,
+		*roleName)
+	if err != nil {
+		return err
+	}
+	if *printURL {
+		fmt.Println(consoleURL)
+		return nil
+	}
+	return openBrowser(consoleURL)
+}
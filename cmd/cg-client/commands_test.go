@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/cloud-gate/lib/apiv1"
+)
+
+func TestFormatExport(t *testing.T) {
+	variable := environmentVariable{"AWS_SESSION_TOKEN", `a'b\c`}
+	tests := map[string]string{
+		"bash":       `export AWS_SESSION_TOKEN='a'\''b\c'`,
+		"fish":       `set -gx AWS_SESSION_TOKEN 'a\'b\\c';`,
+		"powershell": `$Env:AWS_SESSION_TOKEN = 'a''b\c'`,
+	}
+	for shell, expected := range tests {
+		line, err := formatExport(shell, variable)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != expected {
+			t.Errorf("%s: expected: %s, got: %s", shell, expected, line)
+		}
+	}
+	if _, err := formatExport("csh", variable); err == nil {
+		t.Fatal("expected error for unsupported shell")
+	}
+}
+
+func TestGetExecEnvironment(t *testing.T) {
+	credentials := &apiv1.Credentials{AccessKeyID: "AKIATEST",
+		SecretAccessKey: "secret", SessionToken: "session",
+		Region:     "cn-north-1",
+		Expiration: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)}
+	environment := getExecEnvironment([]string{"HOME=/home/user",
+		"AWS_PROFILE=other", "AWS_ACCESS_KEY_ID=AKIAOLD",
+		"AWS_REGION=us-west-2"}, getCredentialEnvironment(credentials))
+	joined := strings.Join(environment, "\n")
+	for _, expected := range []string{"HOME=/home/user",
+		"AWS_ACCESS_KEY_ID=AKIATEST", "AWS_SESSION_TOKEN=session",
+		"AWS_CREDENTIAL_EXPIRATION=2030-01-01T00:00:00Z",
+		"AWS_REGION=cn-north-1"} {
+		if !strings.Contains(joined+"\n", expected+"\n") {
+			t.Errorf("missing %s in %v", expected, environment)
+		}
+	}
+	for _, unexpected := range []string{"AWS_PROFILE=", "AKIAOLD",
+		"us-west-2"} {
+		if strings.Contains(joined, unexpected) {
+			t.Errorf("unexpected %s in %v", unexpected, environment)
+		}
+	}
+}
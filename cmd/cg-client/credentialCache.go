@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Cloud-Foundations/cloud-gate/lib/apiv1"
+)
+
+const credentialCacheKeyInfo = "cloud-gate credential cache v1"
+
+// credentialCache stores the credentials of each role and requested duration
+// in a file encrypted
+// with a key derived from the private key of the client certificate, so that
+// the credentials are no more exposed than the key which can fetch them.
+type credentialCache struct {
+	aead      cipher.AEAD
+	baseURL   string
+	directory string
+}
+
+func getCredentialCacheDirectory() string {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		cacheDir = filepath.Join(getUserHomeDir(), ".cache")
+	}
+	return filepath.Join(cacheDir, "cloud-gate", "credentials")
+}
+
+func newCredentialCache(directory string, keyFilename string,
+	baseURL string) (*credentialCache, error) {
+	keyPEM, err := ioutil.ReadFile(keyFilename)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hkdf.Key(sha256.New, keyPEM, nil, credentialCacheKeyInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &credentialCache{
+		aead:      aead,
+		baseURL:   baseURL,
+		directory: directory,
+	}, nil
+}
+
+// filename hashes the server, account, role and duration, since names such
+// as "a-b" and "c" could otherwise collide.
+func (c *credentialCache) filename(accountName, roleName string,
+	duration time.Duration) string {
+	hash := sha256.Sum256(c.additionalData(accountName, roleName, duration))
+	return filepath.Join(c.directory, hex.EncodeToString(hash[:])+".enc")
+}
+
+// additionalData binds an entry to the server, account, role and duration,
+// so that entries cannot be swapped between files.
+func (c *credentialCache) additionalData(accountName, roleName string,
+	duration time.Duration) []byte {
+	return []byte(c.baseURL + "\n" + accountName + "\n" + roleName + "\n" +
+		duration.String())
+}
+
+// get returns the cached credentials for the role which were requested for
+// the duration, or nil if there are none or they cannot be decrypted (for
+// example after the key was replaced).
+func (c *credentialCache) get(accountName, roleName string,
+	duration time.Duration) (*apiv1.Credentials, error) {
+	data, err := ioutil.ReadFile(c.filename(accountName, roleName, duration))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	nonceSize := c.aead.NonceSize()
+	if len(data) < nonceSize {
+		loggerPrintf(2, "Ignoring truncated cache entry for %s-%s",
+			accountName, roleName)
+		return nil, nil
+	}
+	plaintext, err := c.aead.Open(nil, data[:nonceSize], data[nonceSize:],
+		c.additionalData(accountName, roleName, duration))
+	if err != nil {
+		loggerPrintf(2, "Ignoring undecryptable cache entry for %s-%s",
+			accountName, roleName)
+		return nil, nil
+	}
+	var credentials apiv1.Credentials
+	if err := json.Unmarshal(plaintext, &credentials); err != nil {
+		return nil, nil
+	}
+	return &credentials, nil
+}
+
+// put caches the credentials, which were requested for the duration.
+func (c *credentialCache) put(credentials *apiv1.Credentials,
+	duration time.Duration) error {
+	if credentials.AccountName == "" || credentials.RoleName == "" {
+		return errors.New("credentials without account or role")
+	}
+	plaintext, err := json.Marshal(credentials)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	data := c.aead.Seal(nonce, nonce, plaintext, c.additionalData(
+		credentials.AccountName, credentials.RoleName, duration))
+	if err := os.MkdirAll(c.directory, 0700); err != nil {
+		return err
+	}
+	// Write and rename, since several processes may refresh at once.
+	file, err := ioutil.TempFile(c.directory, ".tmp-")
+	if err != nil {
+		return err
+	}
+	tmpFilename := file.Name()
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(tmpFilename)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmpFilename)
+		return err
+	}
+	return os.Rename(tmpFilename, c.filename(credentials.AccountName,
+		credentials.RoleName, duration))
+}
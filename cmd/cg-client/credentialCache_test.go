@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/cloud-gate/lib/apiv1"
+)
+
+func writeTestKey(t *testing.T, directory string, name string,
+	contents string) string {
+	filename := filepath.Join(directory, name)
+	if err := ioutil.WriteFile(filename, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestCredentialCache(t *testing.T) {
+	directory := t.TempDir()
+	keyFilename := writeTestKey(t, directory, "key1", "first key")
+	cacheDirectory := filepath.Join(directory, "cache")
+	cache, err := newCredentialCache(cacheDirectory, keyFilename,
+		"https://cloudgate.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if credentials, err := cache.get("prod", "admin", 0); err != nil ||
+		credentials != nil {
+		t.Fatalf("expected empty cache: %v %v", credentials, err)
+	}
+	expiration := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	err = cache.put(&apiv1.Credentials{AccountName: "prod", RoleName: "admin",
+		AccessKeyID: "AKIATEST", SecretAccessKey: "secret",
+		Expiration: expiration}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(cache.filename("prod", "admin", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(cache.filename("prod", "admin", 0)); err != nil ||
+		fi.Mode().Perm() != 0600 {
+		t.Fatalf("unexpected cache file mode: %v %v", fi, err)
+	}
+	for _, secret := range []string{"AKIATEST", "secret"} {
+		if bytes.Contains(data, []byte(secret)) {
+			t.Fatalf("cache file contains %s in plain text", secret)
+		}
+	}
+	credentials, err := cache.get("prod", "admin", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if credentials == nil || credentials.AccessKeyID != "AKIATEST" ||
+		!credentials.Expiration.Equal(expiration) {
+		t.Fatalf("unexpected credentials: %+v", credentials)
+	}
+	// An entry copied to another role must not be accepted.
+	if err := os.Rename(cache.filename("prod", "admin", 0),
+		cache.filename("prod", "readonly", 0)); err != nil {
+		t.Fatal(err)
+	}
+	if credentials, _ := cache.get("prod", "readonly", 0); credentials != nil {
+		t.Fatal("moved entry should not decrypt")
+	}
+	otherKeyFilename := writeTestKey(t, directory, "key2", "second key")
+	otherCache, err := newCredentialCache(cacheDirectory, otherKeyFilename,
+		"https://cloudgate.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cache.put(&apiv1.Credentials{AccountName: "prod", RoleName: "admin",
+		AccessKeyID: "AKIATEST"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if credentials, _ := otherCache.get("prod", "admin", 0); credentials != nil {
+		t.Fatal("entry should not decrypt with another key")
+	}
+	// Credentials requested for another duration are not used.
+	if credentials, _ := cache.get("prod", "admin",
+		12*time.Hour); credentials != nil {
+		t.Fatal("entry should not be used for another duration")
+	}
+	if cache.filename("a-b", "c", 0) == cache.filename("a", "b-c", 0) {
+		t.Fatal("ambiguous cache filename")
+	}
+}
+
+func TestGetRefreshWindow(t *testing.T) {
+	tests := map[time.Duration]time.Duration{
+		0:                credentialRefreshWindow,
+		12 * time.Hour:   credentialRefreshWindow,
+		15 * time.Minute: 7*time.Minute + 30*time.Second,
+	}
+	for duration, expected := range tests {
+		if window := getRefreshWindow(duration); window != expected {
+			t.Errorf("getRefreshWindow(%s): expected: %s, got: %s",
+				duration, expected, window)
+		}
+	}
+}
+
+func TestQuoteCommandArg(t *testing.T) {
+	tests := map[string]string{
+		"/usr/bin/cg-client":          "/usr/bin/cg-client",
+		"/Applications/My Tools/cg":   `"/Applications/My Tools/cg"`,
+		`-configFile=/a "quoted" dir`: `"-configFile=/a \"quoted\" dir"`,
+	}
+	for arg, expected := range tests {
+		if quoted := quoteCommandArg(arg); quoted != expected {
+			t.Errorf("quoteCommandArg(%s): expected: %s, got: %s", arg,
+				expected, quoted)
+		}
+	}
+}
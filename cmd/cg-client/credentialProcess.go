@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Cloud-Foundations/cloud-gate/lib/apiv1"
+)
+
+// AWS SDKs call the credential process again once the credentials are within
+// 15 minutes of expiring, so cached credentials are only returned while they
+// are valid for longer than that.
+const credentialRefreshWindow = 20 * time.Minute
+
+// getRefreshWindow returns how long before they expire credentials of the
+// requested duration are refreshed: credentialRefreshWindow, or half of
+// shorter durations, so that those are used at all.
+func getRefreshWindow(duration time.Duration) time.Duration {
+	if duration > 0 && duration/2 < credentialRefreshWindow {
+		return duration / 2
+	}
+	return credentialRefreshWindow
+}
+
+// passThroughFlags are the global flags which setup copies into the
+// credential_process command line.
+var passThroughFlags = map[string]struct{}{
+	"baseURL":    {},
+	"cert":       {},
+	"configFile": {},
+	"key":        {},
+}
+
+// credentialProcessOutput is the format AWS SDKs expect from a
+// credential_process command.
+type credentialProcessOutput struct {
+	Version         int
+	AccessKeyId     string
+	SecretAccessKey string
+	SessionToken    string
+	Expiration      string `json:",omitempty"`
+}
+
+func newHttpClientFromFlags() (*http.Client, error) {
+	cert, err := tls.LoadX509KeyPair(*certFilename, *keyFilename)
+	if err != nil {
+		return nil, fmt.Errorf("Error Loading X509KeyPair: %s", err)
+	}
+	return setupHttpClient(cert)
+}
+
+// getCachedRoleCredentials returns the cached credentials of the role,
+// fetching and caching new ones if they are close to expiring.
+func getCachedRoleCredentials(config AppConfigFile, accountName string,
+	roleName string, duration time.Duration) (*apiv1.Credentials, error) {
+	cache, err := newCredentialCache(getCredentialCacheDirectory(),
+		*keyFilename, config.BaseURL)
+	if err != nil {
+		return nil, err
+	}
+	credentials, err := cache.get(accountName, roleName, duration)
+	if err != nil {
+		loggerPrintf(1, "Cannot read credential cache: %s", err)
+	}
+	if credentials != nil &&
+		time.Until(credentials.Expiration) > getRefreshWindow(duration) {
+		loggerPrintf(2, "Using cached creds for %s-%s", accountName, roleName)
+		return credentials, nil
+	}
+	client, err := newHttpClientFromFlags()
+	if err != nil {
+		return nil, err
+	}
+	credentials, err = getRoleCredentials(client, config.BaseURL,
+		accountName, roleName, duration)
+	if err != nil {
+		return nil, err
+	}
+	if err := cache.put(credentials, duration); err != nil {
+		loggerPrintf(1, "Cannot cache credentials: %s", err)
+	}
+	return credentials, nil
+}
+
+func credentialProcessMain(config AppConfigFile, filter roleFilter,
+	args []string) error {
+	flagSet := flag.NewFlagSet("credential-process", flag.ExitOnError)
+	role := addRoleFlags(flagSet)
+	flagSet.Parse(args)
+	if err := role.check(flagSet.Name()); err != nil {
+		return err
+	}
+	credentials, err := getCachedRoleCredentials(config, role.accountName,
+		role.roleName, role.duration)
+	if err != nil {
+		return err
+	}
+	output := credentialProcessOutput{
+		Version:         1,
+		AccessKeyId:     credentials.AccessKeyID,
+		SecretAccessKey: credentials.SecretAccessKey,
+		SessionToken:    credentials.SessionToken,
+	}
+	if !credentials.Expiration.IsZero() {
+		output.Expiration = credentials.Expiration.UTC().Format(time.RFC3339)
+	}
+	return json.NewEncoder(os.Stdout).Encode(output)
+}
+
+// quoteCommandArg quotes an argument of a credential_process command line,
+// which AWS SDKs split on white space.
+func quoteCommandArg(arg string) string {
+	if !strings.ContainsAny(arg, " \t\"") {
+		return arg
+	}
+	return `"` + strings.Replace(arg, `"`, `\"`, -1) + `"`
+}
+
+func getCredentialProcessCommand(executable string, accountName string,
+	roleName string, duration time.Duration) string {
+	args := []string{quoteCommandArg(executable)}
+	flag.Visit(func(f *flag.Flag) {
+		if _, ok := passThroughFlags[f.Name]; ok {
+			args = append(args,
+				quoteCommandArg("-"+f.Name+"="+f.Value.String()))
+		}
+	})
+	args = append(args, "credential-process",
+		"-account", quoteCommandArg(accountName),
+		"-role", quoteCommandArg(roleName))
+	if duration > 0 {
+		args = append(args, "-duration", duration.String())
+	}
+	return strings.Join(args, " ")
+}
+
+// setupMain writes a credential_process profile into the AWS config file for
+// every selected role, and removes the static credentials of those profiles
+// from the credentials file, since static credentials take precedence.
+func setupMain(config AppConfigFile, filter roleFilter, args []string) error {
+	flagSet := flag.NewFlagSet("setup", flag.ExitOnError)
+	awsConfigFilename := flagSet.String("awsConfigFile",
+		filepath.Join(getUserHomeDir(), ".aws", "config"),
+		"The AWS config file to write profiles to")
+	duration := flagSet.Duration("duration", 0,
+		"session duration to request (default: the server default)")
+	flagSet.Parse(args)
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	client, err := newHttpClientFromFlags()
+	if err != nil {
+		return err
+	}
+	accounts, err := getAPIAccounts(client, config.BaseURL)
+	if err != nil {
+		return err
+	}
+	awsConfig, err := setupCredentialFile(*awsConfigFilename)
+	if err != nil {
+		return err
+	}
+	credFile, err := setupCredentialFile(*crededentialFilename)
+	if err != nil {
+		return err
+	}
+	profileCount := 0
+	for _, account := range accounts.Accounts {
+		for _, roleName := range account.Roles {
+			if !filter.isRoleSelected(account.Name, roleName) {
+				continue
+			}
+			profileName := getProfileName(account.Name, roleName,
+				config.OutputProfilePrefix, *lowerCaseProfileName)
+			section := awsConfig.Section("profile " + profileName)
+			section.Key("credential_process").SetValue(
+				getCredentialProcessCommand(executable, account.Name,
+					roleName, *duration))
+			credFile.DeleteSection(profileName)
+			profileCount++
+		}
+	}
+	if err := awsConfig.SaveTo(*awsConfigFilename); err != nil {
+		return err
+	}
+	if err := credFile.SaveTo(*crededentialFilename); err != nil {
+		return err
+	}
+	log.Printf("%d profiles written to %s", profileCount, *awsConfigFilename)
+	return nil
+}
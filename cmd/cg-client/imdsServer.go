@@ -0,0 +1,304 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Cloud-Foundations/cloud-gate/lib/apiv1"
+)
+
+const (
+	imdsTokenPath          = "/latest/api/token"
+	imdsCredentialsPath    = "/latest/meta-data/iam/security-credentials/"
+	imdsTokenHeader        = "X-aws-ec2-metadata-token"
+	imdsTokenTTLHeader     = "X-aws-ec2-metadata-token-ttl-seconds"
+	imdsMaxTokenTTLSeconds = 21600
+	ecsCredentialsPath     = "/ecs/credentials"
+)
+
+// imdsServer serves the credentials of one role in the formats of the EC2
+// instance metadata service (IMDSv2 only) and of the ECS container
+// credentials endpoint.
+type imdsServer struct {
+	getCredentials func() (*apiv1.Credentials, error)
+	listenAddress  string
+	roleName       string
+	ecsToken       string
+	mutex          sync.Mutex
+	tokens         map[string]time.Time // Key: token, value: expiration.
+}
+
+// imdsCredentials is the format of both the IMDS and ECS endpoints.
+type imdsCredentials struct {
+	Code            string `json:",omitempty"`
+	LastUpdated     string `json:",omitempty"`
+	Type            string `json:",omitempty"`
+	AccessKeyId     string
+	SecretAccessKey string
+	Token           string
+	Expiration      string `json:",omitempty"`
+}
+
+func newRandomToken() (string, error) {
+	buffer := make([]byte, 32)
+	if _, err := rand.Read(buffer); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buffer), nil
+}
+
+func newImdsServer(listenAddress string, roleName string, ecsToken string,
+	getCredentials func() (*apiv1.Credentials, error)) *imdsServer {
+	return &imdsServer{
+		getCredentials: getCredentials,
+		listenAddress:  listenAddress,
+		roleName:       roleName,
+		ecsToken:       ecsToken,
+		tokens:         make(map[string]time.Time),
+	}
+}
+
+func (s *imdsServer) newHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(imdsTokenPath, s.tokenHandler)
+	mux.HandleFunc(imdsCredentialsPath, s.imdsCredentialsHandler)
+	mux.HandleFunc(ecsCredentialsPath, s.ecsCredentialsHandler)
+	return mux
+}
+
+// isLocalRequest refuses requests from browsers: a page cannot set the
+// Host to a loopback name unless its own name resolves to a loopback address
+// (DNS rebinding), and browsers send an Origin with cross-site requests.
+func (s *imdsServer) isLocalRequest(r *http.Request) bool {
+	if r.Header.Get("Origin") != "" {
+		return false
+	}
+	if r.Host == s.listenAddress {
+		return true
+	}
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	return ip != nil && ip.IsLoopback()
+}
+
+func (s *imdsServer) tokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.isLocalRequest(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	// As with the real IMDS, refuse requests which were forwarded.
+	if r.Header.Get("X-Forwarded-For") != "" {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	ttlSeconds, err := strconv.Atoi(r.Header.Get(imdsTokenTTLHeader))
+	if err != nil || ttlSeconds < 1 || ttlSeconds > imdsMaxTokenTTLSeconds {
+		http.Error(w, "invalid token TTL", http.StatusBadRequest)
+		return
+	}
+	token, err := newRandomToken()
+	if err != nil {
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	s.mutex.Lock()
+	for oldToken, expiration := range s.tokens {
+		if now.After(expiration) {
+			delete(s.tokens, oldToken)
+		}
+	}
+	s.tokens[token] = now.Add(time.Duration(ttlSeconds) * time.Second)
+	s.mutex.Unlock()
+	w.Header().Set(imdsTokenTTLHeader, strconv.Itoa(ttlSeconds))
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprint(w, token)
+}
+
+func (s *imdsServer) isValidToken(token string) bool {
+	if token == "" {
+		return false
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	expiration, ok := s.tokens[token]
+	return ok && time.Now().Before(expiration)
+}
+
+func (s *imdsServer) getImdsCredentials(w http.ResponseWriter) (
+	*imdsCredentials, bool) {
+	credentials, err := s.getCredentials()
+	if err != nil {
+		log.Printf("Cannot get credentials: %s", err)
+		http.Error(w, "cannot get credentials", http.StatusInternalServerError)
+		return nil, false
+	}
+	output := &imdsCredentials{
+		AccessKeyId:     credentials.AccessKeyID,
+		SecretAccessKey: credentials.SecretAccessKey,
+		Token:           credentials.SessionToken,
+	}
+	if !credentials.Expiration.IsZero() {
+		output.Expiration = credentials.Expiration.UTC().Format(time.RFC3339)
+	}
+	return output, true
+}
+
+func writeImdsJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *imdsServer) imdsCredentialsHandler(w http.ResponseWriter,
+	r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.isLocalRequest(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if !s.isValidToken(r.Header.Get(imdsTokenHeader)) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	switch strings.TrimPrefix(r.URL.Path, imdsCredentialsPath) {
+	case "":
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, s.roleName)
+	case s.roleName:
+		output, ok := s.getImdsCredentials(w)
+		if !ok {
+			return
+		}
+		output.Code = "Success"
+		output.LastUpdated = time.Now().UTC().Format(time.RFC3339)
+		output.Type = "AWS-HMAC"
+		writeImdsJSON(w, output)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func (s *imdsServer) ecsCredentialsHandler(w http.ResponseWriter,
+	r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")),
+		[]byte(s.ecsToken)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	output, ok := s.getImdsCredentials(w)
+	if !ok {
+		return
+	}
+	writeImdsJSON(w, output)
+}
+
+// checkLoopbackAddress returns an error unless the address only listens on a
+// loopback interface, since anyone who can connect can get the credentials.
+func checkLoopbackAddress(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+	return fmt.Errorf("%s is not a loopback address", address)
+}
+
+// memoryCredentialsGetter returns a function which keeps the credentials in
+// memory, refreshing them through the credential cache as they approach
+// expiry.
+func memoryCredentialsGetter(config AppConfigFile, accountName string,
+	roleName string,
+	duration time.Duration) func() (*apiv1.Credentials, error) {
+	var mutex sync.Mutex
+	var current *apiv1.Credentials
+	return func() (*apiv1.Credentials, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if current != nil &&
+			time.Until(current.Expiration) > getRefreshWindow(duration) {
+			return current, nil
+		}
+		credentials, err := getCachedRoleCredentials(config, accountName,
+			roleName, duration)
+		if err != nil {
+			if current != nil && time.Now().Before(current.Expiration) {
+				log.Printf("Cannot refresh credentials, using current: %s", err)
+				return current, nil
+			}
+			return nil, err
+		}
+		current = credentials
+		return current, nil
+	}
+}
+
+func serveImdsMain(config AppConfigFile, filter roleFilter,
+	args []string) error {
+	flagSet := flag.NewFlagSet("serve-imds", flag.ExitOnError)
+	role := addRoleFlags(flagSet)
+	listenAddress := flagSet.String("listen", "127.0.0.1:9911",
+		"loopback address to listen on")
+	flagSet.Parse(args)
+	if err := role.check(flagSet.Name()); err != nil {
+		return err
+	}
+	if err := checkLoopbackAddress(*listenAddress); err != nil {
+		return err
+	}
+	ecsToken, err := newRandomToken()
+	if err != nil {
+		return err
+	}
+	getCredentials := memoryCredentialsGetter(config, role.accountName,
+		role.roleName, role.duration)
+	if _, err := getCredentials(); err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", *listenAddress)
+	if err != nil {
+		return err
+	}
+	baseURL := "http://" + listener.Addr().String()
+	fmt.Printf("# Set these for SDKs which use ECS container credentials:\n")
+	fmt.Printf("export AWS_CONTAINER_CREDENTIALS_FULL_URI=%s%s\n", baseURL,
+		ecsCredentialsPath)
+	fmt.Printf("export AWS_CONTAINER_AUTHORIZATION_TOKEN=%s\n", ecsToken)
+	fmt.Printf("# Or this for SDKs which only use instance metadata:\n")
+	fmt.Printf("export AWS_EC2_METADATA_SERVICE_ENDPOINT=%s/\n", baseURL)
+	server := newImdsServer(listener.Addr().String(), role.roleName,
+		ecsToken, getCredentials)
+	return http.Serve(listener, server.newHandler())
+}
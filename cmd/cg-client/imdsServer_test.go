@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/cloud-gate/lib/apiv1"
+)
+
+func newTestImdsServer(t *testing.T) *httptest.Server {
+	server := newImdsServer("127.0.0.1:9911", "admin", "ecsToken",
+		func() (*apiv1.Credentials, error) {
+			return &apiv1.Credentials{AccessKeyID: "AKIATEST",
+				SecretAccessKey: "secret", SessionToken: "session",
+				Expiration: time.Now().Add(time.Hour)}, nil
+		})
+	httpServer := httptest.NewServer(server.newHandler())
+	t.Cleanup(httpServer.Close)
+	return httpServer
+}
+
+func doImdsRequest(t *testing.T, method string, url string,
+	headers map[string]string) (int, string) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range headers {
+		if key == "Host" {
+			req.Host = value
+		} else {
+			req.Header.Set(key, value)
+		}
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestImdsServer(t *testing.T) {
+	server := newTestImdsServer(t)
+	status, _ := doImdsRequest(t, "GET", server.URL+imdsCredentialsPath, nil)
+	if status != http.StatusUnauthorized {
+		t.Fatalf("IMDSv1 request should be refused, got %d", status)
+	}
+	status, _ = doImdsRequest(t, "PUT", server.URL+imdsTokenPath, nil)
+	if status != http.StatusBadRequest {
+		t.Fatalf("token without TTL should be refused, got %d", status)
+	}
+	status, _ = doImdsRequest(t, "PUT", server.URL+imdsTokenPath,
+		map[string]string{imdsTokenTTLHeader: "60",
+			"X-Forwarded-For": "10.0.0.1"})
+	if status != http.StatusForbidden {
+		t.Fatalf("forwarded token request should be refused, got %d", status)
+	}
+	status, token := doImdsRequest(t, "PUT", server.URL+imdsTokenPath,
+		map[string]string{imdsTokenTTLHeader: "60"})
+	if status != http.StatusOK || token == "" {
+		t.Fatalf("token request failed: %d", status)
+	}
+	tokenHeader := map[string]string{imdsTokenHeader: token}
+	status, roleName := doImdsRequest(t, "GET",
+		server.URL+imdsCredentialsPath, tokenHeader)
+	if status != http.StatusOK || roleName != "admin" {
+		t.Fatalf("unexpected role listing: %d %s", status, roleName)
+	}
+	status, body := doImdsRequest(t, "GET",
+		server.URL+imdsCredentialsPath+"admin", tokenHeader)
+	if status != http.StatusOK {
+		t.Fatalf("credentials request failed: %d %s", status, body)
+	}
+	var credentials imdsCredentials
+	if err := json.Unmarshal([]byte(body), &credentials); err != nil {
+		t.Fatal(err)
+	}
+	if credentials.Code != "Success" || credentials.AccessKeyId != "AKIATEST" ||
+		credentials.Token != "session" || credentials.Expiration == "" {
+		t.Fatalf("unexpected credentials: %+v", credentials)
+	}
+	status, _ = doImdsRequest(t, "GET",
+		server.URL+imdsCredentialsPath+"other", tokenHeader)
+	if status != http.StatusNotFound {
+		t.Fatalf("expected not found for other role, got %d", status)
+	}
+}
+
+func TestImdsServerRefusesBrowsers(t *testing.T) {
+	server := newTestImdsServer(t)
+	// A page whose name was rebound to the loopback address.
+	status, _ := doImdsRequest(t, "PUT", server.URL+imdsTokenPath,
+		map[string]string{imdsTokenTTLHeader: "60",
+			"Host": "evil.example.com"})
+	if status != http.StatusForbidden {
+		t.Fatalf("rebound token request should be refused, got %d", status)
+	}
+	status, _ = doImdsRequest(t, "PUT", server.URL+imdsTokenPath,
+		map[string]string{imdsTokenTTLHeader: "60",
+			"Origin": "https://evil.example.com"})
+	if status != http.StatusForbidden {
+		t.Fatalf("token request with Origin should be refused, got %d",
+			status)
+	}
+	for _, host := range []string{"localhost:9911", "[::1]:9911"} {
+		status, _ = doImdsRequest(t, "PUT", server.URL+imdsTokenPath,
+			map[string]string{imdsTokenTTLHeader: "60", "Host": host})
+		if status != http.StatusOK {
+			t.Fatalf("token request for %s failed: %d", host, status)
+		}
+	}
+	status, token := doImdsRequest(t, "PUT", server.URL+imdsTokenPath,
+		map[string]string{imdsTokenTTLHeader: "60"})
+	if status != http.StatusOK {
+		t.Fatalf("token request failed: %d", status)
+	}
+	status, _ = doImdsRequest(t, "GET", server.URL+imdsCredentialsPath+"admin",
+		map[string]string{imdsTokenHeader: token, "Host": "evil.example.com"})
+	if status != http.StatusForbidden {
+		t.Fatalf("rebound credentials request should be refused, got %d",
+			status)
+	}
+	status, _ = doImdsRequest(t, "GET", server.URL+imdsCredentialsPath+"admin",
+		map[string]string{imdsTokenHeader: token,
+			"Origin": "https://evil.example.com"})
+	if status != http.StatusForbidden {
+		t.Fatalf("credentials request with Origin should be refused, got %d",
+			status)
+	}
+}
+
+func TestEcsCredentials(t *testing.T) {
+	server := newTestImdsServer(t)
+	status, _ := doImdsRequest(t, "GET", server.URL+ecsCredentialsPath,
+		map[string]string{"Authorization": "wrong"})
+	if status != http.StatusUnauthorized {
+		t.Fatalf("expected unauthorized, got %d", status)
+	}
+	status, body := doImdsRequest(t, "GET", server.URL+ecsCredentialsPath,
+		map[string]string{"Authorization": "ecsToken"})
+	if status != http.StatusOK {
+		t.Fatalf("credentials request failed: %d %s", status, body)
+	}
+	var credentials imdsCredentials
+	if err := json.Unmarshal([]byte(body), &credentials); err != nil {
+		t.Fatal(err)
+	}
+	if credentials.AccessKeyId != "AKIATEST" || credentials.Code != "" {
+		t.Fatalf("unexpected credentials: %+v", credentials)
+	}
+}
+
+func TestCheckLoopbackAddress(t *testing.T) {
+	for _, address := range []string{"127.0.0.1:9911", "[::1]:80",
+		"localhost:9911"} {
+		if err := checkLoopbackAddress(address); err != nil {
+			t.Errorf("%s: %s", address, err)
+		}
+	}
+	for _, address := range []string{"0.0.0.0:9911", ":9911",
+		"10.0.0.1:80"} {
+		if checkLoopbackAddress(address) == nil {
+			t.Errorf("%s should not be accepted", address)
+		}
+	}
+}
@@ -17,11 +17,14 @@ import (
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
 	"strings"
 	"time"
 
 	"gopkg.in/ini.v1"
 	"gopkg.in/yaml.v2"
+
+	"github.com/Cloud-Foundations/cloud-gate/lib/apiv1"
 )
 
 const defaultVersionNumber = "No version provided"
@@ -168,25 +171,39 @@ func getAndUpdateCreds(client *http.Client, baseUrl, accountName, roleName strin
 		log.Fatal(err)
 	}
 	//log.Printf("%+v", awsCreds)
-	fileProfile := outputProfilePrefix + accountName + "-" + roleName
+	updateCredentialsProfile(cfg, accountName, roleName, outputProfilePrefix,
+		lowerCaseProfileName, awsCreds.SessionId, awsCreds.SessionKey,
+		awsCreds.SessionToken, awsCreds.Expiration)
+	return nil
+}
+
+func getProfileName(accountName, roleName string, outputProfilePrefix string,
+	lowerCaseProfileName bool) string {
+	profileName := outputProfilePrefix + accountName + "-" + roleName
 	if lowerCaseProfileName {
-		fileProfile = strings.ToLower(fileProfile)
+		return strings.ToLower(profileName)
 	}
-	cfg.Section(fileProfile).Key("aws_access_key_id").SetValue(awsCreds.SessionId)
-	cfg.Section(fileProfile).Key("aws_secret_access_key").SetValue(awsCreds.SessionKey)
-	cfg.Section(fileProfile).Key("aws_session_token").SetValue(awsCreds.SessionToken)
+	return profileName
+}
+
+func updateCredentialsProfile(cfg *ini.File, accountName, roleName string,
+	outputProfilePrefix string, lowerCaseProfileName bool,
+	accessKeyID, secretAccessKey, sessionToken string, expiration time.Time) {
+	fileProfile := getProfileName(accountName, roleName, outputProfilePrefix,
+		lowerCaseProfileName)
+	cfg.Section(fileProfile).Key("aws_access_key_id").SetValue(accessKeyID)
+	cfg.Section(fileProfile).Key("aws_secret_access_key").SetValue(secretAccessKey)
+	cfg.Section(fileProfile).Key("aws_session_token").SetValue(sessionToken)
 	if *oldBotoCompat {
-		cfg.Section(fileProfile).Key("aws_security_token").SetValue(awsCreds.SessionToken)
+		cfg.Section(fileProfile).Key("aws_security_token").SetValue(sessionToken)
 	} else {
 		cfg.Section(fileProfile).DeleteKey("aws_security_token")
 	}
-	if !awsCreds.Expiration.IsZero() {
-		cfg.Section(fileProfile).Key("token_expiration").SetValue(awsCreds.Expiration.UTC().Format(time.RFC3339))
+	if !expiration.IsZero() {
+		cfg.Section(fileProfile).Key("token_expiration").SetValue(expiration.UTC().Format(time.RFC3339))
 	} else {
 		cfg.Section(fileProfile).DeleteKey("token_expiration")
 	}
-
-	return nil
 }
 
 func getParseURLEnvVariable(name string) (*url.URL, error) {
@@ -278,6 +295,64 @@ func getAccountsList(client *http.Client, baseUrl string) (*getAccountInfo, erro
 
 }
 
+// getAccounts lists the accounts through the v1 API, or from the main page
+// for servers which predate it.
+func getAccounts(client *http.Client, baseUrl string) (
+	[]apiv1.Account, error) {
+	response, err := getAPIAccounts(client, baseUrl)
+	if err == nil {
+		return response.Accounts, nil
+	}
+	if err != errAPIUnsupported {
+		return nil, err
+	}
+	loggerPrintf(1, "Server does not support the v1 API, listing accounts from the main page")
+	accountList, err := getAccountsList(client, baseUrl)
+	if err != nil {
+		return nil, err
+	}
+	accounts := make([]apiv1.Account, 0, len(accountList.CloudAccounts))
+	for _, account := range accountList.CloudAccounts {
+		accounts = append(accounts, apiv1.Account{
+			Name:  account.Name,
+			Roles: account.AvailableRoles,
+		})
+	}
+	sort.Slice(accounts, func(i, j int) bool {
+		return accounts[i].Name < accounts[j].Name
+	})
+	return accounts, nil
+}
+
+var adminRoleRE = regexp.MustCompile("(?i)admin")
+
+// roleFilter holds the compiled role filters of the configuration.
+type roleFilter struct {
+	includeRoleRE *regexp.Regexp
+	excludeRoleRE *regexp.Regexp
+}
+
+func (f roleFilter) isRoleSelected(accountName, roleName string) bool {
+	return isRoleSelected(accountName, roleName, *askAdminRoles,
+		f.includeRoleRE, f.excludeRoleRE)
+}
+
+// isRoleSelected applies the role filters of the configuration.
+func isRoleSelected(accountName, roleName string, askAdminRoles bool,
+	includeRoleRE *regexp.Regexp, excludeRoleRE *regexp.Regexp) bool {
+	if adminRoleRE.MatchString(roleName) && !askAdminRoles {
+		return false
+	}
+	computedName := accountName + "-" + roleName
+	if includeRoleRE != nil && !includeRoleRE.MatchString(computedName) {
+		return false
+	}
+	if excludeRoleRE != nil && excludeRoleRE.MatchString(computedName) {
+		return false
+	}
+	return true
+}
+
 func getCerts(cert tls.Certificate, baseUrl string,
 	credentialFilename string, askAdminRoles bool,
 	outputProfilePrefix string, lowerCaseProfileName bool,
@@ -293,34 +368,47 @@ func getCerts(cert tls.Certificate, baseUrl string,
 	if err != nil {
 		return 0, err
 	}
-	accountList, err := getAccountsList(client, baseUrl)
+	accounts, err := getAccounts(client, baseUrl)
 	if err != nil {
 		return 0, err
 	}
 
-	credentialsGenerated := 0
-	for _, account := range accountList.CloudAccounts {
-		for _, roleName := range account.AvailableRoles {
-			adminRole, err := regexp.Match("(?i)admin", []byte(roleName))
-			if adminRole && !askAdminRoles {
+	var roles []apiv1.Role
+	for _, account := range accounts {
+		for _, roleName := range account.Roles {
+			if !isRoleSelected(account.Name, roleName, askAdminRoles,
+				includeRoleRE, excludeRoleRE) {
 				continue
 			}
-			if err != nil {
-				log.Fatalf("error on regexp=%s", err)
-			}
-			computedName := account.Name + "-" + roleName
-			if includeRoleRE != nil {
-				if !includeRoleRE.Match([]byte(computedName)) {
-					continue
-				}
-			}
-			if excludeRoleRE != nil {
-				if excludeRoleRE.Match([]byte(computedName)) {
-					continue
-				}
+			roles = append(roles,
+				apiv1.Role{AccountName: account.Name, RoleName: roleName})
+		}
+	}
+	credentialsGenerated := 0
+	var results []apiv1.BatchCredentialsResult
+	if len(roles) > 0 {
+		results, err = getBatchCreds(client, baseUrl, roles)
+	}
+	switch err {
+	case nil:
+		for _, result := range results {
+			if result.Credentials == nil {
+				log.Printf("skipping role %s-%s: %s", result.AccountName,
+					result.RoleName, result.Error)
+				continue
 			}
+			updateCredentialsProfile(credFile, result.AccountName,
+				result.RoleName, outputProfilePrefix, lowerCaseProfileName,
+				result.Credentials.AccessKeyID,
+				result.Credentials.SecretAccessKey,
+				result.Credentials.SessionToken, result.Credentials.Expiration)
+			credentialsGenerated += 1
+		}
+	case errBatchUnsupported:
+		loggerPrintf(1, "Server does not support batches, getting creds one by one")
+		for _, role := range roles {
 			err = getAndUpdateCreds(client, baseUrl,
-				account.Name, roleName, credFile,
+				role.AccountName, role.RoleName, credFile,
 				outputProfilePrefix, lowerCaseProfileName)
 			if err != nil {
 				if err.Error() == badReturnErrText {
@@ -331,6 +419,8 @@ func getCerts(cert tls.Certificate, baseUrl string,
 			}
 			credentialsGenerated += 1
 		}
+	default:
+		return 0, err
 	}
 	err = credFile.SaveTo(credentialFilename)
 	if err != nil {
@@ -381,6 +471,14 @@ func computeUserAgent() {
 func usage() {
 	fmt.Fprintf(
 		os.Stderr, "Usage of %s (version %s):\n", os.Args[0], Version)
+	fmt.Fprintf(os.Stderr, "  %s [flags] [command [command flags]]\n",
+		os.Args[0])
+	fmt.Fprintln(os.Stderr, "Commands:")
+	for _, command := range commands {
+		fmt.Fprintf(os.Stderr, "  %-19s %s\n", command.name,
+			command.description)
+	}
+	fmt.Fprintln(os.Stderr, "Flags:")
 	flag.PrintDefaults()
 }
 
@@ -435,25 +533,51 @@ func main() {
 		config.BaseURL = *baseURL
 	}
 
+	filter := roleFilter{includeRoleRE: includeRoleRE,
+		excludeRoleRE: excludeRoleRE}
+	commandName := "sync"
+	var commandArgs []string
+	if flag.NArg() > 0 {
+		commandName = flag.Arg(0)
+		commandArgs = flag.Args()[1:]
+	}
+	for _, command := range commands {
+		if command.name == commandName {
+			if err := command.run(config, filter, commandArgs); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Unknown command: %s\n", commandName)
+	flag.Usage()
+	os.Exit(2)
+}
+
+// syncMain keeps the credentials file up to date until the certificate
+// expires.
+func syncMain(config AppConfigFile, filter roleFilter, args []string) error {
+	flagSet := flag.NewFlagSet("sync", flag.ExitOnError)
+	flagSet.Parse(args)
 	loggerPrintf(1, "Configuration Loaded")
 	loggerPrintf(2, "config=%+v", config)
 	loggerPrintf(2, "Using Cert=%s, key=%s", *certFilename, *keyFilename)
 	certNotAfter, err := getCertExpirationTime(*certFilename)
 	if err != nil {
-		log.Fatalf("Error on getCertExpirationTime: %s", err)
+		return fmt.Errorf("Error on getCertExpirationTime: %s", err)
 	}
 	if certNotAfter.Before(time.Now()) {
-		log.Fatalf("keymaster certificate is expired, please run keymaster binary. Certificate expired at %s", certNotAfter)
+		return fmt.Errorf("keymaster certificate is expired, please run keymaster binary. Certificate expired at %s", certNotAfter)
 	}
 
 	for certNotAfter.After(time.Now()) {
 		cert, err := tls.LoadX509KeyPair(*certFilename, *keyFilename)
 		if err != nil {
-			log.Fatalf("Error Loading X509KeyPair: %s", err)
+			return fmt.Errorf("Error Loading X509KeyPair: %s", err)
 		}
 		credentialCount, err := getCerts(cert, config.BaseURL, *crededentialFilename,
 			*askAdminRoles, config.OutputProfilePrefix, *lowerCaseProfileName,
-			includeRoleRE, excludeRoleRE)
+			filter.includeRoleRE, filter.excludeRoleRE)
 		if err != nil {
 			log.Printf("err=%s", err)
 			log.Printf("Failure getting certs, retrying in (%s)", failureSleepDuration)
@@ -464,10 +588,11 @@ func main() {
 		}
 		certNotAfter, err = getCertExpirationTime(*certFilename)
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
 
 	}
 
 	log.Printf("done")
+	return nil
 }
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	stdlog "log"
 	"log/syslog"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
@@ -16,10 +17,17 @@ import (
 	"github.com/Cloud-Foundations/Dominator/lib/log/serverlogger"
 	"github.com/Cloud-Foundations/Dominator/lib/log/teelogger"
 	"github.com/Cloud-Foundations/cloud-gate/broker"
+	"github.com/Cloud-Foundations/cloud-gate/broker/audit"
 	"github.com/Cloud-Foundations/cloud-gate/broker/aws"
+	"github.com/Cloud-Foundations/cloud-gate/broker/azure"
 	"github.com/Cloud-Foundations/cloud-gate/broker/configuration"
+	"github.com/Cloud-Foundations/cloud-gate/broker/gcp"
+	"github.com/Cloud-Foundations/cloud-gate/broker/grants"
 	"github.com/Cloud-Foundations/cloud-gate/broker/httpd"
 	"github.com/Cloud-Foundations/cloud-gate/broker/staticconfiguration"
+	"github.com/Cloud-Foundations/cloud-gate/broker/userinfo/chain"
+	"github.com/Cloud-Foundations/cloud-gate/broker/userinfo/claims"
+	"github.com/Cloud-Foundations/cloud-gate/broker/userinfo/scim"
 	"github.com/Cloud-Foundations/golib/pkg/auth/userinfo"
 	"github.com/Cloud-Foundations/golib/pkg/auth/userinfo/gitdb"
 	"github.com/Cloud-Foundations/golib/pkg/auth/userinfo/ldap"
@@ -32,9 +40,20 @@ var (
 		"Configuration filename")
 )
 
-func getUserInfo(config *staticconfiguration.StaticConfiguration,
-	logger log.DebugLogger) (userinfo.UserInfo, error) {
-	if config.Ldap.LDAPTargetURLs != "" {
+func newUserInfoSource(config *staticconfiguration.StaticConfiguration,
+	sourceType string, logger log.DebugLogger) (userinfo.UserInfo, error) {
+	switch sourceType {
+	case staticconfiguration.UserInfoSourceSCIM:
+		userInfo, err := scim.New(
+			filepath.Join(config.Base.DataDirectory, "scim-state.json"),
+			config.SCIM.BearerToken, logger)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create SCIM userinfo: %s", err)
+		}
+		// Served on the status port.
+		http.Handle(scim.PathPrefix, userInfo)
+		return userInfo, nil
+	case staticconfiguration.UserInfoSourceLDAP:
 		timeoutSecs := 15
 		userInfo, err := ldap.New(
 			strings.Split(config.Ldap.LDAPTargetURLs, ","),
@@ -49,17 +68,100 @@ func getUserInfo(config *staticconfiguration.StaticConfiguration,
 			return nil, fmt.Errorf("cannot create ldap userinfo: %s", err)
 		}
 		return userInfo, nil
-	}
-	if config.GitDB.LocalRepositoryDirectory != "" {
+	case staticconfiguration.UserInfoSourceGitDB:
 		userInfo, err := gitdb.NewWithConfig(config.GitDB.Config, logger)
 		if err != nil {
 			return nil, fmt.Errorf("cannot create GitDB userinfo: %s", err)
 		}
 		return userInfo, nil
+	case staticconfiguration.UserInfoSourceOIDCClaims:
+		return claims.New(), nil
+	}
+	return nil, fmt.Errorf("unknown userinfo source: %s", sourceType)
+}
+
+func getUserInfo(config *staticconfiguration.StaticConfiguration,
+	logger log.DebugLogger) (userinfo.UserInfo, error) {
+	if len(config.UserInfo.Sources) > 0 {
+		var sources []chain.Source
+		for _, sourceConfig := range config.UserInfo.Sources {
+			userInfo, err := newUserInfoSource(config, sourceConfig.Type,
+				logger)
+			if err != nil {
+				return nil, err
+			}
+			sources = append(sources, chain.Source{
+				Name:     sourceConfig.Type,
+				UserInfo: userInfo,
+				Timeout:  sourceConfig.Timeout,
+			})
+		}
+		return chain.New(sources, config.UserInfo.Policy, logger)
+	}
+	// Without a list of sources, use the first one configured.
+	switch {
+	case config.SCIM.BearerToken != "":
+		return newUserInfoSource(config,
+			staticconfiguration.UserInfoSourceSCIM, logger)
+	case config.Ldap.LDAPTargetURLs != "":
+		return newUserInfoSource(config,
+			staticconfiguration.UserInfoSourceLDAP, logger)
+	case config.GitDB.LocalRepositoryDirectory != "":
+		return newUserInfoSource(config,
+			staticconfiguration.UserInfoSourceGitDB, logger)
+	case config.OpenID.GroupsClaim != "":
+		return newUserInfoSource(config,
+			staticconfiguration.UserInfoSourceOIDCClaims, logger)
 	}
 	return nil, errors.New("no userinfo database specified")
 }
 
+func getAuditSink(config *staticconfiguration.StaticConfiguration,
+	logger log.DebugLogger, auditLogger log.DebugLogger) (
+	audit.AuditSink, error) {
+	sinks := []audit.AuditSink{audit.NewLoggerSink(auditLogger)}
+	if config.Audit.Filename != "" {
+		fileSink, err := audit.NewFileSink(config.Audit.Filename)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, fileSink)
+	}
+	if config.Audit.WebhookURL != "" {
+		sinks = append(sinks,
+			audit.NewWebhookSink(config.Audit.WebhookURL, logger))
+	}
+	return audit.NewMultiSink(sinks...), nil
+}
+
+func getBrokers(config *staticconfiguration.StaticConfiguration,
+	userInfo userinfo.UserInfo, logger log.DebugLogger) (
+	map[string]broker.Broker, error) {
+	brokers := make(map[string]broker.Broker)
+	for _, cloudName := range config.Base.EnabledClouds {
+		switch cloudName {
+		case "aws":
+			brokers[cloudName] = aws.New(userInfo,
+				config.Base.AWSCredentialsFilename,
+				config.Base.AWSListRolesRoleName,
+				filepath.Join(config.Base.DataDirectory, "aws-cache.json"),
+				config.Base.AccountConfigurationCheckInterval,
+				logger)
+		case "gcp":
+			brokers[cloudName] = gcp.New(userInfo,
+				config.Base.GCPCredentialsFilename,
+				logger)
+		case "azure":
+			brokers[cloudName] = azure.New(userInfo,
+				config.Base.AzureFederatedTokenFilename,
+				logger)
+		default:
+			return nil, fmt.Errorf("unknown cloud: %s", cloudName)
+		}
+	}
+	return brokers, nil
+}
+
 func main() {
 	flag.Parse()
 	tricorder.RegisterFlags()
@@ -97,10 +199,14 @@ func main() {
 		logger.Fatalf("Cannot watch for configuration: %s\n", err)
 	}
 
-	brokers := map[string]broker.Broker{
-		"aws": aws.New(userInfo, staticConfig.Base.AWSCredentialsFilename,
-			staticConfig.Base.AWSListRolesRoleName,
-			logger, auditLogger),
+	auditSink, err := getAuditSink(staticConfig, logger, auditLogger)
+	if err != nil {
+		logger.Fatalf("Cannot create audit sink: %s\n", err)
+	}
+
+	brokers, err := getBrokers(staticConfig, userInfo, logger)
+	if err != nil {
+		logger.Fatalln(err)
 	}
 	for brokerName, broker := range brokers {
 		err = broker.LoadCredentialsFile()
@@ -109,11 +215,33 @@ func main() {
 		}
 	}
 
-	webServer, err := httpd.StartServer(staticConfig, userInfo, brokers, logger)
+	var grantStore *grants.Store
+	serverBrokers := brokers
+	if len(staticConfig.Grants.ApproverGroups) > 0 {
+		grantStore, err = grants.NewStore(
+			filepath.Join(staticConfig.Base.DataDirectory, "grants.json"),
+			logger)
+		if err != nil {
+			logger.Fatalf("Cannot load grants: %s\n", err)
+		}
+		serverBrokers = make(map[string]broker.Broker, len(brokers))
+		for brokerName, cloudBroker := range brokers {
+			serverBrokers[brokerName] = grants.NewBroker(cloudBroker,
+				brokerName, grantStore)
+		}
+	}
+
+	webServer, err := httpd.StartServer(staticConfig, userInfo, serverBrokers,
+		auditSink, grantStore, logger)
 	if err != nil {
 		logger.Fatalf("Unable to create http server: %s\n", err)
 	}
 	webServer.AddHtmlWriter(logger)
+	for _, cloudBroker := range brokers {
+		if htmlWriter, ok := cloudBroker.(httpd.HtmlWriter); ok {
+			webServer.AddHtmlWriter(htmlWriter)
+		}
+	}
 
 	isReadyMetric := prometheus.NewGaugeFunc(
 		prometheus.GaugeOpts{
@@ -0,0 +1,105 @@
+// Package apiv1 defines the paths and JSON messages of version 1 of the
+// cloud-gate API. Fields are only ever added to these messages, so that
+// clients built against an older version keep working.
+package apiv1
+
+import (
+	"time"
+)
+
+const (
+	PathPrefix      = "/api/v1/"
+	WhoAmIPath      = PathPrefix + "whoami"
+	AccountsPath    = PathPrefix + "accounts"
+	CredentialsPath = PathPrefix + "credentials"
+	BatchPath       = PathPrefix + "credentials/batch"
+	ConsolePath     = PathPrefix + "console"
+)
+
+// MaxBatchSize is the most roles a BatchCredentialsRequest may hold.
+const MaxBatchSize = 200
+
+// Error is returned with every non-2xx response.
+type Error struct {
+	Error string `json:"error"`
+}
+
+type WhoAmIResponse struct {
+	Username string   `json:"username"`
+	Clouds   []string `json:"clouds"`
+}
+
+type Account struct {
+	Name        string   `json:"name"`
+	DisplayName string   `json:"displayName"`
+	Roles       []string `json:"roles"`
+}
+
+type AccountsResponse struct {
+	Cloud    string    `json:"cloud"`
+	Accounts []Account `json:"accounts"`
+}
+
+// CredentialsRequest requests credentials for a role. If Cloud is empty the
+// default cloud is used and if DurationSeconds is zero the default duration
+// is used.
+type CredentialsRequest struct {
+	Cloud           string `json:"cloud,omitempty"`
+	AccountName     string `json:"accountName"`
+	RoleName        string `json:"roleName"`
+	DurationSeconds int64  `json:"durationSeconds,omitempty"`
+}
+
+type Credentials struct {
+	Cloud           string    `json:"cloud"`
+	AccountName     string    `json:"accountName"`
+	RoleName        string    `json:"roleName"`
+	AccessKeyID     string    `json:"accessKeyId"`
+	SecretAccessKey string    `json:"secretAccessKey"`
+	SessionToken    string    `json:"sessionToken"`
+	Region          string    `json:"region,omitempty"`
+	Expiration      time.Time `json:"expiration,omitempty"`
+}
+
+type Role struct {
+	AccountName string `json:"accountName"`
+	RoleName    string `json:"roleName"`
+}
+
+// BatchCredentialsRequest requests credentials for several roles of one
+// cloud at once.
+type BatchCredentialsRequest struct {
+	Cloud           string `json:"cloud,omitempty"`
+	Roles           []Role `json:"roles"`
+	DurationSeconds int64  `json:"durationSeconds,omitempty"`
+}
+
+// BatchCredentialsResult holds either the credentials for a role or the
+// reason they were not issued. Status is the HTTP status the same request
+// would have had on its own.
+type BatchCredentialsResult struct {
+	AccountName string       `json:"accountName"`
+	RoleName    string       `json:"roleName"`
+	Status      int          `json:"status"`
+	Credentials *Credentials `json:"credentials,omitempty"`
+	Error       string       `json:"error,omitempty"`
+}
+
+// BatchCredentialsResponse has a result for each requested role, in the
+// order of the request.
+type BatchCredentialsResponse struct {
+	Cloud   string                   `json:"cloud"`
+	Results []BatchCredentialsResult `json:"results"`
+}
+
+// ConsoleRequest requests a console sign-in URL for a role. If Cloud is
+// empty the default cloud is used.
+type ConsoleRequest struct {
+	Cloud       string `json:"cloud,omitempty"`
+	AccountName string `json:"accountName"`
+	RoleName    string `json:"roleName"`
+}
+
+type ConsoleResponse struct {
+	URL string `json:"url"`
+}
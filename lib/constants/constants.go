@@ -18,4 +18,6 @@ const (
 	Oauth2redirectPath                       = "/oauth2/redirectendpoint"
 	RedirCookieName                          = "oauth2_redir"
 	MaxAgeSecondsRedirCookie                 = 120
+	DefaultCloudName                         = "aws"
+	DefaultMaxGrantDuration                  = time.Hour * 12
 )